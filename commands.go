@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/naiba/cloudcode/internal/handler"
+)
+
+// commandUsage describes the subcommands in the -help output.
+const commandUsage = `Commands (flags go before the command; without one the server runs):
+  list               List instances and their status
+  create <name>      Create an instance with default settings and start it
+  delete <id|name>   Move an instance to the recycle bin and remove its container
+  logs <id|name>     Print the container output of an instance
+`
+
+// command is a subcommand given after the flags, e.g.
+// "cloudcode -data ./data list". It works on the same store and Docker
+// daemon as the server, without serving HTTP.
+type command struct {
+	name string
+	arg  string // instance name for create, ID or name for delete and logs
+}
+
+// parseCommand parses the arguments left after the flags. It returns nil
+// when there are none.
+func parseCommand(args []string) (*command, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	name, rest := args[0], args[1:]
+	switch name {
+	case "list":
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("usage: cloudcode [flags] list")
+		}
+		return &command{name: name}, nil
+	case "create", "delete", "logs":
+		param := "<id|name>"
+		if name == "create" {
+			param = "<name>"
+		}
+		if len(rest) != 1 || rest[0] == "" {
+			return nil, fmt.Errorf("usage: cloudcode [flags] %s %s", name, param)
+		}
+		return &command{name: name, arg: rest[0]}, nil
+	default:
+		return nil, fmt.Errorf("unknown command %q (commands: list, create, delete, logs)", name)
+	}
+}
+
+// runCommand executes cmd, writing its output to out.
+func runCommand(ctx context.Context, h *handler.Handler, cmd *command, out io.Writer) error {
+	switch cmd.name {
+	case "list":
+		instances, err := h.ListInstances()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tPORT\tCREATED")
+		for _, inst := range instances {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", inst.ID, inst.Name, inst.Status, inst.Port, inst.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		return tw.Flush()
+	case "create":
+		inst, err := h.CreateInstance(ctx, cmd.arg)
+		if err != nil {
+			if inst != nil {
+				return fmt.Errorf("instance %s was created but its container failed: %w", inst.ID, err)
+			}
+			return err
+		}
+		fmt.Fprintf(out, "%s\t%s\tport %d\n", inst.ID, inst.Name, inst.Port)
+		return nil
+	case "delete":
+		inst, err := h.DeleteInstance(ctx, cmd.arg)
+		if err != nil {
+			if inst != nil {
+				return fmt.Errorf("instance %s was moved to the recycle bin but its container could not be removed: %w", inst.ID, err)
+			}
+			return err
+		}
+		fmt.Fprintf(out, "%s\t%s\tmoved to the recycle bin\n", inst.ID, inst.Name)
+		return nil
+	case "logs":
+		logs, err := h.InstanceLogs(ctx, cmd.arg)
+		if err != nil {
+			return err
+		}
+		defer logs.Close()
+		_, err = io.Copy(out, logs)
+		return err
+	}
+	return fmt.Errorf("unknown command %q", cmd.name)
+}
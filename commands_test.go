@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/config"
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/handler"
+	"github.com/naiba/cloudcode/internal/proxy"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    *command
+		wantErr string
+	}{
+		{args: nil, want: nil},
+		{args: []string{"list"}, want: &command{name: "list"}},
+		{args: []string{"create", "dev"}, want: &command{name: "create", arg: "dev"}},
+		{args: []string{"delete", "ab12cd34"}, want: &command{name: "delete", arg: "ab12cd34"}},
+		{args: []string{"logs", "dev"}, want: &command{name: "logs", arg: "dev"}},
+		{args: []string{"list", "extra"}, wantErr: "usage: cloudcode [flags] list"},
+		{args: []string{"create"}, wantErr: "usage: cloudcode [flags] create <name>"},
+		{args: []string{"create", ""}, wantErr: "usage: cloudcode [flags] create <name>"},
+		{args: []string{"delete", "a", "b"}, wantErr: "usage: cloudcode [flags] delete <id|name>"},
+		{args: []string{"logs"}, wantErr: "usage: cloudcode [flags] logs <id|name>"},
+		{args: []string{"serve"}, wantErr: `unknown command "serve"`},
+	}
+	for _, tt := range tests {
+		got, err := parseCommand(tt.args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseCommand(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%q): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCommand(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCreateCommand(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	srv.AddImage("cloudcode-test:latest")
+	t.Setenv("DOCKER_HOST", srv.Host())
+
+	dir := t.TempDir()
+	db, err := store.New(dir, store.Options{})
+	if err != nil {
+		t.Fatalf("store.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	cfgMgr, err := config.NewManager(dir)
+	if err != nil {
+		t.Fatalf("config.NewManager: %v", err)
+	}
+	dm, err := docker.NewManager("cloudcode-test:latest", cfgMgr, docker.Options{})
+	if err != nil {
+		t.Fatalf("docker.NewManager: %v", err)
+	}
+	t.Cleanup(func() { dm.Close() })
+	h := handler.New(db, dm, proxy.New(proxy.Options{}), cfgMgr, nil, handler.Options{StopOnExit: true})
+	// 先于关闭数据库执行，取消创建后开始的就绪等待
+	t.Cleanup(func() { h.Shutdown(context.Background()) })
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), h, &command{name: "create", arg: "cli-dev"}, &out); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	inst, err := db.GetByName("cli-dev")
+	if err != nil {
+		t.Fatalf("no store row for the created instance: %v", err)
+	}
+	if inst.ContainerID == "" {
+		t.Error("instance has no container ID")
+	}
+	if _, ok := srv.Container(inst.ContainerID); !ok {
+		t.Errorf("container %s not created", inst.ContainerID)
+	}
+	if !strings.HasPrefix(out.String(), inst.ID+"\tcli-dev\t") {
+		t.Errorf("output = %q, want it to start with the instance ID and name", out.String())
+	}
+
+	// 重名时拒绝，不新增行
+	if err := runCommand(context.Background(), h, &command{name: "create", arg: "cli-dev"}, &out); err == nil {
+		t.Error("second create with the same name succeeded")
+	}
+	instances, err := db.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Errorf("store has %d instances, want 1", len(instances))
+	}
+}
@@ -72,7 +72,21 @@ fi
 
 PORT="${OPENCODE_PORT:-4096}"
 
+# 实例自定义的命令（container Cmd）替代默认的 opencode web，环境准备照常进行
+if [ "$#" -gt 0 ]; then
+    echo "[7/7] Starting custom command: $*"
+    echo "=== Ready ==="
+    exec "$@"
+fi
+
 echo "[7/7] Starting OpenCode Web UI on port ${PORT}..."
 echo "=== Ready ==="
 
+# OPENCODE_LOG_LEVEL is set per instance by the platform (debug/info/warn/error)
+if [ -n "$OPENCODE_LOG_LEVEL" ]; then
+    LOG_LEVEL=$(echo "$OPENCODE_LOG_LEVEL" | tr '[:lower:]' '[:upper:]')
+    echo "  Log level: ${LOG_LEVEL}"
+    exec opencode web --port "${PORT}" --hostname 0.0.0.0 --log-level "${LOG_LEVEL}" --print-logs
+fi
+
 exec opencode web --port "${PORT}" --hostname 0.0.0.0
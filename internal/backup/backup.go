@@ -0,0 +1,263 @@
+// Package backup writes and reads CloudCode platform archives: a tar.gz
+// holding a manifest, a snapshot of the SQLite store and the config tree.
+// Archives move a whole installation to another host (export/import).
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FormatVersion is the archive layout written by this build.
+const FormatVersion = 1
+
+// Entry names inside an archive. The manifest is always the first entry.
+const (
+	ManifestName = "manifest.json"
+	DBName       = "cloudcode.db"
+	ConfigDir    = "config"
+)
+
+// maxExtractSize caps the bytes Extract writes, so a small compressed
+// archive cannot fill the disk.
+const maxExtractSize = 16 << 30
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format        int       `json:"format"`
+	SchemaVersion int       `json:"schema_version"` // store schema of the database snapshot
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Compatible returns an error unless a build whose store schema is
+// schemaVersion can import the archive. Older schemas are fine: the store
+// migrates them on import.
+func (m Manifest) Compatible(schemaVersion int) error {
+	if m.Format != FormatVersion {
+		return fmt.Errorf("unsupported archive format %d (expected %d)", m.Format, FormatVersion)
+	}
+	if m.SchemaVersion < 1 || m.SchemaVersion > schemaVersion {
+		return fmt.Errorf("archive schema version %d is not supported by this build (up to %d)", m.SchemaVersion, schemaVersion)
+	}
+	return nil
+}
+
+// Write writes an archive to w: the manifest, the database file at dbPath
+// (a consistent snapshot, not the live WAL database) and every directory,
+// regular file and symlink of configFS under config/.
+func Write(w io.Writer, m Manifest, dbPath string, configFS fs.FS) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if err := writeFile(tw, ManifestName, 0640, m.CreatedAt, manifest); err != nil {
+		return err
+	}
+	if err := addFile(tw, DBName, dbPath); err != nil {
+		return err
+	}
+	if err := addTree(tw, ConfigDir, configFS); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("close gzip: %w", err)
+	}
+	return nil
+}
+
+func writeFile(tw *tar.Writer, name string, mode int64, modTime time.Time, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+func addFile(tw *tar.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", src, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", src, err)
+	}
+	hdr := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+// addTree adds fsys under prefix. Other file types (sockets, devices) are
+// skipped.
+func addTree(tw *tar.Writer, prefix string, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, p)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()})
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := fs.ReadLink(fsys, p)
+			if err != nil {
+				return err
+			}
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: link, Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()})
+		case d.Type().IsRegular():
+			f, err := fsys.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, f); err != nil {
+				return fmt.Errorf("write %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Extract unpacks an archive written by Write into dir, which should be
+// empty: the database ends up at dir/cloudcode.db and the config tree at
+// dir/config. check is called with the manifest before anything else is
+// extracted, so an incompatible archive is rejected early. Entries outside
+// dir and symlinks with an absolute or ".." target are rejected.
+func Extract(r io.Reader, dir string, check func(Manifest) error) (Manifest, error) {
+	var m Manifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return m, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != ManifestName {
+		return m, errors.New("archive does not start with " + ManifestName)
+	}
+	if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&m); err != nil {
+		return m, fmt.Errorf("read manifest: %w", err)
+	}
+	if check != nil {
+		if err := check(m); err != nil {
+			return m, err
+		}
+	}
+
+	// 符号链接最后创建，避免后续条目经由链接写到 dir 之外
+	type symlink struct{ target, link string }
+	var (
+		links     []symlink
+		linkNames = make(map[string]bool)
+		written   int64
+		haveDB    bool
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return m, fmt.Errorf("read archive: %w", err)
+		}
+		name := path.Clean(strings.TrimSuffix(hdr.Name, "/"))
+		if name != DBName && !strings.HasPrefix(name, ConfigDir+"/") && name != ConfigDir {
+			return m, fmt.Errorf("unexpected archive entry %q", hdr.Name)
+		}
+		if !filepath.IsLocal(name) {
+			return m, fmt.Errorf("unsafe archive entry %q", hdr.Name)
+		}
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if linkNames[parent] {
+				return m, fmt.Errorf("archive entry %q is below a symlink", hdr.Name)
+			}
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return m, err
+			}
+		case tar.TypeSymlink:
+			// 链接目标必须是相对路径且不含 ".."，否则解开后可指向 dir 之外
+			if !filepath.IsLocal(filepath.FromSlash(hdr.Linkname)) {
+				return m, fmt.Errorf("unsafe symlink %q -> %q", hdr.Name, hdr.Linkname)
+			}
+			links = append(links, symlink{target: target, link: hdr.Linkname})
+			linkNames[name] = true
+		case tar.TypeReg:
+			written += hdr.Size
+			if written > maxExtractSize {
+				return m, errors.New("archive is too large")
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+				return m, err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return m, err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return m, fmt.Errorf("extract %s: %w", name, err)
+			}
+			if name == DBName {
+				haveDB = true
+			}
+		default:
+			return m, fmt.Errorf("unsupported archive entry type for %q", hdr.Name)
+		}
+	}
+	if !haveDB {
+		return m, errors.New("archive does not contain " + DBName)
+	}
+
+	for _, l := range links {
+		if err := os.MkdirAll(filepath.Dir(l.target), 0750); err != nil {
+			return m, err
+		}
+		if err := os.Symlink(l.link, l.target); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
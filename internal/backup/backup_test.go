@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestWriteExtractRoundTrip(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "snapshot.db")
+	if err := os.WriteFile(dbPath, []byte("sqlite"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tree := fstest.MapFS{
+		"opencode.json":          {Data: []byte(`{"theme":"dark"}`), Mode: 0644},
+		"agents/AGENTS.md":       {Data: []byte("# Agents"), Mode: 0600},
+		"agents/current":         {Data: []byte("AGENTS.md"), Mode: fs.ModeSymlink | 0777},
+		"instances/a1/auth.json": {Data: []byte("{}"), Mode: 0600},
+	}
+	want := Manifest{Format: FormatVersion, SchemaVersion: 3, CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, want, dbPath, tree); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dir := t.TempDir()
+	got, err := Extract(&buf, dir, func(m Manifest) error { return m.Compatible(3) })
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || got.Format != want.Format || got.SchemaVersion != want.SchemaVersion {
+		t.Errorf("manifest = %+v, want %+v", got, want)
+	}
+
+	files := map[string]string{
+		DBName:                          "sqlite",
+		"config/opencode.json":          `{"theme":"dark"}`,
+		"config/agents/AGENTS.md":       "# Agents",
+		"config/agents/current":         "# Agents", // 经由符号链接读取
+		"config/instances/a1/auth.json": "{}",
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("read %s: %v", name, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "config", "agents", "current")); err != nil || link != "AGENTS.md" {
+		t.Errorf("symlink = %q, %v; want AGENTS.md", link, err)
+	}
+}
+
+func TestExtractRejectsIncompatibleManifest(t *testing.T) {
+	archive := buildArchive(t, Manifest{Format: FormatVersion, SchemaVersion: 9}, tarEntry{hdr: tar.Header{Name: DBName}})
+	_, err := Extract(bytes.NewReader(archive), t.TempDir(), func(m Manifest) error { return m.Compatible(3) })
+	if err == nil || !strings.Contains(err.Error(), "schema version 9") {
+		t.Errorf("Extract error = %v, want schema version error", err)
+	}
+}
+
+func TestExtractRejectsUnsafeEntries(t *testing.T) {
+	db := tarEntry{hdr: tar.Header{Name: DBName}}
+	cases := map[string][]tarEntry{
+		"parent traversal": {db, {hdr: tar.Header{Name: "config/../../evil"}}},
+		"absolute path":    {db, {hdr: tar.Header{Name: "/etc/evil"}}},
+		"unknown entry":    {db, {hdr: tar.Header{Name: "evil"}}},
+		"absolute symlink": {db, {hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "config/passwd", Linkname: "/etc/passwd"}}},
+		"parent symlink":   {db, {hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "config/up", Linkname: "../../.."}}},
+		"below symlink": {
+			db,
+			{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "config/dir", Linkname: "sub"}},
+			{hdr: tar.Header{Name: "config/dir/file"}, data: "x"},
+		},
+		"missing database": {{hdr: tar.Header{Name: "config/a"}, data: "x"}},
+	}
+	for name, entries := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "extract")
+			if err := os.Mkdir(dir, 0750); err != nil {
+				t.Fatal(err)
+			}
+			archive := buildArchive(t, Manifest{Format: FormatVersion, SchemaVersion: 1}, entries...)
+			if _, err := Extract(bytes.NewReader(archive), dir, nil); err == nil {
+				t.Fatal("Extract succeeded")
+			}
+			// 不得在解压目录之外留下任何东西
+			outside, _ := os.ReadDir(root)
+			if len(outside) != 1 {
+				t.Errorf("files written outside the extract dir: %v", outside)
+			}
+		})
+	}
+}
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+// buildArchive writes a tar.gz with the manifest m followed by entries,
+// bypassing the checks of Write.
+func buildArchive(t *testing.T, m Manifest, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.Marshal(m)
+	entries = append([]tarEntry{{hdr: tar.Header{Name: ManifestName}, data: string(manifest)}}, entries...)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		hdr.Mode = 0644
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultKeep is the number of scheduled backups retained by default.
+const DefaultKeep = 7
+
+// Archive file names are "cloudcode-YYYYmmdd-HHMMSS.tar.gz" (UTC), so they
+// sort chronologically.
+const (
+	filePrefix = "cloudcode-"
+	fileSuffix = ".tar.gz"
+)
+
+// FileName returns the archive file name for a backup taken at t.
+func FileName(t time.Time) string {
+	return filePrefix + t.UTC().Format("20060102-150405") + fileSuffix
+}
+
+// ScheduleOptions configures periodic backups.
+type ScheduleOptions struct {
+	Dir           string        // where archives are written
+	Interval      time.Duration // time between backups
+	Keep          int           // archives retained in Dir; <= 0 = DefaultKeep
+	ConfigDir     string        // config tree to include
+	SchemaVersion int           // store schema recorded in the manifest
+
+	// Snapshot writes a consistent copy of the live database to path,
+	// e.g. Store.Snapshot (VACUUM INTO).
+	Snapshot func(path string) error
+
+	// Leader reports whether this replica holds the leader lease. Replicas
+	// sharing a data directory only back up while it returns true. nil
+	// means a single replica, which always backs up.
+	Leader func() bool
+}
+
+// leaderPoll is how often Schedule checks for the leader lease before the
+// startup backup.
+const leaderPoll = 5 * time.Second
+
+func (opts ScheduleOptions) isLeader() bool {
+	return opts.Leader == nil || opts.Leader()
+}
+
+// Schedule writes a backup right away and then every opts.Interval until
+// ctx is cancelled, pruning all but the newest opts.Keep archives after
+// each one. Each backup is skipped unless this replica is the leader; the
+// startup one waits up to one interval for the lease to be acquired.
+// Failures are logged and retried on the next tick.
+func Schedule(ctx context.Context, opts ScheduleOptions) {
+	// lease 的首次心跳可能还没完成，等到本副本成为 leader 或到第一个周期为止
+	deadline := time.Now().Add(opts.Interval)
+	for !opts.isLeader() && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(min(leaderPoll, opts.Interval)):
+		}
+	}
+	scheduledBackup(opts)
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scheduledBackup(opts)
+		}
+	}
+}
+
+// scheduledBackup runs one backup on the leader and logs the outcome.
+func scheduledBackup(opts ScheduleOptions) {
+	if !opts.isLeader() {
+		return
+	}
+	path, err := RunOnce(opts)
+	if err != nil {
+		log.Printf("Scheduled backup failed: %v", err)
+		return
+	}
+	log.Printf("Scheduled backup written to %s", path)
+}
+
+// RunOnce writes one backup archive into opts.Dir, prunes old archives and
+// returns the path of the new one.
+func RunOnce(opts ScheduleOptions) (string, error) {
+	if err := os.MkdirAll(opts.Dir, 0750); err != nil {
+		return "", fmt.Errorf("create backup dir: %w", err)
+	}
+	m := Manifest{Format: FormatVersion, SchemaVersion: opts.SchemaVersion, CreatedAt: time.Now().UTC()}
+
+	// 数据库快照和未完成的归档都以 "." 开头，不会被 prune 当作备份
+	dbPath := filepath.Join(opts.Dir, "."+DBName+"-"+m.CreatedAt.Format("20060102-150405"))
+	defer os.Remove(dbPath)
+	if err := opts.Snapshot(dbPath); err != nil {
+		return "", fmt.Errorf("snapshot database: %w", err)
+	}
+
+	f, err := os.CreateTemp(opts.Dir, ".backup-*")
+	if err != nil {
+		return "", fmt.Errorf("create archive: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	err = Write(f, m, dbPath, os.DirFS(opts.ConfigDir))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("write archive: %w", err)
+	}
+	path := filepath.Join(opts.Dir, FileName(m.CreatedAt))
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("write archive: %w", err)
+	}
+
+	keep := opts.Keep
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+	if err := prune(opts.Dir, keep); err != nil {
+		log.Printf("Pruning old backups failed: %v", err)
+	}
+	return path, nil
+}
+
+// prune removes all but the newest keep archives in dir. Other files are
+// left alone.
+func prune(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var archives []string
+	for _, e := range entries {
+		if name := e.Name(); e.Type().IsRegular() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			archives = append(archives, name)
+		}
+	}
+	if len(archives) <= keep {
+		return nil
+	}
+	slices.Sort(archives)
+	for _, name := range archives[:len(archives)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		log.Printf("Removed old backup %s", name)
+	}
+	return nil
+}
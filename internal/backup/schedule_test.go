@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testScheduleOptions backs up a fake database and config tree into a
+// temporary directory.
+func testScheduleOptions(t *testing.T) ScheduleOptions {
+	t.Helper()
+	configDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(configDir, "opencode.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ScheduleOptions{
+		Dir:           filepath.Join(t.TempDir(), "backups"),
+		Interval:      time.Hour,
+		Keep:          2,
+		ConfigDir:     configDir,
+		SchemaVersion: 4,
+		Snapshot: func(path string) error {
+			return os.WriteFile(path, []byte("sqlite"), 0600)
+		},
+	}
+}
+
+// archives lists the backup archives in dir.
+func archives(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestRunOnce(t *testing.T) {
+	opts := testScheduleOptions(t)
+	// 两个旧备份和一个无关文件；保留 2 个时最旧的被删除
+	if err := os.MkdirAll(opts.Dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	old := []string{FileName(time.Now().Add(-48 * time.Hour)), FileName(time.Now().Add(-24 * time.Hour)), "notes.txt"}
+	for _, name := range old {
+		if err := os.WriteFile(filepath.Join(opts.Dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := RunOnce(opts)
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := Extract(f, t.TempDir(), func(m Manifest) error { return m.Compatible(4) })
+	if err != nil {
+		t.Fatalf("Extract backup: %v", err)
+	}
+	if m.SchemaVersion != 4 {
+		t.Errorf("schema version = %d, want 4", m.SchemaVersion)
+	}
+
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{old[1], filepath.Base(path), "notes.txt"}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("backup dir = %v, want %v", names, want)
+	}
+}
+
+func TestScheduleBacksUpOnLeaderOnly(t *testing.T) {
+	opts := testScheduleOptions(t)
+	opts.Interval = 50 * time.Millisecond
+	var leader atomic.Bool
+	opts.Leader = leader.Load
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Schedule(ctx, opts)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(3 * opts.Interval)
+	if got := archives(t, opts.Dir); len(got) != 0 {
+		t.Fatalf("follower wrote backups: %v", got)
+	}
+
+	leader.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(archives(t, opts.Dir)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no backup after becoming leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScheduleBacksUpAtStartup(t *testing.T) {
+	opts := testScheduleOptions(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Schedule(ctx, opts)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// 周期是一小时，备份只能来自启动时的那一次
+	deadline := time.Now().Add(5 * time.Second)
+	for len(archives(t, opts.Dir)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no backup at startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
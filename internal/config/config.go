@@ -3,10 +3,15 @@ package config
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"syscall"
+	"time"
 )
 
 //go:embed plugins/_cloudcode-telegram.ts
@@ -20,11 +25,19 @@ var instructionsFile []byte
 
 const instructionsFileName = "_cloudcode-instructions.md"
 
+// agentsTemplate seeds the global AGENTS.md. Unlike the plugins and the
+// instructions file above, which CloudCode owns and rewrites on every
+// start, AGENTS.md belongs to the user: it is only written when missing.
+//
+//go:embed templates/AGENTS.md
+var agentsTemplate []byte
+
 const (
 	DirOpenCodeConfig = "opencode"      // → /root/.config/opencode/
 	DirOpenCodeData   = "opencode-data" // → /root/.local/share/opencode/
 	DirDotOpenCode    = "dot-opencode"  // → /root/.opencode/
 	DirAgentsSkills   = "agents-skills" // → /root/.agents/ (contains skills/ subdir and .skill-lock.json)
+	DirHomeTemplate   = "home-template" // → copied into /root when a new home volume is created
 	FileEnvVars       = "env.json"
 )
 
@@ -50,26 +63,32 @@ var DotOpenCodeFiles = []string{
 }
 
 type ContainerMount struct {
-	HostPath      string
-	ContainerPath string
-	ReadOnly      bool
+	HostPath      string `json:"host_path"`
+	ContainerPath string `json:"container_path"`
+	ReadOnly      bool   `json:"read_only,omitempty"`
 }
 
 type Manager struct {
-	rootDir     string
-	hostRootDir string
+	rootDir      string
+	hostRootDir  string
+	errorLogDir  string
+	recordingDir string
 }
 
 func NewManager(dataDir string) (*Manager, error) {
 	rootDir := filepath.Join(dataDir, "config")
-	m := &Manager{rootDir: rootDir}
+	m := &Manager{
+		rootDir:      rootDir,
+		errorLogDir:  filepath.Join(dataDir, "error-logs"),
+		recordingDir: filepath.Join(dataDir, "recordings"),
+	}
 
 	if hostDataDir := os.Getenv("HOST_DATA_DIR"); hostDataDir != "" {
 		m.hostRootDir = filepath.Join(hostDataDir, "config")
 	}
 
 	if err := m.ensureDirs(); err != nil {
-		return nil, fmt.Errorf("ensure config dirs: %w", err)
+		return nil, fmt.Errorf("ensure config dirs: %w", DescribeWriteError(err))
 	}
 	return m, nil
 }
@@ -86,6 +105,7 @@ func (m *Manager) ensureDirs() error {
 		filepath.Join(m.rootDir, DirAgentsSkills),
 		// skills.sh 安装的技能存放在 skills/ 子目录，.skill-lock.json 在父目录
 		filepath.Join(m.rootDir, DirAgentsSkills, "skills"),
+		filepath.Join(m.rootDir, DirHomeTemplate),
 	}
 	for _, d := range OpenCodeConfigDirs {
 		dirs = append(dirs, filepath.Join(m.rootDir, DirOpenCodeConfig, d))
@@ -96,6 +116,7 @@ func (m *Manager) ensureDirs() error {
 		}
 	}
 
+	// 插件由 CloudCode 管理，每次启动覆盖；AGENTS.md 属于用户，只在缺失时写入（见 seedAgentsFile）
 	pluginPath := filepath.Join(m.rootDir, DirOpenCodeConfig, "plugins", "_cloudcode-telegram.ts")
 	if err := os.WriteFile(pluginPath, telegramPlugin, 0640); err != nil {
 		return fmt.Errorf("write telegram plugin: %w", err)
@@ -107,6 +128,10 @@ func (m *Manager) ensureDirs() error {
 		return fmt.Errorf("write prompt watchdog plugin: %w", err)
 	}
 
+	if err := m.seedAgentsFile(); err != nil {
+		return fmt.Errorf("seed AGENTS.md: %w", err)
+	}
+
 	if err := m.ensureInstructionsFile(); err != nil {
 		return fmt.Errorf("ensure instructions file: %w", err)
 	}
@@ -118,6 +143,25 @@ func (m *Manager) ensureDirs() error {
 	return nil
 }
 
+// seedAgentsFile writes the default AGENTS.md unless the file exists. An
+// existing file is never touched, even when empty: clearing it is a valid
+// choice. O_EXCL keeps replicas starting together from racing each other.
+func (m *Manager) seedAgentsFile() error {
+	path := filepath.Join(m.rootDir, DirOpenCodeConfig, "AGENTS.md")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := f.Write(agentsTemplate); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 // ensureInstructionsFile writes the CloudCode instructions as a standalone
 // instruction file and ensures opencode.jsonc references it via the
 // "instructions" field. This avoids modifying AGENTS.md directly.
@@ -245,6 +289,23 @@ func stripJSONCComments(s string) string {
 	return s
 }
 
+// DescribeWriteError turns low-level filesystem failures into actionable
+// messages. Read-only filesystems, full disks and permission problems are
+// reported distinctly; other errors are returned unchanged.
+func DescribeWriteError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Errorf("data directory is on a read-only filesystem: %w", err)
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return fmt.Errorf("disk is full: %w", err)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("permission denied writing to data directory: %w", err)
+	}
+	return err
+}
+
 func (m *Manager) GetEnvVars() (map[string]string, error) {
 	p := filepath.Join(m.rootDir, FileEnvVars)
 	data, err := os.ReadFile(p)
@@ -261,12 +322,22 @@ func (m *Manager) GetEnvVars() (map[string]string, error) {
 	return env, nil
 }
 
+// MergeEnv returns the environment of an instance: the global variables
+// overlaid with the instance's own, which win on key collisions. Neither
+// map is modified.
+func MergeEnv(global, instance map[string]string) map[string]string {
+	env := make(map[string]string, len(global)+len(instance))
+	maps.Copy(env, global)
+	maps.Copy(env, instance)
+	return env
+}
+
 func (m *Manager) SetEnvVars(env map[string]string) error {
 	data, err := json.MarshalIndent(env, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(m.rootDir, FileEnvVars), data, 0600)
+	return DescribeWriteError(os.WriteFile(filepath.Join(m.rootDir, FileEnvVars), data, 0600))
 }
 
 // ReadFile reads a config file by relPath (e.g. "opencode/opencode.jsonc").
@@ -287,9 +358,9 @@ func (m *Manager) WriteFile(relPath string, content string) error {
 	p := filepath.Join(m.rootDir, relPath)
 	dir := filepath.Dir(p)
 	if err := os.MkdirAll(dir, 0750); err != nil {
-		return err
+		return DescribeWriteError(err)
 	}
-	return os.WriteFile(p, []byte(content), 0600)
+	return DescribeWriteError(os.WriteFile(p, []byte(content), 0600))
 }
 
 func (m *Manager) ContainerMountsForInstance(instanceID string) ([]ContainerMount, error) {
@@ -304,6 +375,10 @@ func (m *Manager) ContainerMountsForInstance(instanceID string) ([]ContainerMoun
 	if m.hostRootDir != "" {
 		root = m.hostRootDir
 	}
+	// 带配置快照的实例挂载自己的副本，而非共享的全局配置
+	if m.HasConfigSnapshot(instanceID) {
+		root = filepath.Join(root, snapshotRelDir(instanceID))
+	}
 
 	// Session data lives in the named volume (cloudcode-home-{id}) at /root.
 	// Only global configs and auth.json are bind-mounted.
@@ -329,9 +404,271 @@ func (m *Manager) ContainerMountsForInstance(instanceID string) ([]ContainerMoun
 	}, nil
 }
 
+// snapshotRelDir is where a per-instance config snapshot lives, relative
+// to the config root. It mirrors the global layout so the same mount list
+// applies with a different root.
+func snapshotRelDir(instanceID string) string {
+	return filepath.Join("instances", instanceID, "config-snapshot")
+}
+
+// HasConfigSnapshot reports whether an instance mounts its own config
+// snapshot instead of the shared global config.
+func (m *Manager) HasConfigSnapshot(instanceID string) bool {
+	info, err := os.Stat(filepath.Join(m.rootDir, snapshotRelDir(instanceID)))
+	return err == nil && info.IsDir()
+}
+
+// SnapshotConfig copies the current global config (opencode config,
+// auth.json, .opencode and .agents) into the instance's snapshot directory.
+func (m *Manager) SnapshotConfig(instanceID string) error {
+	dst := filepath.Join(m.rootDir, snapshotRelDir(instanceID))
+	for _, dir := range []string{DirOpenCodeConfig, DirDotOpenCode, DirAgentsSkills} {
+		if err := copyTree(filepath.Join(m.rootDir, dir), filepath.Join(dst, dir)); err != nil {
+			return fmt.Errorf("copy %s: %w", dir, DescribeWriteError(err))
+		}
+	}
+	auth := filepath.Join(DirOpenCodeData, "auth.json")
+	if err := os.MkdirAll(filepath.Join(dst, DirOpenCodeData), 0750); err != nil {
+		return DescribeWriteError(err)
+	}
+	data, err := os.ReadFile(filepath.Join(m.rootDir, auth))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("read auth.json: %w", err)
+		}
+		data = []byte("{}\n")
+	}
+	return DescribeWriteError(os.WriteFile(filepath.Join(dst, auth), data, 0600))
+}
+
+// copyTree recursively copies regular files and directories from src to
+// dst, preserving permissions. Symlinks are recreated as-is.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == src {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, data, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// ReplaceTree replaces the whole config tree with the contents of src,
+// which must be on the same filesystem (entries are renamed, not copied).
+// The root directory itself is kept so existing bind mounts of it stay
+// valid. Missing directories and the built-in plugins are recreated.
+func (m *Manager) ReplaceTree(src string) error {
+	old, err := os.ReadDir(m.rootDir)
+	if err != nil {
+		return fmt.Errorf("read config dir: %w", err)
+	}
+	for _, e := range old {
+		if err := os.RemoveAll(filepath.Join(m.rootDir, e.Name())); err != nil {
+			return fmt.Errorf("remove %s: %w", e.Name(), err)
+		}
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("read imported config: %w", err)
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(m.rootDir, e.Name())); err != nil {
+			return fmt.Errorf("move %s: %w", e.Name(), err)
+		}
+	}
+	return m.ensureDirs()
+}
+
+// HomeTemplateDir returns the directory whose contents seed new home volumes.
+func (m *Manager) HomeTemplateDir() string {
+	return filepath.Join(m.rootDir, DirHomeTemplate)
+}
+
+// HomeTemplateFiles lists the regular files in the home template directory
+// as slash-separated paths relative to it (e.g. ".gitconfig", ".ssh/config").
+func (m *Manager) HomeTemplateFiles() ([]string, error) {
+	root := m.HomeTemplateDir()
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
 func (m *Manager) RemoveInstanceData(instanceID string) {
 	instDir := filepath.Join(m.rootDir, "instances", instanceID)
 	_ = os.RemoveAll(instDir)
+	_ = os.RemoveAll(filepath.Join(m.errorLogDir, instanceID))
+	_ = os.RemoveAll(filepath.Join(m.recordingDir, instanceID))
+}
+
+// InstanceDataPaths lists the per-instance directories RemoveInstanceData
+// would delete that currently exist on disk.
+func (m *Manager) InstanceDataPaths(instanceID string) []string {
+	var paths []string
+	for _, p := range []string{
+		filepath.Join(m.rootDir, "instances", instanceID),
+		filepath.Join(m.errorLogDir, instanceID),
+		filepath.Join(m.recordingDir, instanceID),
+	} {
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// ErrorLogInfo describes a log snapshot captured when an instance failed.
+type ErrorLogInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// SaveErrorLog writes a post-mortem log snapshot for an instance under
+// {data}/error-logs/{id}/ and returns the file name. These live outside the
+// config dir so they are never mounted into containers.
+func (m *Manager) SaveErrorLog(instanceID string, data []byte) (string, error) {
+	dir := filepath.Join(m.errorLogDir, instanceID)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", DescribeWriteError(err)
+	}
+	name := time.Now().UTC().Format("20060102-150405") + ".log"
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0640); err != nil {
+		return "", DescribeWriteError(err)
+	}
+	return name, nil
+}
+
+// ListErrorLogs returns an instance's captured error logs, newest first.
+func (m *Manager) ListErrorLogs(instanceID string) ([]ErrorLogInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(m.errorLogDir, instanceID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var logs []ErrorLogInfo
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), ".log") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		logs = append(logs, ErrorLogInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return logs, nil
+}
+
+// ErrorLogPath resolves a captured error log file, rejecting names that
+// would escape the instance's log directory.
+func (m *Manager) ErrorLogPath(instanceID, name string) (string, error) {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".log") || strings.Contains(instanceID, "..") || strings.ContainsAny(instanceID, `/\`) {
+		return "", fmt.Errorf("invalid log name %q", name)
+	}
+	return filepath.Join(m.errorLogDir, instanceID, name), nil
+}
+
+// RecordingInfo describes a terminal session recording.
+type RecordingInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// CreateRecording creates a new asciinema cast file for a terminal session
+// under {data}/recordings/{id}/. Like error logs, recordings live outside
+// the config dir so they are never mounted into containers.
+func (m *Manager) CreateRecording(instanceID string) (*os.File, string, error) {
+	dir := filepath.Join(m.recordingDir, instanceID)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, "", DescribeWriteError(err)
+	}
+	// 同一秒内可能打开多个终端，用纳秒区分
+	name := time.Now().UTC().Format("20060102-150405.000000000") + ".cast"
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, "", DescribeWriteError(err)
+	}
+	return f, name, nil
+}
+
+// ListRecordings returns an instance's terminal recordings, newest first.
+func (m *Manager) ListRecordings(instanceID string) ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(m.recordingDir, instanceID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var recordings []RecordingInfo
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), ".cast") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return recordings, nil
+}
+
+// RecordingPath resolves a terminal recording, rejecting names that would
+// escape the instance's recording directory.
+func (m *Manager) RecordingPath(instanceID, name string) (string, error) {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".cast") || strings.Contains(instanceID, "..") || strings.ContainsAny(instanceID, `/\`) {
+		return "", fmt.Errorf("invalid recording name %q", name)
+	}
+	return filepath.Join(m.recordingDir, instanceID, name), nil
 }
 
 type ConfigFileInfo struct {
@@ -435,13 +772,13 @@ func (m *Manager) ReadAgentsSkillFile(relPath string) (string, error) {
 // DeleteAgentsSkill removes an entire skill directory from agents-skills/skills/.
 func (m *Manager) DeleteAgentsSkill(skillName string) error {
 	p := filepath.Join(m.rootDir, DirAgentsSkills, "skills", skillName)
-	return os.RemoveAll(p)
+	return DescribeWriteError(os.RemoveAll(p))
 }
 
 func (m *Manager) DeleteFile(relPath string) error {
 	p := filepath.Join(m.rootDir, relPath)
 	if err := os.Remove(p); err != nil {
-		return err
+		return DescribeWriteError(err)
 	}
 	dir := filepath.Dir(p)
 	entries, _ := os.ReadDir(dir)
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"bytes"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	global := map[string]string{"API_KEY": "global", "REGION": "eu"}
+	instance := map[string]string{"API_KEY": "instance", "DEBUG": "1"}
+	got := MergeEnv(global, instance)
+	want := map[string]string{"API_KEY": "instance", "REGION": "eu", "DEBUG": "1"}
+	if !maps.Equal(got, want) {
+		t.Errorf("MergeEnv = %v, want %v", got, want)
+	}
+	if global["API_KEY"] != "global" || len(global) != 2 || len(instance) != 2 {
+		t.Errorf("MergeEnv modified its inputs: global %v, instance %v", global, instance)
+	}
+	if got := MergeEnv(nil, nil); got == nil || len(got) != 0 {
+		t.Errorf("MergeEnv(nil, nil) = %#v, want an empty map", got)
+	}
+}
+
+func TestAgentsFileSeeding(t *testing.T) {
+	m, dataDir := newTestManager(t)
+	agents := filepath.Join(m.rootDir, DirOpenCodeConfig, "AGENTS.md")
+	got, err := os.ReadFile(agents)
+	if err != nil {
+		t.Fatalf("AGENTS.md not seeded: %v", err)
+	}
+	if len(agentsTemplate) == 0 || !bytes.Equal(got, agentsTemplate) {
+		t.Errorf("seeded AGENTS.md = %q, want the embedded template", got)
+	}
+
+	// 用户的内容（包括清空）在重启后保留；插件则总是被覆盖
+	plugin := filepath.Join(m.rootDir, DirOpenCodeConfig, "plugins", "_cloudcode-telegram.ts")
+	for _, content := range []string{"# my rules\n", ""} {
+		if err := os.WriteFile(agents, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(plugin, []byte("stale"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewManager(dataDir); err != nil {
+			t.Fatalf("NewManager: %v", err)
+		}
+		if got, _ := os.ReadFile(agents); string(got) != content {
+			t.Errorf("AGENTS.md after restart = %q, want %q", got, content)
+		}
+		if got, _ := os.ReadFile(plugin); !bytes.Equal(got, telegramPlugin) {
+			t.Error("plugin was not rewritten on restart")
+		}
+	}
+}
+
+func TestValidEnvKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"API_KEY": true,
+		"_x1":     true,
+		"a":       true,
+		"A=B":     false,
+		"1ABC":    false,
+		"MY-VAR":  false,
+		"HAS SP":  false,
+		"":        false,
+	} {
+		if got := ValidEnvKey(key); got != want {
+			t.Errorf("ValidEnvKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
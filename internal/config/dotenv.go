@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseDotEnv parses the KEY=VALUE lines of a .env file. Blank lines and
+// comments are skipped and an "export " prefix is allowed. Unquoted values
+// are trimmed and end at " #". Single-quoted values are taken literally;
+// double-quoted ones understand \n, \r, \t, \" and \\. Both kinds of quoted
+// values may span lines. A later line for the same key wins.
+//
+// Lines that cannot be parsed are described in malformed, e.g. "line 3:
+// expected KEY=VALUE", without their content, which may hold secrets.
+func ParseDotEnv(content string) (env map[string]string, malformed []string) {
+	env = make(map[string]string)
+	content = strings.TrimPrefix(content, "\ufeff") // UTF-8 BOM
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimSpace(rest)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			malformed = append(malformed, fmt.Sprintf("line %d: expected KEY=VALUE", lineNo))
+			continue
+		}
+		if !ValidEnvKey(key) {
+			malformed = append(malformed, fmt.Sprintf("line %d: invalid variable name %q", lineNo, key))
+			continue
+		}
+
+		value = strings.TrimLeft(value, " \t")
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = value[:j]
+			}
+			env[key] = strings.TrimRight(value, " \t")
+			continue
+		}
+
+		// 引号内的值可以跨行，直到遇到匹配的结束引号
+		quote := value[0]
+		text := value[1:]
+		val, rest, closed := unquoteDotEnv(text, quote)
+		for !closed && i+1 < len(lines) {
+			i++
+			text += "\n" + lines[i]
+			val, rest, closed = unquoteDotEnv(text, quote)
+		}
+		switch rest = strings.TrimSpace(rest); {
+		case !closed:
+			malformed = append(malformed, fmt.Sprintf("line %d: unterminated %c quote", lineNo, quote))
+		case rest != "" && !strings.HasPrefix(rest, "#"):
+			malformed = append(malformed, fmt.Sprintf("line %d: unexpected text after the closing quote", lineNo))
+		default:
+			env[key] = val
+		}
+	}
+	return env, malformed
+}
+
+// unquoteDotEnv reads a quoted value up to its closing quote, returning
+// the value, the text after the quote and whether the quote was closed.
+func unquoteDotEnv(s string, quote byte) (value, rest string, closed bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), s[i+1:], true
+		case quote == '"' && c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
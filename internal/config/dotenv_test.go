@@ -0,0 +1,59 @@
+package config
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestParseDotEnv(t *testing.T) {
+	content := "\ufeff# provider keys\r\n" +
+		"\n" +
+		"export OPENAI_API_KEY=sk-123\n" +
+		"PLAIN = value with spaces   # trailing comment\n" +
+		"HASH=a#b\n" +
+		"SINGLE='literal \\n $HOME # kept'\n" +
+		"DOUBLE=\"tab\\there \\\"quoted\\\"\" # comment\n" +
+		"MULTI=\"line one\n" +
+		"line two\"\n" +
+		"EMPTY=\n" +
+		"DUP=first\n" +
+		"DUP=second\n" +
+		"not a pair\n" +
+		"1BAD=x\n" +
+		"TRAILING=\"ok\" junk\n" +
+		"OPEN='never closed\n"
+
+	env, malformed := ParseDotEnv(content)
+
+	want := map[string]string{
+		"OPENAI_API_KEY": "sk-123",
+		"PLAIN":          "value with spaces",
+		"HASH":           "a#b",
+		"SINGLE":         `literal \n $HOME # kept`,
+		"DOUBLE":         "tab\there \"quoted\"",
+		"MULTI":          "line one\nline two",
+		"EMPTY":          "",
+		"DUP":            "second",
+	}
+	if !maps.Equal(env, want) {
+		t.Errorf("env = %q\nwant  %q", env, want)
+	}
+	wantMalformed := []string{
+		"line 13: expected KEY=VALUE",
+		`line 14: invalid variable name "1BAD"`,
+		"line 15: unexpected text after the closing quote",
+		"line 16: unterminated ' quote",
+	}
+	if !slices.Equal(malformed, wantMalformed) {
+		t.Errorf("malformed = %q\nwant        %q", malformed, wantMalformed)
+	}
+}
+
+func TestParseDotEnvHidesValues(t *testing.T) {
+	// 报错信息不能带出行内容，那可能是密钥
+	_, malformed := ParseDotEnv("sk-secret-token\n")
+	if len(malformed) != 1 || malformed[0] != "line 1: expected KEY=VALUE" {
+		t.Errorf("malformed = %q", malformed)
+	}
+}
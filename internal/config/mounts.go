@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MaxBindMounts caps the host directories one instance may mount.
+const MaxBindMounts = 16
+
+// forbiddenHostPaths may neither be mounted nor contain a mounted path.
+// Mounting a parent of them (e.g. /var/run) is refused too, see
+// ValidateBindMounts.
+var forbiddenHostPaths = []string{"/etc", "/proc", "/sys", "/dev", "/boot"}
+
+// dockerSockets would hand the instance control over the Docker daemon.
+var dockerSockets = []string{"/var/run/docker.sock", "/run/docker.sock"}
+
+// ValidateBindMounts checks user-defined host mounts and returns them with
+// cleaned paths. Host paths must be absolute, must not be "/", a system
+// directory, the Docker socket or overlap the CloudCode data directory, and
+// must exist. Symlinks are resolved and the resolved path is checked and
+// returned. When CloudCode itself runs in a container (HOST_DATA_DIR is
+// set) host paths cannot be checked here; Docker reports missing ones when
+// the container is created. Container paths must be absolute and must not
+// replace the home directory or overlap the shared config mounts.
+func (m *Manager) ValidateBindMounts(mounts []ContainerMount) ([]ContainerMount, error) {
+	if len(mounts) > MaxBindMounts {
+		return nil, fmt.Errorf("at most %d bind mounts are allowed", MaxBindMounts)
+	}
+	reserved, err := m.defaultMountTargets()
+	if err != nil {
+		return nil, err
+	}
+	dataDirs := []string{filepath.Dir(m.rootDir)}
+	if abs, err := filepath.Abs(dataDirs[0]); err == nil {
+		dataDirs[0] = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(dataDirs[0]); err == nil && resolved != dataDirs[0] {
+		dataDirs = append(dataDirs, resolved)
+	}
+	if m.hostRootDir != "" {
+		dataDirs = append(dataDirs, filepath.Dir(m.hostRootDir))
+	}
+
+	out := make([]ContainerMount, 0, len(mounts))
+	seen := make(map[string]bool)
+	for _, mnt := range mounts {
+		host := strings.TrimSpace(mnt.HostPath)
+		target := strings.TrimSpace(mnt.ContainerPath)
+		if !filepath.IsAbs(host) {
+			return nil, fmt.Errorf("host path %q must be absolute", host)
+		}
+		host = filepath.Clean(host)
+		if err := checkHostPath(host, dataDirs); err != nil {
+			return nil, err
+		}
+		if m.hostRootDir == "" {
+			// 符号链接可能指向受限目录，按解析后的真实路径再检查一遍并保存它，
+			// 之后改动链接也不会影响已保存的挂载
+			resolved, err := filepath.EvalSymlinks(host)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil, fmt.Errorf("host path %s does not exist", host)
+				}
+				return nil, fmt.Errorf("host path %s: %w", host, err)
+			}
+			if resolved != host {
+				if err := checkHostPath(resolved, dataDirs); err != nil {
+					return nil, fmt.Errorf("host path %s resolves to %s: %w", host, resolved, err)
+				}
+				host = resolved
+			}
+		}
+
+		if !path.IsAbs(target) {
+			return nil, fmt.Errorf("container path %q must be absolute", target)
+		}
+		target = path.Clean(target)
+		if target == "/" || target == "/root" {
+			return nil, fmt.Errorf("mounting over %s is not allowed", target)
+		}
+		for _, r := range reserved {
+			if pathWithin(target, r) || pathWithin(r, target) {
+				return nil, fmt.Errorf("container path %s overlaps the config mount %s", target, r)
+			}
+		}
+		if seen[target] {
+			return nil, fmt.Errorf("container path %s is mounted twice", target)
+		}
+		seen[target] = true
+
+		out = append(out, ContainerMount{HostPath: host, ContainerPath: target, ReadOnly: mnt.ReadOnly})
+	}
+	return out, nil
+}
+
+// checkHostPath refuses a clean absolute host path that is "/", lies in a
+// system directory, exposes the Docker socket or overlaps one of dataDirs.
+func checkHostPath(host string, dataDirs []string) error {
+	if host == "/" {
+		return fmt.Errorf("mounting the host root directory is not allowed")
+	}
+	for _, p := range forbiddenHostPaths {
+		if pathWithin(host, p) {
+			return fmt.Errorf("host path %s is not allowed", host)
+		}
+	}
+	for _, p := range dockerSockets {
+		if pathWithin(p, host) {
+			return fmt.Errorf("host path %s would expose the Docker socket", host)
+		}
+	}
+	for _, d := range dataDirs {
+		if pathWithin(host, d) || pathWithin(d, host) {
+			return fmt.Errorf("host path %s overlaps the CloudCode data directory", host)
+		}
+	}
+	return nil
+}
+
+// defaultMountTargets lists the container paths of the shared config
+// mounts from ContainerMountsForInstance.
+func (m *Manager) defaultMountTargets() ([]string, error) {
+	mounts, err := m.ContainerMountsForInstance("")
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]string, len(mounts))
+	for i, mnt := range mounts {
+		targets[i] = mnt.ContainerPath
+	}
+	return targets, nil
+}
+
+// pathWithin reports whether p is dir or lies below it. Both paths must be
+// clean.
+func pathWithin(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
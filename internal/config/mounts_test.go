@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	t.Setenv("HOST_DATA_DIR", "")
+	dataDir := t.TempDir()
+	m, err := NewManager(dataDir)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	return m, dataDir
+}
+
+func TestValidateBindMounts(t *testing.T) {
+	m, dataDir := newTestManager(t)
+	hostDir := t.TempDir()
+	realHost, err := filepath.EvalSymlinks(hostDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := t.TempDir()
+	for name, target := range map[string]string{"ok": hostDir, "etc": "/etc", "data": dataDir} {
+		if err := os.Symlink(target, filepath.Join(links, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := m.ValidateBindMounts([]ContainerMount{
+		{HostPath: " " + hostDir + "/ ", ContainerPath: "/work/src/", ReadOnly: true},
+		{HostPath: filepath.Join(links, "ok"), ContainerPath: "/work/link"},
+	})
+	if err != nil {
+		t.Fatalf("ValidateBindMounts: %v", err)
+	}
+	want := []ContainerMount{
+		{HostPath: realHost, ContainerPath: "/work/src", ReadOnly: true},
+		{HostPath: realHost, ContainerPath: "/work/link"},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("mounts = %+v, want %+v", got, want)
+	}
+
+	cases := map[string]ContainerMount{
+		"relative host":        {HostPath: "src", ContainerPath: "/work"},
+		"host root":            {HostPath: "/", ContainerPath: "/work"},
+		"system directory":     {HostPath: "/etc/ssl", ContainerPath: "/work"},
+		"docker socket parent": {HostPath: "/var/run", ContainerPath: "/work"},
+		"data directory":       {HostPath: dataDir, ContainerPath: "/work"},
+		"missing host":         {HostPath: filepath.Join(hostDir, "missing"), ContainerPath: "/work"},
+		"symlink to /etc":      {HostPath: filepath.Join(links, "etc"), ContainerPath: "/work"},
+		"symlink to data":      {HostPath: filepath.Join(links, "data"), ContainerPath: "/work"},
+		"relative container":   {HostPath: hostDir, ContainerPath: "work"},
+		"over home":            {HostPath: hostDir, ContainerPath: "/root"},
+		"over config mount":    {HostPath: hostDir, ContainerPath: "/root/.config/opencode"},
+		"container root":       {HostPath: hostDir, ContainerPath: "/"},
+	}
+	for name, mnt := range cases {
+		if _, err := m.ValidateBindMounts([]ContainerMount{mnt}); err == nil {
+			t.Errorf("%s: %+v accepted", name, mnt)
+		}
+	}
+
+	_, err = m.ValidateBindMounts([]ContainerMount{
+		{HostPath: hostDir, ContainerPath: "/work"},
+		{HostPath: hostDir, ContainerPath: "/work/"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "mounted twice") {
+		t.Errorf("duplicate container path: err = %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ModelInfo is a provider/model pair configured for opencode.
+type ModelInfo struct {
+	Provider       string `json:"provider"`
+	ProviderName   string `json:"provider_name"`
+	Model          string `json:"model"` // empty: provider's built-in model list
+	ModelName      string `json:"model_name"`
+	HasCredentials bool   `json:"has_credentials"`
+	Default        bool   `json:"default"`
+}
+
+// providerEnvKeys maps well-known opencode providers to the environment
+// variables they read credentials from. Other providers fall back to
+// {PROVIDER}_API_KEY.
+var providerEnvKeys = map[string][]string{
+	"anthropic":      {"ANTHROPIC_API_KEY"},
+	"openai":         {"OPENAI_API_KEY"},
+	"google":         {"GOOGLE_GENERATIVE_AI_API_KEY", "GEMINI_API_KEY"},
+	"openrouter":     {"OPENROUTER_API_KEY"},
+	"github-copilot": {"GITHUB_TOKEN"},
+	"amazon-bedrock": {"AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AWS_BEARER_TOKEN_BEDROCK"},
+	"azure":          {"AZURE_API_KEY"},
+	"xai":            {"XAI_API_KEY"},
+}
+
+var envRefPattern = regexp.MustCompile(`^\{env:([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// ListModels parses the provider section of the shared opencode.jsonc and
+// the credentials in auth.json, and reports each configured model with
+// whether credentials for its provider are present. env holds the effective
+// environment of the instance (global env vars plus per-instance ones).
+// Providers that only appear in auth.json are listed once with an empty
+// Model, since opencode supplies their model list.
+func (m *Manager) ListModels(env map[string]string) ([]ModelInfo, error) {
+	var cfg struct {
+		Model    string `json:"model"`
+		Provider map[string]struct {
+			Name    string         `json:"name"`
+			Options map[string]any `json:"options"`
+			Models  map[string]struct {
+				Name string `json:"name"`
+			} `json:"models"`
+		} `json:"provider"`
+	}
+	raw, err := os.ReadFile(filepath.Join(m.rootDir, DirOpenCodeConfig, "opencode.jsonc"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read opencode.jsonc: %w", err)
+	}
+	if stripped := stripJSONCComments(string(raw)); strings.TrimSpace(stripped) != "" {
+		if err := json.Unmarshal([]byte(stripped), &cfg); err != nil {
+			return nil, fmt.Errorf("parse opencode.jsonc: %w", err)
+		}
+	}
+
+	auth := make(map[string]json.RawMessage)
+	raw, err = os.ReadFile(filepath.Join(m.rootDir, DirOpenCodeData, "auth.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read auth.json: %w", err)
+	}
+	if len(strings.TrimSpace(string(raw))) > 0 {
+		if err := json.Unmarshal(raw, &auth); err != nil {
+			return nil, fmt.Errorf("parse auth.json: %w", err)
+		}
+	}
+
+	hasCreds := func(provider string, options map[string]any) bool {
+		if _, ok := auth[provider]; ok {
+			return true
+		}
+		if key, ok := options["apiKey"].(string); ok && key != "" {
+			// "{env:NAME}" 引用只有在环境变量存在时才算有效
+			if ref := envRefPattern.FindStringSubmatch(key); ref != nil {
+				return env[ref[1]] != ""
+			}
+			return true
+		}
+		keys, ok := providerEnvKeys[provider]
+		if !ok {
+			keys = []string{strings.ToUpper(strings.ReplaceAll(provider, "-", "_")) + "_API_KEY"}
+		}
+		for _, k := range keys {
+			if env[k] != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	var models []ModelInfo
+	for id, p := range cfg.Provider {
+		creds := hasCreds(id, p.Options)
+		name := p.Name
+		if name == "" {
+			name = id
+		}
+		if len(p.Models) == 0 {
+			models = append(models, ModelInfo{Provider: id, ProviderName: name, HasCredentials: creds})
+			continue
+		}
+		for mid, mm := range p.Models {
+			models = append(models, ModelInfo{
+				Provider:       id,
+				ProviderName:   name,
+				Model:          mid,
+				ModelName:      mm.Name,
+				HasCredentials: creds,
+				Default:        cfg.Model == id+"/"+mid,
+			})
+		}
+	}
+	for id := range auth {
+		if _, ok := cfg.Provider[id]; !ok {
+			models = append(models, ModelInfo{Provider: id, ProviderName: id, HasCredentials: true})
+		}
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Provider != models[j].Provider {
+			return models[i].Provider < models[j].Provider
+		}
+		return models[i].Model < models[j].Model
+	})
+	return models, nil
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validation severities.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ValidationIssue is one problem found by Validate.
+type ValidationIssue struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"` // json, env, references, auth, skills
+	File     string `json:"file,omitempty"`
+	Message  string `json:"message"`
+}
+
+// envKeyRe matches a POSIX shell identifier.
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidEnvKey reports whether key can be used as an environment variable name.
+func ValidEnvKey(key string) bool {
+	return envKeyRe.MatchString(key)
+}
+
+// Validate runs every config check and returns the issues found, errors
+// first.
+func (m *Manager) Validate() []ValidationIssue {
+	var issues []ValidationIssue
+	issues = append(issues, m.ValidateJSONFiles()...)
+	issues = append(issues, m.ValidateEnvVars()...)
+	issues = append(issues, m.ValidateReferences()...)
+	issues = append(issues, m.ValidateAuth()...)
+	issues = append(issues, m.ValidateSkills()...)
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Severity == SeverityError && issues[j].Severity != SeverityError
+	})
+	return issues
+}
+
+// ValidateJSONFiles checks that every editable JSON/JSONC file parses.
+// Missing files are fine: opencode falls back to its defaults.
+func (m *Manager) ValidateJSONFiles() []ValidationIssue {
+	var issues []ValidationIssue
+	for _, f := range m.EditableFiles() {
+		ext := filepath.Ext(f.RelPath)
+		if ext != ".json" && ext != ".jsonc" {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(m.rootDir, f.RelPath))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				issues = append(issues, ValidationIssue{SeverityError, "json", f.RelPath, err.Error()})
+			}
+			continue
+		}
+		content := string(raw)
+		if ext == ".jsonc" {
+			content = stripJSONCComments(content)
+		}
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal([]byte(content), &v); err != nil {
+			issues = append(issues, ValidationIssue{SeverityError, "json", f.RelPath, "does not parse: " + err.Error()})
+		}
+	}
+	return issues
+}
+
+// ValidateEnvVars checks that global env var names are valid identifiers.
+func (m *Manager) ValidateEnvVars() []ValidationIssue {
+	env, err := m.GetEnvVars()
+	if err != nil {
+		return []ValidationIssue{{SeverityError, "env", FileEnvVars, err.Error()}}
+	}
+	var issues []ValidationIssue
+	for key := range env {
+		if !ValidEnvKey(key) {
+			issues = append(issues, ValidationIssue{SeverityError, "env", FileEnvVars, fmt.Sprintf("%q is not a valid variable name (letters, digits and _, not starting with a digit)", key)})
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Message < issues[j].Message })
+	return issues
+}
+
+// containerDirs maps container paths of the bind-mounted config dirs to
+// their directory under the config root.
+var containerDirs = map[string]string{
+	"/root/.config/opencode": DirOpenCodeConfig,
+	"/root/.opencode":        DirDotOpenCode,
+	"/root/.agents":          DirAgentsSkills,
+}
+
+// hostPathFor maps an absolute container path inside a mounted config dir
+// to the host path. ok is false for paths outside the mounts (e.g. the
+// home volume), which cannot be checked from here.
+func (m *Manager) hostPathFor(containerPath string) (string, bool) {
+	containerPath = filepath.Clean(containerPath)
+	for prefix, dir := range containerDirs {
+		if rel, found := strings.CutPrefix(containerPath, prefix); found && (rel == "" || rel[0] == '/') {
+			return filepath.Join(m.rootDir, dir, rel), true
+		}
+	}
+	return "", false
+}
+
+// ValidateReferences checks that the instruction files and local plugins
+// referenced by opencode.jsonc exist. Relative and glob instruction paths
+// resolve against each project and are skipped.
+func (m *Manager) ValidateReferences() []ValidationIssue {
+	rel := filepath.Join(DirOpenCodeConfig, "opencode.jsonc")
+	raw, err := os.ReadFile(filepath.Join(m.rootDir, rel))
+	if err != nil {
+		return nil
+	}
+	var cfg struct {
+		Instructions []string `json:"instructions"`
+		Plugin       []string `json:"plugin"`
+	}
+	if err := json.Unmarshal([]byte(stripJSONCComments(string(raw))), &cfg); err != nil {
+		// 解析错误已由 ValidateJSONFiles 报告
+		return nil
+	}
+
+	var issues []ValidationIssue
+	check := func(kind, ref, path string) {
+		if strings.HasPrefix(path, "~/") {
+			path = "/root" + path[1:]
+		}
+		if !filepath.IsAbs(path) || strings.ContainsAny(path, "*?[") {
+			return
+		}
+		host, ok := m.hostPathFor(path)
+		if !ok {
+			issues = append(issues, ValidationIssue{SeverityWarning, "references", rel, fmt.Sprintf("%s %q is outside the shared config dirs and cannot be checked", kind, ref)})
+			return
+		}
+		if _, err := os.Stat(host); err != nil {
+			issues = append(issues, ValidationIssue{SeverityError, "references", rel, fmt.Sprintf("%s %q does not exist", kind, ref)})
+		}
+	}
+	for _, ref := range cfg.Instructions {
+		check("instruction file", ref, ref)
+	}
+	for _, ref := range cfg.Plugin {
+		// npm 插件（name@version）由 opencode 安装，只检查本地文件
+		if path, ok := strings.CutPrefix(ref, "file://"); ok {
+			check("plugin", ref, path)
+		}
+	}
+	return issues
+}
+
+// ValidateAuth checks that auth.json is valid JSON and holds at least one
+// credential. No credentials is only a warning since providers may be
+// configured through environment variables instead.
+func (m *Manager) ValidateAuth() []ValidationIssue {
+	rel := filepath.Join(DirOpenCodeData, "auth.json")
+	raw, err := os.ReadFile(filepath.Join(m.rootDir, rel))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ValidationIssue{{SeverityWarning, "auth", rel, "no credentials configured"}}
+		}
+		return []ValidationIssue{{SeverityError, "auth", rel, err.Error()}}
+	}
+	var auth map[string]map[string]any
+	if err := json.Unmarshal(raw, &auth); err != nil {
+		return []ValidationIssue{{SeverityError, "auth", rel, "invalid JSON: " + err.Error()}}
+	}
+	for _, entry := range auth {
+		for _, field := range []string{"key", "access", "refresh"} {
+			if v, _ := entry[field].(string); v != "" {
+				return nil
+			}
+		}
+	}
+	return []ValidationIssue{{SeverityWarning, "auth", rel, "no credentials configured"}}
+}
+
+// ValidateSkills checks that every skill directory has a SKILL.md with
+// YAML front matter naming the skill and describing it.
+func (m *Manager) ValidateSkills() []ValidationIssue {
+	var issues []ValidationIssue
+	for _, dir := range []string{filepath.Join(DirOpenCodeConfig, "skills"), filepath.Join(DirAgentsSkills, "skills")} {
+		entries, err := os.ReadDir(filepath.Join(m.rootDir, dir))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			rel := filepath.Join(dir, e.Name(), "SKILL.md")
+			raw, err := os.ReadFile(filepath.Join(m.rootDir, rel))
+			if err != nil {
+				issues = append(issues, ValidationIssue{SeverityError, "skills", rel, "missing SKILL.md"})
+				continue
+			}
+			for _, msg := range checkSkillFrontMatter(string(raw), e.Name()) {
+				issues = append(issues, ValidationIssue{msg.severity, "skills", rel, msg.text})
+			}
+		}
+	}
+	return issues
+}
+
+type skillProblem struct {
+	severity, text string
+}
+
+// checkSkillFrontMatter validates the "---" delimited front matter of a
+// SKILL.md. Only the flat "key: value" fields skills use are parsed.
+func checkSkillFrontMatter(content, dirName string) []skillProblem {
+	content = strings.TrimPrefix(strings.ReplaceAll(content, "\r\n", "\n"), "\ufeff")
+	body, ok := strings.CutPrefix(content, "---\n")
+	if !ok {
+		return []skillProblem{{SeverityError, "no front matter (expected a leading --- block with name and description)"}}
+	}
+	front, _, ok := strings.Cut(body, "\n---")
+	if !ok {
+		return []skillProblem{{SeverityError, "front matter is not closed with ---"}}
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(front, "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, " ") {
+			fields[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+
+	var problems []skillProblem
+	name := fields["name"]
+	switch {
+	case name == "":
+		problems = append(problems, skillProblem{SeverityError, "front matter has no name"})
+	case name != dirName:
+		problems = append(problems, skillProblem{SeverityWarning, fmt.Sprintf("name %q does not match directory %q", name, dirName)})
+	}
+	if fields["description"] == "" {
+		problems = append(problems, skillProblem{SeverityError, "front matter has no description"})
+	}
+	return problems
+}
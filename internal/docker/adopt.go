@@ -0,0 +1,136 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+)
+
+// AdoptCandidate describes an existing container that can be brought under
+// CloudCode management.
+type AdoptCandidate struct {
+	ID    string
+	Name  string
+	Image string
+	State string
+	Port  int
+}
+
+// InspectForAdoption looks up a container by ID or name and works out the
+// port opencode listens on: port if given, else OPENCODE_PORT from its
+// environment, else its only exposed TCP port. The port must be either
+// exposed or set as OPENCODE_PORT.
+func (m *Manager) InspectForAdoption(ctx context.Context, ref string, port int) (*AdoptCandidate, error) {
+	var result client.ContainerInspectResult
+	err := withRetry(ctx, "inspect", func() (err error) {
+		result, err = m.cli.ContainerInspect(ctx, ref, client.ContainerInspectOptions{})
+		return err
+	})
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return nil, fmt.Errorf("container %q not found", ref)
+		}
+		return nil, fmt.Errorf("inspect container: %w", err)
+	}
+	c := result.Container
+	if c.Config == nil {
+		return nil, fmt.Errorf("container %q has no config", ref)
+	}
+	if c.Config.Labels[labelManaged] == "true" {
+		return nil, fmt.Errorf("container %q is already managed by CloudCode", ref)
+	}
+
+	candidates := make(map[int]bool)
+	var exposed []int
+	for p := range c.Config.ExposedPorts {
+		if p.Proto() == network.TCP {
+			candidates[int(p.Num())] = true
+			exposed = append(exposed, int(p.Num()))
+		}
+	}
+	envPort := 0
+	for _, kv := range c.Config.Env {
+		if v, ok := strings.CutPrefix(kv, "OPENCODE_PORT="); ok {
+			envPort, _ = strconv.Atoi(v)
+		}
+	}
+	if envPort > 0 {
+		candidates[envPort] = true
+	}
+
+	switch {
+	case port > 0:
+		if !candidates[port] {
+			return nil, fmt.Errorf("container %q does not expose port %d", ref, port)
+		}
+	case envPort > 0:
+		port = envPort
+	case len(exposed) == 1:
+		port = exposed[0]
+	default:
+		return nil, fmt.Errorf("cannot determine the opencode port of %q, pass it explicitly", ref)
+	}
+
+	state := ""
+	if c.State != nil {
+		state = string(c.State.Status)
+	}
+	return &AdoptCandidate{
+		ID:    c.ID,
+		Name:  strings.TrimPrefix(c.Name, "/"),
+		Image: c.Config.Image,
+		State: state,
+		Port:  port,
+	}, nil
+}
+
+// AttachToNetwork connects an adopted container to the CloudCode network
+// under the alias cloudcode-{instanceID}, so the proxy reaches it the same
+// way as containers CloudCode created. An existing connection to the
+// network is replaced to add the alias.
+//
+// Docker cannot add labels to an existing container, so adopted containers
+// are tracked by ID instead (see TrackAdopted).
+func (m *Manager) AttachToNetwork(ctx context.Context, containerID, instanceID string) error {
+	_, err := m.cli.NetworkDisconnect(ctx, networkName, client.NetworkDisconnectOptions{Container: containerID})
+	if err != nil && !cerrdefs.IsNotFound(err) && !strings.Contains(err.Error(), "is not connected") {
+		return fmt.Errorf("disconnect from %s: %w", networkName, err)
+	}
+	_, err = m.cli.NetworkConnect(ctx, networkName, client.NetworkConnectOptions{
+		Container: containerID,
+		EndpointConfig: &network.EndpointSettings{
+			Aliases: []string{ContainerName(instanceID)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", networkName, err)
+	}
+	return nil
+}
+
+// TrackAdopted makes ManagedContainers (and so status sweeps and
+// reconciliation) include an adopted container under instanceID.
+func (m *Manager) TrackAdopted(containerID, instanceID string) {
+	m.adoptedMu.Lock()
+	defer m.adoptedMu.Unlock()
+	m.adopted[containerID] = instanceID
+}
+
+// ForgetAdopted stops tracking an adopted container.
+func (m *Manager) ForgetAdopted(containerID string) {
+	m.adoptedMu.Lock()
+	defer m.adoptedMu.Unlock()
+	delete(m.adopted, containerID)
+}
+
+func (m *Manager) adoptedIDs() map[string]string {
+	m.adoptedMu.Lock()
+	defer m.adoptedMu.Unlock()
+	return maps.Clone(m.adopted)
+}
@@ -0,0 +1,96 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxCommandLen bounds the command line of an instance.
+const maxCommandLen = 4096
+
+// ParseCommand splits a command line into the arguments of a container
+// command, like a POSIX shell without expansion: arguments are separated
+// by whitespace, single quotes keep their content literally, and double
+// quotes and backslashes escape as usual. An empty line returns nil, so the
+// image's own command runs.
+func ParseCommand(line string) ([]string, error) {
+	if len(line) > maxCommandLen {
+		return nil, fmt.Errorf("command is longer than %d characters", maxCommandLen)
+	}
+	var (
+		args  []string
+		cur   strings.Builder
+		inArg bool
+		quote rune // ' or " while inside quotes
+	)
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]):
+				i++
+				cur.WriteRune(runes[i])
+			default:
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("command ends with a backslash")
+			}
+			i++
+			cur.WriteRune(runes[i])
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("command has an unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) > 0 && args[0] == "" {
+		return nil, errors.New("command must start with a program name")
+	}
+	return args, nil
+}
+
+// FormatCommand joins command arguments into a line ParseCommand reads
+// back, quoting the arguments that need it.
+func FormatCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && !strings.ContainsFunc(a, needsQuote) {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`'"\$`+"`", r)
+}
@@ -0,0 +1,63 @@
+package docker
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"opencode serve", []string{"opencode", "serve"}},
+		{"  sh   -c  'echo $HOME && ls'  ", []string{"sh", "-c", "echo $HOME && ls"}},
+		{`echo "a \"b\" \$c" d\ e`, []string{"echo", `a "b" $c`, "d e"}},
+		{`echo "\n"`, []string{"echo", `\n`}},
+		{`run ''`, []string{"run", ""}},
+		{`pre"fix"'ed'`, []string{"prefixed"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCommand(tt.line)
+		if err != nil {
+			t.Errorf("ParseCommand(%q): %v", tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) || (tt.want == nil) != (got == nil) {
+			t.Errorf("ParseCommand(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{
+		`echo 'open`,
+		`echo "open`,
+		`echo \`,
+		`'' serve`, // 程序名不能为空
+		strings.Repeat("a", maxCommandLen+1),
+	} {
+		if _, err := ParseCommand(line); err == nil {
+			t.Errorf("ParseCommand(%q) succeeded", line)
+		}
+	}
+}
+
+func TestFormatCommandRoundTrip(t *testing.T) {
+	for _, args := range [][]string{
+		{"opencode", "serve"},
+		{"sh", "-c", "echo 'hi' && ls $HOME"},
+		{"printf", `a"b\c`, "", "tab\there"},
+	} {
+		line := FormatCommand(args)
+		got, err := ParseCommand(line)
+		if err != nil {
+			t.Errorf("ParseCommand(FormatCommand(%q) = %q): %v", args, line, err)
+			continue
+		}
+		if !slices.Equal(got, args) {
+			t.Errorf("round trip of %q via %q = %q", args, line, got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package docker
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// maxDNSServers is how many nameservers the resolver in the container
+	// reads from resolv.conf; further entries would be ignored.
+	maxDNSServers = 3
+	// maxExtraHosts bounds the /etc/hosts entries of an instance.
+	maxExtraHosts = 64
+)
+
+// hostGateway is the extra-hosts address Docker replaces with the host's
+// gateway IP.
+const hostGateway = "host-gateway"
+
+// hostnameRe matches an RFC 1123 host name.
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// NormalizeDNS trims and de-duplicates the DNS servers of an instance,
+// keeping their order, and checks that each is an IP address.
+func NormalizeDNS(servers []string) ([]string, error) {
+	out := []string{}
+	for _, s := range servers {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q: must be an IP address", s)
+		}
+		if s = addr.String(); !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	if len(out) > maxDNSServers {
+		return nil, fmt.Errorf("at most %d DNS servers are allowed", maxDNSServers)
+	}
+	return out, nil
+}
+
+// NormalizeExtraHosts checks /etc/hosts entries of the form
+// "hostname:ip", as docker run --add-host takes them, and returns them
+// trimmed with the address in canonical form. The address may be IPv6,
+// optionally in brackets, or "host-gateway".
+func NormalizeExtraHosts(entries []string) ([]string, error) {
+	out := []string{}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		host, ip, ok := strings.Cut(e, ":")
+		host, ip = strings.TrimSpace(host), strings.TrimSpace(ip)
+		if !ok || host == "" || ip == "" {
+			return nil, fmt.Errorf("invalid extra host %q: use hostname:ip", e)
+		}
+		if len(host) > 253 || !hostnameRe.MatchString(host) {
+			return nil, fmt.Errorf("invalid host name %q in extra host %q", host, e)
+		}
+		if ip != hostGateway {
+			addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address %q in extra host %q", ip, e)
+			}
+			ip = addr.String()
+		}
+		if entry := host + ":" + ip; !slices.Contains(out, entry) {
+			out = append(out, entry)
+		}
+	}
+	if len(out) > maxExtraHosts {
+		return nil, fmt.Errorf("at most %d extra hosts are allowed", maxExtraHosts)
+	}
+	return out, nil
+}
+
+// dnsAddrs converts the DNS servers of an instance, validated by
+// NormalizeDNS when they were saved, for HostConfig.DNS.
+func dnsAddrs(servers []string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, s := range servers {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,864 @@
+// Package dockertest runs an in-memory fake of the Docker Engine API for
+// tests. It implements the endpoints CloudCode uses, records every call
+// and lets tests inject errors and delays through hooks.
+package dockertest
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/common"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/image"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/api/types/system"
+	"github.com/moby/moby/api/types/volume"
+	"github.com/moby/moby/client"
+)
+
+// APIVersion is the API version the fake daemon announces.
+const APIVersion = "1.53"
+
+// Call is one request received by the fake daemon. Path has the API
+// version prefix removed, e.g. "/containers/abc/stop".
+type Call struct {
+	Method string
+	Path   string
+	Query  url.Values
+}
+
+// Error is returned by a Hook to fail a request with a status code, which
+// the client maps to the matching errdefs class (404 not found, 409
+// conflict, 503 unavailable, ...).
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Hook runs before a request is handled. A non-nil error is sent instead
+// of the normal response: an *Error with its status, anything else as 500.
+// Hooks may block to simulate a slow daemon.
+type Hook func(c Call) error
+
+// ExecResult is the outcome of an exec process.
+type ExecResult struct {
+	Stdout, Stderr string
+	ExitCode       int
+}
+
+// Container is the state of a fake container.
+type Container struct {
+	ID               string
+	Name             string
+	State            container.ContainerState
+	Config           *container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+	// Logs is returned on stdout by the logs endpoint.
+	Logs string
+	// RawLogs, if set, is sent by the logs endpoint as is instead of Logs,
+	// e.g. canned multiplexed stdout and stderr frames.
+	RawLogs []byte
+	// Files are served by the archive endpoint, keyed by absolute path.
+	Files map[string][]byte
+	// Uploads collects archives written into the container, keyed by the
+	// destination directory.
+	Uploads map[string][][]byte
+	// ExitCode is reported by the wait endpoint.
+	ExitCode int
+}
+
+type execState struct {
+	containerID string
+	cmd         []string
+	done        bool
+	exitCode    int
+}
+
+// Server is a fake Docker daemon listening on a local TCP port.
+type Server struct {
+	*httptest.Server
+
+	// Exec produces the result of an exec process. It may block to
+	// simulate a hung command. nil means no output and exit status 0.
+	Exec func(containerID string, cmd []string) ExecResult
+	// Stats returns the stats sample of a container. nil returns an empty
+	// sample.
+	Stats func(containerID string) container.StatsResponse
+	// NCPU is the CPU count reported by /info.
+	NCPU int
+
+	mu         sync.Mutex
+	seq        int
+	hooks      []Hook
+	calls      []Call
+	containers map[string]*Container // by ID
+	volumes    map[string]*volume.Volume
+	networks   map[string]string // name → ID
+	images     map[string]bool   // normalized reference
+	execs      map[string]*execState
+}
+
+// NewServer starts a fake daemon that is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{
+		NCPU:       4,
+		containers: make(map[string]*Container),
+		volumes:    make(map[string]*volume.Volume),
+		networks:   make(map[string]string),
+		images:     make(map[string]bool),
+		execs:      make(map[string]*execState),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Host returns the address to use as DOCKER_HOST.
+func (s *Server) Host() string {
+	return "tcp://" + s.Listener.Addr().String()
+}
+
+// Client returns a Docker client talking to the fake daemon.
+func (s *Server) Client(t testing.TB) *client.Client {
+	t.Helper()
+	cli, err := client.NewClientWithOpts(client.WithHost(s.Host()), client.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Fatalf("docker client: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+// AddHook registers a hook run before every request.
+func (s *Server) AddHook(h Hook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, h)
+}
+
+// AddImage makes an image available locally.
+func (s *Server) AddImage(ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[normalizeRef(ref)] = true
+}
+
+// AddVolume creates a volume.
+func (s *Server) AddVolume(name string, labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volumes[name] = &volume.Volume{Name: name, Driver: "local", Labels: labels, Scope: "local"}
+}
+
+// AddContainer stores a container as if it had been created, filling in
+// the ID, state and configs when unset, and returns its ID.
+func (s *Server) AddContainer(c Container) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.ID == "" {
+		c.ID = s.newID(c.Name)
+	}
+	if c.State == "" {
+		c.State = container.StateCreated
+	}
+	if c.Config == nil {
+		c.Config = &container.Config{}
+	}
+	if c.HostConfig == nil {
+		c.HostConfig = &container.HostConfig{}
+	}
+	s.containers[c.ID] = &c
+	return c.ID
+}
+
+// Container returns a copy of the container with the given ID or name.
+func (s *Server) Container(ref string) (Container, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.lookup(ref)
+	if c == nil {
+		return Container{}, false
+	}
+	return *c, true
+}
+
+// Containers returns copies of all containers, sorted by name.
+func (s *Server) Containers() []Container {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		out = append(out, *c)
+	}
+	slices.SortFunc(out, func(a, b Container) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// SetState changes the state of a container, e.g. to simulate a crash.
+func (s *Server) SetState(ref string, state container.ContainerState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.lookup(ref); c != nil {
+		c.State = state
+	}
+}
+
+// SetLogs replaces the output the logs endpoint returns for a container.
+func (s *Server) SetLogs(ref, logs string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.lookup(ref); c != nil {
+		c.Logs = logs
+	}
+}
+
+// Volumes returns the names of all volumes, sorted.
+func (s *Server) Volumes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.volumes))
+	for name := range s.volumes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Calls returns the requests received so far whose method matches and
+// whose path matches pattern (path.Match syntax, e.g.
+// "/containers/*/stop"). An empty method matches any.
+func (s *Server) Calls(method, pattern string) []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Call
+	for _, c := range s.calls {
+		if method != "" && c.Method != method {
+			continue
+		}
+		if ok, _ := path.Match(pattern, c.Path); ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	if loc := versionPrefix.FindStringIndex(p); loc != nil {
+		p = p[loc[1]-1:]
+	}
+	call := Call{Method: r.Method, Path: p, Query: r.URL.Query()}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	hooks := slices.Clone(s.hooks)
+	s.mu.Unlock()
+	for _, h := range hooks {
+		if err := h(call); err != nil {
+			var apiErr *Error
+			if errors.As(err, &apiErr) {
+				writeError(w, apiErr.Status, apiErr.Message)
+			} else {
+				writeError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	switch {
+	case p == "/_ping":
+		w.Header().Set("Api-Version", APIVersion)
+		w.Header().Set("Ostype", "linux")
+		_, _ = io.WriteString(w, "OK")
+	case p == "/info":
+		writeJSON(w, http.StatusOK, system.Info{
+			NCPU:        s.NCPU,
+			MemoryLimit: true,
+			SwapLimit:   true,
+			CPUCfsQuota: true,
+		})
+	case parts[0] == "containers":
+		s.serveContainers(w, r, parts[1:])
+	case parts[0] == "exec" && len(parts) == 3:
+		s.serveExec(w, r, parts[1], parts[2])
+	case parts[0] == "images":
+		s.serveImages(w, r, strings.TrimPrefix(p, "/images/"))
+	case parts[0] == "volumes":
+		s.serveVolumes(w, r, parts[1:])
+	case parts[0] == "networks":
+		s.serveNetworks(w, r, parts[1:])
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (s *Server) serveContainers(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 1 && parts[0] == "json" && r.Method == http.MethodGet:
+		s.listContainers(w, r)
+		return
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		s.createContainer(w, r)
+		return
+	case len(parts) == 0:
+		writeError(w, http.StatusNotFound, "page not found")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.lookup(parts[0])
+	if c == nil {
+		writeError(w, http.StatusNotFound, "No such container: "+parts[0])
+		return
+	}
+	op := ""
+	if len(parts) > 1 {
+		op = parts[1]
+	}
+	switch r.Method + " " + op {
+	case "DELETE ":
+		if c.State == container.StateRunning && r.URL.Query().Get("force") != "1" {
+			writeError(w, http.StatusConflict, "cannot remove a running container")
+			return
+		}
+		delete(s.containers, c.ID)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET json":
+		writeJSON(w, http.StatusOK, s.inspect(c))
+	case "POST start":
+		if c.State == container.StateRunning {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		c.State = container.StateRunning
+		w.WriteHeader(http.StatusNoContent)
+	case "POST stop":
+		if c.State != container.StateRunning {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		c.State = container.StateExited
+		w.WriteHeader(http.StatusNoContent)
+	case "POST wait":
+		c.State = container.StateExited
+		writeJSON(w, http.StatusOK, container.WaitResponse{StatusCode: int64(c.ExitCode)})
+	case "GET logs":
+		w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+		w.WriteHeader(http.StatusOK)
+		if c.RawLogs != nil {
+			_, _ = w.Write(c.RawLogs)
+			return
+		}
+		_, _ = w.Write(Frame(stdcopy.Stdout, c.Logs))
+	case "GET stats":
+		var stats container.StatsResponse
+		if s.Stats != nil {
+			stats = s.Stats(c.ID)
+		}
+		writeJSON(w, http.StatusOK, stats)
+	case "PUT archive":
+		body, _ := io.ReadAll(r.Body)
+		if c.Uploads == nil {
+			c.Uploads = make(map[string][][]byte)
+		}
+		dir := r.URL.Query().Get("path")
+		c.Uploads[dir] = append(c.Uploads[dir], body)
+		w.WriteHeader(http.StatusOK)
+	case "GET archive", "HEAD archive":
+		s.serveArchive(w, r, c)
+	case "POST exec":
+		var req container.ExecCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if c.State != container.StateRunning {
+			writeError(w, http.StatusConflict, "container "+c.ID+" is not running")
+			return
+		}
+		id := s.newID("exec")
+		s.execs[id] = &execState{containerID: c.ID, cmd: req.Cmd}
+		writeJSON(w, http.StatusCreated, common.IDResponse{ID: id})
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (s *Server) createContainer(w http.ResponseWriter, r *http.Request) {
+	var req container.CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Config == nil {
+		req.Config = &container.Config{}
+	}
+	if req.HostConfig == nil {
+		req.HostConfig = &container.HostConfig{}
+	}
+	name := r.URL.Query().Get("name")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.images[normalizeRef(req.Config.Image)] {
+		writeError(w, http.StatusNotFound, "No such image: "+req.Config.Image)
+		return
+	}
+	if name != "" && s.lookup(name) != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Conflict. The container name %q is already in use", "/"+name))
+		return
+	}
+	id := s.newID(name)
+	if name == "" {
+		name = "fake_" + id[:8]
+	}
+	// 像真实的 daemon 一样，命名卷在创建容器时自动创建
+	for _, m := range req.HostConfig.Mounts {
+		if m.Type == mount.TypeVolume && s.volumes[m.Source] == nil {
+			s.volumes[m.Source] = &volume.Volume{Name: m.Source, Driver: "local", Scope: "local"}
+		}
+	}
+	s.containers[id] = &Container{
+		ID:               id,
+		Name:             name,
+		State:            container.StateCreated,
+		Config:           req.Config,
+		HostConfig:       req.HostConfig,
+		NetworkingConfig: req.NetworkingConfig,
+	}
+	writeJSON(w, http.StatusCreated, container.CreateResponse{ID: id, Warnings: []string{}})
+}
+
+func (s *Server) listContainers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filters, err := parseFilters(q.Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	all := q.Get("all") == "1" || q.Get("all") == "true"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []container.Summary{}
+	for _, c := range s.containers {
+		if !all && c.State != container.StateRunning {
+			continue
+		}
+		if !matchLabels(filters["label"], c.Config.Labels) {
+			continue
+		}
+		if ids := filters["id"]; len(ids) > 0 && !slices.ContainsFunc(ids, func(id string) bool { return strings.HasPrefix(c.ID, id) }) {
+			continue
+		}
+		if names := filters["name"]; len(names) > 0 && !slices.ContainsFunc(names, func(n string) bool { return strings.Contains(c.Name, n) }) {
+			continue
+		}
+		sum := container.Summary{
+			ID:     c.ID,
+			Names:  []string{"/" + c.Name},
+			Image:  c.Config.Image,
+			Labels: c.Config.Labels,
+			State:  c.State,
+			Mounts: mountPoints(c),
+		}
+		out = append(out, sum)
+	}
+	slices.SortFunc(out, func(a, b container.Summary) int { return strings.Compare(a.Names[0], b.Names[0]) })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) inspect(c *Container) container.InspectResponse {
+	return container.InspectResponse{
+		ID:      c.ID,
+		Name:    "/" + c.Name,
+		Created: time.Now().UTC().Format(time.RFC3339Nano),
+		Image:   c.Config.Image,
+		State: &container.State{
+			Status:  c.State,
+			Running: c.State == container.StateRunning,
+		},
+		Config:     c.Config,
+		HostConfig: c.HostConfig,
+		Mounts:     mountPoints(c),
+	}
+}
+
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, c *Container) {
+	p := r.URL.Query().Get("path")
+	data, ok := c.Files[p]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Could not find the file "+p+" in container "+c.Name)
+		return
+	}
+	stat, _ := json.Marshal(container.PathStat{Name: path.Base(p), Size: int64(len(data)), Mode: 0o644, Mtime: time.Unix(0, 0)})
+	w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+	w.Header().Set("Content-Type", "application/x-tar")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	tw := tar.NewWriter(w)
+	_ = tw.WriteHeader(&tar.Header{Name: path.Base(p), Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	_, _ = tw.Write(data)
+	_ = tw.Close()
+}
+
+func (s *Server) serveExec(w http.ResponseWriter, r *http.Request, id, op string) {
+	s.mu.Lock()
+	e := s.execs[id]
+	s.mu.Unlock()
+	if e == nil {
+		writeError(w, http.StatusNotFound, "No such exec instance: "+id)
+		return
+	}
+	switch r.Method + " " + op {
+	case "GET json":
+		s.mu.Lock()
+		code := e.exitCode
+		resp := container.ExecInspectResponse{ID: id, ContainerID: e.containerID, Running: !e.done, ExitCode: &code}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+	case "POST resize":
+		w.WriteHeader(http.StatusOK)
+	case "POST start":
+		s.startExec(w, r, id, e)
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// startExec hijacks the connection, like the real daemon, and writes the
+// multiplexed output of the exec.
+func (s *Server) startExec(w http.ResponseWriter, r *http.Request, id string, e *execState) {
+	var req container.ExecStartRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "hijack unsupported")
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	contentType := "application/vnd.docker.multiplexed-stream"
+	if req.Tty {
+		contentType = "application/vnd.docker.raw-stream"
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 101 UPGRADED\r\nContent-Type: %s\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n", contentType)
+	_ = buf.Flush()
+
+	var res ExecResult
+	if s.Exec != nil {
+		res = s.Exec(e.containerID, e.cmd)
+	}
+	if req.Tty {
+		_, _ = io.WriteString(buf, res.Stdout+res.Stderr)
+	} else {
+		_, _ = buf.Write(Frame(stdcopy.Stdout, res.Stdout))
+		_, _ = buf.Write(Frame(stdcopy.Stderr, res.Stderr))
+	}
+	_ = buf.Flush()
+
+	s.mu.Lock()
+	e.done, e.exitCode = true, res.ExitCode
+	s.mu.Unlock()
+}
+
+func (s *Server) serveImages(w http.ResponseWriter, r *http.Request, rest string) {
+	switch {
+	case r.Method == http.MethodGet && rest == "json":
+		filters, err := parseFilters(r.URL.Query().Get("filters"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		out := []image.Summary{}
+		for ref := range s.images {
+			if refs := filters["reference"]; len(refs) > 0 && !slices.ContainsFunc(refs, func(f string) bool { return normalizeRef(f) == ref }) {
+				continue
+			}
+			out = append(out, image.Summary{ID: imageID(ref), RepoTags: []string{ref}})
+		}
+		writeJSON(w, http.StatusOK, out)
+	case r.Method == http.MethodPost && rest == "create":
+		q := r.URL.Query()
+		ref := q.Get("fromImage")
+		if tag := q.Get("tag"); tag != "" {
+			ref += ":" + tag
+		}
+		s.mu.Lock()
+		s.images[normalizeRef(ref)] = true
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		_ = enc.Encode(map[string]any{"status": "Pulling fs layer", "id": "layer1"})
+		_ = enc.Encode(map[string]any{"status": "Downloading", "id": "layer1", "progressDetail": map[string]int{"current": 50, "total": 100}})
+		_ = enc.Encode(map[string]any{"status": "Download complete", "id": "layer1"})
+		_ = enc.Encode(map[string]any{"status": "Status: Downloaded newer image for " + ref})
+	case r.Method == http.MethodGet && strings.HasSuffix(rest, "/json"):
+		ref := normalizeRef(strings.TrimSuffix(rest, "/json"))
+		s.mu.Lock()
+		ok := s.images[ref]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such image: "+ref)
+			return
+		}
+		writeJSON(w, http.StatusOK, image.InspectResponse{ID: imageID(ref), RepoTags: []string{ref}})
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (s *Server) serveVolumes(w http.ResponseWriter, r *http.Request, parts []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		filters, err := parseFilters(r.URL.Query().Get("filters"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		resp := volume.ListResponse{Volumes: []volume.Volume{}, Warnings: []string{}}
+		for _, v := range s.volumes {
+			if names := filters["name"]; len(names) > 0 && !slices.ContainsFunc(names, func(n string) bool { return strings.Contains(v.Name, n) }) {
+				continue
+			}
+			if !matchLabels(filters["label"], v.Labels) {
+				continue
+			}
+			resp.Volumes = append(resp.Volumes, *v)
+		}
+		slices.SortFunc(resp.Volumes, func(a, b volume.Volume) int { return strings.Compare(a.Name, b.Name) })
+		writeJSON(w, http.StatusOK, resp)
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		var req volume.CreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if s.volumes[req.Name] == nil {
+			driver := req.Driver
+			if driver == "" {
+				driver = "local"
+			}
+			s.volumes[req.Name] = &volume.Volume{Name: req.Name, Driver: driver, Labels: req.Labels, Options: req.DriverOpts, Scope: "local"}
+		}
+		writeJSON(w, http.StatusCreated, s.volumes[req.Name])
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		v := s.volumes[parts[0]]
+		if v == nil {
+			writeError(w, http.StatusNotFound, "get "+parts[0]+": no such volume")
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		name := parts[0]
+		if s.volumes[name] == nil {
+			writeError(w, http.StatusNotFound, "get "+name+": no such volume")
+			return
+		}
+		for _, c := range s.containers {
+			if slices.ContainsFunc(mountPoints(c), func(m container.MountPoint) bool { return m.Name == name }) {
+				writeError(w, http.StatusConflict, "remove "+name+": volume is in use")
+				return
+			}
+		}
+		delete(s.volumes, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (s *Server) serveNetworks(w http.ResponseWriter, r *http.Request, parts []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		filters, err := parseFilters(r.URL.Query().Get("filters"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		out := []network.Summary{}
+		for name, id := range s.networks {
+			if names := filters["name"]; len(names) > 0 && !slices.ContainsFunc(names, func(n string) bool { return strings.Contains(name, n) }) {
+				continue
+			}
+			out = append(out, network.Summary{Network: network.Network{Name: name, ID: id, Driver: "bridge"}})
+		}
+		writeJSON(w, http.StatusOK, out)
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		var req struct{ Name string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := s.networks[req.Name]; ok {
+			writeError(w, http.StatusConflict, "network with name "+req.Name+" already exists")
+			return
+		}
+		id := s.newID(req.Name)
+		s.networks[req.Name] = id
+		writeJSON(w, http.StatusCreated, network.CreateResponse{ID: id})
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		for name, id := range s.networks {
+			if parts[0] == name || parts[0] == id {
+				writeJSON(w, http.StatusOK, network.Inspect{Network: network.Network{Name: name, ID: id, Driver: "bridge"}})
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "network "+parts[0]+" not found")
+	case len(parts) == 2 && (parts[1] == "connect" || parts[1] == "disconnect") && r.Method == http.MethodPost:
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// Frame encodes data as one frame of a multiplexed stream, the format of
+// non-TTY logs and exec output. Empty data yields no frame.
+func Frame(stream stdcopy.StdType, data string) []byte {
+	if data == "" {
+		return nil
+	}
+	frame := make([]byte, 8, 8+len(data))
+	frame[0] = byte(stream)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// lookup finds a container by ID, unique ID prefix or name. The caller
+// holds s.mu.
+func (s *Server) lookup(ref string) *Container {
+	if c, ok := s.containers[ref]; ok {
+		return c
+	}
+	ref = strings.TrimPrefix(ref, "/")
+	for _, c := range s.containers {
+		if c.Name == ref {
+			return c
+		}
+	}
+	var match *Container
+	for id, c := range s.containers {
+		if strings.HasPrefix(id, ref) {
+			if match != nil {
+				return nil
+			}
+			match = c
+		}
+	}
+	return match
+}
+
+// newID returns a fresh 64-character hex ID. The caller holds s.mu.
+func (s *Server) newID(seed string) string {
+	s.seq++
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s/%d", seed, s.seq))
+	return hex.EncodeToString(sum[:])
+}
+
+func mountPoints(c *Container) []container.MountPoint {
+	var out []container.MountPoint
+	for _, m := range c.HostConfig.Mounts {
+		mp := container.MountPoint{Type: m.Type, Source: m.Source, Destination: m.Target, RW: !m.ReadOnly}
+		if m.Type == mount.TypeVolume {
+			mp.Name = m.Source
+		}
+		out = append(out, mp)
+	}
+	return out
+}
+
+// parseFilters decodes the filters query parameter, {"key":{"value":true}}.
+func parseFilters(raw string) (map[string][]string, error) {
+	out := make(map[string][]string)
+	if raw == "" {
+		return out, nil
+	}
+	var m map[string]map[string]bool
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		return nil, fmt.Errorf("invalid filters: %w", err)
+	}
+	for k, values := range m {
+		for v := range values {
+			out[k] = append(out[k], v)
+		}
+	}
+	return out, nil
+}
+
+// matchLabels reports whether labels satisfy every "key" or "key=value"
+// filter.
+func matchLabels(filters []string, labels map[string]string) bool {
+	for _, f := range filters {
+		k, v, hasValue := strings.Cut(f, "=")
+		got, ok := labels[k]
+		if !ok || hasValue && got != v {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeRef(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+func imageID(ref string) string {
+	sum := sha256.Sum256([]byte(ref))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"message": msg})
+}
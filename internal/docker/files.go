@@ -0,0 +1,255 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// ErrPathNotFound is returned when a container path does not exist.
+var ErrPathNotFound = errors.New("no such file or directory in container")
+
+// containerHome is where relative container paths are resolved.
+const containerHome = "/root"
+
+// ContainerPath validates a path inside an instance container and returns
+// it cleaned and absolute. Relative paths are resolved against /root. Any
+// ".." element is rejected rather than cleaned away, so a request can never
+// name a different file than it appears to.
+func ContainerPath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "", errors.New("path is required")
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("path %q must not contain ..", p)
+		}
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(containerHome, p)
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		return "", errors.New("path must not be the root directory")
+	}
+	return p, nil
+}
+
+// NormalizeWorkDir validates the working directory of an instance and
+// returns it cleaned. An empty value means store.DefaultWorkDir.
+func NormalizeWorkDir(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return store.DefaultWorkDir, nil
+	}
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("working directory %q must be an absolute path", p)
+	}
+	return path.Clean(p), nil
+}
+
+// CopyToContainer writes size bytes from r to the file destPath in the
+// container, replacing an existing file. The parent directory must exist.
+// The tar stream the Docker API expects is built on the fly, so r is never
+// buffered in memory.
+func (m *Manager) CopyToContainer(ctx context.Context, containerID, destPath string, r io.Reader, size int64) error {
+	destPath, err := ContainerPath(destPath)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeFileTar(pw, path.Base(destPath), r, size, time.Now()))
+	}()
+	_, err = m.cli.CopyToContainer(ctx, containerID, client.CopyToContainerOptions{
+		DestinationPath: path.Dir(destPath),
+		Content:         pr,
+	})
+	// 让仍在写入的 goroutine 退出
+	pr.CloseWithError(io.ErrClosedPipe)
+	if cerrdefs.IsNotFound(err) {
+		return fmt.Errorf("copy to %s: %w: %s", destPath, ErrPathNotFound, path.Dir(destPath))
+	}
+	if err != nil {
+		return fmt.Errorf("copy to %s: %w", destPath, err)
+	}
+	return nil
+}
+
+// writeFileTar writes a tar stream holding a single root-owned 0644 file.
+func writeFileTar(w io.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Uname:    "root",
+		Gname:    "root",
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("read upload: %w", err)
+	}
+	return tw.Close()
+}
+
+// CopyFromContainer returns the Docker archive stream of srcPath in the
+// container: a tar holding the file or the directory tree under its base
+// name, plus the stat of srcPath. A symlink is followed once so the
+// archive holds its target. The caller must close the stream; cancelling
+// ctx aborts the copy.
+func (m *Manager) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	srcPath, err := ContainerPath(srcPath)
+	if err != nil {
+		return nil, container.PathStat{}, err
+	}
+	res, err := m.cli.CopyFromContainer(ctx, containerID, client.CopyFromContainerOptions{SourcePath: srcPath})
+	if err == nil && res.Stat.Mode&os.ModeSymlink != 0 && res.Stat.LinkTarget != "" {
+		res.Content.Close()
+		srcPath = res.Stat.LinkTarget
+		res, err = m.cli.CopyFromContainer(ctx, containerID, client.CopyFromContainerOptions{SourcePath: srcPath})
+	}
+	if cerrdefs.IsNotFound(err) {
+		return nil, container.PathStat{}, fmt.Errorf("copy from %s: %w", srcPath, ErrPathNotFound)
+	}
+	if err != nil {
+		return nil, container.PathStat{}, fmt.Errorf("copy from %s: %w", srcPath, err)
+	}
+	return res.Content, res.Stat, nil
+}
+
+// MaxDirEntries caps how many entries ListContainerDir returns.
+const MaxDirEntries = 1000
+
+// ErrNotDirectory is returned when a listed container path is not a
+// directory.
+var ErrNotDirectory = errors.New("not a directory")
+
+// DirEntry is one entry of a container directory listing. Type is "dir",
+// "file" or "other"; for a symlink it describes the target and Link is set.
+type DirEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Link    bool      `json:"link,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// listDirScript prints the entries of $1 NUL-terminated as
+// "type<TAB>target type<TAB>size<TAB>mtime<TAB>name", at most $2 of them.
+// Exit status 3 means $1 does not exist and 4 that it is not a directory.
+const listDirScript = `[ -e "$1" ] || exit 3
+[ -d "$1" ] || exit 4
+find "$1" -mindepth 1 -maxdepth 1 -printf '%y\t%Y\t%s\t%T@\t%f\0' | head -z -n "$2"`
+
+// ListContainerDir lists the directory dir in a running container by
+// running find through docker exec. Directories come first, then files,
+// each sorted by name. At most MaxDirEntries are returned; truncated
+// reports whether more were left out.
+func (m *Manager) ListContainerDir(ctx context.Context, containerID, dir string) (entries []DirEntry, truncated bool, err error) {
+	if dir != "/" {
+		if dir, err = ContainerPath(dir); err != nil {
+			return nil, false, err
+		}
+	}
+	exec, err := m.cli.ExecCreate(ctx, containerID, client.ExecCreateOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"sh", "-c", listDirScript, "sh", dir, strconv.Itoa(MaxDirEntries + 1)},
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("list %s: %w", dir, err)
+	}
+	attach, err := m.cli.ExecAttach(ctx, exec.ID, client.ExecAttachOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("list %s: %w", dir, err)
+	}
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, attach.Reader)
+	attach.Close()
+	if err != nil {
+		return nil, false, fmt.Errorf("list %s: %w", dir, err)
+	}
+	res, err := m.cli.ExecInspect(ctx, exec.ID, client.ExecInspectOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("list %s: %w", dir, err)
+	}
+	switch res.ExitCode {
+	case 0:
+	case 3:
+		return nil, false, fmt.Errorf("list %s: %w", dir, ErrPathNotFound)
+	case 4:
+		return nil, false, fmt.Errorf("list %s: %w", dir, ErrNotDirectory)
+	default:
+		return nil, false, fmt.Errorf("list %s: exit code %d: %s", dir, res.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	entries = parseDirListing(stdout.Bytes())
+	if len(entries) > MaxDirEntries {
+		entries, truncated = entries[:MaxDirEntries], true
+	}
+	slices.SortFunc(entries, func(a, b DirEntry) int {
+		if (a.Type == "dir") != (b.Type == "dir") {
+			if a.Type == "dir" {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return entries, truncated, nil
+}
+
+// parseDirListing parses the output of listDirScript, skipping malformed
+// records.
+func parseDirListing(out []byte) []DirEntry {
+	var entries []DirEntry
+	for _, rec := range strings.Split(string(out), "\x00") {
+		fields := strings.SplitN(rec, "\t", 5)
+		if len(fields) != 5 || fields[4] == "" {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		secs, _ := strconv.ParseFloat(fields[3], 64)
+		entries = append(entries, DirEntry{
+			Name:    fields[4],
+			Type:    dirEntryType(fields[1]),
+			Link:    fields[0] == "l",
+			Size:    size,
+			ModTime: time.Unix(0, int64(secs*1e9)).UTC(),
+		})
+	}
+	return entries
+}
+
+// dirEntryType maps a find %y/%Y letter to a DirEntry type.
+func dirEntryType(letter string) string {
+	switch letter {
+	case "d":
+		return "dir"
+	case "f":
+		return "file"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+)
+
+// readTar returns the headers and contents of every entry in a tar stream.
+func readTar(t *testing.T, r io.Reader) ([]*tar.Header, [][]byte) {
+	t.Helper()
+	var hdrs []*tar.Header
+	var bodies [][]byte
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs, bodies
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		hdrs = append(hdrs, hdr)
+		bodies = append(bodies, body)
+	}
+}
+
+func TestWriteFileTar(t *testing.T) {
+	const content = "ssh-ed25519 AAAA test@example\n"
+	mtime := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	if err := writeFileTar(&buf, "authorized_keys", strings.NewReader(content), int64(len(content)), mtime); err != nil {
+		t.Fatal(err)
+	}
+	hdrs, bodies := readTar(t, &buf)
+	if len(hdrs) != 1 {
+		t.Fatalf("tar has %d entries, want 1", len(hdrs))
+	}
+	hdr := hdrs[0]
+	if hdr.Name != "authorized_keys" || hdr.Typeflag != tar.TypeReg || hdr.Mode != 0644 || hdr.Size != int64(len(content)) {
+		t.Errorf("header = %+v", hdr)
+	}
+	if hdr.Uname != "root" || hdr.Gname != "root" || !hdr.ModTime.Equal(mtime) {
+		t.Errorf("owner %s:%s, mtime %v", hdr.Uname, hdr.Gname, hdr.ModTime)
+	}
+	if string(bodies[0]) != content {
+		t.Errorf("content = %q, want %q", bodies[0], content)
+	}
+}
+
+func TestWriteFileTarShortRead(t *testing.T) {
+	err := writeFileTar(io.Discard, "f", strings.NewReader("abc"), 10, time.Now())
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("err = %v, want EOF for an upload shorter than its size", err)
+	}
+}
+
+func TestCopyToContainer(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	id := srv.AddContainer(dockertest.Container{Name: "cloudcode-upload", State: container.StateRunning})
+
+	const content = "dataset"
+	if err := m.CopyToContainer(context.Background(), id, ".ssh/id_ed25519", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("CopyToContainer: %v", err)
+	}
+	c, _ := srv.Container(id)
+	uploads := c.Uploads["/root/.ssh"]
+	if len(uploads) != 1 {
+		t.Fatalf("uploads = %v, want one archive for /root/.ssh", c.Uploads)
+	}
+	hdrs, bodies := readTar(t, bytes.NewReader(uploads[0]))
+	if len(hdrs) != 1 || hdrs[0].Name != "id_ed25519" || string(bodies[0]) != content {
+		t.Errorf("archive holds %d entries, first %+v", len(hdrs), hdrs)
+	}
+
+	if err := m.CopyToContainer(context.Background(), id, "/root/../etc/passwd", strings.NewReader(content), int64(len(content))); err == nil {
+		t.Error("CopyToContainer accepted a path with ..")
+	}
+}
+
+func TestContainerPath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"notes.txt", "/root/notes.txt", true},
+		{"/tmp/a//b/", "/tmp/a/b", true},
+		{"./x", "/root/x", true},
+		{"", "", false},
+		{"/", "", false},
+		{"../etc/passwd", "", false},
+		{"/root/../etc", "", false},
+		{"a/..", "", false},
+	} {
+		got, err := ContainerPath(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ContainerPath(%q) = %q, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestNormalizeWorkDir(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                "/root",
+		"  ":              "/root",
+		"/workspace/app/": "/workspace/app",
+		"/srv//x/../y":    "/srv/y",
+	} {
+		if got, err := NormalizeWorkDir(in); err != nil || got != want {
+			t.Errorf("NormalizeWorkDir(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := NormalizeWorkDir("workspace"); err == nil {
+		t.Error("NormalizeWorkDir accepted a relative path")
+	}
+}
+
+func TestListContainerDir(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	id := srv.AddContainer(dockertest.Container{Name: "cloudcode-ls", State: container.StateRunning})
+	var gotCmd []string
+	srv.Exec = func(_ string, cmd []string) dockertest.ExecResult {
+		gotCmd = cmd
+		switch cmd[4] {
+		case "/root/missing":
+			return dockertest.ExecResult{ExitCode: 3}
+		case "/root/file.txt":
+			return dockertest.ExecResult{ExitCode: 4}
+		}
+		return dockertest.ExecResult{Stdout: "f\tf\t42\t1767225600.5\tnotes.txt\x00" +
+			"d\td\t4096\t1767225600\tsrc\x00" +
+			"l\td\t7\t1767225600\tlink\x00" +
+			"l\tN\t7\t1767225600\tbroken\x00" +
+			"garbage\x00" +
+			"f\tf\t0\t1767225600\twith\ttab\x00"}
+	}
+
+	entries, truncated, err := m.ListContainerDir(context.Background(), id, "project")
+	if err != nil {
+		t.Fatalf("ListContainerDir: %v", err)
+	}
+	if gotCmd[4] != "/root/project" {
+		t.Errorf("listed %q, want /root/project", gotCmd[4])
+	}
+	if truncated {
+		t.Error("small listing reported as truncated")
+	}
+	mtime := time.Unix(1767225600, 0).UTC()
+	want := []DirEntry{
+		{Name: "link", Type: "dir", Link: true, Size: 7, ModTime: mtime},
+		{Name: "src", Type: "dir", Size: 4096, ModTime: mtime},
+		{Name: "broken", Type: "other", Link: true, Size: 7, ModTime: mtime},
+		{Name: "notes.txt", Type: "file", Size: 42, ModTime: mtime.Add(500 * time.Millisecond)},
+		{Name: "with\ttab", Type: "file", ModTime: mtime},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	if _, _, err := m.ListContainerDir(context.Background(), id, "missing"); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("missing dir: err = %v, want ErrPathNotFound", err)
+	}
+	if _, _, err := m.ListContainerDir(context.Background(), id, "file.txt"); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("file: err = %v, want ErrNotDirectory", err)
+	}
+	if _, _, err := m.ListContainerDir(context.Background(), id, "../etc"); err == nil {
+		t.Error("listing a path with .. succeeded")
+	}
+}
+
+func TestListContainerDirTruncates(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	id := srv.AddContainer(dockertest.Container{Name: "cloudcode-big", State: container.StateRunning})
+	srv.Exec = func(string, []string) dockertest.ExecResult {
+		var out strings.Builder
+		for i := range MaxDirEntries + 1 {
+			fmt.Fprintf(&out, "f\tf\t1\t0\tf%04d\x00", i)
+		}
+		return dockertest.ExecResult{Stdout: out.String()}
+	}
+	entries, truncated, err := m.ListContainerDir(context.Background(), id, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != MaxDirEntries || !truncated {
+		t.Errorf("got %d entries, truncated %v; want %d, true", len(entries), truncated, MaxDirEntries)
+	}
+}
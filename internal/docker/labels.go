@@ -0,0 +1,52 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/moby/moby/client"
+)
+
+// MaxCustomLabels caps the custom labels of one instance.
+const MaxCustomLabels = 32
+
+// maxLabelValue caps a custom label value in bytes.
+const maxLabelValue = 1024
+
+// labelKeyRe accepts keys in the style Docker recommends, alphanumerics
+// separated by dots, dashes, underscores or slashes, such as
+// "com.example.team" or "traefik.http.routers.myApp.rule".
+var labelKeyRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,126}[A-Za-z0-9])?$`)
+
+// ValidateLabel checks a custom container label. Keys under the
+// "cloudcode." prefix are reserved for CloudCode's own bookkeeping.
+func ValidateLabel(key, value string) error {
+	if !labelKeyRe.MatchString(key) {
+		return fmt.Errorf("invalid label key %q: use letters, digits, '.', '-', '_' and '/', up to 128 characters", key)
+	}
+	if strings.HasPrefix(key, labelPrefix) {
+		return fmt.Errorf("label key %q uses the reserved %q prefix", key, labelPrefix)
+	}
+	if len(value) > maxLabelValue {
+		return fmt.Errorf("value of label %q exceeds %d bytes", key, maxLabelValue)
+	}
+	return nil
+}
+
+// ContainerLabels returns the labels a container currently carries.
+func (m *Manager) ContainerLabels(ctx context.Context, containerID string) (map[string]string, error) {
+	var result client.ContainerInspectResult
+	err := withRetry(ctx, "inspect", func() (err error) {
+		result, err = m.cli.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inspect container: %w", err)
+	}
+	if result.Container.Config == nil {
+		return nil, nil
+	}
+	return result.Container.Config.Labels, nil
+}
@@ -1,14 +1,23 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"maps"
+	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/distribution/reference"
 	"github.com/moby/moby/api/pkg/stdcopy"
 	"github.com/moby/moby/api/types/container"
 	"github.com/moby/moby/api/types/mount"
@@ -16,27 +25,151 @@ import (
 	"github.com/moby/moby/client"
 
 	"github.com/naiba/cloudcode/internal/config"
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/metrics"
 	"github.com/naiba/cloudcode/internal/store"
 )
 
+var containerOps = metrics.Register(metrics.NewCounterVec(
+	"cloudcode_container_operations_total",
+	"Container lifecycle operations by operation and result.",
+	"op", "result",
+))
+
+// countOp records a container operation outcome in containerOps.
+func countOp(op string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	containerOps.Inc(op, result)
+}
+
 const (
 	labelPrefix     = "cloudcode."
 	labelManaged    = labelPrefix + "managed"
 	labelInstID     = labelPrefix + "instance-id"
+	labelPort       = labelPrefix + "port"
+	labelTagPrefix  = labelPrefix + "tag."
+	labelHelper     = labelPrefix + "helper"
 	defaultImage    = "ghcr.io/naiba/cloudcode-base:latest"
 	networkName     = "cloudcode-net"
 	containerPrefix = "cloudcode-"
 	volumePrefix    = "cloudcode-home-"
 )
 
+// Options tunes how instance containers are created.
+type Options struct {
+	// LogDriver sets HostConfig.LogConfig explicitly. Empty keeps the daemon default.
+	LogDriver string
+	// LogMaxSize and LogMaxFile bound log disk usage for the json-file and
+	// local drivers (e.g. "10m" and "3"). Ignored for other drivers.
+	LogMaxSize string
+	LogMaxFile string
+	// VolumeDriver, when set, creates home volumes explicitly with this
+	// driver and VolumeOpts instead of letting Docker auto-create them
+	// with the local driver on container create.
+	VolumeDriver string
+	VolumeOpts   map[string]string
+	// StopSignal is the default signal sent on stop (e.g. "SIGINT").
+	// Empty keeps Docker's default, SIGTERM.
+	StopSignal string
+	// AlwaysPull pulls the image on every container create. By default the
+	// pull is skipped when the image already exists locally.
+	AlwaysPull bool
+	// AllowBindMounts applies the host directories of Instance.BindMounts.
+	// When off they are ignored, even if stored while it was on.
+	AllowBindMounts bool
+}
+
+// StopSignals lists the signal names accepted as a container stop signal.
+var StopSignals = []string{"SIGTERM", "SIGINT", "SIGQUIT", "SIGHUP", "SIGUSR1", "SIGUSR2", "SIGKILL"}
+
+// NormalizeStopSignal validates a signal name, accepting "int", "SIGINT"
+// or "sigint", and returns its canonical "SIGINT" form. Empty stays empty.
+func NormalizeStopSignal(name string) (string, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for _, s := range StopSignals {
+		if s == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown stop signal %q (allowed: %s)", name, strings.Join(StopSignals, ", "))
+}
+
+// NormalizeCpuset validates a cpuset list such as "0-3,8" against the
+// number of host CPUs and returns it in canonical form (sorted, merged
+// ranges). An empty spec means no pinning.
+func NormalizeCpuset(spec string, hostCPUs int) (string, error) {
+	spec = strings.ReplaceAll(strings.TrimSpace(spec), " ", "")
+	if spec == "" {
+		return "", nil
+	}
+	cpus := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return "", fmt.Errorf("invalid CPU %q in cpuset %q", lo, spec)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return "", fmt.Errorf("invalid CPU range %q in cpuset %q", part, spec)
+			}
+		}
+		if hostCPUs > 0 && last >= hostCPUs {
+			return "", fmt.Errorf("CPU %d in cpuset %q does not exist, the host has %d CPUs (0-%d)", last, spec, hostCPUs, hostCPUs-1)
+		}
+		for c := first; c <= last; c++ {
+			cpus[c] = true
+		}
+	}
+
+	var parts []string
+	maxCPU := slices.Max(slices.Collect(maps.Keys(cpus)))
+	for c := 0; c <= maxCPU; c++ {
+		if !cpus[c] {
+			continue
+		}
+		end := c
+		for cpus[end+1] {
+			end++
+		}
+		if end == c {
+			parts = append(parts, strconv.Itoa(c))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", c, end))
+		}
+		c = end
+	}
+	return strings.Join(parts, ","), nil
+}
+
 type Manager struct {
 	cli    *client.Client
-	mu     sync.Mutex
 	image  string
 	config *config.Manager
+	opts   Options
+
+	// containerLocks serializes operations on the container of one
+	// instance, keyed by the instance ID whichever container reference the
+	// caller holds (see lockInstance). imageLocks keeps concurrent creates
+	// from pulling the same image twice.
+	containerLocks keyedMutex
+	imageLocks     keyedMutex
+
+	adoptedMu sync.Mutex
+	adopted   map[string]string // container ID → instance ID, see TrackAdopted
 }
 
-func NewManager(imageName string, cfgMgr *config.Manager) (*Manager, error) {
+func NewManager(imageName string, cfgMgr *config.Manager, opts Options) (*Manager, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, fmt.Errorf("create docker client: %w", err)
@@ -46,7 +179,7 @@ func NewManager(imageName string, cfgMgr *config.Manager) (*Manager, error) {
 		imageName = defaultImage
 	}
 
-	m := &Manager{cli: cli, image: imageName, config: cfgMgr}
+	m := &Manager{cli: cli, image: imageName, config: cfgMgr, opts: opts, adopted: make(map[string]string)}
 
 	if err := m.ensureNetwork(context.Background()); err != nil {
 		return nil, fmt.Errorf("ensure network: %w", err)
@@ -72,50 +205,151 @@ func (m *Manager) ensureNetwork(ctx context.Context) error {
 	return err
 }
 
-func (m *Manager) ensureImage(ctx context.Context) error {
-	log.Printf("Pulling latest image %s...", m.image)
-	reader, err := m.cli.ImagePull(ctx, m.image, client.ImagePullOptions{})
+// ensureImage makes sure image is available locally, pulling it unless
+// it already exists and AlwaysPull is off.
+func (m *Manager) ensureImage(ctx context.Context, image string, progress ProgressFunc) error {
+	defer m.imageLocks.lock(image)()
+	if !m.opts.AlwaysPull {
+		if exists, err := m.imageExists(ctx, image); err == nil && exists {
+			progress.report(PhasePull, pullEndPercent, "Using local image")
+			return nil
+		}
+	}
+	logger := logctx.From(ctx)
+	logger.Info("Pulling image", "image", image)
+	progress.report(PhasePull, 0, "Pulling image")
+	err := m.pullImage(ctx, image, progress, pullEndPercent)
 	if err != nil {
 		// pull 失败时，如果本地已有镜像则继续使用
-		exists, checkErr := m.ImageExists(ctx)
+		exists, checkErr := m.imageExists(ctx, image)
 		if checkErr == nil && exists {
-			log.Printf("Pull failed (%v), using existing local image %s", err, m.image)
+			logger.Warn("Pull failed, using existing local image", "image", image, "error", err)
 			return nil
 		}
-		return fmt.Errorf("pull image %s: %w", m.image, err)
+		return fmt.Errorf("pull image %s: %w", image, err)
+	}
+	logger.Info("Image pulled", "image", image)
+	return nil
+}
+
+// pullImage pulls image, reporting download progress scaled to
+// 0–endPercent.
+func (m *Manager) pullImage(ctx context.Context, image string, progress ProgressFunc, endPercent int) error {
+	reader, err := m.cli.ImagePull(ctx, image, client.ImagePullOptions{})
+	if err != nil {
+		return err
 	}
 	defer reader.Close()
-	_, _ = io.Copy(io.Discard, reader)
-	log.Printf("Image %s pulled successfully", m.image)
+	return readPullProgress(reader, progress, endPercent)
+}
+
+// PullImage pulls the latest version of the instance image, reporting
+// layer download progress over the whole 0–100 range. Unlike container
+// creation it never falls back to the local image.
+func (m *Manager) PullImage(ctx context.Context, progress ProgressFunc) error {
+	defer m.imageLocks.lock(m.image)()
+	logctx.From(ctx).Info("Pulling image", "image", m.image)
+	progress.report(PhasePull, 0, "Pulling image")
+	if err := m.pullImage(ctx, m.image, progress, 100); err != nil {
+		return fmt.Errorf("pull image %s: %w", m.image, err)
+	}
+	logctx.From(ctx).Info("Image pulled", "image", m.image)
 	return nil
 }
 
-func (m *Manager) CreateContainer(ctx context.Context, inst *store.Instance) (string, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// Image returns the default instance image reference.
+func (m *Manager) Image() string {
+	return m.image
+}
 
-	if err := m.ensureImage(ctx); err != nil {
-		return "", fmt.Errorf("ensure image: %w", err)
+// InstanceImage returns the image inst runs: its own, or the default.
+func (m *Manager) InstanceImage(inst *store.Instance) string {
+	if inst.Image != "" {
+		return inst.Image
 	}
+	return m.image
+}
+
+// ValidateImageRef checks that ref is a well-formed image reference such
+// as "ubuntu:24.04" or "ghcr.io/org/image@sha256:…", so a typo fails at
+// once instead of when the pull is attempted.
+func ValidateImageRef(ref string) error {
+	if _, err := reference.ParseNormalizedNamed(ref); err != nil {
+		return fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	return nil
+}
+
+// ImageDigest returns the repo digest of the local instance image, or its
+// image ID for locally built images that were never pushed or pulled.
+func (m *Manager) ImageDigest(ctx context.Context) (string, error) {
+	result, err := m.cli.ImageInspect(ctx, m.image)
+	if err != nil {
+		return "", fmt.Errorf("inspect image %s: %w", m.image, err)
+	}
+	if len(result.RepoDigests) > 0 {
+		return result.RepoDigests[0], nil
+	}
+	return result.ID, nil
+}
 
-	containerName := containerPrefix + inst.ID
+// StartErrorLogLines is how many trailing log lines a StartError keeps.
+const StartErrorLogLines = 500
+
+// StartError is returned by CreateContainer when the container was created
+// but did not start. The container has been removed; Logs holds the tail
+// of its output, read before the removal.
+type StartError struct {
+	ContainerID string
+	Logs        []byte
+	Err         error
+}
+
+func (e *StartError) Error() string { return "start container: " + e.Err.Error() }
+
+func (e *StartError) Unwrap() error { return e.Err }
+
+// CreateContainer pulls the image, creates and starts the container of an
+// instance. progress, if non-nil, receives the pull/create/start phases.
+// A container that fails to start is removed and a *StartError returned.
+func (m *Manager) CreateContainer(ctx context.Context, inst *store.Instance, progress ProgressFunc) (_ string, err error) {
+	defer func() { countOp("create", err) }()
+	logger := logctx.From(ctx)
+	containerName := ContainerName(inst.ID)
+	defer m.lockInstance(inst.ID, "")()
+
+	image := m.InstanceImage(inst)
+	if err := m.ensureImage(ctx, image, progress); err != nil {
+		return "", fmt.Errorf("ensure image: %w", err)
+	}
 
 	env := []string{
 		fmt.Sprintf("OPENCODE_PORT=%d", inst.Port),
 		fmt.Sprintf("CC_INSTANCE_NAME=%s", inst.Name),
 	}
+	if inst.LogLevel != "" {
+		// entrypoint.sh 将其转换为 opencode 的 --log-level 参数
+		env = append(env, "OPENCODE_LOG_LEVEL="+inst.LogLevel)
+	}
 
+	// 实例自身的环境变量覆盖同名的全局变量
+	var globalEnv map[string]string
 	if m.config != nil {
-		globalEnv, err := m.config.GetEnvVars()
-		if err == nil {
-			for k, v := range globalEnv {
-				env = append(env, fmt.Sprintf("%s=%s", k, v))
-			}
-		}
+		globalEnv, _ = m.config.GetEnvVars()
+	}
+	merged := config.MergeEnv(globalEnv, inst.EnvVars)
+	for _, k := range slices.Sorted(maps.Keys(merged)) {
+		env = append(env, k+"="+merged[k])
 	}
 
 	// Named volume for /root (persists across container recreations)
-	homeVolume := volumePrefix + inst.ID
+	homeVolume := HomeVolumeName(inst)
+	freshVolume := !m.volumeExists(ctx, homeVolume)
+	if freshVolume && m.opts.VolumeDriver != "" {
+		if err := m.createVolume(ctx, homeVolume, inst.ID); err != nil {
+			return "", err
+		}
+	}
 	mounts := []mount.Mount{
 		{
 			Type:   mount.TypeVolume,
@@ -138,76 +372,583 @@ func (m *Manager) CreateContainer(ctx context.Context, inst *store.Instance) (st
 			})
 		}
 	}
+	// 用户定义的宿主机目录，保存时已由 config.ValidateBindMounts 校验；
+	// 关闭 -allow-bind-mounts 后不再挂载之前保存的目录
+	if m.opts.AllowBindMounts {
+		for _, bm := range inst.BindMounts {
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   bm.HostPath,
+				Target:   bm.ContainerPath,
+				ReadOnly: bm.ReadOnly,
+			})
+		}
+	} else if len(inst.BindMounts) > 0 {
+		logger.Warn("Bind mounts are disabled, not mounting", "instance", inst.ID, "mounts", len(inst.BindMounts))
+	}
 
-	resp, err := m.cli.ContainerCreate(ctx, client.ContainerCreateOptions{
+	stopSignal := inst.StopSignal
+	if stopSignal == "" {
+		stopSignal = m.opts.StopSignal
+	}
+
+	if err := m.ensureExtraNetworks(ctx, inst.Networks); err != nil {
+		return "", err
+	}
+
+	createOpts := client.ContainerCreateOptions{
 		Name: containerName,
 		Config: &container.Config{
-			Image:      m.image,
-			WorkingDir: "/root",
+			Image:      image,
+			Cmd:        inst.Command, // nil 时沿用镜像的 CMD
+			WorkingDir: inst.ContainerWorkDir(),
 			Env:        env,
-			Labels: map[string]string{
-				labelManaged: "true",
-				labelInstID:  inst.ID,
-			},
+			StopSignal: stopSignal,
+			Labels:     instanceLabels(inst),
 		},
 		HostConfig: &container.HostConfig{
-			Mounts: mounts,
-			RestartPolicy: container.RestartPolicy{
-				Name: "unless-stopped",
-			},
-			Resources: inst.ContainerResources(),
+			Mounts:        mounts,
+			RestartPolicy: inst.ContainerRestartPolicy(),
+			Resources:     inst.ContainerResources(),
+			LogConfig:     m.logConfig(),
+			Sysctls:       inst.Sysctls,
+			DNS:           dnsAddrs(inst.DNS),
+			ExtraHosts:    inst.ExtraHosts,
 		},
 		NetworkingConfig: &network.NetworkingConfig{
-			EndpointsConfig: map[string]*network.EndpointSettings{
-				networkName: {},
-			},
+			EndpointsConfig: endpointsConfig(inst.Networks),
 		},
+	}
+	progress.report(PhaseCreate, pullEndPercent, "Creating container")
+	var resp client.ContainerCreateResult
+	err = withRetry(ctx, "create", func() (err error) {
+		resp, err = m.cli.ContainerCreate(ctx, createOpts)
+		return err
 	})
 	if err != nil {
 		return "", fmt.Errorf("create container: %w", err)
 	}
+	for _, w := range resp.Warnings {
+		logger.Warn("Docker warning", "instance", inst.ID, "warning", w)
+	}
 
-	if _, err := m.cli.ContainerStart(ctx, resp.ID, client.ContainerStartOptions{}); err != nil {
-		_, _ = m.cli.ContainerRemove(ctx, resp.ID, client.ContainerRemoveOptions{Force: true})
-		return "", fmt.Errorf("start container: %w", err)
+	// 仅在 home volume 首次创建时写入模板，重建容器不会覆盖用户修改
+	if freshVolume {
+		if err := m.seedHomeTemplate(ctx, resp.ID); err != nil {
+			logger.Error("Error copying home template", "instance", inst.ID, "error", err)
+		}
+	}
+
+	progress.report(PhaseStart, createEndPercent, "Starting container")
+	if err := m.startContainer(ctx, resp.ID); err != nil {
+		// ctx 可能已被取消（实例被删除），清理时不能继承取消
+		cleanupCtx := context.WithoutCancel(ctx)
+		// 容器删除后日志就没了，先留下启动失败时的输出
+		logs, _ := m.ContainerLogsTail(cleanupCtx, resp.ID, StartErrorLogLines)
+		_, _ = m.cli.ContainerRemove(cleanupCtx, resp.ID, client.ContainerRemoveOptions{Force: true})
+		return "", &StartError{ContainerID: resp.ID, Logs: logs, Err: err}
+	}
+
+	if problems, err := m.VerifyResources(ctx, resp.ID, inst.ContainerResources()); err != nil {
+		logger.Warn("Could not verify resource limits", "instance", inst.ID, "error", err)
+	} else {
+		for _, p := range problems {
+			logger.Warn("Resource limit mismatch", "instance", inst.ID, "problem", p)
+		}
 	}
 
 	return resp.ID, nil
 }
 
-func (m *Manager) StopContainer(ctx context.Context, containerID string) error {
-	timeout := 30
-	_, err := m.cli.ContainerStop(ctx, containerID, client.ContainerStopOptions{Timeout: &timeout})
+// logConfig returns the configured container log driver, or a zero value
+// so the daemon default applies.
+func (m *Manager) logConfig() container.LogConfig {
+	if m.opts.LogDriver == "" {
+		return container.LogConfig{}
+	}
+	lc := container.LogConfig{Type: m.opts.LogDriver}
+	// max-size/max-file 仅 json-file 和 local 驱动支持，其他驱动传入会导致创建失败
+	if m.opts.LogDriver == "json-file" || m.opts.LogDriver == "local" {
+		lc.Config = map[string]string{}
+		if m.opts.LogMaxSize != "" {
+			lc.Config["max-size"] = m.opts.LogMaxSize
+		}
+		if m.opts.LogMaxFile != "" {
+			lc.Config["max-file"] = m.opts.LogMaxFile
+		}
+	}
+	return lc
+}
+
+// Ping checks that the Docker daemon is reachable.
+func (m *Manager) Ping(ctx context.Context) error {
+	if _, err := m.cli.Ping(ctx, client.PingOptions{}); err != nil {
+		return fmt.Errorf("ping docker: %w", err)
+	}
+	return nil
+}
+
+// HostCPUs returns the number of CPUs the Docker host reports.
+func (m *Manager) HostCPUs(ctx context.Context) (int, error) {
+	info, err := m.cli.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("docker info: %w", err)
+	}
+	return info.Info.NCPU, nil
+}
+
+// VerifyResources inspects a container and reports requested resource limits
+// that Docker did not apply. The daemon may accept a limit it cannot enforce
+// (e.g. no swap accounting on cgroup v1), so the host capabilities reported by
+// Info are checked as well. An empty result means everything matches.
+func (m *Manager) VerifyResources(ctx context.Context, containerID string, want container.Resources) ([]string, error) {
+	if want.Memory == 0 && want.NanoCPUs == 0 && want.CpusetCpus == "" {
+		return nil, nil
+	}
+
+	var result client.ContainerInspectResult
+	err := withRetry(ctx, "inspect", func() (err error) {
+		result, err = m.cli.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inspect container: %w", err)
+	}
+	var got container.Resources
+	if hc := result.Container.HostConfig; hc != nil {
+		got = hc.Resources
+	}
+
+	var problems []string
+	if want.Memory > 0 && got.Memory != want.Memory {
+		problems = append(problems, fmt.Sprintf("memory limit requested %d MB, applied %d MB", want.Memory>>20, got.Memory>>20))
+	}
+	if want.NanoCPUs > 0 && got.NanoCPUs != want.NanoCPUs {
+		problems = append(problems, fmt.Sprintf("CPU limit requested %.2f cores, applied %.2f cores", float64(want.NanoCPUs)/1e9, float64(got.NanoCPUs)/1e9))
+	}
+	if want.CpusetCpus != "" && got.CpusetCpus != want.CpusetCpus {
+		problems = append(problems, fmt.Sprintf("cpuset requested %q, applied %q", want.CpusetCpus, got.CpusetCpus))
+	}
+
+	info, err := m.cli.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return problems, nil
+	}
+	if want.Memory > 0 && !info.Info.MemoryLimit {
+		problems = append(problems, "host kernel does not support memory limits, the memory limit is not enforced")
+	} else if want.Memory > 0 && !info.Info.SwapLimit {
+		problems = append(problems, "host has no swap limit support, the container may exceed its memory limit using swap")
+	}
+	if want.NanoCPUs > 0 && !info.Info.CPUCfsQuota {
+		problems = append(problems, "host kernel does not support CFS quota, the CPU limit is not enforced")
+	}
+	return problems, nil
+}
+
+// lockInstance locks the container operations of an instance and returns
+// the unlock func. Create only knows the container name and later calls
+// pass the ID (or the name), so every call is keyed by the instance ID; a
+// container that belongs to no instance, such as an orphan, is keyed by
+// its own ID.
+func (m *Manager) lockInstance(instanceID, containerID string) func() {
+	if instanceID == "" {
+		return m.containerLocks.lock(containerID)
+	}
+	return m.containerLocks.lock(instanceID)
+}
+
+// StopContainer sends the stop signal and kills the container of an
+// instance if it is still running after timeout seconds (see
+// Instance.StopTimeout).
+func (m *Manager) StopContainer(ctx context.Context, instanceID, containerID string, timeout int) error {
+	defer m.lockInstance(instanceID, containerID)()
+	err := withRetry(ctx, "stop", func() error {
+		_, err := m.cli.ContainerStop(ctx, containerID, client.ContainerStopOptions{Timeout: &timeout})
+		return err
+	})
+	countOp("stop", err)
 	return err
 }
 
-func (m *Manager) StartContainer(ctx context.Context, containerID string) error {
-	_, err := m.cli.ContainerStart(ctx, containerID, client.ContainerStartOptions{})
+// StartContainer starts the container of an instance.
+func (m *Manager) StartContainer(ctx context.Context, instanceID, containerID string) error {
+	defer m.lockInstance(instanceID, containerID)()
+	return m.startContainer(ctx, containerID)
+}
+
+// startContainer starts a container; the caller holds the instance lock.
+func (m *Manager) startContainer(ctx context.Context, containerID string) error {
+	err := withRetry(ctx, "start", func() error {
+		_, err := m.cli.ContainerStart(ctx, containerID, client.ContainerStartOptions{})
+		return err
+	})
+	countOp("start", err)
 	return err
 }
 
-func (m *Manager) RemoveContainer(ctx context.Context, containerID string) error {
+// RemoveContainer force-removes the container of an instance; instanceID
+// is empty for a container that belongs to none. A container that does
+// not exist counts as removed.
+func (m *Manager) RemoveContainer(ctx context.Context, instanceID, containerID string) error {
+	defer m.lockInstance(instanceID, containerID)()
 	_, err := m.cli.ContainerRemove(ctx, containerID, client.ContainerRemoveOptions{
 		Force: true,
 	})
+	if cerrdefs.IsNotFound(err) {
+		err = nil
+	}
+	countOp("delete", err)
 	return err
 }
 
+// ContainerName returns the Docker container name of an instance. Docker
+// accepts it anywhere a container ID is expected.
+func ContainerName(instanceID string) string {
+	return containerPrefix + instanceID
+}
+
 // RemoveContainerAndVolume removes the container and its named home volume.
 // Used when permanently deleting an instance.
-func (m *Manager) RemoveContainerAndVolume(ctx context.Context, containerID, instanceID string) error {
+func (m *Manager) RemoveContainerAndVolume(ctx context.Context, instanceID, containerID, volumeName string) error {
+	defer m.lockInstance(instanceID, containerID)()
 	_, err := m.cli.ContainerRemove(ctx, containerID, client.ContainerRemoveOptions{
 		Force: true,
 	})
-	if err != nil {
+	if err != nil && !cerrdefs.IsNotFound(err) {
+		countOp("delete", err)
 		return err
 	}
+	countOp("delete", nil)
 	// Best-effort removal of the named volume
-	volName := volumePrefix + instanceID
-	_, _ = m.cli.VolumeRemove(ctx, volName, client.VolumeRemoveOptions{Force: true})
+	_, _ = m.cli.VolumeRemove(ctx, volumeName, client.VolumeRemoveOptions{Force: true})
+	return nil
+}
+
+// createVolume creates a home volume with the configured driver.
+func (m *Manager) createVolume(ctx context.Context, name, instanceID string) error {
+	_, err := m.cli.VolumeCreate(ctx, client.VolumeCreateOptions{
+		Name:       name,
+		Driver:     m.opts.VolumeDriver,
+		DriverOpts: m.opts.VolumeOpts,
+		Labels: map[string]string{
+			labelManaged: "true",
+			labelInstID:  instanceID,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create volume %s with driver %s: %w", name, m.opts.VolumeDriver, err)
+	}
 	return nil
 }
 
+// CopyVolume creates the home volume dst for instanceID and copies the
+// contents of src into it with a short-lived helper container. Files being
+// written in src while it is mounted by a running instance may be copied
+// in an inconsistent state.
+func (m *Manager) CopyVolume(ctx context.Context, src, dst, instanceID string, progress ProgressFunc) error {
+	if !m.volumeExists(ctx, src) {
+		return fmt.Errorf("source volume %s does not exist", src)
+	}
+	if err := m.ensureImage(ctx, m.image, progress); err != nil {
+		return fmt.Errorf("ensure image: %w", err)
+	}
+	if err := m.createVolume(ctx, dst, instanceID); err != nil {
+		return err
+	}
+
+	progress.report(PhaseCreate, pullEndPercent, "Copying home volume")
+	resp, err := m.cli.ContainerCreate(ctx, client.ContainerCreateOptions{
+		Config: &container.Config{
+			Image:      m.image,
+			Entrypoint: []string{"cp"},
+			Cmd:        []string{"-a", "/from/.", "/to/"},
+			// 带上目标实例 ID，孤立容器清理据此判断归属；helper 标签让对账不把它当作实例容器
+			Labels: map[string]string{labelManaged: "true", labelInstID: instanceID, labelHelper: "copy-volume"},
+		},
+		HostConfig: &container.HostConfig{
+			Mounts: []mount.Mount{
+				{Type: mount.TypeVolume, Source: src, Target: "/from", ReadOnly: true},
+				{Type: mount.TypeVolume, Source: dst, Target: "/to"},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create copy container: %w", err)
+	}
+	defer func() {
+		// 使用独立的 context，确保请求取消后仍能清理辅助容器
+		rmCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, _ = m.cli.ContainerRemove(rmCtx, resp.ID, client.ContainerRemoveOptions{Force: true})
+	}()
+
+	if _, err := m.cli.ContainerStart(ctx, resp.ID, client.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("start copy container: %w", err)
+	}
+	wait := m.cli.ContainerWait(ctx, resp.ID, client.ContainerWaitOptions{Condition: container.WaitConditionNotRunning})
+	select {
+	case res := <-wait.Result:
+		if res.StatusCode != 0 {
+			logs, _ := m.ContainerLogsTail(ctx, resp.ID, 20)
+			return fmt.Errorf("copy volume %s to %s: exit code %d: %s", src, dst, res.StatusCode, strings.TrimSpace(string(logs)))
+		}
+	case err := <-wait.Error:
+		return fmt.Errorf("wait for copy container: %w", err)
+	}
+	return nil
+}
+
+// instanceLabels returns the labels of an instance container: the
+// instance's custom labels, the CloudCode bookkeeping labels and one
+// cloudcode.tag.<tag>=true label per tag for external tooling. Custom
+// labels never override CloudCode's own.
+func instanceLabels(inst *store.Instance) map[string]string {
+	labels := make(map[string]string, len(inst.Labels)+3+len(inst.Tags))
+	for k, v := range inst.Labels {
+		if !strings.HasPrefix(k, labelPrefix) {
+			labels[k] = v
+		}
+	}
+	labels[labelManaged] = "true"
+	labels[labelInstID] = inst.ID
+	labels[labelPort] = strconv.Itoa(inst.Port)
+	for _, tag := range inst.Tags {
+		labels[labelTagPrefix+tag] = "true"
+	}
+	return labels
+}
+
+func (m *Manager) volumeExists(ctx context.Context, name string) bool {
+	_, err := m.cli.VolumeInspect(ctx, name, client.VolumeInspectOptions{})
+	return err == nil
+}
+
+// seedHomeTemplate copies the home template directory from the config
+// manager into /root of a created (not yet started) container. The copy
+// lands in the freshly created home volume.
+func (m *Manager) seedHomeTemplate(ctx context.Context, containerID string) error {
+	if m.config == nil {
+		return nil
+	}
+	files, err := m.config.HomeTemplateFiles()
+	if err != nil {
+		return fmt.Errorf("list home template: %w", err)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, m.config.HomeTemplateDir(), files); err != nil {
+		return fmt.Errorf("build home template archive: %w", err)
+	}
+	_, err = m.cli.CopyToContainer(ctx, containerID, client.CopyToContainerOptions{
+		DestinationPath: "/root",
+		Content:         &buf,
+	})
+	return err
+}
+
+// writeTar writes the given slash-separated files under root into a tar
+// stream owned by root:root, preserving their permission bits.
+func writeTar(w io.Writer, root string, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, rel := range files {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "root", "root"
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// HomeVolumeName returns the named volume mounted at /root for an instance.
+// Instances normally own cloudcode-home-{id}, but may attach an existing
+// home volume left behind by a deleted instance.
+func HomeVolumeName(inst *store.Instance) string {
+	if inst.HomeVolume != "" {
+		return inst.HomeVolume
+	}
+	return volumePrefix + inst.ID
+}
+
+// GPUInfo reports what the Docker daemon exposes for NVIDIA GPU access.
+type GPUInfo struct {
+	// Runtime is true when the nvidia container runtime is registered.
+	Runtime bool `json:"runtime"`
+	// Devices lists GPU devices discovered via CDI (e.g. "nvidia.com/gpu=0").
+	// Empty when the daemon does not report CDI devices.
+	Devices []string `json:"devices"`
+}
+
+// Available reports whether GPU device requests can be satisfied at all.
+func (g GPUInfo) Available() bool {
+	return g.Runtime || len(g.Devices) > 0
+}
+
+// GPUInfo inspects the daemon for the nvidia runtime and CDI GPU devices.
+func (m *Manager) GPUInfo(ctx context.Context) (GPUInfo, error) {
+	result, err := m.cli.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return GPUInfo{}, fmt.Errorf("docker info: %w", err)
+	}
+	var g GPUInfo
+	_, g.Runtime = result.Info.Runtimes["nvidia"]
+	for _, d := range result.Info.DiscoveredDevices {
+		// CDI 会额外列出 "=all" 这样的聚合设备，不计入数量
+		if strings.Contains(d.ID, "/gpu=") && !strings.HasSuffix(d.ID, "=all") {
+			g.Devices = append(g.Devices, d.ID)
+		}
+	}
+	return g, nil
+}
+
+// VolumeInfo describes a CloudCode home volume.
+type VolumeInfo struct {
+	Name      string `json:"name"`
+	Driver    string `json:"driver"`
+	CreatedAt string `json:"created_at"`
+	InUse     bool   `json:"in_use"`
+	// SizeBytes is only filled by VolumeSizes callers; -1 means unknown.
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// ListVolumes returns all cloudcode-home-* volumes and whether any container
+// (running or not) currently mounts them.
+func (m *Manager) ListVolumes(ctx context.Context) ([]VolumeInfo, error) {
+	result, err := m.cli.VolumeList(ctx, client.VolumeListOptions{
+		Filters: make(client.Filters).Add("name", volumePrefix),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list volumes: %w", err)
+	}
+
+	containers, err := m.cli.ContainerList(ctx, client.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+	inUse := make(map[string]bool)
+	for _, c := range containers.Items {
+		for _, mp := range c.Mounts {
+			if mp.Name != "" {
+				inUse[mp.Name] = true
+			}
+		}
+	}
+
+	var volumes []VolumeInfo
+	for _, v := range result.Items {
+		// The name filter is a substring match
+		if !strings.HasPrefix(v.Name, volumePrefix) {
+			continue
+		}
+		volumes = append(volumes, VolumeInfo{
+			Name:      v.Name,
+			Driver:    v.Driver,
+			CreatedAt: v.CreatedAt,
+			InUse:     inUse[v.Name],
+			SizeBytes: -1,
+		})
+	}
+	return volumes, nil
+}
+
+// VolumeSizes returns the disk usage of each cloudcode-home-* volume. The
+// daemon computes this on demand, so it can be slow on large volumes.
+func (m *Manager) VolumeSizes(ctx context.Context) (map[string]int64, error) {
+	du, err := m.cli.DiskUsage(ctx, client.DiskUsageOptions{Volumes: true})
+	if err != nil {
+		return nil, fmt.Errorf("volume disk usage: %w", err)
+	}
+	sizes := make(map[string]int64)
+	for _, v := range du.Volumes.Items {
+		if strings.HasPrefix(v.Name, volumePrefix) && v.UsageData != nil {
+			sizes[v.Name] = v.UsageData.Size
+		}
+	}
+	return sizes, nil
+}
+
+// VolumeUsage returns the size of one home volume in bytes, or -1 if the
+// daemon does not report it.
+func (m *Manager) VolumeUsage(ctx context.Context, name string) (int64, error) {
+	sizes, err := m.VolumeSizes(ctx)
+	if err != nil {
+		return -1, err
+	}
+	if size, ok := sizes[name]; ok {
+		return size, nil
+	}
+	return -1, nil
+}
+
+// RemoveVolume deletes a home volume that no container mounts.
+func (m *Manager) RemoveVolume(ctx context.Context, name string) error {
+	if !strings.HasPrefix(name, volumePrefix) {
+		return fmt.Errorf("volume %q is not a CloudCode home volume", name)
+	}
+	volumes, err := m.ListVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if v.Name != name {
+			continue
+		}
+		if v.InUse {
+			return fmt.Errorf("volume %q is in use by a container", name)
+		}
+		// 不使用 Force，Docker 在竞争条件下仍会拒绝删除正在使用的卷
+		if _, err := m.cli.VolumeRemove(ctx, name, client.VolumeRemoveOptions{}); err != nil {
+			return fmt.Errorf("remove volume %s: %w", name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("volume %q does not exist", name)
+}
+
+// CheckVolumeAttachable verifies that an existing home volume can be mounted
+// by a new instance: it must exist and no container may be using it.
+func (m *Manager) CheckVolumeAttachable(ctx context.Context, name string) error {
+	if !strings.HasPrefix(name, volumePrefix) {
+		return fmt.Errorf("volume %q is not a CloudCode home volume", name)
+	}
+	volumes, err := m.ListVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if v.Name != name {
+			continue
+		}
+		if v.InUse {
+			return fmt.Errorf("volume %q is in use by another container", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("volume %q does not exist", name)
+}
+
 func (m *Manager) ContainerLogsStream(ctx context.Context, containerID string, tail string) (io.ReadCloser, error) {
 	if tail == "" {
 		tail = "100"
@@ -233,10 +974,177 @@ func (m *Manager) ContainerLogsStream(ctx context.Context, containerID string, t
 	return pr, nil
 }
 
+// ContainerLogs returns a container's buffered logs without following,
+// demultiplexed with timestamps. tail is a line count or "all" (the
+// default). The caller must close the reader.
+func (m *Manager) ContainerLogs(ctx context.Context, containerID string, tail string) (io.ReadCloser, error) {
+	if tail == "" {
+		tail = "all"
+	}
+
+	raw, err := m.cli.ContainerLogs(ctx, containerID, client.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       tail,
+		Timestamps: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read container logs: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, raw)
+		raw.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// ContainerLogsTail returns the last lines of a container's output without
+// following, demultiplexed with timestamps.
+func (m *Manager) ContainerLogsTail(ctx context.Context, containerID string, lines int) ([]byte, error) {
+	raw, err := m.cli.ContainerLogs(ctx, containerID, client.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(lines),
+		Timestamps: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read container logs: %w", err)
+	}
+	defer raw.Close()
+
+	var buf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&buf, &buf, raw); err != nil {
+		return buf.Bytes(), fmt.Errorf("read container logs: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ManagedContainer is a container carrying the cloudcode.managed label.
+type ManagedContainer struct {
+	ID         string
+	Name       string
+	InstanceID string
+	State      string
+	// Port is the instance port recorded in the cloudcode.port label, 0 for
+	// containers created before the label existed (and adopted ones).
+	Port int
+	// PublishedPorts are host ports the container publishes, if any.
+	PublishedPorts []int
+	// Helper is set for short-lived helper containers, such as the one
+	// CopyVolume runs, which belong to InstanceID but are not its container.
+	Helper bool
+}
+
+// ManagedContainers lists every CloudCode-managed container, running or not.
+func (m *Manager) ManagedContainers(ctx context.Context) ([]ManagedContainer, error) {
+	var result client.ContainerListResult
+	err := withRetry(ctx, "list", func() (err error) {
+		result, err = m.cli.ContainerList(ctx, client.ContainerListOptions{
+			All:     true,
+			Filters: make(client.Filters).Add("label", labelManaged+"=true"),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+	items := result.Items
+	if adopted := m.adoptedIDs(); len(adopted) > 0 {
+		// 被接管的容器没有 managed 标签，按 ID 单独列出
+		filters := make(client.Filters)
+		for id := range adopted {
+			filters.Add("id", id)
+		}
+		var extra client.ContainerListResult
+		err := withRetry(ctx, "list", func() (err error) {
+			extra, err = m.cli.ContainerList(ctx, client.ContainerListOptions{All: true, Filters: filters})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list adopted containers: %w", err)
+		}
+		for _, c := range extra.Items {
+			if c.Labels == nil {
+				c.Labels = make(map[string]string)
+			}
+			c.Labels[labelInstID] = adopted[c.ID]
+			items = append(items, c)
+		}
+	}
+	containers := make([]ManagedContainer, 0, len(items))
+	for _, c := range items {
+		mc := ManagedContainer{ID: c.ID, InstanceID: c.Labels[labelInstID], State: string(c.State)}
+		mc.Port, _ = strconv.Atoi(c.Labels[labelPort])
+		mc.Helper = c.Labels[labelHelper] != ""
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				mc.PublishedPorts = append(mc.PublishedPorts, int(p.PublicPort))
+			}
+		}
+		if len(c.Names) > 0 {
+			mc.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		containers = append(containers, mc)
+	}
+	return containers, nil
+}
+
+// ContainerPorts returns every port held by a CloudCode container, running
+// or not, including orphans with no instance row: the instance port each
+// was created with and any published host ports. Containers without the
+// port label have their OPENCODE_PORT read via inspect.
+func (m *Manager) ContainerPorts(ctx context.Context) ([]int, error) {
+	containers, err := m.ManagedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ports []int
+	for _, c := range containers {
+		ports = append(ports, c.PublishedPorts...)
+		if c.Port > 0 {
+			ports = append(ports, c.Port)
+			continue
+		}
+		result, err := m.cli.ContainerInspect(ctx, c.ID, client.ContainerInspectOptions{})
+		if err != nil || result.Container.Config == nil {
+			continue
+		}
+		for _, kv := range result.Container.Config.Env {
+			if v, ok := strings.CutPrefix(kv, "OPENCODE_PORT="); ok {
+				if p, err := strconv.Atoi(v); err == nil {
+					ports = append(ports, p)
+				}
+			}
+		}
+	}
+	return ports, nil
+}
+
+// ContainerStates returns the state of every CloudCode-managed container,
+// keyed by container ID, using a single list call.
+func (m *Manager) ContainerStates(ctx context.Context) (map[string]string, error) {
+	containers, err := m.ManagedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]string, len(containers))
+	for _, c := range containers {
+		states[c.ID] = c.State
+	}
+	return states, nil
+}
+
 func (m *Manager) ContainerStatus(ctx context.Context, containerID string) (string, error) {
-	result, err := m.cli.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+	var result client.ContainerInspectResult
+	err := withRetry(ctx, "inspect", func() (err error) {
+		result, err = m.cli.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+		return err
+	})
 	if err != nil {
-		if strings.Contains(err.Error(), "No such container") {
+		if cerrdefs.IsNotFound(err) || strings.Contains(err.Error(), "No such container") {
 			return "removed", nil
 		}
 		return "unknown", err
@@ -244,12 +1152,17 @@ func (m *Manager) ContainerStatus(ctx context.Context, containerID string) (stri
 	return string(result.Container.State.Status), nil
 }
 
+// ImageExists reports whether the default instance image exists locally.
 func (m *Manager) ImageExists(ctx context.Context) (bool, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	return m.imageExists(ctx, m.image)
+}
+
+func (m *Manager) imageExists(ctx context.Context, image string) (bool, error) {
 	result, err := m.cli.ImageList(ctx, client.ImageListOptions{
-		Filters: make(client.Filters).Add("reference", m.image),
+		Filters: make(client.Filters).Add("reference", image),
 	})
 	if err != nil {
 		return false, err
@@ -257,12 +1170,15 @@ func (m *Manager) ImageExists(ctx context.Context) (bool, error) {
 	return len(result.Items) > 0, nil
 }
 
-func (m *Manager) ExecCreate(ctx context.Context, containerID string, cmd []string) (string, error) {
+// ExecCreate prepares an interactive TTY exec of cmd in workDir, or in the
+// container's working directory when workDir is empty.
+func (m *Manager) ExecCreate(ctx context.Context, containerID, workDir string, cmd []string) (string, error) {
 	result, err := m.cli.ExecCreate(ctx, containerID, client.ExecCreateOptions{
 		TTY:          true,
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
+		WorkingDir:   workDir,
 		Cmd:          cmd,
 	})
 	if err != nil {
@@ -279,6 +1195,93 @@ func (m *Manager) ExecAttach(ctx context.Context, execID string) (client.Hijacke
 	return resp.HijackedResponse, nil
 }
 
+// ExecExitCode returns the exit code of an exec process, or -1 while it is
+// still running.
+func (m *Manager) ExecExitCode(ctx context.Context, execID string) (int, error) {
+	res, err := m.cli.ExecInspect(ctx, execID, client.ExecInspectOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("exec inspect: %w", err)
+	}
+	if res.Running {
+		return -1, nil
+	}
+	return res.ExitCode, nil
+}
+
+// ErrCommandNotFound is returned by ExecOutput when the command is not
+// installed in the container (exit status 126 or 127), e.g. because the
+// entrypoint is still setting it up.
+var ErrCommandNotFound = errors.New("command not found in container")
+
+// maxExecOutput bounds the output ExecOutput keeps of each stream.
+const maxExecOutput = 64 << 10
+
+// ExecOutput runs cmd in a container without a TTY and returns its stdout
+// with surrounding whitespace trimmed. A non-zero exit status is an error
+// carrying the trimmed stderr. Output beyond 64 KiB per stream is dropped.
+func (m *Manager) ExecOutput(ctx context.Context, containerID string, cmd []string) (string, error) {
+	exec, err := m.cli.ExecCreate(ctx, containerID, client.ExecCreateOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", fmt.Errorf("exec create: %w", err)
+	}
+	attach, err := m.cli.ExecAttach(ctx, exec.ID, client.ExecAttachOptions{})
+	if err != nil {
+		return "", fmt.Errorf("exec attach: %w", err)
+	}
+	// 劫持的连接只在建立时受 ctx 控制，取消时关闭它以中断阻塞的读取
+	stop := context.AfterFunc(ctx, attach.Close)
+	defer stop()
+	stdout, stderr, err := demuxExecOutput(attach.Reader)
+	attach.Close()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("exec read: %w", err)
+	}
+	res, err := m.cli.ExecInspect(ctx, exec.ID, client.ExecInspectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("exec inspect: %w", err)
+	}
+	switch res.ExitCode {
+	case 0:
+		return stdout, nil
+	case 126, 127:
+		return "", fmt.Errorf("%s: %w", cmd[0], ErrCommandNotFound)
+	default:
+		return "", fmt.Errorf("%s: exit code %d: %s", cmd[0], res.ExitCode, stderr)
+	}
+}
+
+// demuxExecOutput splits a multiplexed non-TTY exec stream into trimmed
+// stdout and stderr.
+func demuxExecOutput(r io.Reader) (stdout, stderr string, err error) {
+	var out, errOut limitedBuffer
+	out.limit, errOut.limit = maxExecOutput, maxExecOutput
+	if _, err := stdcopy.StdCopy(&out, &errOut, r); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(out.String()), strings.TrimSpace(errOut.String()), nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty command cannot exhaust memory.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
 func (m *Manager) ExecResize(ctx context.Context, execID string, height, width uint) error {
 	_, err := m.cli.ExecResize(ctx, execID, client.ExecResizeOptions{
 		Height: height,
@@ -0,0 +1,516 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/client"
+
+	"github.com/naiba/cloudcode/internal/config"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// newTestManager returns a Manager talking to a fresh fake daemon that
+// already has the default image.
+func newTestManager(t *testing.T, opts Options) (*Manager, *dockertest.Server) {
+	t.Helper()
+	srv := dockertest.NewServer(t)
+	srv.AddImage(defaultImage)
+	t.Setenv("DOCKER_HOST", srv.Host())
+	m, err := NewManager("", nil, opts)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m, srv
+}
+
+// blockCalls makes requests matching method and pattern wait until the
+// returned release func is called. entered receives once per blocked call.
+func blockCalls(srv *dockertest.Server, method, pattern string) (entered <-chan struct{}, release func()) {
+	ch := make(chan struct{}, 16)
+	gate := make(chan struct{})
+	srv.AddHook(func(c dockertest.Call) error {
+		if ok, _ := path.Match(pattern, c.Path); ok && c.Method == method {
+			ch <- struct{}{}
+			<-gate
+		}
+		return nil
+	})
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(gate) }) }
+}
+
+func TestContainerLocksKeyedByInstance(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	ctx := context.Background()
+	inst := &store.Instance{ID: "inst1", Name: "one", Port: 10000, MemoryMB: 512}
+	other := srv.AddContainer(dockertest.Container{Name: ContainerName("inst2"), State: container.StateRunning})
+
+	// 在创建流程末尾（启动后校验资源限制时）挂起
+	entered, release := blockCalls(srv, "GET", "/containers/*/json")
+	defer release()
+	created := make(chan error, 1)
+	go func() {
+		_, err := m.CreateContainer(ctx, inst, nil)
+		created <- err
+	}()
+	<-entered
+
+	// 另一个实例的操作不受影响
+	if err := m.StopContainer(ctx, "inst2", other, 5); err != nil {
+		t.Fatalf("stop other instance: %v", err)
+	}
+
+	// 同一实例按容器 ID 停止，必须等创建完成
+	c, ok := srv.Container(ContainerName(inst.ID))
+	if !ok {
+		t.Fatal("container not created")
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.StopContainer(ctx, inst.ID, c.ID, 5) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("stop returned during create: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := len(srv.Calls("POST", "/containers/"+c.ID+"/stop")); n != 0 {
+		t.Fatalf("stop reached the daemon during create (%d calls)", n)
+	}
+
+	release()
+	if err := <-created; err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+	if c, _ := srv.Container(c.ID); c.State != container.StateExited {
+		t.Fatalf("container state = %q, want exited", c.State)
+	}
+}
+
+func TestExecOutput(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	id := srv.AddContainer(dockertest.Container{Name: "c", State: container.StateRunning})
+	results := map[string]dockertest.ExecResult{
+		"ok":      {Stdout: "  line 1\nv1.2.3\n", Stderr: "update available\n"},
+		"fail":    {Stdout: "partial", Stderr: " boom \n", ExitCode: 2},
+		"missing": {Stderr: "sh: missing: not found", ExitCode: 127},
+	}
+	srv.Exec = func(_ string, cmd []string) dockertest.ExecResult { return results[cmd[0]] }
+	ctx := context.Background()
+
+	out, err := m.ExecOutput(ctx, id, []string{"ok"})
+	if err != nil || out != "line 1\nv1.2.3" {
+		t.Errorf("ExecOutput(ok) = %q, %v; want stdout only, trimmed", out, err)
+	}
+	_, err = m.ExecOutput(ctx, id, []string{"fail"})
+	if err == nil || err.Error() != "fail: exit code 2: boom" {
+		t.Errorf("ExecOutput(fail) error = %v, want exit code and trimmed stderr", err)
+	}
+	if _, err = m.ExecOutput(ctx, id, []string{"missing"}); !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("ExecOutput(missing) error = %v, want ErrCommandNotFound", err)
+	}
+}
+
+func TestExecOutputHungCommand(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	id := srv.AddContainer(dockertest.Container{Name: "c", State: container.StateRunning})
+	hang := make(chan struct{})
+	defer close(hang)
+	srv.Exec = func(string, []string) dockertest.ExecResult {
+		<-hang
+		return dockertest.ExecResult{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.ExecOutput(ctx, id, []string{"sleep"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ExecOutput did not return after its context expired")
+	}
+}
+
+func TestDemuxExecOutputLimit(t *testing.T) {
+	stream := append(dockertest.Frame(stdcopy.Stdout, strings.Repeat("a", maxExecOutput)),
+		dockertest.Frame(stdcopy.Stdout, "dropped")...)
+	stream = append(stream, dockertest.Frame(stdcopy.Stderr, "err")...)
+	stdout, stderr, err := demuxExecOutput(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) != maxExecOutput || strings.Contains(stdout, "dropped") {
+		t.Errorf("stdout has %d bytes, want the first %d", len(stdout), maxExecOutput)
+	}
+	if stderr != "err" {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
+
+func TestCopyVolumeHelperLabels(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	ctx := context.Background()
+	srv.AddVolume("cloudcode-home-src", nil)
+
+	var seen []ManagedContainer
+	var listErr error
+	srv.AddHook(func(c dockertest.Call) error {
+		if c.Method == "POST" && path.Base(c.Path) == "wait" {
+			seen, listErr = m.ManagedContainers(ctx)
+		}
+		return nil
+	})
+	if err := m.CopyVolume(ctx, "cloudcode-home-src", "cloudcode-home-dst", "dst", nil); err != nil {
+		t.Fatalf("CopyVolume: %v", err)
+	}
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	if len(seen) != 1 || !seen[0].Helper || seen[0].InstanceID != "dst" {
+		t.Errorf("containers during copy = %+v, want one helper of instance dst", seen)
+	}
+	if cs := srv.Containers(); len(cs) != 0 {
+		t.Errorf("helper left behind: %v", cs)
+	}
+}
+
+func TestCreateContainerBindMounts(t *testing.T) {
+	bind := config.ContainerMount{HostPath: "/srv/projects", ContainerPath: "/work", ReadOnly: true}
+	for _, allow := range []bool{false, true} {
+		m, srv := newTestManager(t, Options{AllowBindMounts: allow})
+		cfg, err := config.NewManager(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.config = cfg
+		inst := &store.Instance{ID: "bm", Name: "bm", Port: 10000, BindMounts: []config.ContainerMount{bind}}
+		if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+			t.Fatalf("CreateContainer: %v", err)
+		}
+		c, _ := srv.Container(ContainerName(inst.ID))
+
+		var targets []string
+		var found *mount.Mount
+		for i, mnt := range c.HostConfig.Mounts {
+			targets = append(targets, mnt.Target)
+			if mnt.Target == bind.ContainerPath {
+				found = &c.HostConfig.Mounts[i]
+			}
+		}
+		// 共享配置目录总是挂载，用户目录只在允许时合并进来
+		if !slices.Contains(targets, "/root") || !slices.Contains(targets, "/root/.config/opencode") {
+			t.Errorf("allow=%v: mounts %v lack the home volume or config mounts", allow, targets)
+		}
+		switch {
+		case !allow && found != nil:
+			t.Errorf("bind mount applied while disabled: %+v", *found)
+		case allow && found == nil:
+			t.Errorf("bind mount missing while enabled: %v", targets)
+		case allow && (found.Type != mount.TypeBind || found.Source != bind.HostPath || !found.ReadOnly):
+			t.Errorf("bind mount = %+v, want read-only bind of %s", *found, bind.HostPath)
+		}
+	}
+}
+
+func TestCreateContainerResources(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	inst := &store.Instance{ID: "res", Name: "res", Port: 10000, MemoryMB: 512, CPUCores: 1.5}
+	if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	c, _ := srv.Container(ContainerName(inst.ID))
+	if got := c.HostConfig.Memory; got != 512*1024*1024 {
+		t.Errorf("Memory = %d, want %d", got, 512*1024*1024)
+	}
+	if got := c.HostConfig.NanoCPUs; got != 1.5e9 {
+		t.Errorf("NanoCPUs = %d, want 1.5e9", got)
+	}
+}
+
+func TestCreateContainerDNS(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	inst := &store.Instance{
+		ID: "dns", Name: "dns", Port: 10000,
+		DNS:        []string{"10.0.0.53", "2001:db8::53"},
+		ExtraHosts: []string{"git.internal:10.0.0.7"},
+	}
+	if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	c, _ := srv.Container(ContainerName(inst.ID))
+	var dns []string
+	for _, addr := range c.HostConfig.DNS {
+		dns = append(dns, addr.String())
+	}
+	if !slices.Equal(dns, inst.DNS) {
+		t.Errorf("DNS = %v, want %v", dns, inst.DNS)
+	}
+	if !slices.Equal(c.HostConfig.ExtraHosts, inst.ExtraHosts) {
+		t.Errorf("ExtraHosts = %v, want %v", c.HostConfig.ExtraHosts, inst.ExtraHosts)
+	}
+}
+
+func TestCreateContainerCommand(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	for _, tc := range []struct {
+		id      string
+		command []string
+	}{
+		{"cmd-custom", []string{"opencode", "serve", "--hostname", "0.0.0.0"}},
+		{"cmd-default", nil}, // 为空时沿用镜像的 CMD
+	} {
+		inst := &store.Instance{ID: tc.id, Name: tc.id, Port: 10000, Command: tc.command}
+		if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+			t.Fatalf("CreateContainer %s: %v", tc.id, err)
+		}
+		c, _ := srv.Container(ContainerName(inst.ID))
+		if !slices.Equal(c.Config.Cmd, tc.command) || (tc.command == nil) != (c.Config.Cmd == nil) {
+			t.Errorf("%s: container Cmd = %q, want %q", tc.id, c.Config.Cmd, tc.command)
+		}
+	}
+}
+
+func TestCreateContainerTagLabels(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	inst := &store.Instance{ID: "tag", Name: "tag", Port: 10000, Tags: []string{"alice", "backend"}}
+	if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	c, _ := srv.Container(ContainerName(inst.ID))
+	var tags []string
+	for k, v := range c.Config.Labels {
+		if tag, ok := strings.CutPrefix(k, "cloudcode.tag."); ok {
+			if v != "true" {
+				t.Errorf("label %s = %q, want true", k, v)
+			}
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	if !slices.Equal(tags, inst.Tags) {
+		t.Errorf("tag labels = %v, want %v", tags, inst.Tags)
+	}
+}
+
+func TestCreateContainerEnvPrecedence(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetEnvVars(map[string]string{"API_KEY": "global", "REGION": "eu"}); err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	inst := &store.Instance{
+		ID: "env", Name: "env", Port: 10000,
+		EnvVars: map[string]string{"API_KEY": "instance", "DEBUG": "1"},
+	}
+	if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	c, _ := srv.Container(ContainerName(inst.ID))
+	got := make(map[string][]string)
+	for _, kv := range c.Config.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		got[k] = append(got[k], v)
+	}
+	// 同名变量只出现一次，且取实例自身的值
+	for k, want := range map[string]string{"API_KEY": "instance", "REGION": "eu", "DEBUG": "1"} {
+		if len(got[k]) != 1 || got[k][0] != want {
+			t.Errorf("%s = %q, want exactly [%q]", k, got[k], want)
+		}
+	}
+}
+
+func TestCreateContainerExtraNetworks(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	ctx := context.Background()
+	if _, err := m.cli.NetworkCreate(ctx, "db-net", client.NetworkCreateOptions{Driver: "bridge"}); err != nil {
+		t.Fatal(err)
+	}
+	inst := &store.Instance{ID: "net", Name: "net", Port: 10000, Networks: []string{"db-net", "tools-net"}}
+	if _, err := m.CreateContainer(ctx, inst, nil); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	c, _ := srv.Container(ContainerName(inst.ID))
+	var got []string
+	for name := range c.NetworkingConfig.EndpointsConfig {
+		got = append(got, name)
+	}
+	slices.Sort(got)
+	// 代理经由 cloudcode-net 访问容器，额外网络不能取代它
+	if want := []string{networkName, "db-net", "tools-net"}; !slices.Equal(got, want) {
+		t.Errorf("endpoints = %v, want %v", got, want)
+	}
+	// 不存在的网络会被创建
+	if _, err := m.cli.NetworkInspect(ctx, "tools-net", client.NetworkInspectOptions{}); err != nil {
+		t.Errorf("tools-net was not created: %v", err)
+	}
+}
+
+func TestNormalizeNetworks(t *testing.T) {
+	got, err := NormalizeNetworks([]string{" tools-net", "db-net", networkName, "", "tools-net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"db-net", "tools-net"}; !slices.Equal(got, want) {
+		t.Errorf("NormalizeNetworks = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"host", "none", "bridge", "-net", "a b"} {
+		if _, err := NormalizeNetworks([]string{bad}); err == nil {
+			t.Errorf("NormalizeNetworks(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCreateContainerCustomImage(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	const custom = "ghcr.io/example/toolchain:1.2"
+	for _, tc := range []struct {
+		id, image, want string
+	}{
+		{"img-custom", custom, custom},
+		{"img-default", "", defaultImage},
+	} {
+		inst := &store.Instance{ID: tc.id, Name: tc.id, Port: 10000, Image: tc.image}
+		if _, err := m.CreateContainer(context.Background(), inst, nil); err != nil {
+			t.Fatalf("CreateContainer %s: %v", tc.id, err)
+		}
+		c, _ := srv.Container(ContainerName(inst.ID))
+		if c.Config.Image != tc.want {
+			t.Errorf("%s: container image = %q, want %q", tc.id, c.Config.Image, tc.want)
+		}
+	}
+	// 只有缺失的自定义镜像被拉取，默认镜像已在本地
+	pulls := srv.Calls("POST", "/images/create")
+	if len(pulls) != 1 || pulls[0].Query.Get("fromImage") != "ghcr.io/example/toolchain" || pulls[0].Query.Get("tag") != "1.2" {
+		t.Errorf("pulls = %+v, want one pull of %s", pulls, custom)
+	}
+}
+
+func TestValidateImageRef(t *testing.T) {
+	for _, ref := range []string{"ubuntu", "ubuntu:24.04", "ghcr.io/org/image:tag", "localhost:5000/img"} {
+		if err := ValidateImageRef(ref); err != nil {
+			t.Errorf("ValidateImageRef(%q) = %v", ref, err)
+		}
+	}
+	for _, ref := range []string{"", "Ubuntu", "ubuntu:", "a b", "img@sha256:xyz"} {
+		if err := ValidateImageRef(ref); err == nil {
+			t.Errorf("ValidateImageRef(%q) succeeded", ref)
+		}
+	}
+}
+
+func TestCreateContainerLabelMerge(t *testing.T) {
+	m, _ := newTestManager(t, Options{})
+	cfg, err := config.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config = cfg
+	inst := &store.Instance{
+		ID: "lbl", Name: "lbl", Port: 10000,
+		Tags: []string{"team-a"},
+		Labels: map[string]string{
+			"traefik.enable":        "true",
+			"com.example.owner":     "alice",
+			"cloudcode.instance-id": "spoofed", // 保留前缀的自定义标签不能覆盖自己的
+		},
+	}
+	cid, err := m.CreateContainer(context.Background(), inst, nil)
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	got, err := m.ContainerLabels(context.Background(), cid)
+	if err != nil {
+		t.Fatalf("ContainerLabels: %v", err)
+	}
+	want := map[string]string{
+		"traefik.enable":        "true",
+		"com.example.owner":     "alice",
+		"cloudcode.managed":     "true",
+		"cloudcode.instance-id": "lbl",
+		"cloudcode.port":        "10000",
+		"cloudcode.tag.team-a":  "true",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("label %s = %q, want %q", k, got[k], v)
+		}
+	}
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("unexpected label %s=%q", k, got[k])
+		}
+	}
+}
+
+func TestValidateLabel(t *testing.T) {
+	for _, key := range []string{"traefik.http.routers.myApp.rule", "com.example/team", "a"} {
+		if err := ValidateLabel(key, "v"); err != nil {
+			t.Errorf("ValidateLabel(%q) = %v", key, err)
+		}
+	}
+	for _, tc := range []struct{ key, value string }{
+		{"cloudcode.managed", "false"},
+		{"-leading", "v"},
+		{"has space", "v"},
+		{"ok", strings.Repeat("x", 1025)},
+	} {
+		if err := ValidateLabel(tc.key, tc.value); err == nil {
+			t.Errorf("ValidateLabel(%q, %d bytes) succeeded", tc.key, len(tc.value))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+)
+
+// maxNetworks bounds how many extra networks an instance may join.
+const maxNetworks = 8
+
+// networkNameRe matches the names Docker accepts for user-defined networks.
+var networkNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// NormalizeNetworks trims and de-duplicates the extra networks of an
+// instance and returns them sorted. cloudcode-net is always joined and is
+// dropped from the list; "host", "none" and "bridge" cannot be combined
+// with it and are rejected, as are invalid names.
+func NormalizeNetworks(names []string) ([]string, error) {
+	out := []string{}
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if n == "" || n == networkName || slices.Contains(out, n) {
+			continue
+		}
+		switch {
+		case n == "host" || n == "none" || n == "bridge":
+			return nil, fmt.Errorf("network %q cannot be joined alongside %s", n, networkName)
+		case !networkNameRe.MatchString(n):
+			return nil, fmt.Errorf("invalid network name %q", n)
+		}
+		out = append(out, n)
+	}
+	if len(out) > maxNetworks {
+		return nil, fmt.Errorf("at most %d networks are allowed", maxNetworks)
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// endpointsConfig returns the networks a container joins: cloudcode-net,
+// through which the reverse proxy reaches it by container name, plus the
+// instance's extra networks.
+func endpointsConfig(extra []string) map[string]*network.EndpointSettings {
+	endpoints := map[string]*network.EndpointSettings{
+		networkName: {},
+	}
+	for _, n := range extra {
+		endpoints[n] = &network.EndpointSettings{}
+	}
+	return endpoints
+}
+
+// ensureExtraNetworks creates the instance's extra networks that do not
+// exist yet as bridge networks, so an instance can name a network shared
+// with containers started later.
+func (m *Manager) ensureExtraNetworks(ctx context.Context, names []string) error {
+	for _, n := range names {
+		_, err := m.cli.NetworkInspect(ctx, n, client.NetworkInspectOptions{})
+		if err == nil {
+			continue
+		}
+		if !cerrdefs.IsNotFound(err) {
+			return fmt.Errorf("inspect network %s: %w", n, err)
+		}
+		if _, err := m.cli.NetworkCreate(ctx, n, client.NetworkCreateOptions{
+			Driver: "bridge",
+			Labels: map[string]string{labelManaged: "true"},
+		}); err != nil && !cerrdefs.IsConflict(err) {
+			return fmt.Errorf("create network %s: %w", n, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Creation phases reported through a ProgressFunc.
+const (
+	PhasePull   = "pull"
+	PhaseCreate = "create"
+	PhaseStart  = "start"
+	PhaseReady  = "ready" // waiting for opencode to answer, reported by the caller
+	PhaseDone   = "done"
+	PhaseError  = "error"
+)
+
+// Progress is one step of container creation. Percent covers the whole
+// flow (0–100), not just the current phase.
+type Progress struct {
+	Phase   string `json:"phase"`
+	Percent int    `json:"percent"`
+	Message string `json:"message"`
+}
+
+// ProgressFunc receives creation progress. It must not block.
+type ProgressFunc func(Progress)
+
+// Share of the overall percentage each phase ends at. StartedPercent is
+// where callers continue once the container runs (e.g. readiness checks).
+const (
+	pullEndPercent   = 60
+	createEndPercent = 70
+	StartedPercent   = 80
+)
+
+func (f ProgressFunc) report(phase string, percent int, format string, args ...any) {
+	if f == nil {
+		return
+	}
+	f(Progress{Phase: phase, Percent: percent, Message: fmt.Sprintf(format, args...)})
+}
+
+// pullMessage is one line of the ImagePull JSON stream.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+type layerProgress struct {
+	current, total int64
+	done           bool
+}
+
+// readPullProgress consumes an ImagePull stream, reporting the download
+// share of all layers seen so far scaled to 0–endPercent, and returns the
+// first error message the daemon sent.
+func readPullProgress(r io.Reader, progress ProgressFunc, endPercent int) error {
+	dec := json.NewDecoder(r)
+	layers := make(map[string]*layerProgress)
+	lastPercent, lastDone := -1, -1
+	for {
+		var msg pullMessage
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read pull stream: %w", err)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		// "Pulling from <repo>" 的 id 是镜像标签而不是层
+		if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from ") {
+			continue
+		}
+		l := layers[msg.ID]
+		if l == nil {
+			l = &layerProgress{}
+			layers[msg.ID] = l
+		}
+		switch msg.Status {
+		case "Downloading":
+			l.current, l.total = msg.ProgressDetail.Current, msg.ProgressDetail.Total
+		case "Download complete", "Pull complete", "Already exists":
+			l.done = true
+		}
+
+		var current, total int64
+		done := 0
+		for _, l := range layers {
+			if l.done {
+				done++
+			}
+			if l.total == 0 {
+				continue
+			}
+			total += l.total
+			if l.done {
+				current += l.total
+			} else {
+				current += l.current
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		// 新出现的层会拉低比例，只向前推进
+		pct := max(int(current*100/total), lastPercent)
+		if pct > lastPercent || done > lastDone {
+			lastPercent, lastDone = pct, done
+			progress.report(PhasePull, pct*endPercent/100, "Pulling image (%d%%, %d/%d layers)", pct, done, len(layers))
+		}
+	}
+}
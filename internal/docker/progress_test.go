@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+// samplePull is an ImagePull stream for a two-layer image, as sent by the
+// daemon.
+const samplePull = `{"status":"Pulling from naiba/cloudcode-base","id":"latest"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"b2"}
+{"status":"Downloading","progressDetail":{"current":50,"total":100},"progress":"[=====>     ]","id":"a1"}
+{"status":"Downloading","progressDetail":{"current":100,"total":300},"id":"b2"}
+{"status":"Download complete","progressDetail":{},"id":"a1"}
+{"status":"Downloading","progressDetail":{"current":300,"total":300},"id":"b2"}
+{"status":"Download complete","progressDetail":{},"id":"b2"}
+{"status":"Extracting","progressDetail":{"current":100,"total":100},"id":"a1"}
+{"status":"Pull complete","progressDetail":{},"id":"a1"}
+{"status":"Pull complete","progressDetail":{},"id":"b2"}
+{"status":"Digest: sha256:0123456789abcdef"}
+{"status":"Status: Downloaded newer image for naiba/cloudcode-base:latest"}
+`
+
+func TestReadPullProgress(t *testing.T) {
+	var got []Progress
+	if err := readPullProgress(strings.NewReader(samplePull), func(p Progress) { got = append(got, p) }, pullEndPercent); err != nil {
+		t.Fatalf("readPullProgress: %v", err)
+	}
+	// 百分比只增不减；第二层出现后整体比例下降时不重复上报
+	want := []Progress{
+		{PhasePull, 30, "Pulling image (50%, 0/2 layers)"},
+		{PhasePull, 30, "Pulling image (50%, 1/2 layers)"},
+		{PhasePull, 60, "Pulling image (100%, 1/2 layers)"},
+		{PhasePull, 60, "Pulling image (100%, 2/2 layers)"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("progress = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("update %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadPullProgressError(t *testing.T) {
+	stream := `{"status":"Pulling fs layer","id":"a1"}
+{"errorDetail":{"message":"pull access denied"},"error":"pull access denied"}
+`
+	err := readPullProgress(strings.NewReader(stream), nil, 100)
+	if err == nil || err.Error() != "pull access denied" {
+		t.Errorf("err = %v, want the daemon's error", err)
+	}
+	if err := readPullProgress(strings.NewReader(`{"status":`), nil, 100); err == nil {
+		t.Error("truncated stream read without error")
+	}
+}
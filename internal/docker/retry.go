@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+const (
+	retryAttempts = 3
+	retryBaseWait = 200 * time.Millisecond
+)
+
+// withRetry runs fn, retrying transient daemon errors (connection refused,
+// timeouts, 5xx unavailable) with jittered exponential backoff. Permanent
+// errors such as a missing container or image are returned immediately.
+// Retries are logged with the logger carried by ctx.
+func withRetry(ctx context.Context, op string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		if err = fn(); err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt == retryAttempts-1 {
+			break
+		}
+		wait := retryBaseWait<<attempt + rand.N(retryBaseWait)
+		logctx.From(ctx).Warn("Docker call failed, retrying", "op", op, "attempt", attempt+1, "of", retryAttempts, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+	return err
+}
+
+// isTransient reports whether a Docker API error is worth retrying.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// 客户端类错误（不存在、冲突、参数错误等）重试也不会成功
+	if cerrdefs.IsNotFound(err) || cerrdefs.IsConflict(err) || cerrdefs.IsInvalidArgument(err) ||
+		cerrdefs.IsAlreadyExists(err) || cerrdefs.IsPermissionDenied(err) || cerrdefs.IsUnauthorized(err) ||
+		cerrdefs.IsNotImplemented(err) || cerrdefs.IsFailedPrecondition(err) {
+		return false
+	}
+	if cerrdefs.IsUnavailable(err) || cerrdefs.IsDeadlineExceeded(err) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "i/o timeout")
+}
@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+func TestWithRetry(t *testing.T) {
+	transient := fmt.Errorf("dial: %w", syscall.ECONNREFUSED)
+	tests := []struct {
+		name      string
+		errs      []error // 依次返回，用完后返回 nil
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", nil, 1, false},
+		{"transient then success", []error{transient, io.ErrUnexpectedEOF}, 3, false},
+		{"transient every time", []error{transient, transient, transient, transient}, retryAttempts, true},
+		{"permanent", []error{errors.New("no such container")}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := withRetry(context.Background(), "test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != tt.wantCalls || (err != nil) != tt.wantErr {
+				t.Errorf("calls = %d, err = %v; want %d calls, error %v", calls, err, tt.wantCalls, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := withRetry(ctx, "test", func() error {
+		calls++
+		cancel()
+		return syscall.ECONNRESET
+	})
+	if calls != 1 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("calls = %d, err = %v; want one call returning the last error", calls, err)
+	}
+}
+
+func TestWithRetryLogsWithContextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil)).With("request_id", "req-1")
+	calls := 0
+	err := withRetry(logctx.With(context.Background(), logger), "create", func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重试记录带着发起请求的 ID
+	if out := buf.String(); !strings.Contains(out, "request_id=req-1") || !strings.Contains(out, "op=create") {
+		t.Errorf("retry log = %q, want it under the request logger", out)
+	}
+}
+
+func TestStartContainerRetriesUnavailableDaemon(t *testing.T) {
+	m, srv := newTestManager(t, Options{})
+	id := srv.AddContainer(dockertest.Container{Name: "flaky", State: container.StateCreated})
+	var failures atomic.Int32
+	srv.AddHook(func(c dockertest.Call) error {
+		if c.Method == "POST" && c.Path == "/containers/"+id+"/start" && failures.Add(1) == 1 {
+			return &dockertest.Error{Status: http.StatusServiceUnavailable, Message: "daemon busy"}
+		}
+		return nil
+	})
+
+	if err := m.StartContainer(context.Background(), "flaky", id); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if n := len(srv.Calls("POST", "/containers/*/start")); n != 2 {
+		t.Errorf("start requests = %d, want 2", n)
+	}
+	if c, _ := srv.Container(id); c.State != container.StateRunning {
+		t.Errorf("state = %s, want running", c.State)
+	}
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// ContainerStats is a compact resource usage sample of one container.
+type ContainerStats struct {
+	Read        time.Time `json:"read"`
+	CPUPercent  float64   `json:"cpu_percent"`  // 100 = one full core
+	MemoryUsage uint64    `json:"memory_usage"` // bytes, excluding page cache
+	MemoryLimit uint64    `json:"memory_limit"` // bytes; the host total when unlimited
+	NetworkRx   uint64    `json:"network_rx"`   // bytes received, all interfaces
+	NetworkTx   uint64    `json:"network_tx"`   // bytes sent, all interfaces
+}
+
+// ParseStats reduces a raw Docker stats sample the way `docker stats` does:
+// CPU percent from the delta to the previous sample, memory without the
+// inactive page cache (cgroup v1 and v2 key names), network summed over
+// interfaces.
+func ParseStats(s container.StatsResponse) ContainerStats {
+	out := ContainerStats{
+		Read:        s.Read,
+		MemoryUsage: s.MemoryStats.Usage,
+		MemoryLimit: s.MemoryStats.Limit,
+	}
+
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	sysDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	cpus := float64(s.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(s.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && sysDelta > 0 {
+		out.CPUPercent = cpuDelta / sysDelta * cpus * 100
+	}
+
+	cache := s.MemoryStats.Stats["total_inactive_file"] // cgroup v1
+	if v, ok := s.MemoryStats.Stats["inactive_file"]; ok && cache == 0 {
+		cache = v // cgroup v2
+	}
+	if cache < out.MemoryUsage {
+		out.MemoryUsage -= cache
+	}
+
+	for _, n := range s.Networks {
+		out.NetworkRx += n.RxBytes
+		out.NetworkTx += n.TxBytes
+	}
+	return out
+}
+
+// ContainerStatsSample takes a single stats sample of a running container.
+// The daemon waits about a second for a previous sample, so the CPU percent
+// is meaningful.
+func (m *Manager) ContainerStatsSample(ctx context.Context, containerID string) (ContainerStats, error) {
+	result, err := m.cli.ContainerStats(ctx, containerID, client.ContainerStatsOptions{IncludePreviousSample: true})
+	if err != nil {
+		return ContainerStats{}, fmt.Errorf("container stats: %w", err)
+	}
+	defer result.Body.Close()
+	var raw container.StatsResponse
+	if err := json.NewDecoder(result.Body).Decode(&raw); err != nil {
+		return ContainerStats{}, fmt.Errorf("decode container stats: %w", err)
+	}
+	return ParseStats(raw), nil
+}
+
+// ContainerStatsStream streams stats samples of a container, about one per
+// second, until ctx is cancelled or the container stops. The channel is
+// closed when the stream ends.
+func (m *Manager) ContainerStatsStream(ctx context.Context, containerID string) (<-chan ContainerStats, error) {
+	result, err := m.cli.ContainerStats(ctx, containerID, client.ContainerStatsOptions{Stream: true})
+	if err != nil {
+		return nil, fmt.Errorf("container stats: %w", err)
+	}
+	ch := make(chan ContainerStats)
+	go func() {
+		defer close(ch)
+		defer result.Body.Close()
+		dec := json.NewDecoder(result.Body)
+		for {
+			var raw container.StatsResponse
+			if err := dec.Decode(&raw); err != nil {
+				return
+			}
+			select {
+			case ch <- ParseStats(raw):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// sampleStats is a stats payload as sent by a cgroup v2 daemon, trimmed to
+// the fields ParseStats reads.
+const sampleStats = `{
+  "read": "2026-03-01T10:00:01.5Z",
+  "preread": "2026-03-01T10:00:00.5Z",
+  "cpu_stats": {
+    "cpu_usage": {"total_usage": 5500000000},
+    "system_cpu_usage": 400000000000,
+    "online_cpus": 4
+  },
+  "precpu_stats": {
+    "cpu_usage": {"total_usage": 5000000000},
+    "system_cpu_usage": 396000000000,
+    "online_cpus": 4
+  },
+  "memory_stats": {
+    "usage": 536870912,
+    "limit": 2147483648,
+    "stats": {"inactive_file": 134217728, "anon": 402653184}
+  },
+  "networks": {
+    "eth0": {"rx_bytes": 1000, "tx_bytes": 2000},
+    "eth1": {"rx_bytes": 30, "tx_bytes": 40}
+  }
+}`
+
+func TestParseStats(t *testing.T) {
+	var raw container.StatsResponse
+	if err := json.Unmarshal([]byte(sampleStats), &raw); err != nil {
+		t.Fatal(err)
+	}
+	got := ParseStats(raw)
+	want := ContainerStats{
+		Read:        time.Date(2026, 3, 1, 10, 0, 1, 5e8, time.UTC),
+		CPUPercent:  50, // 0.5s / 4s × 4 核
+		MemoryUsage: 384 << 20,
+		MemoryLimit: 2 << 30,
+		NetworkRx:   1030,
+		NetworkTx:   2040,
+	}
+	if !got.Read.Equal(want.Read) {
+		t.Errorf("Read = %v, want %v", got.Read, want.Read)
+	}
+	got.Read = want.Read
+	if got != want {
+		t.Errorf("ParseStats = %+v\nwant          %+v", got, want)
+	}
+}
+
+func TestParseStatsCgroupV1(t *testing.T) {
+	var raw container.StatsResponse
+	raw.CPUStats.CPUUsage.TotalUsage = 200
+	raw.CPUStats.CPUUsage.PercpuUsage = []uint64{100, 100} // 旧版本没有 online_cpus
+	raw.CPUStats.SystemUsage = 1000
+	raw.MemoryStats.Usage = 100 << 20
+	raw.MemoryStats.Stats = map[string]uint64{"total_inactive_file": 40 << 20}
+
+	got := ParseStats(raw)
+	if got.CPUPercent != 40 || got.MemoryUsage != 60<<20 {
+		t.Errorf("ParseStats = %+v, want 40%% CPU and 60 MiB", got)
+	}
+}
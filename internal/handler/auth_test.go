@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	for _, base := range []string{"", "/cloudcode"} {
+		_, srv := newTestHandler(t, nil, Options{BasePath: base, AuthUser: "admin", AuthPass: "secret"})
+		tests := []struct {
+			path string
+			auth bool
+			want int
+		}{
+			{base + "/settings/export", false, http.StatusUnauthorized},
+			{base + "/settings/export", true, http.StatusOK},
+			{base + "/healthz", false, http.StatusOK},
+			// opencode 的静态资源走 catch-all，同样需要认证
+			{"/assets/index.js", false, http.StatusUnauthorized},
+			{"/assets/index.js", true, http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.auth {
+				r.SetBasicAuth("admin", "secret")
+			}
+			if got := serve(srv, r).Code; got != tt.want {
+				t.Errorf("base %q: GET %s (auth %v) = %d, want %d", base, tt.path, tt.auth, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestBasicAuthWrongPassword(t *testing.T) {
+	_, srv := newTestHandler(t, nil, Options{AuthUser: "admin", AuthPass: "secret"})
+	r := httptest.NewRequest("GET", "/settings/export", nil)
+	r.SetBasicAuth("admin", "wrong")
+	rec := serve(srv, r)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("missing WWW-Authenticate challenge")
+	}
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/backup"
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// maxImportSize bounds an uploaded platform archive.
+const maxImportSize = 4 << 30
+
+// writeArchive writes a platform archive of the current store and config
+// tree to w.
+func (h *Handler) writeArchive(w http.ResponseWriter) error {
+	tmp, err := os.MkdirTemp("", "cloudcode-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dbPath := filepath.Join(tmp, backup.DBName)
+	if err := h.store.Snapshot(dbPath); err != nil {
+		return err
+	}
+	manifest := backup.Manifest{
+		Format:        backup.FormatVersion,
+		SchemaVersion: store.SchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": backup.FileName(manifest.CreatedAt)}))
+	return backup.Write(w, manifest, dbPath, os.DirFS(h.config.RootDir()))
+}
+
+// handleExport downloads the store and config tree as a platform archive
+// for moving CloudCode to another host.
+func (h *Handler) handleExport(w http.ResponseWriter, r *http.Request) {
+	if err := h.writeArchive(w); err != nil {
+		logctx.From(r.Context()).Error("Export failed", "error", err)
+		// 归档开始写出后无法再改状态码，只有尚未输出时这里才有效
+		writeError(w, r, http.StatusInternalServerError, "Export failed: "+err.Error())
+	}
+}
+
+// handleImport restores a platform archive uploaded as the "archive" form
+// file. It requires confirm=true and, unless force=true, an installation
+// without instances (including the recycle bin). The archive replaces the
+// whole store and config tree; with force the containers of the replaced
+// instances are removed first.
+func (h *Handler) handleImport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	if r.FormValue("confirm") != "true" {
+		writeError(w, r, http.StatusBadRequest, "Import replaces all instances and settings; confirm it to continue")
+		return
+	}
+	active, err := h.store.List()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to list instances")
+		return
+	}
+	deleted, err := h.store.ListDeleted()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to list instances")
+		return
+	}
+	existing := append(active, deleted...)
+	if len(existing) > 0 && r.FormValue("force") != "true" {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("%d instance(s) already exist; import with force to replace them", len(existing)))
+		return
+	}
+
+	file, _, err := r.FormFile("archive")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Missing archive file")
+		return
+	}
+	defer file.Close()
+
+	// 暂存目录放在数据目录下，保证之后可以直接 rename 到位
+	staging, err := os.MkdirTemp(filepath.Dir(h.config.RootDir()), ".import-")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to create staging directory: "+err.Error())
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := backup.Extract(file, staging, func(m backup.Manifest) error {
+		return m.Compatible(store.SchemaVersion)
+	})
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid archive: "+err.Error())
+		return
+	}
+
+	// 被替换的实例不再出现在数据库里，先停掉并删除它们的容器，否则会变成占着端口的孤儿
+	for _, inst := range existing {
+		h.removeReplacedInstance(r.Context(), inst)
+	}
+
+	if err := h.store.ImportFrom(filepath.Join(staging, backup.DBName)); err != nil {
+		logctx.From(r.Context()).Error("Import failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to import database: "+err.Error())
+		return
+	}
+	configDir := filepath.Join(staging, backup.ConfigDir)
+	if _, err := os.Stat(configDir); err == nil {
+		if err := h.config.ReplaceTree(configDir); err != nil {
+			logctx.From(r.Context()).Error("Import failed after the database was replaced", "error", err)
+			writeError(w, r, http.StatusInternalServerError, "Database imported but restoring the config tree failed: "+err.Error())
+			return
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, http.StatusInternalServerError, "Failed to read imported config: "+err.Error())
+		return
+	}
+
+	// 导入的实例占用的端口和代理路由需要重新加载
+	h.OnLeaderElected()
+	logctx.From(r.Context()).Info("Imported platform archive", "created", manifest.CreatedAt.Format(time.RFC3339))
+	h.audit(r.Context(), h.actor(r), "import", "", "archive created "+manifest.CreatedAt.Format(time.RFC3339))
+
+	w.Header().Set("HX-Redirect", h.url("/"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeReplacedInstance detaches an instance that a forced import is
+// about to replace and removes its container (an adopted one is only
+// stopped, like on delete). Home volumes are kept: the archive may hold
+// the same instances. Errors are logged.
+func (h *Handler) removeReplacedInstance(ctx context.Context, inst *store.Instance) {
+	h.cancelOp(inst.ID)
+	h.closeSessions(ctx, inst.ID, "platform import")
+	h.proxy.Unregister(inst.ID)
+	h.forgetVersion(inst.ID)
+	h.portPool.Release(inst.Port)
+	if h.docker != nil {
+		_ = h.removeDeletedContainer(ctx, inst)
+	}
+}
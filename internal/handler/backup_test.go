@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// importRequest builds a POST /settings/import upload of archive.
+func importRequest(t *testing.T, archive []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("archive", "backup.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write(archive)
+	_ = mw.Close()
+	r := httptest.NewRequest("POST", "/settings/import", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestForcedImportRemovesReplacedContainers(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "old", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "old", Name: "old", Status: "running", ContainerID: cid, Port: 10001})
+	h.portPool.MarkUsed(10001)
+
+	// 另一套空的安装导出的归档
+	_, emptyMux := newTestHandler(t, nil, Options{})
+	rec := serve(emptyMux, httptest.NewRequest("GET", "/settings/export", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export status = %d: %s", rec.Code, rec.Body)
+	}
+	archive := rec.Body.Bytes()
+
+	rec = serve(mux, importRequest(t, archive, map[string]string{"confirm": "true"}))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("import without force = %d, want 409", rec.Code)
+	}
+	if _, ok := srv.Container(cid); !ok {
+		t.Fatal("container removed by a refused import")
+	}
+
+	rec = serve(mux, importRequest(t, archive, map[string]string{"confirm": "true", "force": "true"}))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("forced import = %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := srv.Container(cid); ok {
+		t.Error("container of the replaced instance still exists")
+	}
+	if instances, _ := h.store.List(); len(instances) != 0 {
+		t.Errorf("instances after import = %d, want 0", len(instances))
+	}
+	if got := h.portPool.Allocated(); len(got) != 0 {
+		t.Errorf("ports still allocated after import: %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Bulk actions accepted by POST /instances/bulk.
+var bulkActions = map[string]bool{"start": true, "stop": true, "delete": true}
+
+// bulkResult is the outcome of a bulk action on one instance.
+type bulkResult struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleBulkAction applies start, stop or delete to every instance in the
+// repeated "ids" form field. Failures are collected per instance instead
+// of aborting the batch; the summary is rendered as the bulk_result
+// partial for HTMX requests and as JSON otherwise.
+func (h *Handler) handleBulkAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	action := r.FormValue("action")
+	if !bulkActions[action] {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown action %q (expected start, stop or delete)", action))
+		return
+	}
+	ids := r.Form["ids"]
+	if len(ids) == 0 {
+		writeError(w, r, http.StatusBadRequest, "No instances selected")
+		return
+	}
+
+	var results []bulkResult
+	failed := 0
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		res := bulkResult{ID: id}
+		if inst, err := h.store.Get(id); err != nil {
+			res.Error = "instance not found"
+		} else {
+			res.Name = inst.Name
+			switch action {
+			case "start":
+				err = h.startInstance(r.Context(), inst, h.actor(r))
+			case "stop":
+				h.stopInstance(r.Context(), inst, h.actor(r))
+			case "delete":
+				err = h.deleteInstance(r.Context(), inst, h.actor(r))
+			}
+			if err != nil {
+				res.Error = err.Error()
+			}
+		}
+		if res.Error != "" {
+			failed++
+		}
+		results = append(results, res)
+	}
+
+	if r.Header.Get("HX-Request") == "" {
+		writeJSON(w, http.StatusOK, map[string]any{"action": action, "results": results, "failed": failed})
+		return
+	}
+	h.renderPartial(w, r, "bulk_result", map[string]any{
+		"Action":    action,
+		"Results":   results,
+		"Failed":    failed,
+		"Succeeded": len(results) - failed,
+	})
+}
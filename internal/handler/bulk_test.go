@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestBulkActionMixedIDs(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	for _, id := range []string{"b1", "b2"} {
+		cid := addInstanceContainer(srv, id, container.StateRunning)
+		createTestInstance(t, h, &store.Instance{ID: id, Name: id, Status: "running", ContainerID: cid})
+	}
+
+	bulk := func(action string, ids ...string) (results []bulkResult, failed int) {
+		t.Helper()
+		rec := serve(mux, postForm("/instances/bulk", url.Values{"action": {action}, "ids": ids}))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", action, rec.Code, rec.Body)
+		}
+		var body struct {
+			Results []bulkResult `json:"results"`
+			Failed  int          `json:"failed"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Results, body.Failed
+	}
+
+	// 重复的 ID 只处理一次，不存在的 ID 单独报错，不影响其他实例
+	results, failed := bulk("stop", "b1", "missing", "b2", "b1")
+	want := []bulkResult{{ID: "b1", Name: "b1"}, {ID: "missing", Error: "instance not found"}, {ID: "b2", Name: "b2"}}
+	if !slices.Equal(results, want) || failed != 1 {
+		t.Errorf("stop results = %+v (failed %d), want %+v (failed 1)", results, failed, want)
+	}
+	for _, id := range []string{"b1", "b2"} {
+		waitStatus(t, h, id, "stopped")
+	}
+	waitOps(t, h)
+
+	results, failed = bulk("delete", "b2", "gone")
+	if failed != 1 || results[0].Error != "" || results[1].Error == "" {
+		t.Errorf("delete results = %+v (failed %d)", results, failed)
+	}
+	waitCall(t, srv, "DELETE", "/containers/*")
+	if _, err := h.store.Get("b2"); err == nil {
+		t.Error("b2 still listed after bulk delete")
+	}
+	if _, err := h.store.Get("b1"); err != nil {
+		t.Errorf("b1 affected by deleting b2: %v", err)
+	}
+
+	rec := serve(mux, postForm("/instances/bulk", url.Values{"action": {"explode"}, "ids": {"b1"}}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown action: status %d, want 400", rec.Code)
+	}
+}
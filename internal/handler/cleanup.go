@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// CleanupReport lists what CleanupOrphans removed, and what it could not.
+type CleanupReport struct {
+	Containers []string `json:"containers"` // names of removed containers
+	Volumes    []string `json:"volumes"`    // names of removed home volumes
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// CleanupOrphans removes Docker resources left behind by instances that no
+// longer exist, e.g. after a delete that failed halfway: managed containers
+// whose instance ID has no row in the store, then home volumes that belong
+// to no instance and that no container mounts. Instances in the recycle bin
+// still own their container and volume. Helper containers are skipped:
+// they remove themselves when done, and a running one is still copying
+// into a volume. Failures to remove a single resource are collected in
+// the report.
+func (h *Handler) CleanupOrphans(ctx context.Context) (*CleanupReport, error) {
+	if h.docker == nil {
+		return nil, errDockerUnavailable
+	}
+	containers, err := h.docker.ManagedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := h.volumeOwners()
+	if err != nil {
+		return nil, fmt.Errorf("list instances: %w", err)
+	}
+	known := make(map[string]bool, len(owners))
+	for _, o := range owners {
+		known[o.ID] = true
+	}
+
+	report := &CleanupReport{Containers: []string{}, Volumes: []string{}}
+	for _, c := range containers {
+		if c.Helper || known[c.InstanceID] {
+			continue
+		}
+		name := c.Name
+		if name == "" {
+			name = c.ID
+		}
+		if err := h.docker.RemoveContainer(ctx, c.InstanceID, c.ID); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("container %s: %v", name, err))
+			continue
+		}
+		report.Containers = append(report.Containers, name)
+	}
+
+	// 在删除孤立容器之后再列出卷，这样它们挂载的卷也能被清理
+	volumes, err := h.docker.ListVolumes(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, v := range volumes {
+		if _, ok := owners[v.Name]; ok || v.InUse {
+			continue
+		}
+		if err := h.docker.RemoveVolume(ctx, v.Name); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("volume %s: %v", v.Name, err))
+			continue
+		}
+		report.Volumes = append(report.Volumes, v.Name)
+	}
+	return report, nil
+}
+
+// handleCleanup serves POST /settings/cleanup, answering with the
+// CleanupReport as JSON, or as an alert for HTMX.
+func (h *Handler) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	if !h.requireDocker(w, r) {
+		return
+	}
+	report, err := h.CleanupOrphans(r.Context())
+	if err != nil {
+		if r.Header.Get("HX-Request") != "" {
+			writeError(w, r, http.StatusBadGateway, "Cleanup failed: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	if n := len(report.Containers) + len(report.Volumes); n > 0 {
+		logctx.From(r.Context()).Info("Cleanup removed orphaned resources", "containers", len(report.Containers), "volumes", len(report.Volumes))
+		h.audit(r.Context(), h.actor(r), "cleanup", "", strings.Join(slices.Concat(report.Containers, report.Volumes), ","))
+	}
+
+	if r.Header.Get("HX-Request") != "" {
+		h.renderPartial(w, r, "cleanup_result", report)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// addHelperContainer adds a leftover CopyVolume helper of instance id.
+func addHelperContainer(srv *dockertest.Server, id string) string {
+	return srv.AddContainer(dockertest.Container{
+		Name:  "fake_helper_" + id,
+		State: container.StateExited,
+		Config: &container.Config{
+			Image:  testImage,
+			Labels: map[string]string{"cloudcode.managed": "true", "cloudcode.instance-id": id, "cloudcode.helper": "copy-volume"},
+		},
+	})
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	keep := addInstanceContainer(srv, "keep", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "keep", Name: "keep", ContainerID: keep, Port: 10001})
+	addInstanceContainer(srv, "gone", container.StateExited)
+	helper := addHelperContainer(srv, "gone")
+	srv.AddVolume("cloudcode-home-keep", nil)
+	srv.AddVolume("cloudcode-home-gone", nil)
+
+	report, err := h.CleanupOrphans(context.Background())
+	if err != nil {
+		t.Fatalf("CleanupOrphans: %v", err)
+	}
+	if want := []string{docker.ContainerName("gone")}; !slices.Equal(report.Containers, want) {
+		t.Errorf("removed containers = %v, want %v", report.Containers, want)
+	}
+	if want := []string{"cloudcode-home-gone"}; !slices.Equal(report.Volumes, want) {
+		t.Errorf("removed volumes = %v, want %v", report.Volumes, want)
+	}
+	if len(report.Errors) > 0 {
+		t.Errorf("errors: %v", report.Errors)
+	}
+	for _, id := range []string{keep, helper} {
+		if _, ok := srv.Container(id); !ok {
+			t.Errorf("container %s was removed", id)
+		}
+	}
+}
+
+func TestReconcileIgnoresHelpers(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	createTestInstance(t, h, &store.Instance{ID: "clone", Name: "clone", Status: "created", Port: 10001})
+	addHelperContainer(srv, "clone")
+	addHelperContainer(srv, "gone")
+
+	report, err := h.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(report.Recovered) > 0 || len(report.Orphans) > 0 {
+		t.Errorf("helpers reconciled: recovered %v, orphans %v", report.Recovered, report.Orphans)
+	}
+	inst, err := h.store.Get("clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.ContainerID != "" || inst.Status != "created" {
+		t.Errorf("instance = container %q status %q, want no container and created", inst.ContainerID, inst.Status)
+	}
+}
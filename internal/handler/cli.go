@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// cliActor is recorded in the audit log for changes made by the command
+// line subcommands.
+const cliActor = "cli"
+
+// ListInstances returns all instances with their current container status,
+// as shown on the dashboard.
+func (h *Handler) ListInstances() ([]*store.Instance, error) {
+	instances, err := h.store.List()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := h.instanceStatuses()
+	if err != nil {
+		return nil, fmt.Errorf("sync container statuses: %w", err)
+	}
+	for _, inst := range instances {
+		if status, ok := statuses[inst.ID]; ok {
+			inst.Status = status
+		}
+	}
+	return instances, nil
+}
+
+// CreateInstance creates an instance with default settings, as the new
+// instance form does when only the name is filled in. Unlike the form it
+// waits until the container has been created and started. Readiness is not
+// awaited: the instance is left as starting, and a running server marks it
+// running and routes it on its next status sync or reconciliation.
+func (h *Handler) CreateInstance(ctx context.Context, name string) (*store.Instance, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("name is required")
+	}
+	if err := h.checkNameFree(name); err != nil {
+		return nil, err
+	}
+	if err := h.dockerErr(ctx); err != nil {
+		return nil, err
+	}
+	port, err := h.allocatePort(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &store.Instance{
+		ID:          uuid.New().String()[:8],
+		Name:        name,
+		Status:      "created",
+		Port:        port,
+		WorkDir:     store.DefaultWorkDir,
+		EnvVars:     make(map[string]string),
+		StopTimeout: store.DefaultStopTimeout,
+	}
+	if err := h.store.Create(inst); err != nil {
+		h.portPool.Release(port)
+		return nil, fmt.Errorf("create instance: %w", err)
+	}
+	h.audit(ctx, cliActor, "create", inst.ID, inst.Name)
+
+	ctx, finish := h.beginOp(ctx, inst.ID)
+	defer finish()
+	if err := h.createContainer(ctx, inst, nil); err != nil {
+		return inst, err
+	}
+	return inst, nil
+}
+
+// DeleteInstance moves the instance with the given ID or name to the
+// recycle bin, like the dashboard's delete, and waits for its container to
+// be removed.
+func (h *Handler) DeleteInstance(ctx context.Context, idOrName string) (*store.Instance, error) {
+	inst, err := h.lookupInstance(idOrName)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.trashInstance(ctx, inst, cliActor); err != nil {
+		return nil, fmt.Errorf("delete instance: %w", err)
+	}
+	if h.docker != nil {
+		if err := h.removeDeletedContainer(ctx, inst); err != nil {
+			return inst, err
+		}
+	}
+	return inst, nil
+}
+
+// InstanceLogs returns the buffered container output of the instance with
+// the given ID or name. The caller must close the reader.
+func (h *Handler) InstanceLogs(ctx context.Context, idOrName string) (io.ReadCloser, error) {
+	inst, err := h.lookupInstance(idOrName)
+	if err != nil {
+		return nil, err
+	}
+	if inst.ContainerID == "" {
+		return nil, fmt.Errorf("instance %s has no container", inst.Name)
+	}
+	if err := h.dockerErr(ctx); err != nil {
+		return nil, err
+	}
+	return h.docker.ContainerLogs(ctx, inst.ContainerID, "all")
+}
+
+// lookupInstance finds a live instance by ID, then by name.
+func (h *Handler) lookupInstance(idOrName string) (*store.Instance, error) {
+	if inst, err := h.store.Get(idOrName); err == nil {
+		return inst, nil
+	}
+	inst, err := h.store.GetByName(idOrName)
+	if err != nil || inst.DeletedAt != nil {
+		return nil, fmt.Errorf("instance %q not found", idOrName)
+	}
+	return inst, nil
+}
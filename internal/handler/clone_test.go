@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestCloneNameDedup(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	createTestInstance(t, h, &store.Instance{ID: "src", Name: "app", Port: 10001})
+	createTestInstance(t, h, &store.Instance{ID: "taken", Name: "app-copy", Port: 10002})
+
+	for _, want := range []string{"app-copy-2", "app-copy-3"} {
+		rec := serve(mux, httptest.NewRequest("POST", "/instances/src/clone", nil))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("clone status = %d: %s", rec.Code, rec.Body)
+		}
+		if _, err := h.store.GetByName(want); err != nil {
+			t.Errorf("no clone named %s: %v", want, err)
+		}
+	}
+}
+
+func TestCloneResponse(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	createTestInstance(t, h, &store.Instance{ID: "src", Name: "app", Port: 10001})
+
+	// HTMX 表单只跳转，不带行片段
+	r := httptest.NewRequest("POST", "/instances/src/clone", nil)
+	r.Header.Set("HX-Request", "true")
+	rec := serve(mux, r)
+	if rec.Code != http.StatusCreated || rec.Header().Get("HX-Redirect") != "/" || rec.Body.Len() != 0 {
+		t.Errorf("HTMX clone = %d, HX-Redirect %q, body %q; want 201, redirect to / and no body", rec.Code, rec.Header().Get("HX-Redirect"), rec.Body)
+	}
+
+	rec = serve(mux, httptest.NewRequest("POST", "/instances/src/clone", nil))
+	if rec.Code != http.StatusCreated || rec.Header().Get("HX-Redirect") != "" || rec.Body.String() != "instance_row" {
+		t.Errorf("clone = %d, HX-Redirect %q, body %q; want 201 with the row only", rec.Code, rec.Header().Get("HX-Redirect"), rec.Body)
+	}
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+)
+
+// postForm builds a form POST request.
+func postForm(target string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// blockDocker makes fake daemon requests with the given method and path
+// prefix wait until release is called; entered receives once per request.
+func blockDocker(srv *dockertest.Server, method, prefix string) (entered <-chan struct{}, release func()) {
+	ch := make(chan struct{}, 16)
+	gate := make(chan struct{})
+	srv.AddHook(func(c dockertest.Call) error {
+		if c.Method == method && strings.HasPrefix(c.Path, prefix) {
+			ch <- struct{}{}
+			<-gate
+		}
+		return nil
+	})
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(gate) }) }
+}
+
+// waitCall waits until the fake daemon has received a request matching
+// method and pattern, see dockertest.Server.Calls.
+func waitCall(t *testing.T, srv *dockertest.Server, method, pattern string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Calls(method, pattern)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s %s request", method, pattern)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitOps waits until no instance operation is running.
+func waitOps(t *testing.T, h *Handler) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.opsMu.Lock()
+		n := len(h.ops)
+		h.opsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d instance operations still running", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCreateThenDeleteLeavesNoContainer(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+
+	// 创建停在镜像检查处，此时请求已经返回
+	entered, release := blockDocker(srv, "GET", "/images/json")
+	defer release()
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"racy"}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	inst, err := h.store.GetByName("racy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+
+	rec = serve(mux, httptest.NewRequest("DELETE", "/instances/"+inst.ID, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	release()
+	waitOps(t, h)
+
+	if n := len(srv.Calls("POST", "/containers/create")); n != 0 {
+		t.Errorf("container created for a deleted instance (%d create calls)", n)
+	}
+	if cs := srv.Containers(); len(cs) != 0 {
+		t.Errorf("containers left behind: %v", cs)
+	}
+	if _, err := h.store.GetDeleted(inst.ID); err != nil {
+		t.Errorf("instance not in the recycle bin: %v", err)
+	}
+}
+
+func TestCreateRegistersOperationBeforeResponding(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	_, release := blockDocker(srv, "GET", "/images/json")
+	defer release()
+
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"queued"}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	inst, _ := h.store.GetByName("queued")
+	h.opsMu.Lock()
+	_, busy := h.ops[inst.ID]
+	h.opsMu.Unlock()
+	if !busy {
+		t.Error("create operation not registered when the handler returned")
+	}
+	release()
+	waitOps(t, h)
+}
+
+func TestCreateReturnsBeforeContainerCreated(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	entered, release := blockDocker(srv, "GET", "/images/json")
+	defer release()
+
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"slow"}}))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "instance_row" {
+		t.Fatalf("create = %d %q, want 201 with the instance row", rec.Code, rec.Body)
+	}
+	<-entered
+	inst, err := h.store.GetByName("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Status != "created" || inst.ContainerID != "" {
+		t.Errorf("instance = status %q container %q while creating", inst.Status, inst.ContainerID)
+	}
+
+	release()
+	waitOps(t, h)
+	inst, _ = h.store.Get(inst.ID)
+	if inst.ContainerID == "" {
+		t.Errorf("no container after the background create (status %q, error %q)", inst.Status, inst.ErrorMsg)
+	}
+}
+
+func TestParseResourceLimits(t *testing.T) {
+	tests := []struct {
+		memory, cpus string
+		wantMemory   int
+		wantCPUs     float64
+		wantErr      bool
+	}{
+		{"", "", defaultMemoryMB, defaultCPUCores, false},
+		{" ", "", defaultMemoryMB, defaultCPUCores, false},
+		{"0", "0", 0, 0, false}, // 显式 0 表示不限制
+		{"512", "1.5", 512, 1.5, false},
+		{"", "4", defaultMemoryMB, 4, false},
+		{"-1", "", 0, 0, true},
+		{"1.5", "", 0, 0, true},
+		{"", "NaN", 0, 0, true},
+		{"", "-2", 0, 0, true},
+	}
+	for _, tt := range tests {
+		memory, cpus, err := parseResourceLimits(tt.memory, tt.cpus)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseResourceLimits(%q, %q) error = %v, wantErr %v", tt.memory, tt.cpus, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (memory != tt.wantMemory || cpus != tt.wantCPUs) {
+			t.Errorf("parseResourceLimits(%q, %q) = %d, %v; want %d, %v", tt.memory, tt.cpus, memory, cpus, tt.wantMemory, tt.wantCPUs)
+		}
+	}
+}
+
+func TestCreateWithWorkDir(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"wd"}, "work_dir": {"/workspace/app/"}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	waitOps(t, h)
+	inst, err := h.store.GetByName("wd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.WorkDir != "/workspace/app" {
+		t.Errorf("stored WorkDir = %q, want /workspace/app", inst.WorkDir)
+	}
+	c, ok := srv.Container(docker.ContainerName(inst.ID))
+	if !ok {
+		t.Fatal("no container created")
+	}
+	if c.Config.WorkingDir != "/workspace/app" {
+		t.Errorf("container WorkingDir = %q, want /workspace/app", c.Config.WorkingDir)
+	}
+
+	rec = serve(mux, postForm("/instances", url.Values{"name": {"rel"}, "work_dir": {"workspace"}}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("relative work_dir: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestCreateWithCommand(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"cmd"}, "command": {`opencode serve --log-level "debug info"`}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	waitOps(t, h)
+	inst, err := h.store.GetByName("cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"opencode", "serve", "--log-level", "debug info"}
+	if !slices.Equal(inst.Command, want) {
+		t.Errorf("stored Command = %q, want %q", inst.Command, want)
+	}
+	c, ok := srv.Container(docker.ContainerName(inst.ID))
+	if !ok {
+		t.Fatal("no container created")
+	}
+	if !slices.Equal(c.Config.Cmd, want) {
+		t.Errorf("container Cmd = %q, want %q", c.Config.Cmd, want)
+	}
+
+	rec = serve(mux, postForm("/instances", url.Values{"name": {"bad"}, "command": {`opencode "serve`}}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unterminated quote: status = %d, want 400", rec.Code)
+	}
+}
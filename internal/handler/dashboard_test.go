@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNewPager(t *testing.T) {
+	q := url.Values{"q": {"api"}, "page": {"2"}}
+	p := newPager(q, 2, 50, 120)
+	want := pager{
+		Page: 2, Pages: 3, PerPage: 50, Total: 120,
+		FirstURL: "?page=1&q=api",
+		PrevURL:  "?page=1&q=api",
+		NextURL:  "?page=3&q=api",
+	}
+	if p != want {
+		t.Errorf("newPager = %+v\nwant       %+v", p, want)
+	}
+
+	// 最后一页没有下一页；超出范围的页回到最后一页
+	if p := newPager(q, 3, 50, 120); p.NextURL != "" || p.PrevURL != "?page=2&q=api" {
+		t.Errorf("last page = %+v", p)
+	}
+	if p := newPager(q, 9, 50, 120); p.PrevURL != "?page=3&q=api" || p.NextURL != "" {
+		t.Errorf("page past the end = %+v", p)
+	}
+	if p := newPager(url.Values{}, 1, 50, 0); p.Pages != 1 || p.PrevURL != "" || p.NextURL != "" {
+		t.Errorf("empty list = %+v", p)
+	}
+}
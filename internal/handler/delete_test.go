@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestRemoveDeletedAdoptedUsesStopTimeout(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	cid := srv.AddContainer(dockertest.Container{Name: "external", State: container.StateRunning})
+	inst := createTestInstance(t, h, &store.Instance{Name: "adopted", ContainerID: cid, Adopted: true, StopTimeout: 90, Status: "running"})
+
+	if got, want := stopDeadline(inst), 90*time.Second+stopMargin; got != want {
+		t.Errorf("stopDeadline = %v, want %v", got, want)
+	}
+	if err := h.removeDeletedContainer(context.Background(), inst); err != nil {
+		t.Fatalf("removeDeletedContainer: %v", err)
+	}
+	calls := srv.Calls("POST", "/containers/"+cid+"/stop")
+	if len(calls) != 1 {
+		t.Fatalf("stop calls = %d, want 1", len(calls))
+	}
+	if got := calls[0].Query.Get("t"); got != "90" {
+		t.Errorf("stop timeout sent to Docker = %q, want 90", got)
+	}
+	if c, ok := srv.Container(cid); !ok || c.State != container.StateExited {
+		t.Errorf("adopted container should be stopped and kept, got %+v (exists %v)", c.State, ok)
+	}
+}
+
+func TestTrashForgetsOpencodeVersion(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	inst := createTestInstance(t, h, &store.Instance{Name: "versioned", ContainerID: "c1", Port: 10001})
+	h.versions[inst.ID] = cachedVersion{containerID: "c1", version: "1.0.0"}
+
+	if err := h.trashInstance(context.Background(), inst, ""); err != nil {
+		t.Fatalf("trashInstance: %v", err)
+	}
+	if _, ok := h.versions[inst.ID]; ok {
+		t.Error("cached version kept after delete")
+	}
+}
+
+func TestStartThenDeleteLeavesNoContainer(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	inst := createTestInstance(t, h, &store.Instance{Name: "startdel", Port: 10001})
+	h.portPool.MarkUsed(inst.Port)
+
+	// 启动停在镜像检查处之前就可能被删除，两种情况都不能留下容器
+	_, release := blockDocker(srv, "GET", "/images/json")
+	defer release()
+	rec := serve(mux, httptest.NewRequest("POST", "/instances/"+inst.ID+"/start", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start status = %d: %s", rec.Code, rec.Body)
+	}
+	h.opsMu.Lock()
+	_, busy := h.ops[inst.ID]
+	h.opsMu.Unlock()
+	if !busy {
+		t.Error("start operation not registered when the handler returned")
+	}
+	rec = serve(mux, httptest.NewRequest("DELETE", "/instances/"+inst.ID, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	release()
+	waitOps(t, h)
+
+	if cs := srv.Containers(); len(cs) != 0 {
+		t.Errorf("containers left behind: %v", cs)
+	}
+	got, err := h.store.GetDeleted(inst.ID)
+	if err != nil {
+		t.Fatalf("instance not in the recycle bin: %v", err)
+	}
+	if got.Status == "error" || got.ContainerID != "" {
+		t.Errorf("trashed instance rewritten: status %q container %q", got.Status, got.ContainerID)
+	}
+}
+
+func TestQueuedStartCancelledByDelete(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "queued", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "queued", Name: "queued", Port: 10001, Status: "running", ContainerID: cid})
+	h.portPool.MarkUsed(10001)
+
+	// 停止卡在 Docker 中，随后的启动排在它后面
+	entered, release := blockDocker(srv, "POST", "/containers/"+cid+"/stop")
+	defer release()
+	serve(mux, httptest.NewRequest("POST", "/instances/queued/stop", nil))
+	<-entered
+	rec := serve(mux, httptest.NewRequest("POST", "/instances/queued/start", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start status = %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(mux, httptest.NewRequest("DELETE", "/instances/queued", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	release()
+	waitOps(t, h)
+
+	if n := len(srv.Calls("POST", "/containers/*/start")) + len(srv.Calls("POST", "/containers/create")); n != 0 {
+		t.Errorf("queued start ran after the delete (%d start/create calls)", n)
+	}
+	if cs := srv.Containers(); len(cs) != 0 {
+		t.Errorf("containers left behind: %v", cs)
+	}
+	if got, err := h.store.GetDeleted("queued"); err != nil || got.Status == "error" {
+		t.Errorf("trashed instance = %+v, %v; want it deleted and not marked failed", got, err)
+	}
+}
+
+func TestRestoreAfterDelete(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	inst := createTestInstance(t, h, &store.Instance{Name: "back", Port: 10001, Status: "stopped", ContainerID: "c1"})
+	if err := h.trashInstance(context.Background(), inst, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(mux, httptest.NewRequest("POST", "/instances/"+inst.ID+"/restore", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore status = %d: %s", rec.Code, rec.Body)
+	}
+	got, err := h.store.Get(inst.ID)
+	if err != nil {
+		t.Fatalf("instance not restored: %v", err)
+	}
+	if got.Status != "created" || got.ContainerID != "" {
+		t.Errorf("restored instance = status %q container %q, want created without a container", got.Status, got.ContainerID)
+	}
+}
+
+func TestRestoreTakenPortLogsRequestID(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	inst := createTestInstance(t, h, &store.Instance{Name: "moved", Port: 10001, Status: "stopped"})
+	if err := h.trashInstance(context.Background(), inst, ""); err != nil {
+		t.Fatal(err)
+	}
+	// 回收期间端口被其他实例占用
+	h.portPool.MarkUsed(10001)
+	logged := captureLog(t)
+
+	rec := serve(mux, httptest.NewRequest("POST", "/instances/"+inst.ID+"/restore", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore status = %d: %s", rec.Code, rec.Body)
+	}
+	got, err := h.store.Get(inst.ID)
+	if err != nil || got.Port == 10001 {
+		t.Fatalf("restored instance = %+v, %v; want a new port", got, err)
+	}
+	id := rec.Header().Get(requestIDHeader)
+	for _, line := range logged() {
+		if line["msg"] == "Port of restored instance is taken, using another" {
+			if line["request_id"] != id || line["new_port"] != float64(got.Port) {
+				t.Errorf("port line = %v, want request_id %s and new_port %d", line, id, got.Port)
+			}
+			return
+		}
+	}
+	t.Error("taken port not logged")
+}
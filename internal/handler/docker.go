@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors returned by actions that need Docker.
+var (
+	errDockerUnavailable = errors.New("Docker is disabled (CloudCode was started with -no-docker)")
+	errDockerUnreachable = errors.New("Docker daemon unreachable")
+)
+
+// dockerPingTimeout bounds the daemon check done before a Docker action.
+const dockerPingTimeout = 3 * time.Second
+
+// dockerErr reports why Docker cannot be used right now: it is disabled,
+// or the daemon does not answer a ping (e.g. the socket went away while
+// CloudCode was running). It returns nil when Docker is usable.
+func (h *Handler) dockerErr(ctx context.Context) error {
+	if h.docker == nil {
+		return errDockerUnavailable
+	}
+	ctx, cancel := context.WithTimeout(ctx, dockerPingTimeout)
+	defer cancel()
+	if err := h.docker.Ping(ctx); err != nil {
+		return fmt.Errorf("%w: %v", errDockerUnreachable, err)
+	}
+	return nil
+}
+
+// requireDocker responds 503 and returns false when Docker cannot be used,
+// as JSON for /api/ requests and as plain text otherwise, which HTMX shows
+// as an error toast.
+func (h *Handler) requireDocker(w http.ResponseWriter, r *http.Request) bool {
+	err := h.dockerErr(r.Context())
+	if err == nil {
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	} else {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+	}
+	return false
+}
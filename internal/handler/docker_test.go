@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestActionsWithoutDocker(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	createTestInstance(t, h, &store.Instance{ID: "nd", Name: "nd", Port: 10001, Status: "running", ContainerID: "c1"})
+
+	for _, tc := range []struct {
+		method, target, body string
+	}{
+		{"POST", "/instances", url.Values{"name": {"fresh"}, "home_volume": {"shared"}}.Encode()},
+		{"POST", "/instances/nd/start", ""},
+		{"POST", "/instances/nd/stop", ""},
+		{"POST", "/instances/nd/restart", ""},
+		{"POST", "/instances/nd/clone", url.Values{"name": {"copy"}, "with-data": {"true"}}.Encode()},
+		{"GET", "/instances/nd/logs/download", ""},
+		{"GET", "/instances/nd/files/download?path=notes.txt", ""},
+		{"GET", "/instances/nd/files/list", ""},
+		{"POST", "/settings/cleanup", ""},
+		{"POST", "/settings/image/pull", ""},
+		{"GET", "/api/v1/volumes", ""},
+		{"DELETE", "/api/v1/volumes/cloudcode-home-nd", ""},
+		{"POST", "/api/v1/instances/adopt", `{"container":"c1"}`},
+	} {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if strings.HasPrefix(tc.body, "{") {
+				r.Header.Set("Content-Type", "application/json")
+			} else if tc.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rec := serve(mux, r)
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503: %s", rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), errDockerUnavailable.Error()) {
+				t.Errorf("body = %q, want the Docker disabled message", rec.Body)
+			}
+		})
+	}
+
+	// 没有容器的实例停止时只需更新数据库，不依赖 Docker
+	createTestInstance(t, h, &store.Instance{ID: "bare", Name: "bare", Port: 10002, Status: "error"})
+	rec := serve(mux, httptest.NewRequest("POST", "/instances/bare/stop", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("stop without a container: status = %d: %s", rec.Code, rec.Body)
+	}
+	if inst, _ := h.store.Get("bare"); inst.Status != "stopped" {
+		t.Errorf("status after stop = %q, want stopped", inst.Status)
+	}
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestImportInstanceEnvResponse(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	inst := createTestInstance(t, h, &store.Instance{Name: "env", EnvVars: map[string]string{"KEEP": "1"}})
+
+	for _, tt := range []struct {
+		accept, want string
+	}{
+		{"text/html", "env_import_result"},
+		{"application/json", `"imported":["API_KEY"]`},
+		{"", `"malformed":["line 2: expected KEY=VALUE"]`},
+	} {
+		r := postForm("/instances/"+inst.ID+"/env/import", url.Values{"content": {"API_KEY=abc\nbroken"}})
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		rec := serve(mux, r)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("Accept %q: %d %s, want %q", tt.accept, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	got, err := h.store.Get(inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EnvVars["API_KEY"] != "abc" || got.EnvVars["KEEP"] != "1" {
+		t.Errorf("env = %v, want API_KEY merged over KEEP", got.EnvVars)
+	}
+}
+
+func TestSaveEnvVarsValidatesKeys(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+
+	rec := serve(mux, postForm("/settings/env", url.Values{
+		"env_key":   {"API_KEY", "A=B", "1ABC", "_OK2"},
+		"env_value": {"x", "y", "z", "w"},
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	// 所有不合法的变量名一次列出，合法的不在其中
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("body = %q, want a JSON error object", rec.Body)
+	}
+	body := resp["error"]
+	if !strings.Contains(body, `"A=B"`) || !strings.Contains(body, `"1ABC"`) || strings.Contains(body, "API_KEY") || strings.Contains(body, "_OK2") {
+		t.Errorf("error = %q, want both invalid keys listed", body)
+	}
+	if env, _ := h.config.GetEnvVars(); len(env) != 0 {
+		t.Errorf("env saved despite invalid keys: %v", env)
+	}
+
+	rec = serve(mux, postForm("/settings/env", url.Values{
+		"env_key":   {" API_KEY ", "_OK2", ""},
+		"env_value": {"  hello  world  ", "", "dropped"},
+	}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	env, err := h.config.GetEnvVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 2 || env["API_KEY"] != "hello  world" || env["_OK2"] != "" {
+		t.Errorf("env = %q, want API_KEY trimmed and _OK2 empty", env)
+	}
+}
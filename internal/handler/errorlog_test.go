@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// failStarts makes the fake daemon refuse to start containers, after
+// giving each one the output logs.
+func failStarts(srv *dockertest.Server, logs string) {
+	srv.AddHook(func(c dockertest.Call) error {
+		if c.Method == "POST" && strings.HasSuffix(c.Path, "/start") {
+			srv.SetLogs(path.Base(path.Dir(c.Path)), logs)
+			return &dockertest.Error{Status: http.StatusBadRequest, Message: "exec format error"}
+		}
+		return nil
+	})
+}
+
+// capturedErrorLog returns the only error log captured for instance id.
+func capturedErrorLog(t *testing.T, h *Handler, id string) string {
+	t.Helper()
+	logs, err := h.config.ListErrorLogs(id)
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("error logs of %s = %v, %v; want one", id, logs, err)
+	}
+	p, err := h.config.ErrorLogPath(id, logs[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreateStartFailureCapturesLogs(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	failStarts(srv, "panic: bad config\n")
+
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"broken"}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	waitOps(t, h)
+
+	inst, err := h.store.GetByName("broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Status != "error" {
+		t.Fatalf("status = %q, want error", inst.Status)
+	}
+	if _, ok := srv.Container(docker.ContainerName(inst.ID)); ok {
+		t.Error("container that failed to start was not removed")
+	}
+	if got := capturedErrorLog(t, h, inst.ID); !strings.Contains(got, "panic: bad config") {
+		t.Errorf("captured log lacks the container output:\n%s", got)
+	}
+}
+
+func TestRestartFailureCapturesLogs(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	old := addInstanceContainer(srv, "rs", container.StateRunning)
+	srv.SetLogs(old, "old container output\n")
+	createTestInstance(t, h, &store.Instance{ID: "rs", Name: "rs", Status: "running", ContainerID: old, Port: 10001})
+	failStarts(srv, "new container output\n")
+
+	serve(mux, httptest.NewRequest("POST", "/instances/rs/restart", nil))
+	waitCall(t, srv, "POST", "/containers/*/start")
+	waitOps(t, h)
+
+	got := capturedErrorLog(t, h, "rs")
+	if !strings.Contains(got, "new container output") || strings.Contains(got, "old container output") {
+		t.Errorf("captured log is not the recreated container's output:\n%s", got)
+	}
+}
+
+func TestStartFailureLogsRequestID(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "reqid", container.StateExited)
+	createTestInstance(t, h, &store.Instance{ID: "reqid", Name: "reqid", Port: 10001, ContainerID: cid})
+	failStarts(srv, "panic: bad config\n")
+	logged := captureLog(t)
+
+	rec := serve(mux, httptest.NewRequest("POST", "/instances/reqid/start", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start status = %d: %s", rec.Code, rec.Body)
+	}
+	waitOps(t, h)
+
+	// 后台操作中保存错误日志的记录带着发起请求的 ID
+	id := rec.Header().Get(requestIDHeader)
+	for _, line := range logged() {
+		if line["msg"] == "Saved error logs" {
+			if line["request_id"] != id || line["instance"] != "reqid" {
+				t.Errorf("error log line = %v, want request_id %s", line, id)
+			}
+			return
+		}
+	}
+	t.Error("no \"Saved error logs\" line logged")
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestWantsHTML(t *testing.T) {
+	tests := []struct {
+		hx     bool
+		accept string
+		want   bool
+	}{
+		{hx: true, want: true},
+		{hx: true, accept: "application/json", want: true},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: true},
+		{accept: "application/json", want: false},
+		{accept: "application/json, text/html", want: false},
+		{accept: "text/html;q=0.1, application/json", want: true}, // 按顺序，不看 q 值
+		{accept: "*/*", want: false},
+		{accept: "", want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		if tt.hx {
+			r.Header.Set("HX-Request", "true")
+		}
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsHTML(r); got != tt.want {
+			t.Errorf("wantsHTML(hx=%v, Accept=%q) = %v, want %v", tt.hx, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	const msg = `Invalid value "<b>"`
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("HX-Request", "true")
+	rec := httptest.NewRecorder()
+	writeError(rec, r, http.StatusBadRequest, msg)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("HTML status = %d, want 400", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("HTML Content-Type = %q", ct)
+	}
+	if want := `<div class="alert alert-error">Invalid value &#34;&lt;b&gt;&#34;</div>`; rec.Body.String() != want {
+		t.Errorf("HTML body = %q, want %q", rec.Body, want)
+	}
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	writeError(rec, r, http.StatusConflict, msg)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("JSON status = %d, want 409", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("JSON Content-Type = %q", ct)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != msg {
+		t.Errorf("JSON body = %q (%v), want {\"error\": %q}", rec.Body, err, msg)
+	}
+}
+
+func TestActionErrorStatus(t *testing.T) {
+	h, mux := newTestHandler(t, nil, Options{})
+	createTestInstance(t, h, &store.Instance{ID: "ae", Name: "ae", Port: 10001, ContainerID: "c1"})
+	// 未获取的租约：本副本是跟随者
+	follower := h.store.NewLease("leader", "other", time.Minute)
+
+	for _, tc := range []struct {
+		name, target string
+		form         url.Values
+		hx           bool
+		accept       string
+		follower     bool
+		wantStatus   int
+		wantJSON     bool
+	}{
+		{"htmx bad input", "/instances/ae/log-level", url.Values{"log_level": {"loud"}}, true, "", false, http.StatusBadRequest, false},
+		{"browser bad input", "/instances/ae/log-level", url.Values{"log_level": {"loud"}}, false, "text/html,*/*;q=0.8", false, http.StatusBadRequest, false},
+		{"api bad input", "/instances/ae/log-level", url.Values{"log_level": {"loud"}}, false, "application/json", false, http.StatusBadRequest, true},
+		{"script bad input", "/instances/ae/log-level", url.Values{"log_level": {"loud"}}, false, "", false, http.StatusBadRequest, true},
+		{"htmx no docker", "/instances/ae/start", nil, true, "", false, http.StatusServiceUnavailable, false},
+		{"api no docker", "/instances/ae/start", nil, false, "application/json", false, http.StatusServiceUnavailable, true},
+		{"htmx not found", "/instances/missing/start", nil, true, "", false, http.StatusNotFound, false},
+		{"api not found", "/instances/missing/start", nil, false, "application/json", false, http.StatusNotFound, true},
+		{"htmx follower", "/instances/ae/start", nil, true, "", true, http.StatusServiceUnavailable, false},
+		{"api follower", "/instances/ae/start", nil, false, "application/json", true, http.StatusServiceUnavailable, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h.opts.Lease = nil
+			if tc.follower {
+				h.opts.Lease = follower
+			}
+			r := postForm(tc.target, tc.form)
+			if tc.hx {
+				r.Header.Set("HX-Request", "true")
+			}
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			rec := serve(mux, r)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if tc.follower && rec.Header().Get("Retry-After") == "" {
+				t.Error("follower rejection has no Retry-After header")
+			}
+			if tc.wantJSON {
+				var body map[string]string
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == "" {
+					t.Errorf("body = %q, want a JSON error object", rec.Body)
+				}
+			} else if !strings.Contains(rec.Body.String(), `class="alert alert-error"`) {
+				t.Errorf("body = %q, want an alert fragment", rec.Body)
+			}
+		})
+	}
+
+	h.opts.Lease = nil
+
+	// 成功的操作仍然是 200
+	rec := serve(mux, postForm("/instances/ae/log-level", url.Values{"log_level": {"debug"}}))
+	if rec.Code != http.StatusOK {
+		t.Errorf("valid log level: status = %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// eventHeartbeat is how often an idle event stream sends a comment so
+// proxies don't time it out.
+const eventHeartbeat = 15 * time.Second
+
+// instanceEvent is a status change pushed to dashboard clients. Status is
+// "deleted" when the instance was removed.
+type instanceEvent struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// eventHub fans instance status changes out to the /events subscribers.
+type eventHub struct {
+	mu   sync.Mutex
+	last map[string]string // instance ID → last published status
+	subs map[chan instanceEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		last: make(map[string]string),
+		subs: make(map[chan instanceEvent]struct{}),
+	}
+}
+
+// publish sends a status change to all subscribers. Repeated publishes of
+// the same status are dropped; subscribers that fall behind miss events
+// rather than blocking the publisher.
+func (hub *eventHub) publish(id, status string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.last[id] == status {
+		return
+	}
+	if status == "deleted" {
+		delete(hub.last, id)
+	} else {
+		hub.last[id] = status
+	}
+	ev := instanceEvent{ID: id, Status: status}
+	for ch := range hub.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of events and a func to unsubscribe.
+func (hub *eventHub) subscribe() (<-chan instanceEvent, func()) {
+	ch := make(chan instanceEvent, 64)
+	hub.mu.Lock()
+	hub.subs[ch] = struct{}{}
+	hub.mu.Unlock()
+	return ch, func() {
+		hub.mu.Lock()
+		delete(hub.subs, ch)
+		hub.mu.Unlock()
+	}
+}
+
+// saveInstance persists inst and publishes its status to event subscribers
+// if it changed. Nothing is published when the store update fails.
+func (h *Handler) saveInstance(inst *store.Instance) error {
+	if err := h.store.Update(inst); err != nil {
+		return err
+	}
+	h.events.publish(inst.ID, inst.Status)
+	return nil
+}
+
+// handleEvents streams instance status changes to the dashboard as
+// Server-Sent Events ("status" events with an instanceEvent JSON body).
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := h.events.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
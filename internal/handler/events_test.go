@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestEventsStream(t *testing.T) {
+	h, srv := newTestHandler(t, nil, Options{})
+	inst := createTestInstance(t, h, &store.Instance{Name: "events", Port: 10001})
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	inst.Status = "running"
+	h.saveInstance(inst)
+
+	sc := bufio.NewScanner(resp.Body)
+	var lines []string
+	for sc.Scan() && sc.Text() != "" {
+		lines = append(lines, sc.Text())
+	}
+	want := []string{"event: status", `data: {"id":"` + inst.ID + `","status":"running"}`}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("event = %q, want %q", lines, want)
+	}
+	if got, _ := h.store.Get(inst.ID); got.Status != "running" {
+		t.Errorf("stored status = %q, want running", got.Status)
+	}
+}
+
+func TestEventHubDropsRepeats(t *testing.T) {
+	hub := newEventHub()
+	events, cancel := hub.subscribe()
+	defer cancel()
+	hub.publish("a", "running")
+	hub.publish("a", "running")
+	hub.publish("a", "stopped")
+	hub.publish("a", "deleted")
+
+	var got []string
+	for len(events) > 0 {
+		ev := <-events
+		got = append(got, ev.Status)
+	}
+	if want := "running stopped deleted"; strings.Join(got, " ") != want {
+		t.Errorf("events = %v, want %s", got, want)
+	}
+}
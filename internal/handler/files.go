@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// fileUploadResult is the outcome of POST /instances/{id}/files.
+type fileUploadResult struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleUploadFile copies the multipart "file" into the instance container.
+// The "path" field names the target file; when it is empty or ends with
+// "/", the uploaded file name is appended. Relative paths are resolved
+// against /root.
+func (h *Handler) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	htmx := r.Header.Get("HX-Request") != ""
+	fail := func(status int, msg string) {
+		if htmx {
+			h.renderPartial(w, r, "file_upload_result", fileUploadResult{Error: msg})
+			return
+		}
+		writeJSON(w, status, fileUploadResult{Error: msg})
+	}
+
+	inst, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		fail(http.StatusNotFound, "Instance not found")
+		return
+	}
+	if inst.ContainerID == "" {
+		fail(http.StatusBadRequest, "Container not available")
+		return
+	}
+	if err := h.dockerErr(r.Context()); err != nil {
+		fail(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	limit := h.opts.MaxUploadSize
+	tooLarge := fmt.Sprintf("File exceeds the %d MiB upload limit", limit>>20)
+	// 额外留 1 MiB 给 multipart 边界和其他字段
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			fail(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		fail(http.StatusBadRequest, "Invalid upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		fail(http.StatusBadRequest, "Missing file")
+		return
+	}
+	defer file.Close()
+	if header.Size > limit {
+		fail(http.StatusRequestEntityTooLarge, tooLarge)
+		return
+	}
+
+	dest := strings.TrimSpace(r.FormValue("path"))
+	if dest == "" || strings.HasSuffix(dest, "/") {
+		// 浏览器可能带上客户端路径，只取文件名
+		name := path.Base(strings.ReplaceAll(header.Filename, `\`, "/"))
+		if name == "." || name == "/" || name == ".." {
+			fail(http.StatusBadRequest, "Target path is required")
+			return
+		}
+		dest += name
+	}
+	dest, err = docker.ContainerPath(dest)
+	if err != nil {
+		fail(http.StatusBadRequest, "Invalid target path: "+err.Error())
+		return
+	}
+
+	if err := h.docker.CopyToContainer(r.Context(), inst.ContainerID, dest, file, header.Size); err != nil {
+		if errors.Is(err, docker.ErrPathNotFound) {
+			fail(http.StatusNotFound, "Target directory "+path.Dir(dest)+" does not exist")
+			return
+		}
+		logctx.From(r.Context()).Error("Upload failed", "instance", inst.ID, "path", dest, "error", err)
+		fail(http.StatusBadGateway, "Upload failed: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "upload", inst.ID, fmt.Sprintf("%s (%d bytes)", dest, header.Size))
+
+	res := fileUploadResult{Path: dest, Size: header.Size}
+	if htmx {
+		h.renderPartial(w, r, "file_upload_result", res)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleDownloadFile serves ?path= from the instance container: a file as
+// is, a directory as a tar.gz of its tree. Transfers above MaxDownloadSize
+// are refused, up front for files and by aborting the response for
+// directories, whose size is only known while streaming. The copy is tied
+// to the request, so a cancelled download stops reading from Docker.
+func (h *Handler) handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	inst, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Instance not found", http.StatusNotFound)
+		return
+	}
+	if inst.ContainerID == "" {
+		http.Error(w, "Container not available", http.StatusBadRequest)
+		return
+	}
+	if !h.requireDocker(w, r) {
+		return
+	}
+	src, err := docker.ContainerPath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	content, stat, err := h.docker.CopyFromContainer(r.Context(), inst.ContainerID, src)
+	if errors.Is(err, docker.ErrPathNotFound) {
+		http.Error(w, src+" does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer content.Close()
+
+	limit := h.opts.MaxDownloadSize
+	tooLarge := fmt.Sprintf("%s exceeds the %d MiB download limit", src, limit>>20)
+
+	if !stat.Mode.IsDir() {
+		if stat.Size > limit {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Docker 总是返回 tar 流，单个文件需要解包后再发给浏览器
+		tr := tar.NewReader(content)
+		hdr, err := tr.Next()
+		if err != nil || hdr.Typeflag != tar.TypeReg {
+			http.Error(w, src+" is not a regular file", http.StatusBadRequest)
+			return
+		}
+		ctype := mime.TypeByExtension(path.Ext(stat.Name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": stat.Name}))
+		w.Header().Set("Content-Length", strconv.FormatInt(hdr.Size, 10))
+		if _, err := io.Copy(w, tr); err != nil && r.Context().Err() == nil {
+			logctx.From(r.Context()).Error("Error sending file", "instance", inst.ID, "path", src, "error", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": stat.Name + ".tar.gz"}))
+	gz := gzip.NewWriter(w)
+	n, err := io.Copy(gz, io.LimitReader(content, limit+1))
+	if err != nil {
+		if r.Context().Err() == nil {
+			logctx.From(r.Context()).Error("Error sending file", "instance", inst.ID, "path", src, "error", err)
+		}
+		return
+	}
+	if n > limit {
+		logctx.From(r.Context()).Warn("Aborted download", "instance", inst.ID, "path", src, "reason", tooLarge)
+		// 已经开始发送，无法再返回错误状态码；中断连接让客户端得到不完整的下载
+		panic(http.ErrAbortHandler)
+	}
+	if err := gz.Close(); err != nil && r.Context().Err() == nil {
+		logctx.From(r.Context()).Error("Error sending file", "instance", inst.ID, "path", src, "error", err)
+	}
+}
+
+// fileListing is the response of GET /instances/{id}/files/list.
+type fileListing struct {
+	InstanceID string            `json:"-"`
+	Path       string            `json:"path"`
+	Parent     string            `json:"parent,omitempty"`
+	Entries    []docker.DirEntry `json:"entries"`
+	Truncated  bool              `json:"truncated"`
+}
+
+// Join returns the path of the entry name in the listed directory.
+func (l fileListing) Join(name string) string {
+	return path.Join(l.Path, name)
+}
+
+// handleListFiles lists the container directory ?path=, the instance's
+// working directory by default, as JSON or, for HTMX, as the file browser
+// partial. The container must be running.
+func (h *Handler) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	htmx := r.Header.Get("HX-Request") != ""
+	fail := func(status int, msg string) {
+		if htmx {
+			http.Error(w, msg, status)
+			return
+		}
+		writeJSON(w, status, map[string]string{"error": msg})
+	}
+
+	inst, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		fail(http.StatusNotFound, "Instance not found")
+		return
+	}
+	if inst.ContainerID == "" || inst.Status != "running" {
+		fail(http.StatusConflict, "Instance is not running")
+		return
+	}
+	if !h.requireDocker(w, r) {
+		return
+	}
+	dir := strings.TrimSpace(r.URL.Query().Get("path"))
+	if dir == "" {
+		dir = inst.ContainerWorkDir()
+	}
+	if dir != "/" {
+		if dir, err = docker.ContainerPath(dir); err != nil {
+			fail(http.StatusBadRequest, "Invalid path: "+err.Error())
+			return
+		}
+	}
+
+	entries, truncated, err := h.docker.ListContainerDir(r.Context(), inst.ContainerID, dir)
+	switch {
+	case errors.Is(err, docker.ErrPathNotFound):
+		fail(http.StatusNotFound, dir+" does not exist")
+		return
+	case errors.Is(err, docker.ErrNotDirectory):
+		fail(http.StatusBadRequest, dir+" is not a directory")
+		return
+	case err != nil:
+		fail(http.StatusBadGateway, err.Error())
+		return
+	}
+
+	res := fileListing{InstanceID: inst.ID, Path: dir, Entries: entries, Truncated: truncated}
+	if res.Entries == nil {
+		res.Entries = []docker.DirEntry{}
+	}
+	if dir != "/" {
+		res.Parent = path.Dir(dir)
+	}
+	if htmx {
+		h.renderPartial(w, r, "file_browser", res)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestDownloadSingleFile(t *testing.T) {
+	const content = "line one\nline two\n"
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{MaxDownloadSize: 64})
+	cid := srv.AddContainer(dockertest.Container{
+		Name:  docker.ContainerName("dl"),
+		State: container.StateRunning,
+		Files: map[string][]byte{
+			"/root/notes.txt": []byte(content),
+			"/root/big.bin":   make([]byte, 65),
+		},
+	})
+	createTestInstance(t, h, &store.Instance{ID: "dl", Name: "dl", ContainerID: cid})
+
+	// Docker 返回的 tar 被解开，只发送文件本身
+	rec := serve(mux, httptest.NewRequest("GET", "/instances/dl/files/download?path=notes.txt", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Body.String() != content {
+		t.Errorf("body = %q, want %q", rec.Body, content)
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename=notes.txt` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "18" {
+		t.Errorf("Content-Length = %q, want 18", got)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"big.bin", http.StatusRequestEntityTooLarge},
+		{"missing.txt", http.StatusNotFound},
+		{"../etc/passwd", http.StatusBadRequest},
+	} {
+		rec := serve(mux, httptest.NewRequest("GET", "/instances/dl/files/download?path="+tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.path, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
@@ -4,23 +4,36 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"maps"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"github.com/naiba/cloudcode/internal/config"
 	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/metrics"
 	"github.com/naiba/cloudcode/internal/proxy"
+	"github.com/naiba/cloudcode/internal/recording"
 	"github.com/naiba/cloudcode/internal/store"
 )
 
@@ -31,13 +44,299 @@ type Handler struct {
 	config   *config.Manager
 	tmpls    map[string]*template.Template
 	portPool *PortPool
+	opts     Options
+	metrics  *metrics.Registry // handler gauges, see registerMetrics
+
+	opsMu sync.Mutex
+	ops   map[string]*instanceOp
+
+	sweepMu sync.Mutex
+	sweep   *statusSweep
+
+	upgrader websocket.Upgrader
+
+	progress *progressTracker
+	events   *eventHub
+
+	imagePulling atomic.Bool
+
+	readyMu    sync.Mutex
+	readyWatch map[string]*readyWatcher
+	probe      func(ctx context.Context, instanceID string, port int, path string) error // proxy.Probe; replaced in tests
+
+	sessionsMu sync.Mutex
+	sessions   map[string]map[*session]struct{} // instance ID → open log/terminal sessions, see registerSession
+
+	wakeMu sync.Mutex // serializes wakeInstance
+
+	accessMu      sync.Mutex
+	flushedAccess map[string]time.Time // instance ID → access time last written, see FlushAccess
+
+	usageMu sync.Mutex
+	usage   map[string]store.ResourceUsage // instance ID → latest sample, see CollectStats
+
+	versionsMu sync.Mutex
+	versions   map[string]cachedVersion // instance ID → opencode version, see opencodeVersion
+}
+
+// statusCacheTTL is how long a container status sweep is reused. Dashboard
+// loads and per-row polling within this window share one Docker call.
+const statusCacheTTL = 2 * time.Second
+
+// statusSweep is one shared pass over all container states.
+type statusSweep struct {
+	done     chan struct{}
+	statuses map[string]string // instance ID → status
+	err      error
+	at       time.Time
+}
+
+// instanceStatuses returns the Docker status of every instance that has a
+// container. Concurrent callers share one in-flight sweep, and a finished
+// sweep is reused for statusCacheTTL. Changed statuses are persisted by the
+// sweep itself on the leader.
+func (h *Handler) instanceStatuses() (map[string]string, error) {
+	h.sweepMu.Lock()
+	if sw := h.sweep; sw != nil {
+		select {
+		case <-sw.done:
+			if time.Since(sw.at) < statusCacheTTL {
+				h.sweepMu.Unlock()
+				return sw.statuses, sw.err
+			}
+		default:
+			h.sweepMu.Unlock()
+			<-sw.done
+			return sw.statuses, sw.err
+		}
+	}
+	sw := &statusSweep{done: make(chan struct{})}
+	h.sweep = sw
+	h.sweepMu.Unlock()
+
+	sw.statuses, sw.err = h.runStatusSweep()
+	sw.at = time.Now()
+	close(sw.done)
+	return sw.statuses, sw.err
+}
+
+// invalidateStatuses drops the cached status sweep so that the next caller
+// sees a container that was just created, started, stopped or removed
+// instead of its state from up to statusCacheTTL ago.
+func (h *Handler) invalidateStatuses() {
+	// 进行中的扫描可能已读到旧状态，同样不再复用；它的等待者仍会拿到结果
+	h.sweepMu.Lock()
+	h.sweep = nil
+	h.sweepMu.Unlock()
+}
+
+func (h *Handler) runStatusSweep() (map[string]string, error) {
+	if h.docker == nil {
+		return nil, nil
+	}
+	// 共享的扫描不能绑定到某个请求的 context，否则该请求取消会影响所有等待者
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	states, err := h.docker.ContainerStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := h.store.List()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]string, len(instances))
+	changed := make(map[string]string)
+	for _, inst := range instances {
+		if inst.ContainerID == "" {
+			continue
+		}
+		status, ok := states[inst.ContainerID]
+		if !ok {
+			status = "removed"
+		}
+		if status == "running" && h.watchingReady(inst.ID) {
+			// 容器已运行但 opencode 尚未就绪
+			status = "starting"
+		}
+		statuses[inst.ID] = status
+		if status != inst.Status {
+			changed[inst.ID] = status
+		}
+	}
+
+	// 变化的状态在一个事务中写回，避免实例多时逐行写库
+	if len(changed) > 0 && h.isLeader() {
+		if err := h.store.UpdateStatuses(changed); err != nil {
+			log.Printf("Error saving container statuses: %v", err)
+		} else {
+			for _, id := range slices.Sorted(maps.Keys(changed)) {
+				h.events.publish(id, changed[id])
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// instanceOp is an in-flight background container operation (create, start,
+// stop, restart) for one instance.
+type instanceOp struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// beginOp serializes container operations per instance. It waits for any
+// running operation on the same instance, then returns a context that
+// cancelOp can cancel and a finish func that must be called when done.
+// The context keeps the values of parent, such as the request logger, but
+// not its cancellation: operations outlive the request that started them.
+// The status sweep cache is invalidated when an operation begins and ends.
+func (h *Handler) beginOp(parent context.Context, id string) (context.Context, func()) {
+	ctx, wait, finish := h.queueOp(parent, id)
+	wait()
+	return ctx, finish
+}
+
+// queueOp is beginOp for operations that run in the background: the
+// operation is registered right away, behind any already queued for the
+// instance, so a delete that follows the response cancels it. The caller
+// starts the goroutine, which must call wait before touching the container
+// and finish when done. Cancelling a queued operation also cancels the
+// ones ahead of it.
+func (h *Handler) queueOp(parent context.Context, id string) (ctx context.Context, wait, finish func()) {
+	// 新的操作取代尚未完成的就绪等待
+	h.stopReadyWatch(id)
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	op := &instanceOp{done: make(chan struct{})}
+	h.opsMu.Lock()
+	prev := h.ops[id]
+	op.cancel = func() {
+		cancel()
+		if prev != nil {
+			prev.cancel()
+		}
+	}
+	h.ops[id] = op
+	h.opsMu.Unlock()
+	h.invalidateStatuses()
+
+	wait = func() {
+		if prev == nil {
+			return
+		}
+		<-prev.done
+		// 前一个操作可能在结束前开始了就绪等待
+		h.stopReadyWatch(id)
+	}
+	finish = func() {
+		h.opsMu.Lock()
+		if h.ops[id] == op {
+			delete(h.ops, id)
+		}
+		h.opsMu.Unlock()
+		cancel()
+		h.invalidateStatuses()
+		close(op.done)
+	}
+	return ctx, wait, finish
+}
+
+// cancelOp cancels the running operation (and readiness watch) for an
+// instance, if any, and returns a channel that is closed once it has finished.
+func (h *Handler) cancelOp(id string) <-chan struct{} {
+	h.stopReadyWatch(id)
+	h.opsMu.Lock()
+	defer h.opsMu.Unlock()
+	if op, ok := h.ops[id]; ok {
+		op.cancel()
+		return op.done
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// Options holds tunables for the handler. Zero values select the defaults.
+type Options struct {
+	// CookieTTL is how long the _cc_inst routing cookie stays valid without
+	// a request to the instance.
+	CookieTTL time.Duration
+	// PublicStatus exposes a read-only GET /status page listing instance
+	// names and states. It is meant to be reachable without authentication.
+	PublicStatus bool
+	// Lease, when set, is the leader lease shared by replicas of one
+	// database. Only the holder performs mutations; followers serve the UI
+	// read-only. nil means a single replica that is always the leader.
+	Lease *store.Lease
+	// AllowedSysctls lists the kernel parameters instances may set. Entries
+	// ending in ".*" allow a whole namespace (e.g. "net.ipv4.*"). Empty
+	// disables per-instance sysctls.
+	AllowedSysctls []string
+	// BasePath mounts the platform under a URL prefix such as "/cloudcode".
+	// Empty serves from the root. See Mount.
+	BasePath string
+	// EnableGPU allows instances to request NVIDIA GPUs.
+	EnableGPU bool
+	// AllowBindMounts lets instances mount host directories. Paths are
+	// checked by config.ValidateBindMounts; anyone with access to the UI can
+	// still read and write everything else the Docker daemon can reach.
+	AllowBindMounts bool
+	// WSAllowedOrigins lists extra origins (e.g. "https://ide.example.com")
+	// allowed to open WebSockets besides the serving host itself.
+	WSAllowedOrigins []string
+	// WSAllowAnyOrigin disables the WebSocket origin check (development only).
+	WSAllowAnyOrigin bool
+	// PortStart and PortEnd bound the instance port pool (inclusive).
+	// An unset or empty range selects 10000-10100.
+	PortStart int
+	PortEnd   int
+	// ReadyTimeout is how long a started instance may take to answer on its
+	// opencode port before it is marked running anyway, with a warning in the
+	// log. 0 selects 10 minutes.
+	ReadyTimeout time.Duration
+	// ReadyPath is the opencode path probed for readiness; any non-5xx
+	// response counts as ready. Empty selects "/".
+	ReadyPath string
+	// AuthUser and AuthPass, when both set, protect every route except the
+	// instance proxy (and the public status page) with HTTP basic auth.
+	AuthUser string
+	AuthPass string
+	// StopOnExit makes Shutdown stop all running instance containers.
+	// By default they keep running when CloudCode exits.
+	StopOnExit bool
+	// MaxUploadSize caps files uploaded into containers, in bytes. 0
+	// selects 100 MiB.
+	MaxUploadSize int64
+	// MaxDownloadSize caps files and directory archives downloaded from
+	// containers, in bytes. 0 selects 1 GiB.
+	MaxDownloadSize int64
+	// IdleTimeout is how long a running instance may go without proxy
+	// traffic before StopIdleInstances stops it. 0 disables idle stops.
+	IdleTimeout time.Duration
+	// WakeOnTraffic starts a stopped instance when a proxied request for
+	// it arrives; the client gets the waiting page meanwhile.
+	WakeOnTraffic bool
 }
 
-// PortPool allocates ports for new instances.
+const defaultCookieTTL = 30 * time.Minute
+
+const (
+	defaultMaxUploadSize   = 100 << 20
+	defaultMaxDownloadSize = 1 << 30
+)
+
+// Default instance port range.
+const (
+	defaultPortStart = 10000
+	defaultPortEnd   = 10100
+)
+
+// PortPool allocates ports for new instances. It is safe for concurrent use.
 type PortPool struct {
+	mu    sync.Mutex
 	start int
 	end   int
-	used  map[int]bool
+	used  map[int]time.Time // port → when it was marked used
 }
 
 // NewPortPool creates a port pool with the given range.
@@ -45,15 +344,17 @@ func NewPortPool(start, end int) *PortPool {
 	return &PortPool{
 		start: start,
 		end:   end,
-		used:  make(map[int]bool),
+		used:  make(map[int]time.Time),
 	}
 }
 
 // Allocate returns the next available port.
 func (pp *PortPool) Allocate() (int, error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
 	for p := pp.start; p <= pp.end; p++ {
-		if !pp.used[p] {
-			pp.used[p] = true
+		if _, ok := pp.used[p]; !ok {
+			pp.used[p] = time.Now()
 			return p, nil
 		}
 	}
@@ -62,22 +363,137 @@ func (pp *PortPool) Allocate() (int, error) {
 
 // Release frees a port.
 func (pp *PortPool) Release(port int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
 	delete(pp.used, port)
 }
 
-// MarkUsed marks a port as used.
-func (pp *PortPool) MarkUsed(port int) {
-	pp.used[port] = true
+// Allocated returns the ports currently in use, sorted.
+func (pp *PortPool) Allocated() []int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return slices.Sorted(maps.Keys(pp.used))
+}
+
+// Size returns the number of ports in the range.
+func (pp *PortPool) Size() int {
+	return pp.end - pp.start + 1
+}
+
+// InUse returns how many ports of the range are in use. Ports outside the
+// range marked by ReconcilePorts are not counted.
+func (pp *PortPool) InUse() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	n := 0
+	for p := range pp.used {
+		if p >= pp.start && p <= pp.end {
+			n++
+		}
+	}
+	return n
+}
+
+// MarkUsed marks a port as used. It reports whether the port was free.
+func (pp *PortPool) MarkUsed(port int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if _, ok := pp.used[port]; ok {
+		return false
+	}
+	pp.used[port] = time.Now()
+	return true
+}
+
+// ReleaseUnheld frees every port that is not in held and was marked used
+// before cutoff, and returns the freed ports sorted. Ports marked since
+// cutoff are kept: they may belong to an instance that is not stored yet.
+func (pp *PortPool) ReleaseUnheld(held map[int]bool, cutoff time.Time) []int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	var freed []int
+	for p, at := range pp.used {
+		if !held[p] && at.Before(cutoff) {
+			delete(pp.used, p)
+			freed = append(freed, p)
+		}
+	}
+	slices.Sort(freed)
+	return freed
+}
+
+// allocatePort allocates an instance port, logging what is held when the
+// range is exhausted so an operator can see what to free or widen.
+func (h *Handler) allocatePort(ctx context.Context) (int, error) {
+	port, err := h.portPool.Allocate()
+	if err != nil {
+		logctx.From(ctx).Error("Port allocation failed", "error", err, "allocated", h.portPool.Allocated())
+	}
+	return port, err
+}
+
+// portSource reports ports held by containers. *docker.Manager implements it.
+type portSource interface {
+	ContainerPorts(ctx context.Context) ([]int, error)
+}
+
+// ReconcilePorts marks every port still held by a container as used, so a
+// port of an orphaned or stopped container missing from the store is
+// never handed out again. Ports outside the pool range are ignored by
+// Allocate anyway. It returns the ports that were newly marked.
+func (h *Handler) ReconcilePorts(ctx context.Context, src portSource) ([]int, error) {
+	ports, err := src.ContainerPorts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list container ports: %w", err)
+	}
+	var marked []int
+	for _, p := range ports {
+		if h.portPool.MarkUsed(p) {
+			marked = append(marked, p)
+		}
+	}
+	return marked, nil
 }
 
-func New(s *store.Store, dm *docker.Manager, rp *proxy.ReverseProxy, cfgMgr *config.Manager, tmpls map[string]*template.Template) *Handler {
+func New(s *store.Store, dm *docker.Manager, rp *proxy.ReverseProxy, cfgMgr *config.Manager, tmpls map[string]*template.Template, opts Options) *Handler {
+	if opts.CookieTTL <= 0 {
+		opts.CookieTTL = defaultCookieTTL
+	}
+	if opts.PortStart <= 0 || opts.PortEnd < opts.PortStart {
+		opts.PortStart, opts.PortEnd = defaultPortStart, defaultPortEnd
+	}
+	if !strings.HasPrefix(opts.ReadyPath, "/") {
+		opts.ReadyPath = "/" + opts.ReadyPath
+	}
+	if opts.MaxUploadSize <= 0 {
+		opts.MaxUploadSize = defaultMaxUploadSize
+	}
+	if opts.MaxDownloadSize <= 0 {
+		opts.MaxDownloadSize = defaultMaxDownloadSize
+	}
+
 	h := &Handler{
 		store:    s,
 		docker:   dm,
 		proxy:    rp,
 		config:   cfgMgr,
 		tmpls:    tmpls,
-		portPool: NewPortPool(10000, 10100),
+		portPool: NewPortPool(opts.PortStart, opts.PortEnd),
+		opts:     opts,
+		ops:      make(map[string]*instanceOp),
+		progress: newProgressTracker(),
+		events:   newEventHub(),
+
+		readyWatch: make(map[string]*readyWatcher),
+		probe:      proxy.Probe,
+		sessions:   make(map[string]map[*session]struct{}),
+		versions:   make(map[string]cachedVersion),
+
+		flushedAccess: make(map[string]time.Time),
+	}
+	h.upgrader = websocket.Upgrader{CheckOrigin: h.checkWSOrigin}
+	if opts.WakeOnTraffic {
+		rp.SetWake(func(id string) { h.wakeInstance(context.Background(), id) })
 	}
 
 	// Load existing instances and mark their ports as used
@@ -87,16 +503,62 @@ func New(s *store.Store, dm *docker.Manager, rp *proxy.ReverseProxy, cfgMgr *con
 			if inst.Port > 0 {
 				h.portPool.MarkUsed(inst.Port)
 			}
+			if inst.Adopted && inst.ContainerID != "" && dm != nil {
+				dm.TrackAdopted(inst.ContainerID, inst.ID)
+			}
 			// Register proxy for running instances
 			if inst.Status == "running" && inst.Port > 0 {
-				_ = rp.Register(inst.ID, inst.Port)
+				_ = h.registerProxy(inst)
 			}
 		}
 	}
 
+	h.registerMetrics()
+
+	// 数据库之外仍被容器占用的端口（如孤儿容器）也不能再分配
+	if dm != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if marked, err := h.ReconcilePorts(ctx, dm); err != nil {
+			log.Printf("Warning: could not reconcile ports with Docker: %v", err)
+		} else if len(marked) > 0 {
+			log.Printf("Reserved ports held by containers not in the store: %v", marked)
+		}
+		cancel()
+	}
+
 	return h
 }
 
+// url prefixes a platform path with the configured base path.
+func (h *Handler) url(path string) string {
+	return h.opts.BasePath + path
+}
+
+// Mount wraps a mux built by RegisterRoutes so the platform is served under
+// Options.BasePath, behind basic auth when configured, with every request
+// logged under a request ID. Requests outside the base path still reach
+// the catch-all proxy: opencode's Web UI loads its assets from absolute
+// root paths.
+func (h *Handler) Mount(mux *http.ServeMux) http.Handler {
+	root := h.requireBasicAuth(mux)
+	base := h.opts.BasePath
+	if base == "" {
+		return h.logRequests(root)
+	}
+	stripped := http.StripPrefix(base, root)
+	catchAll := h.requireBasicAuth(http.HandlerFunc(h.handleCatchAll))
+	return h.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == base:
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			catchAll.ServeHTTP(w, r)
+		}
+	}))
+}
+
 // RegisterRoutes sets up all HTTP routes.
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	// Static files
@@ -108,29 +570,82 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	})
 
 	mux.HandleFunc("GET /{$}", h.handleDashboard)
+	mux.HandleFunc("GET /events", h.handleEvents)
+	mux.HandleFunc("GET /healthz", h.handleHealthz)
+	mux.HandleFunc("GET /readyz", h.handleReadyz)
+	if h.opts.PublicStatus {
+		mux.HandleFunc("GET /status", h.handlePublicStatus)
+	}
 	mux.HandleFunc("GET /instances/new", h.handleNewInstanceForm)
+	mux.HandleFunc("GET /audit", h.handleAuditPage)
 	mux.HandleFunc("GET /settings", h.handleSettings)
-	mux.HandleFunc("POST /settings/env", h.handleSaveEnvVars)
+	mux.HandleFunc("POST /settings/env", h.leaderOnly(h.handleSaveEnvVars))
+	mux.HandleFunc("POST /settings/env/import", h.leaderOnly(h.handleImportEnvVars))
+	mux.HandleFunc("GET /settings/validate", h.handleValidateSettings)
+	mux.HandleFunc("GET /settings/export", h.handleExport)
+	mux.HandleFunc("POST /settings/import", h.leaderOnly(h.handleImport))
+	mux.HandleFunc("POST /settings/cleanup", h.leaderOnly(h.handleCleanup))
+	mux.HandleFunc("GET /settings/image", h.handleImageSettings)
+	mux.HandleFunc("POST /settings/image/pull", h.leaderOnly(h.handleImagePull))
+	mux.HandleFunc("GET /settings/image/pull/ws", h.handleImagePullWS)
 	mux.HandleFunc("GET /settings/file", h.handleGetConfigFile)
-	mux.HandleFunc("POST /settings/file", h.handleSaveConfigFile)
+	mux.HandleFunc("POST /settings/file", h.leaderOnly(h.handleSaveConfigFile))
 	mux.HandleFunc("GET /settings/dir-files", h.handleListDirFiles)
-	mux.HandleFunc("POST /settings/dir-file", h.handleSaveDirFile)
-	mux.HandleFunc("DELETE /settings/dir-file", h.handleDeleteDirFile)
-	mux.HandleFunc("DELETE /settings/agents-skill", h.handleDeleteAgentsSkill)
+	mux.HandleFunc("POST /settings/dir-file", h.leaderOnly(h.handleSaveDirFile))
+	mux.HandleFunc("DELETE /settings/dir-file", h.leaderOnly(h.handleDeleteDirFile))
+	mux.HandleFunc("DELETE /settings/agents-skill", h.leaderOnly(h.handleDeleteAgentsSkill))
 
 	// Instance CRUD (HTMX endpoints)
-	mux.HandleFunc("POST /instances", h.handleCreateInstance)
+	mux.HandleFunc("POST /instances", h.leaderOnly(h.handleCreateInstance))
 	mux.HandleFunc("GET /instances/{id}", h.handleGetInstance)
-	mux.HandleFunc("DELETE /instances/{id}", h.handleDeleteInstance)
+	mux.HandleFunc("DELETE /instances/{id}", h.leaderOnly(h.handleDeleteInstance))
+	mux.HandleFunc("GET /instances/{id}/delete-preview", h.handleDeletePreview)
+	mux.HandleFunc("POST /instances/{id}/restore", h.leaderOnly(h.handleRestoreInstance))
+	mux.HandleFunc("DELETE /instances/{id}/purge", h.leaderOnly(h.handlePurgeInstance))
 
 	// Instance actions
-	mux.HandleFunc("POST /instances/{id}/start", h.handleStartInstance)
-	mux.HandleFunc("POST /instances/{id}/stop", h.handleStopInstance)
-	mux.HandleFunc("POST /instances/{id}/restart", h.handleRestartInstance)
+	mux.HandleFunc("POST /instances/bulk", h.leaderOnly(h.handleBulkAction))
+	mux.HandleFunc("POST /instances/{id}/start", h.leaderOnly(h.handleStartInstance))
+	mux.HandleFunc("POST /instances/{id}/stop", h.leaderOnly(h.handleStopInstance))
+	mux.HandleFunc("POST /instances/{id}/restart", h.leaderOnly(h.handleRestartInstance))
+	mux.HandleFunc("POST /instances/{id}/clone", h.leaderOnly(h.handleCloneInstance))
+	mux.HandleFunc("POST /instances/{id}/env", h.leaderOnly(h.handleSaveInstanceEnv))
+	mux.HandleFunc("POST /instances/{id}/env/import", h.leaderOnly(h.handleImportInstanceEnv))
+	mux.HandleFunc("POST /instances/{id}/proxy-headers", h.leaderOnly(h.handleSaveProxyHeaders))
+	mux.HandleFunc("POST /instances/{id}/labels", h.leaderOnly(h.handleSaveLabels))
+	mux.HandleFunc("POST /instances/{id}/log-level", h.leaderOnly(h.handleSetLogLevel))
+	mux.HandleFunc("POST /instances/{id}/tags", h.leaderOnly(h.handleSaveTags))
+	mux.HandleFunc("POST /instances/{id}/sysctls", h.leaderOnly(h.handleSaveSysctls))
+	mux.HandleFunc("POST /instances/{id}/dns", h.leaderOnly(h.handleSaveDNS))
+	mux.HandleFunc("POST /instances/{id}/mounts", h.leaderOnly(h.handleSaveBindMounts))
+	mux.HandleFunc("POST /instances/{id}/stop-signal", h.leaderOnly(h.handleSetStopSignal))
+	mux.HandleFunc("POST /instances/{id}/stop-timeout", h.leaderOnly(h.handleSetStopTimeout))
+	mux.HandleFunc("POST /instances/{id}/cpuset", h.leaderOnly(h.handleSetCpuset))
 	mux.HandleFunc("GET /instances/{id}/logs/ws", h.handleLogsWS)
+	mux.HandleFunc("GET /instances/{id}/logs/download", h.handleLogsDownload)
+	mux.HandleFunc("GET /instances/{id}/stats/ws", h.handleStatsWS)
+	mux.HandleFunc("GET /instances/{id}/progress/ws", h.handleInstanceProgressWS)
 	mux.HandleFunc("GET /instances/{id}/status", h.handleInstanceStatus)
+	mux.HandleFunc("GET /instances/{id}/opencode-version", h.handleOpencodeVersion)
+	mux.HandleFunc("GET /instances/{id}/error-logs/{name}", h.handleErrorLog)
+	mux.HandleFunc("POST /instances/{id}/files", h.leaderOnly(h.handleUploadFile))
+	mux.HandleFunc("GET /instances/{id}/files/download", h.handleDownloadFile)
+	mux.HandleFunc("GET /instances/{id}/files/list", h.handleListFiles)
 	mux.HandleFunc("GET /instances/{id}/terminal", h.handleTerminalPage)
 	mux.HandleFunc("GET /instances/{id}/terminal/ws", h.handleTerminalWS)
+	mux.HandleFunc("GET /instances/{id}/terminal/recordings", h.handleRecordings)
+	mux.HandleFunc("GET /instances/{id}/terminal/recordings/{name}", h.handleRecording)
+
+	// JSON API
+	mux.Handle("GET /metrics", metrics.Handler(metrics.Default, h.metrics))
+	mux.HandleFunc("GET /api/v1/audit", h.handleAuditAPI)
+	mux.HandleFunc("GET /api/v1/diagnostics", h.handleDiagnostics)
+	mux.HandleFunc("GET /api/v1/instances/status", h.handleBatchStatus)
+	mux.HandleFunc("GET /api/v1/instances/{id}/ready", h.handleInstanceReady)
+	mux.HandleFunc("GET /api/v1/instances/{id}/progress", h.handleInstanceProgress)
+	mux.HandleFunc("POST /api/v1/instances/adopt", h.leaderOnly(h.handleAdoptInstance))
+	mux.HandleFunc("GET /api/v1/volumes", h.handleListVolumes)
+	mux.HandleFunc("DELETE /api/v1/volumes/{name}", h.leaderOnly(h.handleDeleteVolume))
 
 	// Reverse proxy to opencode web UI
 	mux.HandleFunc("/instance/{id}/", h.handleProxy)
@@ -139,30 +654,332 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/", h.handleCatchAll)
 }
 
-// --- Page handlers ---
+// isLeader reports whether this replica may mutate shared state.
+func (h *Handler) isLeader() bool {
+	return h.opts.Lease == nil || h.opts.Lease.Held()
+}
 
-func (h *Handler) handleDashboard(w http.ResponseWriter, r *http.Request) {
+// leaderOnly rejects mutating requests on follower replicas.
+func (h *Handler) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isLeader() {
+			w.Header().Set("Retry-After", "5")
+			writeError(w, r, http.StatusServiceUnavailable, "This replica is read-only; another CloudCode replica holds the leader lease")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// OnLeaderElected reloads state that only the leader relies on, since the
+// previous leader may have created or deleted instances in the meantime.
+func (h *Handler) OnLeaderElected() {
 	instances, err := h.store.List()
 	if err != nil {
-		http.Error(w, "Failed to list instances", http.StatusInternalServerError)
+		log.Printf("Reload instances after election: %v", err)
 		return
 	}
+	for _, inst := range instances {
+		if inst.Port > 0 {
+			h.portPool.MarkUsed(inst.Port)
+		}
+		if inst.Status == "running" && inst.Port > 0 {
+			_ = h.registerProxy(inst)
+		}
+	}
+}
+
+// ReconcileReport summarizes what one Reconcile pass changed.
+type ReconcileReport struct {
+	StatusUpdated []string // instance IDs whose status changed
+	Recovered     []string // instance IDs whose container ID was recovered from labels
+	Removed       []string // instance IDs whose container is gone and will be recreated on start
+	Orphans       []string // managed containers with no instance row
+	PortsMarked   []int    // instance ports missing from the port pool
+	PortsReleased []int    // leaked ports held by no instance or container
+}
+
+// portReleaseGrace keeps a port allocated this recently out of Reconcile's
+// leak release: it may belong to an instance being created that is not in
+// the store yet.
+const portReleaseGrace = time.Minute
+
+// Reconcile does a full pass matching managed containers (by label) against
+// the store: it corrects statuses, recovers container IDs lost by an
+// interrupted create, logs orphaned containers, fixes proxy registrations
+// and marks instance ports in the pool. Ports the pool holds for no
+// instance and no container, e.g. left by a create that failed before
+// storing its row, are released. An instance whose container has
+// disappeared is marked "removed" and loses its container ID, so the next
+// start recreates it; adopted containers keep theirs since CloudCode
+// cannot recreate them. Instances with an operation in flight are
+// skipped, and so are helper containers. Followers only fix their local
+// proxy routes.
+func (h *Handler) Reconcile(ctx context.Context) (*ReconcileReport, error) {
+	if h.docker == nil {
+		return nil, fmt.Errorf("docker is not available")
+	}
+	// 在读取实例之前取截止时间，之后分配的端口可能还没写入数据库
+	cutoff := time.Now().Add(-portReleaseGrace)
+	containers, err := h.docker.ManagedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := h.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("list instances: %w", err)
+	}
+
+	byInstance := make(map[string]docker.ManagedContainer, len(containers))
+	for _, c := range containers {
+		if c.Helper {
+			// 复制卷等辅助容器属于实例但不是它的容器
+			continue
+		}
+		// 同一实例出现多个容器时优先取运行中的那个
+		if prev, ok := byInstance[c.InstanceID]; !ok || (prev.State != "running" && c.State == "running") {
+			byInstance[c.InstanceID] = c
+		}
+	}
+
+	report := &ReconcileReport{}
+	leader := h.isLeader()
+	known := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		known[inst.ID] = true
+		if inst.Port > 0 && h.portPool.MarkUsed(inst.Port) {
+			report.PortsMarked = append(report.PortsMarked, inst.Port)
+		}
+
+		h.opsMu.Lock()
+		_, busy := h.ops[inst.ID]
+		h.opsMu.Unlock()
+		if busy || h.watchingReady(inst.ID) {
+			continue
+		}
+
+		changed := false
+		status := inst.Status
+		if c, ok := byInstance[inst.ID]; ok {
+			if inst.ContainerID != c.ID {
+				inst.ContainerID = c.ID
+				report.Recovered = append(report.Recovered, inst.ID)
+				changed = true
+			}
+			status = c.State
+		} else if inst.ContainerID != "" {
+			status = "removed"
+			if !inst.Adopted {
+				// 容器已不存在，清空 ID 让下次启动重新创建
+				inst.ContainerID = ""
+				report.Removed = append(report.Removed, inst.ID)
+				changed = true
+			}
+		}
+		if status != inst.Status {
+			inst.Status = status
+			report.StatusUpdated = append(report.StatusUpdated, inst.ID)
+			changed = true
+		}
+		if changed && leader {
+			h.saveInstance(inst)
+		}
+
+		running := inst.Status == "running" && inst.Port > 0
+		switch {
+		case running && !h.proxy.IsRegistered(inst.ID):
+			_ = h.registerProxy(inst)
+		case !running && h.proxy.IsRegistered(inst.ID):
+			h.proxy.Unregister(inst.ID)
+		}
+	}
 
+	for _, c := range containers {
+		if !known[c.InstanceID] && !c.Helper {
+			report.Orphans = append(report.Orphans, c.Name)
+		}
+	}
+
+	// 端口池有锁（PortPool.mu），释放与并发的分配互不干扰
+	containerPorts, err := h.docker.ContainerPorts(ctx)
+	if err != nil {
+		return report, fmt.Errorf("list container ports: %w", err)
+	}
+	held := make(map[int]bool, len(instances)+len(containerPorts))
 	for _, inst := range instances {
-		if inst.ContainerID != "" && h.docker != nil {
-			status, err := h.docker.ContainerStatus(r.Context(), inst.ContainerID)
-			if err == nil && status != inst.Status {
+		held[inst.Port] = true
+	}
+	for _, p := range containerPorts {
+		held[p] = true
+	}
+	report.PortsReleased = h.portPool.ReleaseUnheld(held, cutoff)
+	return report, nil
+}
+
+// LogReconcile runs Reconcile and logs anything it changed.
+func (h *Handler) LogReconcile(ctx context.Context) {
+	report, err := h.Reconcile(ctx)
+	if err != nil {
+		log.Printf("Reconcile failed: %v", err)
+		return
+	}
+	if n := len(report.StatusUpdated) + len(report.Recovered) + len(report.Removed) + len(report.PortsMarked); n > 0 {
+		log.Printf("Reconcile: %d status updates, %d container IDs recovered, %d containers gone, %d ports marked", len(report.StatusUpdated), len(report.Recovered), len(report.Removed), len(report.PortsMarked))
+	}
+	if len(report.PortsReleased) > 0 {
+		log.Printf("Reconcile: released leaked ports %v", report.PortsReleased)
+	}
+	if len(report.Orphans) > 0 {
+		log.Printf("Reconcile: orphaned containers without an instance: %s", strings.Join(report.Orphans, ", "))
+	}
+}
+
+// --- Page handlers ---
+
+// Dashboard page sizes for ?per_page=.
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// pager describes the dashboard page being shown and links to its
+// neighbours. The links are query-only so they keep the other parameters
+// and resolve against the current path, base path included.
+type pager struct {
+	Page, Pages, PerPage, Total int
+	FirstURL, PrevURL, NextURL  string
+}
+
+func newPager(query url.Values, page, perPage, total int) pager {
+	p := pager{Page: page, PerPage: perPage, Total: total, Pages: max(1, (total+perPage-1)/perPage)}
+	pageURL := func(n int) string {
+		q := maps.Clone(query)
+		q.Set("page", strconv.Itoa(n))
+		return "?" + q.Encode()
+	}
+	p.FirstURL = pageURL(1)
+	if page > 1 {
+		p.PrevURL = pageURL(min(page-1, p.Pages))
+	}
+	if page < p.Pages {
+		p.NextURL = pageURL(page + 1)
+	}
+	return p
+}
+
+// positiveIntParam parses an optional query parameter that must be >= 1.
+func positiveIntParam(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", name, v)
+	}
+	return n, nil
+}
+
+// dashboardStatuses are the statuses offered by the dashboard filter.
+var dashboardStatuses = []string{"running", "starting", "restarting", "created", "stopped", "exited", "removed", "error"}
+
+func (h *Handler) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := store.QueryOptions{
+		Name:   strings.TrimSpace(q.Get("q")),
+		Status: q.Get("status"),
+		Tag:    strings.ToLower(strings.TrimSpace(q.Get("tag"))),
+		Sort:   q.Get("sort"),
+	}
+	if !store.ValidSort(opts.Sort) {
+		http.Error(w, "Invalid sort order", http.StatusBadRequest)
+		return
+	}
+	page, err := positiveIntParam(q, "page", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	perPage, err := positiveIntParam(q, "per_page", defaultPerPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	perPage = min(perPage, maxPerPage)
+
+	// 先同步容器状态（leader 会写回数据库），再按数据库中的状态过滤
+	statuses, err := h.instanceStatuses()
+	if err != nil {
+		logctx.From(r.Context()).Error("Error syncing container statuses", "error", err)
+	}
+
+	instances, total, err := h.store.QueryPaged(opts, perPage, (page-1)*perPage)
+	if err != nil {
+		http.Error(w, "Failed to list instances", http.StatusInternalServerError)
+		return
+	}
+	if statuses != nil {
+		for _, inst := range instances {
+			if status, ok := statuses[inst.ID]; ok {
 				inst.Status = status
-				_ = h.store.Update(inst)
 			}
 		}
 	}
+	h.attachUsage(instances...)
+
+	deleted, err := h.store.ListDeleted()
+	if err != nil {
+		logctx.From(r.Context()).Error("Error listing recycle bin", "error", err)
+	}
+	tags, err := h.store.Tags()
+	if err != nil {
+		logctx.From(r.Context()).Error("Error listing tags", "error", err)
+	}
 
 	data := map[string]interface{}{
 		"Instances": instances,
+		"Deleted":   deleted,
+		"Query":     opts,
+		"Tags":      tags,
+		"Filtered":  opts.Name != "" || opts.Status != "" || opts.Tag != "",
+		"Pager":     newPager(q, page, perPage, total),
+		"Statuses":  dashboardStatuses,
 		"Title":     "CloudCode - Dashboard",
 	}
-	h.render(w, "dashboard", data)
+	h.render(w, r, "dashboard", data)
+}
+
+// publicInstance is the subset of an instance shown on the public status page.
+// Only non-sensitive fields are copied so nothing else can leak via the template.
+type publicInstance struct {
+	Name      string
+	Status    string
+	UpdatedAt time.Time
+}
+
+func (h *Handler) handlePublicStatus(w http.ResponseWriter, r *http.Request) {
+	instances, err := h.store.List()
+	if err != nil {
+		http.Error(w, "Failed to list instances", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]publicInstance, 0, len(instances))
+	running := 0
+	for _, inst := range instances {
+		if inst.Status == "running" {
+			running++
+		}
+		list = append(list, publicInstance{Name: inst.Name, Status: inst.Status, UpdatedAt: inst.UpdatedAt})
+	}
+
+	data := map[string]interface{}{
+		"Instances": list,
+		"Running":   running,
+		"Title":     "CloudCode - Status",
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderPartial(w, r, "status", data)
 }
 
 func (h *Handler) handleNewInstanceForm(w http.ResponseWriter, r *http.Request) {
@@ -188,190 +1005,1713 @@ func (h *Handler) handleNewInstanceForm(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	h.render(w, "new_instance", map[string]interface{}{
-		"Title":         "CloudCode - New Instance",
-		"TotalMemoryMB": totalMemMB,
-		"TotalCPUCores": runtime.NumCPU(),
+	// 只列出未被占用的 home volume，供数据恢复时挂载
+	var volumes []docker.VolumeInfo
+	if h.docker != nil {
+		all, err := h.docker.ListVolumes(r.Context())
+		if err != nil {
+			logctx.From(r.Context()).Error("Error listing volumes", "error", err)
+		}
+		for _, v := range all {
+			if !v.InUse {
+				volumes = append(volumes, v)
+			}
+		}
+	}
+
+	var gpuPresets []gpuPreset
+	if h.opts.EnableGPU && h.docker != nil {
+		if info, err := h.docker.GPUInfo(r.Context()); err != nil {
+			logctx.From(r.Context()).Error("Error reading GPU info", "error", err)
+		} else {
+			gpuPresets = buildGPUPresets(info)
+		}
+	}
+
+	defaultImage := ""
+	if h.docker != nil {
+		defaultImage = h.docker.Image()
+	}
+
+	h.render(w, r, "new_instance", map[string]interface{}{
+		"Title":                "CloudCode - New Instance",
+		"DefaultImage":         defaultImage,
+		"TotalMemoryMB":        totalMemMB,
+		"TotalCPUCores":        runtime.NumCPU(),
+		"Volumes":              volumes,
+		"GPUPresets":           gpuPresets,
+		"StopSignals":          docker.StopSignals,
+		"RestartPolicies":      store.RestartPolicies,
+		"DefaultRestartPolicy": store.DefaultRestartPolicy,
 	})
 }
 
-// --- Instance CRUD ---
+// gpuPreset is a GPU option offered on the new instance form.
+type gpuPreset struct {
+	Label string
+	Count int
+}
 
-func (h *Handler) handleCreateInstance(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form data", http.StatusBadRequest)
-		return
+// buildGPUPresets offers power-of-two GPU counts up to what the host has,
+// plus "all". Without CDI device discovery the count is unknown, so only a
+// single GPU and all GPUs are offered. Returns nil when no GPU is usable.
+func buildGPUPresets(info docker.GPUInfo) []gpuPreset {
+	if !info.Available() {
+		return nil
+	}
+	presets := []gpuPreset{{Label: "None", Count: 0}}
+	limit := len(info.Devices)
+	if limit == 0 {
+		limit = 1
+	}
+	for n := 1; n <= limit; n *= 2 {
+		label := "1 GPU"
+		if n > 1 {
+			label = fmt.Sprintf("%d GPUs", n)
+		}
+		presets = append(presets, gpuPreset{Label: label, Count: n})
 	}
+	return append(presets, gpuPreset{Label: "All GPUs", Count: -1})
+}
 
-	name := strings.TrimSpace(r.FormValue("name"))
-	if name == "" {
-		http.Error(w, "Name is required", http.StatusBadRequest)
-		return
+// validateGPUs checks a requested GPU count against the flag and the GPUs
+// the daemon reports.
+func (h *Handler) validateGPUs(ctx context.Context, gpus int) error {
+	if gpus == 0 {
+		return nil
 	}
-
-	if existing, _ := h.store.GetByName(name); existing != nil {
-		http.Error(w, "Instance name already exists", http.StatusConflict)
+	if !h.opts.EnableGPU {
+		return fmt.Errorf("GPU access is disabled (start CloudCode with -enable-gpu)")
+	}
+	if gpus < -1 {
+		return fmt.Errorf("invalid GPU count %d", gpus)
+	}
+	if h.docker == nil {
+		return errDockerUnavailable
+	}
+	info, err := h.docker.GPUInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if !info.Available() {
+		return fmt.Errorf("Docker reports no NVIDIA runtime or GPU devices")
+	}
+	if n := len(info.Devices); n > 0 && gpus > n {
+		return fmt.Errorf("requested %d GPUs but only %d are available", gpus, n)
+	}
+	return nil
+}
+
+// normalizeCpuset validates a cpuset against the Docker host's CPU count,
+// falling back to the local count when Docker is unavailable.
+func (h *Handler) normalizeCpuset(ctx context.Context, spec string) (string, error) {
+	hostCPUs := runtime.NumCPU()
+	if h.docker != nil && strings.TrimSpace(spec) != "" {
+		n, err := h.docker.HostCPUs(ctx)
+		if err != nil {
+			logctx.From(ctx).Warn("Could not read host CPU count, using local count", "error", err)
+		} else {
+			hostCPUs = n
+		}
+	}
+	return docker.NormalizeCpuset(spec, hostCPUs)
+}
+
+// --- Instance CRUD ---
+
+// checkNameFree reports an error if an instance, live or in the recycle
+// bin, already has the name.
+func (h *Handler) checkNameFree(name string) error {
+	existing, _ := h.store.GetByName(name)
+	if existing == nil {
+		return nil
+	}
+	if existing.DeletedAt != nil {
+		return errors.New("instance name is used by an instance in the recycle bin; restore or purge it first")
+	}
+	return errors.New("instance name already exists")
+}
+
+// handleCreateInstance stores a new instance and responds right away with
+// its row (status "created"), or a redirect to the dashboard for HTMX, see
+// respondCreated; the container is created in the background and the row
+// follows its progress. If creation fails the instance keeps
+// its port, in the error state, until it is deleted.
+func (h *Handler) handleCreateInstance(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		writeError(w, r, http.StatusBadRequest, "Name is required")
+		return
+	}
+
+	if err := h.checkNameFree(name); err != nil {
+		writeError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+
+	homeVolume := strings.TrimSpace(r.FormValue("home_volume"))
+	if homeVolume != "" {
+		if !h.requireDocker(w, r) {
+			return
+		}
+		if err := h.docker.CheckVolumeAttachable(r.Context(), homeVolume); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		// 容器尚未创建的实例不会出现在 Docker 的挂载列表里，需要再查一次 store；
+		// 回收站中的实例仍保留着自己的 volume
+		if instances, err := h.store.List(); err == nil {
+			deleted, _ := h.store.ListDeleted()
+			for _, other := range append(instances, deleted...) {
+				if docker.HomeVolumeName(other) == homeVolume {
+					writeError(w, r, http.StatusConflict, fmt.Sprintf("Volume %q is already assigned to instance %s", homeVolume, other.Name))
+					return
+				}
+			}
+		}
+	}
+
+	port, err := h.allocatePort(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, "No available ports")
+		return
+	}
+
+	// Parse resource limits: empty = default, 0 = unlimited
+	memoryMB, cpuCores, err := parseResourceLimits(r.FormValue("memory_mb"), r.FormValue("cpu_cores"))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	gpus, _ := strconv.Atoi(r.FormValue("gpus"))
+	if err := h.validateGPUs(r.Context(), gpus); err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	stopSignal, err := docker.NormalizeStopSignal(r.FormValue("stop_signal"))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	cpuset, err := h.normalizeCpuset(r.Context(), r.FormValue("cpuset_cpus"))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	restartPolicy := r.FormValue("restart_policy")
+	if !store.ValidRestartPolicy(restartPolicy) {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid restart policy %q (allowed: %s)", restartPolicy, strings.Join(store.RestartPolicies, ", ")))
+		return
+	}
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	networks, err := docker.NormalizeNetworks(strings.Split(r.FormValue("networks"), ","))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	workDir, err := docker.NormalizeWorkDir(r.FormValue("work_dir"))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	// 与默认镜像相同时不单独记录，之后修改 -image 也会跟随
+	image := strings.TrimSpace(r.FormValue("image"))
+	if h.docker != nil && image == h.docker.Image() {
+		image = ""
+	}
+	if image != "" {
+		if err := docker.ValidateImageRef(image); err != nil {
+			h.portPool.Release(port)
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	command, err := docker.ParseCommand(strings.TrimSpace(r.FormValue("command")))
+	if err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	inst := &store.Instance{
+		ID:            uuid.New().String()[:8],
+		Name:          name,
+		Status:        "created",
+		Port:          port,
+		WorkDir:       workDir,
+		EnvVars:       make(map[string]string),
+		MemoryMB:      memoryMB,
+		CPUCores:      cpuCores,
+		CpusetCpus:    cpuset,
+		GPUs:          gpus,
+		StopSignal:    stopSignal,
+		HomeVolume:    homeVolume,
+		RestartPolicy: restartPolicy,
+		StopTimeout:   store.DefaultStopTimeout,
+		Tags:          tags,
+		Networks:      networks,
+		Image:         image,
+		Command:       command,
+	}
+
+	if err := h.store.Create(inst); err != nil {
+		h.portPool.Release(port)
+		writeError(w, r, http.StatusInternalServerError, "Failed to create instance")
+		return
+	}
+	h.events.publish(inst.ID, inst.Status)
+	h.audit(r.Context(), h.actor(r), "create", inst.ID, inst.Name)
+
+	// 先返回新实例的卡片，镜像拉取和容器创建在后台异步完成，进度通过 SSE 推送
+	h.createContainerAsync(r.Context(), inst)
+	h.respondCreated(w, r, inst)
+}
+
+// createContainerAsync creates and starts the container of a freshly stored
+// instance in the background.
+func (h *Handler) createContainerAsync(ctx context.Context, inst *store.Instance) {
+	h.createContainerAsyncAfter(ctx, inst, nil)
+}
+
+// createContainerAsyncAfter is createContainerAsync with a prepare step
+// (e.g. copying a home volume) run first within the same instance
+// operation. A prepare error marks the instance as failed.
+//
+// The operation is registered before it returns, so callers must call it
+// before responding: a delete that follows the response then cancels the
+// create instead of racing it. The instance is reloaded inside the
+// operation and nothing is created once it is gone.
+func (h *Handler) createContainerAsyncAfter(parent context.Context, inst *store.Instance, prepare func(ctx context.Context) error) {
+	if h.docker == nil {
+		return
+	}
+	ctx, wait, finish := h.queueOp(parent, inst.ID)
+	go func() {
+		defer finish()
+		wait()
+		cur, err := h.store.Get(inst.ID)
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		_ = h.createContainer(ctx, cur, prepare)
+	}()
+}
+
+// createContainer runs prepare, if any, then creates and starts the
+// container of inst and starts watching for readiness. Failures mark the
+// instance as failed and are returned. It must run inside an instance
+// operation (beginOp).
+func (h *Handler) createContainer(ctx context.Context, inst *store.Instance, prepare func(ctx context.Context) error) error {
+	if prepare != nil {
+		err := prepare(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			logctx.From(ctx).Error("Error preparing container", "instance", inst.ID, "error", err)
+			h.markError(ctx, inst, err)
+			return err
+		}
+	}
+	containerID, err := h.docker.CreateContainer(ctx, inst, h.progressFunc(inst.ID))
+	if ctx.Err() != nil {
+		// 实例在创建过程中被删除，容器由删除流程按名称清理
+		return ctx.Err()
+	}
+	if err != nil {
+		logctx.From(ctx).Error("Error creating container", "instance", inst.ID, "error", err)
+		h.markError(ctx, inst, err)
+		return err
+	}
+	inst.ContainerID = containerID
+	h.watchReady(ctx, inst)
+	return nil
+}
+
+// Resource limits of an instance created without memory_mb or cpu_cores,
+// the values the new instance form suggests.
+const (
+	defaultMemoryMB = 2048
+	defaultCPUCores = 2
+)
+
+// parseResourceLimits parses the memory (MB) and CPU (cores) form values.
+// Empty selects defaultMemoryMB and defaultCPUCores, an explicit 0 means
+// unlimited; malformed or negative values are rejected instead of silently
+// becoming unlimited.
+func parseResourceLimits(memory, cpus string) (int, float64, error) {
+	memoryMB := defaultMemoryMB
+	cpuCores := float64(defaultCPUCores)
+	if memory = strings.TrimSpace(memory); memory != "" {
+		v, err := strconv.Atoi(memory)
+		if err != nil || v < 0 {
+			return 0, 0, fmt.Errorf("invalid memory limit %q: must be a whole number of MB, 0 = unlimited", memory)
+		}
+		memoryMB = v
+	}
+	if cpus = strings.TrimSpace(cpus); cpus != "" {
+		v, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, 0, fmt.Errorf("invalid CPU limit %q: must be a number of cores, 0 = unlimited", cpus)
+		}
+		cpuCores = v
+	}
+	return memoryMB, cpuCores, nil
+}
+
+// portSharedWithOther reports whether another instance uses inst's port.
+// Adopted containers keep the port they were started with, which may
+// coincide with a pool port already allocated to another instance.
+func (h *Handler) portSharedWithOther(inst *store.Instance) bool {
+	instances, err := h.store.List()
+	if err != nil {
+		return true
+	}
+	for _, other := range instances {
+		if other.ID != inst.ID && other.Port == inst.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdoptInstance brings an existing container that CloudCode did not
+// create under management without recreating it. Form values: container
+// (ID or name, required), name (defaults to the container name) and port
+// (defaults to OPENCODE_PORT or the only exposed port). The container is
+// attached to the CloudCode network under its instance alias and the proxy
+// is registered if it is running.
+func (h *Handler) handleAdoptInstance(w http.ResponseWriter, r *http.Request) {
+	if !h.requireDocker(w, r) {
+		return
+	}
+	ref := strings.TrimSpace(r.FormValue("container"))
+	if ref == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "container is required"})
+		return
+	}
+	port := 0
+	if v := strings.TrimSpace(r.FormValue("port")); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > 65535 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid port"})
+			return
+		}
+		port = p
+	}
+
+	cand, err := h.docker.InspectForAdoption(r.Context(), ref, port)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	instances, err := h.store.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list instances"})
+		return
+	}
+	for _, other := range instances {
+		if other.ContainerID == cand.ID {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "container is already adopted as " + other.Name})
+			return
+		}
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = cand.Name
+	}
+	if existing, _ := h.store.GetByName(name); existing != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "instance name already exists"})
+		return
+	}
+
+	inst := &store.Instance{
+		ID:          uuid.New().String()[:8],
+		Name:        name,
+		ContainerID: cand.ID,
+		Status:      cand.State,
+		Port:        cand.Port,
+		WorkDir:     store.DefaultWorkDir,
+		EnvVars:     make(map[string]string),
+		StopTimeout: store.DefaultStopTimeout,
+		Adopted:     true,
+	}
+	if err := h.docker.AttachToNetwork(r.Context(), cand.ID, inst.ID); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := h.store.Create(inst); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create instance"})
+		return
+	}
+	h.events.publish(inst.ID, inst.Status)
+	h.docker.TrackAdopted(cand.ID, inst.ID)
+	h.portPool.MarkUsed(inst.Port)
+	h.audit(r.Context(), h.actor(r), "adopt", inst.ID, fmt.Sprintf("container %s (%s)", cand.Name, cand.ID[:12]))
+
+	resp := map[string]interface{}{"instance": inst, "ready": false}
+	if inst.Status == "running" {
+		if err := h.registerProxy(inst); err != nil {
+			logctx.From(r.Context()).Error("Error registering proxy", "instance", inst.ID, "error", err)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		if err := proxy.Probe(ctx, inst.ID, inst.Port, "/"); err != nil {
+			resp["detail"] = "opencode not answering yet: " + err.Error()
+		} else {
+			resp["ready"] = true
+		}
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// uniqueCloneName derives "{name}-copy", "{name}-copy-2", ... that no
+// existing instance uses.
+func (h *Handler) uniqueCloneName(name string) string {
+	candidate := name + "-copy"
+	for i := 2; ; i++ {
+		if existing, _ := h.store.GetByName(candidate); existing == nil {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-copy-%d", name, i)
+	}
+}
+
+// handleCloneInstance creates a new instance with the source's settings and
+// an empty home volume. With with-data=true the source's home volume is
+// copied into the clone's instead. With snapshot_config=true the current
+// global config is copied into the clone's own config directory and
+// mounted instead of the shared one, so later global changes don't affect
+// it. The response is the new instance row, see respondCreated.
+func (h *Handler) handleCloneInstance(w http.ResponseWriter, r *http.Request) {
+	src, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+	snapshot := r.FormValue("snapshot_config") == "true" || r.FormValue("snapshot_config") == "on"
+	withData := r.FormValue("with-data") == "true" || r.FormValue("with-data") == "on"
+	if withData {
+		if !h.requireDocker(w, r) {
+			return
+		}
+		if src.Adopted {
+			writeError(w, r, http.StatusBadRequest, "Adopted instances have no CloudCode home volume to copy")
+			return
+		}
+	}
+
+	port, err := h.allocatePort(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, "No available ports")
+		return
+	}
+
+	inst := &store.Instance{
+		ID:            uuid.New().String()[:8],
+		Name:          h.uniqueCloneName(src.Name),
+		Status:        "created",
+		Port:          port,
+		WorkDir:       src.WorkDir,
+		EnvVars:       maps.Clone(src.EnvVars),
+		MemoryMB:      src.MemoryMB,
+		CPUCores:      src.CPUCores,
+		CpusetCpus:    src.CpusetCpus,
+		ProxyHeaders:  maps.Clone(src.ProxyHeaders),
+		LogLevel:      src.LogLevel,
+		Sysctls:       maps.Clone(src.Sysctls),
+		GPUs:          src.GPUs,
+		StopSignal:    src.StopSignal,
+		RestartPolicy: src.RestartPolicy,
+		StopTimeout:   src.StopTimeout,
+		Tags:          slices.Clone(src.Tags),
+		Networks:      slices.Clone(src.Networks),
+		Image:         src.Image,
+		Command:       slices.Clone(src.Command),
+		DNS:           slices.Clone(src.DNS),
+		ExtraHosts:    slices.Clone(src.ExtraHosts),
+	}
+	if inst.EnvVars == nil {
+		inst.EnvVars = make(map[string]string)
+	}
+
+	if snapshot {
+		if err := h.config.SnapshotConfig(inst.ID); err != nil {
+			h.portPool.Release(port)
+			h.config.RemoveInstanceData(inst.ID)
+			writeError(w, r, http.StatusInternalServerError, "Failed to snapshot config: "+err.Error())
+			return
+		}
+	}
+
+	if err := h.store.Create(inst); err != nil {
+		h.portPool.Release(port)
+		h.config.RemoveInstanceData(inst.ID)
+		writeError(w, r, http.StatusInternalServerError, "Failed to create instance")
+		return
+	}
+	h.events.publish(inst.ID, inst.Status)
+	detail := "from " + src.ID
+	if withData {
+		detail += " with home volume data"
+	}
+	if snapshot {
+		detail += " with config snapshot"
+	}
+	h.audit(r.Context(), h.actor(r), "clone", inst.ID, detail)
+
+	if withData {
+		srcVolume, dstVolume := docker.HomeVolumeName(src), docker.HomeVolumeName(inst)
+		h.createContainerAsyncAfter(r.Context(), inst, func(ctx context.Context) error {
+			return h.docker.CopyVolume(ctx, srcVolume, dstVolume, inst.ID, h.progressFunc(inst.ID))
+		})
+	} else {
+		h.createContainerAsync(r.Context(), inst)
+	}
+	h.respondCreated(w, r, inst)
+}
+
+// respondCreated answers a request that stored a new instance. HTMX forms
+// are sent to the dashboard, where the new row follows the creation over
+// SSE; other clients get the new instance row.
+func (h *Handler) respondCreated(w http.ResponseWriter, r *http.Request, inst *store.Instance) {
+	if r.Header.Get("HX-Request") != "" {
+		w.Header().Set("HX-Redirect", h.url("/"))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	h.renderPartial(w, r, "instance_row", inst)
+}
+
+func (h *Handler) handleGetInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		http.Error(w, "Instance not found", http.StatusNotFound)
+		return
+	}
+
+	if inst.ContainerID != "" && h.docker != nil {
+		if status, err := h.docker.ContainerStatus(r.Context(), inst.ContainerID); err == nil && status != inst.Status {
+			inst.Status = status
+			// 只有 leader 写库；follower 仅在本次响应中展示实时状态
+			if h.isLeader() {
+				h.saveInstance(inst)
+			}
+		}
+	}
+
+	var resourceWarnings []string
+	if inst.Status == "running" && h.docker != nil {
+		resourceWarnings, _ = h.docker.VerifyResources(r.Context(), inst.ContainerID, inst.ContainerResources())
+	}
+	var containerLabels map[string]string
+	if inst.ContainerID != "" && inst.Status != "removed" && h.docker != nil {
+		containerLabels, _ = h.docker.ContainerLabels(r.Context(), inst.ContainerID)
+	}
+	errorLogs, _ := h.config.ListErrorLogs(inst.ID)
+	recordings, _ := h.config.ListRecordings(inst.ID)
+
+	// 实例的有效环境 = 全局环境变量 + 实例自身环境变量
+	globalEnv, _ := h.config.GetEnvVars()
+	env := config.MergeEnv(globalEnv, inst.EnvVars)
+	models, err := h.config.ListModels(env)
+	modelsErr := ""
+	if err != nil {
+		modelsErr = err.Error()
+	}
+
+	data := map[string]interface{}{
+		"Instance":         inst,
+		"LogLevels":        store.LogLevels,
+		"StopSignals":      docker.StopSignals,
+		"MaxStopTimeout":   store.MaxStopTimeout,
+		"TotalCPUCores":    runtime.NumCPU(),
+		"AllowedSysctls":   h.opts.AllowedSysctls,
+		"AllowBindMounts":  h.opts.AllowBindMounts,
+		"ContainerLabels":  containerLabels,
+		"ErrorLogs":        errorLogs,
+		"Recordings":       recordings,
+		"Models":           models,
+		"ModelsError":      modelsErr,
+		"ResourceWarnings": resourceWarnings,
+		"Title":            fmt.Sprintf("CloudCode - %s", inst.Name),
+	}
+	h.render(w, r, "instance_detail", data)
+}
+
+// deletePreview lists everything handleDeleteInstance will destroy.
+type deletePreview struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Port            int      `json:"port"`
+	Container       string   `json:"container"`
+	ContainerExists bool     `json:"container_exists"`
+	Volume          string   `json:"volume"`
+	VolumeExists    bool     `json:"volume_exists"`
+	VolumeBytes     int64    `json:"volume_bytes"` // -1 = unknown
+	VolumeSize      string   `json:"-"`
+	ConfigPaths     []string `json:"config_paths"`
+}
+
+// handleDeletePreview returns the delete summary as a confirmation modal
+// for HTMX requests and as JSON otherwise.
+func (h *Handler) handleDeletePreview(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	p := deletePreview{
+		ID:          inst.ID,
+		Name:        inst.Name,
+		Port:        inst.Port,
+		Container:   docker.ContainerName(inst.ID),
+		Volume:      docker.HomeVolumeName(inst),
+		VolumeBytes: -1,
+		ConfigPaths: h.config.InstanceDataPaths(inst.ID),
+	}
+	if h.docker != nil {
+		if status, err := h.docker.ContainerStatus(r.Context(), p.Container); err == nil && status != "removed" {
+			p.ContainerExists = true
+		}
+		if volumes, err := h.docker.ListVolumes(r.Context()); err == nil {
+			for _, v := range volumes {
+				if v.Name == p.Volume {
+					p.VolumeExists = true
+				}
+			}
+		}
+		if p.VolumeExists {
+			if size, err := h.docker.VolumeUsage(r.Context(), p.Volume); err != nil {
+				logctx.From(r.Context()).Error("Error reading volume size", "volume", p.Volume, "error", err)
+			} else {
+				p.VolumeBytes = size
+			}
+		}
+	}
+	p.VolumeSize = "unknown size"
+	if p.VolumeBytes >= 0 {
+		p.VolumeSize = formatBytes(p.VolumeBytes)
+	}
+
+	if r.Header.Get("HX-Request") == "" {
+		writeJSON(w, http.StatusOK, p)
+		return
+	}
+	h.renderPartial(w, r, "delete_preview", p)
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// handleDeleteInstance moves an instance to the recycle bin. See
+// deleteInstance.
+func (h *Handler) handleDeleteInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	if err := h.deleteInstance(r.Context(), inst, h.actor(r)); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to delete instance")
+		return
+	}
+
+	if c, err := r.Cookie(instanceCookieName); err == nil && c.Value == id {
+		clearInstanceCookie(w)
+	}
+
+	referer := r.Header.Get("Referer")
+	if referer != "" && strings.Contains(referer, "/instances/") {
+		w.Header().Set("HX-Redirect", h.url("/"))
+	} else {
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"instanceDeleted":{"id":"%s"}}`, id))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteInstance moves an instance to the recycle bin: the container is
+// removed (in the background) and the port released, but the home volume
+// and instance data are kept so the instance can be restored until it is
+// purged.
+func (h *Handler) deleteInstance(ctx context.Context, inst *store.Instance, actor string) error {
+	if err := h.trashInstance(ctx, inst, actor); err != nil {
+		return err
+	}
+	// 先返回响应避免浏览器超时，容器清理在后台异步完成，但在返回前排队
+	if h.docker != nil {
+		remove := h.queueRemoval(ctx, inst)
+		go remove()
+	}
+	return nil
+}
+
+// trashInstance is the part of deleteInstance that does not touch Docker:
+// it cancels running operations, releases the port and marks the instance
+// deleted in the store.
+func (h *Handler) trashInstance(ctx context.Context, inst *store.Instance, actor string) error {
+	id := inst.ID
+
+	// 取消进行中的创建/重启，避免删除后遗留孤儿容器
+	h.cancelOp(id)
+	// 先断开终端和日志会话，否则 exec 连接会一直挂着，容器删除可能等到超时
+	h.closeSessions(ctx, id, "instance deleted")
+	h.progress.fail(id, errors.New("instance deleted"))
+	h.proxy.Unregister(id)
+	h.forgetVersion(id)
+	if !inst.Adopted || !h.portSharedWithOther(inst) {
+		h.portPool.Release(inst.Port)
+	}
+
+	if err := h.store.Delete(id); err != nil {
+		return err
+	}
+	h.events.publish(id, "deleted")
+	h.audit(ctx, actor, "delete", id, inst.Name)
+	return nil
+}
+
+// stopMargin is added to an instance's stop timeout when bounding an
+// operation that stops its container, for the daemon to kill and reap it
+// once the grace period is over.
+const stopMargin = 30 * time.Second
+
+// stopDeadline bounds an operation that stops the container of inst.
+func stopDeadline(inst *store.Instance) time.Duration {
+	return time.Duration(inst.StopTimeout)*time.Second + stopMargin
+}
+
+// removeDeletedContainer removes the container of an instance that was
+// just moved to the recycle bin; an adopted container is only stopped.
+// Errors are logged and returned.
+func (h *Handler) removeDeletedContainer(ctx context.Context, inst *store.Instance) error {
+	return h.queueRemoval(ctx, inst)()
+}
+
+// queueRemoval queues removeDeletedContainer as an instance operation and
+// returns the func that performs it, for callers that run it in the
+// background.
+func (h *Handler) queueRemoval(ctx context.Context, inst *store.Instance) func() error {
+	// 作为实例操作执行：等待被取消的操作结束，并让紧接着的恢复排在清理之后
+	_, wait, finish := h.queueOp(ctx, inst.ID)
+	return func() error {
+		defer finish()
+		wait()
+		return h.removeContainerOf(ctx, inst)
+	}
+}
+
+// removeContainerOf is the body of removeDeletedContainer, run inside the
+// instance operation.
+func (h *Handler) removeContainerOf(ctx context.Context, inst *store.Instance) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stopDeadline(inst))
+	defer cancel()
+	if inst.Adopted {
+		// 接管的容器不是 CloudCode 创建的，删除后无法重建，只停止并保留到彻底清除
+		h.docker.ForgetAdopted(inst.ContainerID)
+		if err := h.docker.StopContainer(ctx, inst.ID, inst.ContainerID, inst.StopTimeout); err != nil {
+			logctx.From(ctx).Error("Error stopping adopted container", "instance", inst.ID, "error", err)
+			return err
+		}
+		return nil
+	}
+	// 按容器名删除：被取消的创建可能已生成容器，但 ID 未写入数据库
+	if err := h.docker.RemoveContainer(ctx, inst.ID, docker.ContainerName(inst.ID)); err != nil {
+		logctx.From(ctx).Error("Error removing container", "instance", inst.ID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// handleRestoreInstance takes an instance out of the recycle bin and
+// recreates its container on the kept home volume. The old port is reused
+// when it is still free.
+func (h *Handler) handleRestoreInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.GetDeleted(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found in recycle bin")
+		return
+	}
+
+	// 接管容器的端口由容器本身决定，不能更换
+	if !h.portPool.MarkUsed(inst.Port) && !inst.Adopted {
+		port, err := h.allocatePort(r.Context())
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, "No available ports")
+			return
+		}
+		logctx.From(r.Context()).Info("Port of restored instance is taken, using another", "instance", id, "port", inst.Port, "new_port", port)
+		inst.Port = port
+	}
+
+	// 先清除 deleted_at：回收站中的行不接受 Update
+	if err := h.store.Restore(id); err != nil {
+		h.portPool.Release(inst.Port)
+		writeError(w, r, http.StatusInternalServerError, "Failed to restore instance")
+		return
+	}
+	inst.DeletedAt = nil
+	inst.ErrorMsg = ""
+	if inst.Adopted {
+		inst.Status = "stopped"
+	} else {
+		inst.ContainerID = ""
+		inst.Status = "created"
+	}
+	h.saveInstance(inst)
+	h.audit(r.Context(), h.actor(r), "restore", id, inst.Name)
+
+	if h.docker != nil {
+		if inst.Adopted {
+			h.docker.TrackAdopted(inst.ContainerID, inst.ID)
+			ctx, wait, finish := h.queueOp(r.Context(), inst.ID)
+			go func() {
+				defer finish()
+				wait()
+				cur, err := h.store.Get(inst.ID)
+				if err != nil || ctx.Err() != nil {
+					return
+				}
+				if err := h.docker.StartContainer(ctx, cur.ID, cur.ContainerID); err != nil {
+					if ctx.Err() == nil {
+						h.markError(ctx, cur, err)
+					}
+					return
+				}
+				h.watchReady(ctx, cur)
+			}()
+		} else {
+			h.createContainerAsync(r.Context(), inst)
+		}
+	}
+
+	if r.Header.Get("HX-Request") == "" {
+		writeJSON(w, http.StatusOK, inst)
+		return
+	}
+	w.Header().Set("HX-Redirect", h.url("/instances/"+id))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePurgeInstance permanently removes an instance from the recycle
+// bin together with its container, home volume and instance data.
+func (h *Handler) handlePurgeInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.GetDeleted(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found in recycle bin")
+		return
+	}
+
+	h.config.RemoveInstanceData(id)
+	if err := h.store.HardDelete(id); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to purge instance")
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "purge", id, inst.Name)
+	w.WriteHeader(http.StatusOK)
+
+	if h.docker != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 30*time.Second)
+			defer cancel()
+			defer h.invalidateStatuses()
+			if inst.Adopted {
+				// 接管的容器不使用 CloudCode 的 home volume，只删除容器本身
+				if err := h.docker.RemoveContainer(ctx, inst.ID, inst.ContainerID); err != nil {
+					logctx.From(ctx).Error("Error removing adopted container", "instance", id, "error", err)
+				}
+				return
+			}
+			if err := h.docker.RemoveContainerAndVolume(ctx, id, docker.ContainerName(id), docker.HomeVolumeName(inst)); err != nil {
+				logctx.From(ctx).Error("Error removing container and volume", "instance", id, "error", err)
+			}
+		}()
+	}
+}
+
+// --- Instance actions ---
+
+func (h *Handler) handleStartInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	if err := h.startInstance(r.Context(), inst, h.actor(r)); err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	h.renderPartial(w, r, "instance_row", inst)
+}
+
+// startInstance marks an instance as starting and starts (or first
+// creates) its container in the background. The operation is queued before
+// it returns and works on the instance as stored when it runs.
+func (h *Handler) startInstance(ctx context.Context, inst *store.Instance, actor string) error {
+	if err := h.dockerErr(context.Background()); err != nil {
+		return err
+	}
+
+	h.audit(ctx, actor, "start", inst.ID, "")
+
+	// 先返回响应避免浏览器超时，容器操作在后台异步完成
+	inst.Status = "starting"
+	inst.ErrorMsg = ""
+	h.saveInstance(inst)
+
+	ctx, wait, finish := h.queueOp(ctx, inst.ID)
+	go func() {
+		defer finish()
+		wait()
+		// 排队期间实例可能已被删除，或已有其他操作改变了它的容器
+		inst, err := h.store.Get(inst.ID)
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		if inst.ContainerID == "" {
+			containerID, err := h.docker.CreateContainer(ctx, inst, h.progressFunc(inst.ID))
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				h.markError(ctx, inst, err)
+				return
+			}
+			inst.ContainerID = containerID
+		} else {
+			if err := h.docker.StartContainer(ctx, inst.ID, inst.ContainerID); err != nil {
+				if ctx.Err() == nil {
+					h.markError(ctx, inst, err)
+				}
+				return
+			}
+		}
+		h.watchReady(ctx, inst)
+	}()
+	return nil
+}
+
+func (h *Handler) handleStopInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+	if inst.ContainerID != "" && !h.requireDocker(w, r) {
+		return
+	}
+
+	h.stopInstance(r.Context(), inst, h.actor(r))
+	h.renderPartial(w, r, "instance_row", inst)
+}
+
+// stopInstance marks an instance as stopping, unregisters its proxy and
+// stops the container in the background, queued like startInstance. An
+// instance without a container, or with Docker disabled, is marked stopped
+// right away.
+func (h *Handler) stopInstance(ctx context.Context, inst *store.Instance, actor string) {
+	h.audit(ctx, actor, "stop", inst.ID, "")
+	h.proxy.Unregister(inst.ID)
+	if inst.ContainerID == "" || h.docker == nil {
+		inst.Status = "stopped"
+		h.saveInstance(inst)
+		return
+	}
+
+	// 先返回响应避免浏览器超时，容器操作在后台异步完成
+	inst.Status = "stopping"
+	h.saveInstance(inst)
+	ctx, wait, finish := h.queueOp(ctx, inst.ID)
+	go func() {
+		defer finish()
+		wait()
+		inst, err := h.store.Get(inst.ID)
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		if inst.ContainerID == "" {
+			// 排队期间的操作已删除了容器
+			inst.Status = "stopped"
+			h.saveInstance(inst)
+			return
+		}
+		if err := h.docker.StopContainer(ctx, inst.ID, inst.ContainerID, inst.StopTimeout); err != nil {
+			if ctx.Err() == nil {
+				logctx.From(ctx).Error("Error stopping container", "instance", inst.ID, "error", err)
+				h.markError(ctx, inst, err)
+			}
+			return
+		}
+		inst.Status = "stopped"
+		h.saveInstance(inst)
+	}()
+}
+
+func (h *Handler) handleRestartInstance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	if !h.requireDocker(w, r) {
+		return
+	}
+
+	h.audit(r.Context(), h.actor(r), "restart", inst.ID, "")
+
+	// 先返回响应避免浏览器超时，容器操作在后台异步完成
+	h.beginRestart(r.Context(), inst)
+	h.renderPartial(w, r, "instance_row", inst)
+}
+
+// errorLogLines is how many trailing log lines are captured when an
+// instance fails.
+const errorLogLines = docker.StartErrorLogLines
+
+// markError moves an instance into the error state and saves the recent
+// logs of its container under the data dir for post-mortem: those carried
+// by a docker.StartError when the new container was removed, otherwise
+// those of inst.ContainerID if it still exists.
+func (h *Handler) markError(ctx context.Context, inst *store.Instance, err error) {
+	inst.Status = "error"
+	inst.ErrorMsg = err.Error()
+	h.saveInstance(inst)
+	h.progress.fail(inst.ID, err)
+	h.captureErrorLog(ctx, inst, err)
+}
+
+// captureErrorLog snapshots the tail of the container logs for the failure
+// err. Best effort: the container may already be gone (e.g. creation
+// failed before it existed).
+func (h *Handler) captureErrorLog(ctx context.Context, inst *store.Instance, err error) {
+	if h.docker == nil {
+		return
+	}
+	containerID := inst.ContainerID
+	var data []byte
+	var startErr *docker.StartError
+	if errors.As(err, &startErr) {
+		containerID, data = startErr.ContainerID, startErr.Logs
+	} else if containerID != "" {
+		// 操作可能已被取消，读取日志只保留其中的 logger
+		tailCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		data, err = h.docker.ContainerLogsTail(tailCtx, containerID, errorLogLines)
+		if len(data) == 0 && err != nil {
+			logctx.From(ctx).Warn("Could not capture error logs", "instance", inst.ID, "error", err)
+		}
+	}
+	if len(data) == 0 {
+		return
+	}
+	header := fmt.Sprintf("# instance %s (%s) container %s\n# error: %s\n\n", inst.ID, inst.Name, containerID, inst.ErrorMsg)
+	name, err := h.config.SaveErrorLog(inst.ID, append([]byte(header), data...))
+	if err != nil {
+		logctx.From(ctx).Error("Could not save error logs", "instance", inst.ID, "error", err)
+		return
+	}
+	logctx.From(ctx).Info("Saved error logs", "instance", inst.ID, "file", name)
+}
+
+func (h *Handler) handleErrorLog(w http.ResponseWriter, r *http.Request) {
+	path, err := h.config.ErrorLogPath(r.PathValue("id"), r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(w, r, path)
+}
+
+// beginRestart marks the instance as restarting and recreates its container
+// in the background, queued like startInstance.
+func (h *Handler) beginRestart(ctx context.Context, inst *store.Instance) {
+	inst.Status = "restarting"
+	inst.ErrorMsg = ""
+	h.saveInstance(inst)
+	h.proxy.Unregister(inst.ID)
+
+	ctx, wait, finish := h.queueOp(ctx, inst.ID)
+	go func() {
+		defer finish()
+		wait()
+		inst, err := h.store.Get(inst.ID)
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		if inst.Adopted {
+			// 接管的容器不是由 CloudCode 创建的，无法按实例配置重建，只做原地重启
+			_ = h.docker.StopContainer(ctx, inst.ID, inst.ContainerID, inst.StopTimeout)
+			if err := h.docker.StartContainer(ctx, inst.ID, inst.ContainerID); err != nil {
+				if ctx.Err() == nil {
+					h.markError(ctx, inst, err)
+				}
+				return
+			}
+			h.watchReady(ctx, inst)
+			return
+		}
+		// Remove old container and recreate to trigger entrypoint (updates dependencies)
+		if inst.ContainerID != "" {
+			_ = h.docker.StopContainer(ctx, inst.ID, inst.ContainerID, inst.StopTimeout)
+			_ = h.docker.RemoveContainer(ctx, inst.ID, inst.ContainerID)
+			// 旧容器已删除，重建失败时不能再去读它的日志
+			inst.ContainerID = ""
+		}
+
+		containerID, err := h.docker.CreateContainer(ctx, inst, h.progressFunc(inst.ID))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			h.markError(ctx, inst, err)
+			return
+		}
+		inst.ContainerID = containerID
+		h.watchReady(ctx, inst)
+	}()
+}
+
+func (h *Handler) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	level := strings.ToLower(strings.TrimSpace(r.FormValue("log_level")))
+	if !store.ValidLogLevel(level) {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid log level %q", level))
+		return
+	}
+
+	inst.LogLevel = level
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save log level: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "log-level", inst.ID, level)
+
+	// 日志级别通过环境变量注入，需要重建容器才能生效
+	if inst.ContainerID != "" && h.docker != nil {
+		h.beginRestart(r.Context(), inst)
+	}
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseTags splits a comma- or space-separated tag list and normalizes it.
+func parseTags(s string) ([]string, error) {
+	return store.NormalizeTags(strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}))
+}
+
+// handleSaveTags replaces the tags of an instance. The container's
+// cloudcode.tag.* labels are updated the next time it is recreated, since
+// Docker cannot change labels in place.
+func (h *Handler) handleSaveTags(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	inst.Tags = tags
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save tags: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "tags", inst.ID, strings.Join(tags, ","))
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// sysctlAllowed reports whether key matches the configured allowlist.
+func (h *Handler) sysctlAllowed(key string) bool {
+	for _, a := range h.opts.AllowedSysctls {
+		if a == key {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(a, "*"); ok && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) handleSaveSysctls(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	sysctls := make(map[string]string)
+	keys := r.Form["sysctl_key"]
+	values := r.Form["sysctl_value"]
+	for i, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if !h.sysctlAllowed(k) {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Sysctl %q is not allowed (allowed: %s)", k, strings.Join(h.opts.AllowedSysctls, ", ")))
+			return
+		}
+		v := ""
+		if i < len(values) {
+			v = strings.TrimSpace(values[i])
+		}
+		if v == "" {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Sysctl %q needs a value", k))
+			return
+		}
+		sysctls[k] = v
+	}
+
+	inst.Sysctls = sysctls
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save sysctls: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "sysctls", inst.ID, strings.Join(slices.Sorted(maps.Keys(sysctls)), ","))
 
-	port, err := h.portPool.Allocate()
+	// sysctls 只能在创建容器时设置，需要重建容器
+	if inst.ContainerID != "" && h.docker != nil {
+		h.beginRestart(r.Context(), inst)
+	}
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSaveDNS replaces the DNS servers and /etc/hosts entries of the
+// instance, one per line in the "dns" and "extra_hosts" fields, and
+// recreates its container, since both are fixed at create time.
+func (h *Handler) handleSaveDNS(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	dns, err := docker.NormalizeDNS(strings.Split(r.FormValue("dns"), "\n"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	hosts, err := docker.NormalizeExtraHosts(strings.Split(r.FormValue("extra_hosts"), "\n"))
 	if err != nil {
-		http.Error(w, "No available ports", http.StatusServiceUnavailable)
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Parse resource limits: 0 = unlimited
-	memoryMB, _ := strconv.Atoi(r.FormValue("memory_mb"))
-	cpuCores, _ := strconv.ParseFloat(r.FormValue("cpu_cores"), 64)
+	inst.DNS = dns
+	inst.ExtraHosts = hosts
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save DNS settings: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "dns", inst.ID, strings.Join(slices.Concat(dns, hosts), ","))
 
-	inst := &store.Instance{
-		ID:       uuid.New().String()[:8],
-		Name:     name,
-		Status:   "created",
-		Port:     port,
-		WorkDir:  "/root",
-		EnvVars:  make(map[string]string),
-		MemoryMB: memoryMB,
-		CPUCores: cpuCores,
+	// DNS 和 hosts 只能在创建容器时设置，需要重建容器
+	if inst.ContainerID != "" && h.docker != nil {
+		h.beginRestart(r.Context(), inst)
 	}
 
-	if err := h.store.Create(inst); err != nil {
-		h.portPool.Release(port)
-		http.Error(w, "Failed to create instance", http.StatusInternalServerError)
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSaveBindMounts replaces the host directories mounted into the
+// instance and recreates its container, since mounts are fixed at create
+// time.
+func (h *Handler) handleSaveBindMounts(w http.ResponseWriter, r *http.Request) {
+	if !h.opts.AllowBindMounts {
+		writeError(w, r, http.StatusForbidden, "Bind mounts are disabled (start with -allow-bind-mounts)")
+		return
+	}
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
 		return
 	}
 
-	// 先返回响应避免浏览器超时，容器创建在后台异步完成
-	w.Header().Set("HX-Redirect", "/")
-	w.WriteHeader(http.StatusCreated)
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
+		return
+	}
 
-	if h.docker != nil {
-		go func() {
-			containerID, err := h.docker.CreateContainer(context.Background(), inst)
-			if err != nil {
-				log.Printf("Error creating container for %s: %v", inst.ID, err)
-				inst.Status = "error"
-				inst.ErrorMsg = err.Error()
-				_ = h.store.Update(inst)
-				return
-			}
-			inst.ContainerID = containerID
-			inst.Status = "running"
-			_ = h.store.Update(inst)
+	var mounts []config.ContainerMount
+	hosts := r.Form["mount_host"]
+	targets := r.Form["mount_container"]
+	modes := r.Form["mount_mode"]
+	for i, host := range hosts {
+		target := ""
+		if i < len(targets) {
+			target = targets[i]
+		}
+		if strings.TrimSpace(host) == "" && strings.TrimSpace(target) == "" {
+			continue
+		}
+		mounts = append(mounts, config.ContainerMount{
+			HostPath:      host,
+			ContainerPath: target,
+			ReadOnly:      i < len(modes) && modes[i] == "ro",
+		})
+	}
+	mounts, err = h.config.ValidateBindMounts(mounts)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-			if err := h.proxy.Register(inst.ID, inst.Port); err != nil {
-				log.Printf("Error registering proxy for %s: %v", inst.ID, err)
-			}
-		}()
+	inst.BindMounts = mounts
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save bind mounts: "+err.Error())
+		return
+	}
+	detail := make([]string, len(mounts))
+	for i, m := range mounts {
+		detail[i] = m.HostPath + ":" + m.ContainerPath
+		if m.ReadOnly {
+			detail[i] += ":ro"
+		}
+	}
+	h.audit(r.Context(), h.actor(r), "mounts", inst.ID, strings.Join(detail, ","))
+
+	// 挂载只能在创建容器时设置，需要重建容器
+	if inst.ContainerID != "" && h.docker != nil {
+		h.beginRestart(r.Context(), inst)
 	}
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) handleGetInstance(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleSetStopSignal(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	inst, err := h.store.Get(id)
 	if err != nil {
-		http.Error(w, "Instance not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	signal, err := docker.NormalizeStopSignal(r.FormValue("stop_signal"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	inst.StopSignal = signal
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save stop signal: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "stop-signal", inst.ID, signal)
 
+	// StopSignal 属于容器配置，需要重建容器才能生效
 	if inst.ContainerID != "" && h.docker != nil {
-		if status, err := h.docker.ContainerStatus(r.Context(), inst.ContainerID); err == nil {
-			inst.Status = status
-			_ = h.store.Update(inst)
-		}
+		h.beginRestart(r.Context(), inst)
 	}
 
-	data := map[string]interface{}{
-		"Instance": inst,
-		"Title":    fmt.Sprintf("CloudCode - %s", inst.Name),
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetStopTimeout saves how long a stop waits before killing the
+// container. It is passed with each stop, so no restart is needed.
+func (h *Handler) handleSetStopTimeout(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
 	}
-	h.render(w, "instance_detail", data)
+
+	timeout, err := strconv.Atoi(strings.TrimSpace(r.FormValue("stop_timeout")))
+	if err != nil || timeout < 0 || timeout > store.MaxStopTimeout {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Stop timeout must be a whole number of seconds between 0 and %d", store.MaxStopTimeout))
+		return
+	}
+
+	inst.StopTimeout = timeout
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save stop timeout: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "stop-timeout", inst.ID, strconv.Itoa(timeout)+"s")
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) handleDeleteInstance(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleSetCpuset(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	inst, err := h.store.Get(id)
 	if err != nil {
-		http.Error(w, "Instance not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, "Instance not found")
 		return
 	}
 
-	containerID := inst.ContainerID
-	h.proxy.Unregister(id)
-	h.portPool.Release(inst.Port)
-	h.config.RemoveInstanceData(id)
+	cpuset, err := h.normalizeCpuset(r.Context(), r.FormValue("cpuset_cpus"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if err := h.store.Delete(id); err != nil {
-		http.Error(w, "Failed to delete instance", http.StatusInternalServerError)
+	inst.CpusetCpus = cpuset
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save cpuset: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "cpuset", inst.ID, cpuset)
 
-	referer := r.Header.Get("Referer")
-	if referer != "" && strings.Contains(referer, "/instances/") {
-		w.Header().Set("HX-Redirect", "/")
-	} else {
-		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"instanceDeleted":{"id":"%s"}}`, id))
+	// CpusetCpus 属于 HostConfig，需要重建容器才能生效
+	if inst.ContainerID != "" && h.docker != nil {
+		h.beginRestart(r.Context(), inst)
 	}
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
 	w.WriteHeader(http.StatusOK)
+}
 
-	// 先返回响应避免浏览器超时，容器清理在后台异步完成
-	if containerID != "" && h.docker != nil {
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-			if err := h.docker.RemoveContainerAndVolume(ctx, containerID, id); err != nil {
-				log.Printf("Error removing container for %s: %v", id, err)
-			}
-		}()
+// handleSaveInstanceEnv replaces the instance's own environment variables,
+// which override global ones with the same name. Like the global set, they
+// reach the container the next time it is started or recreated.
+func (h *Handler) handleSaveInstanceEnv(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
 	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	// The form is posted with hx-swap="none", so errors need a 4xx status
+	// to show up as a toast.
+	env, err := envFromForm(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	inst.EnvVars = env
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save environment variables: "+err.Error())
+		return
+	}
+	// 只记录变量名，值通常是 API key
+	h.audit(r.Context(), h.actor(r), "env", inst.ID, strings.Join(slices.Sorted(maps.Keys(env)), ","))
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
 }
 
-// --- Instance actions ---
+// handleImportInstanceEnv merges the variables of an uploaded .env file
+// into the instance's environment, see readDotEnv.
+func (h *Handler) handleImportInstanceEnv(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
 
-func (h *Handler) handleStartInstance(w http.ResponseWriter, r *http.Request) {
+	imported, malformed, ok := readDotEnv(w, r)
+	if !ok {
+		return
+	}
+	if inst.EnvVars == nil {
+		inst.EnvVars = make(map[string]string)
+	}
+	maps.Copy(inst.EnvVars, imported)
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save environment variables: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "env-import", inst.ID, strings.Join(slices.Sorted(maps.Keys(imported)), ","))
+
+	h.respondEnvImport(w, r, "instance-env-rows", inst.EnvVars, imported, malformed)
+}
+
+func (h *Handler) handleSaveProxyHeaders(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	inst, err := h.store.Get(id)
 	if err != nil {
-		http.Error(w, "Instance not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, "Instance not found")
 		return
 	}
 
-	if h.docker == nil {
-		respondError(w, "Docker is not available")
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
 		return
 	}
 
-	// 先返回响应避免浏览器超时，容器操作在后台异步完成
-	inst.Status = "starting"
-	inst.ErrorMsg = ""
-	_ = h.store.Update(inst)
-	h.renderPartial(w, "instance_row", inst)
+	headers := make(map[string]string)
+	keys := r.Form["header_key"]
+	values := r.Form["header_value"]
+	for i, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if err := proxy.ValidateHeaderName(k); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		v := ""
+		if i < len(values) {
+			v = strings.TrimSpace(values[i])
+		}
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
 
-	go func() {
-		if inst.ContainerID == "" {
-			containerID, err := h.docker.CreateContainer(context.Background(), inst)
-			if err != nil {
-				inst.Status = "error"
-				inst.ErrorMsg = err.Error()
-				_ = h.store.Update(inst)
-				return
-			}
-			inst.ContainerID = containerID
-		} else {
-			if err := h.docker.StartContainer(context.Background(), inst.ContainerID); err != nil {
-				inst.Status = "error"
-				inst.ErrorMsg = err.Error()
-				_ = h.store.Update(inst)
-				return
-			}
+	inst.ProxyHeaders = headers
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save proxy headers: "+err.Error())
+		return
+	}
+	// 只记录头名称，值可能是凭据
+	h.audit(r.Context(), h.actor(r), "proxy-headers", inst.ID, strings.Join(slices.Sorted(maps.Keys(headers)), ","))
+
+	// 代理路由可以直接热更新，无需重启容器
+	if h.proxy.IsRegistered(inst.ID) {
+		if err := h.registerProxy(inst); err != nil {
+			logctx.From(r.Context()).Error("Error re-registering proxy", "instance", inst.ID, "error", err)
 		}
-		inst.Status = "running"
-		_ = h.store.Update(inst)
-		_ = h.proxy.Register(inst.ID, inst.Port)
-	}()
+	}
+
+	w.Header().Set("HX-Redirect", h.url("/instances/"+inst.ID))
+	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) handleStopInstance(w http.ResponseWriter, r *http.Request) {
+// handleSaveLabels replaces the custom container labels of an instance.
+// Docker cannot change the labels of an existing container, so they are
+// only stored here and applied the next time the container is created;
+// the response says so instead of restarting the instance.
+func (h *Handler) handleSaveLabels(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Instance not found")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	labels := make(map[string]string)
+	keys := r.Form["label_key"]
+	values := r.Form["label_value"]
+	for i, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		v := ""
+		if i < len(values) {
+			v = strings.TrimSpace(values[i])
+		}
+		if err := docker.ValidateLabel(k, v); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		labels[k] = v
+	}
+	if len(labels) > docker.MaxCustomLabels {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("At most %d custom labels are allowed", docker.MaxCustomLabels))
+		return
+	}
+
+	changed := !maps.Equal(labels, inst.Labels)
+	inst.Labels = labels
+	if err := h.saveInstance(inst); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save labels: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "labels", inst.ID, strings.Join(slices.Sorted(maps.Keys(labels)), ","))
+
+	msg := fmt.Sprintf("Saved %d custom label(s).", len(labels))
+	if changed && inst.ContainerID != "" {
+		msg += " Labels cannot change on an existing container: they apply when the container is recreated (Restart recreates it)."
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<div class="alert alert-success">%s</div>`, template.HTMLEscapeString(msg))
+}
+
+// handleLogsDownload sends the container logs as a text file attachment.
+// ?tail= limits it to the last N lines; the default is the whole history.
+func (h *Handler) handleLogsDownload(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	inst, err := h.store.Get(id)
 	if err != nil {
@@ -379,28 +2719,38 @@ func (h *Handler) handleStopInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 先返回响应避免浏览器超时，容器操作在后台异步完成
-	inst.Status = "stopping"
-	_ = h.store.Update(inst)
-	h.proxy.Unregister(id)
-	h.renderPartial(w, "instance_row", inst)
+	if inst.ContainerID == "" {
+		http.Error(w, "Container not available", http.StatusBadRequest)
+		return
+	}
+	if !h.requireDocker(w, r) {
+		return
+	}
 
-	if inst.ContainerID != "" && h.docker != nil {
-		go func() {
-			if err := h.docker.StopContainer(context.Background(), inst.ContainerID); err != nil {
-				log.Printf("Error stopping container for %s: %v", id, err)
-				inst.Status = "error"
-				inst.ErrorMsg = err.Error()
-				_ = h.store.Update(inst)
-				return
-			}
-			inst.Status = "stopped"
-			_ = h.store.Update(inst)
-		}()
+	tail := r.URL.Query().Get("tail")
+	if tail == "" {
+		tail = "all"
+	}
+	if n, err := strconv.Atoi(tail); tail != "all" && (err != nil || n < 0) {
+		http.Error(w, `tail must be a number of lines or "all"`, http.StatusBadRequest)
+		return
+	}
+
+	reader, err := h.docker.ContainerLogs(r.Context(), inst.ContainerID, tail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": inst.Name + "-logs.txt"}))
+	if _, err := io.Copy(w, reader); err != nil && r.Context().Err() == nil {
+		logctx.From(r.Context()).Error("Error sending logs", "instance", id, "error", err)
 	}
 }
 
-func (h *Handler) handleRestartInstance(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	inst, err := h.store.Get(id)
 	if err != nil {
@@ -408,40 +2758,63 @@ func (h *Handler) handleRestartInstance(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if h.docker == nil {
-		respondError(w, "Docker is not available")
+	if inst.ContainerID == "" {
+		http.Error(w, "Container not available", http.StatusBadRequest)
+		return
+	}
+	if !h.requireDocker(w, r) {
 		return
 	}
 
-	// 先返回响应避免浏览器超时，容器操作在后台异步完成
-	inst.Status = "restarting"
-	inst.ErrorMsg = ""
-	_ = h.store.Update(inst)
-	h.proxy.Unregister(id)
-	h.renderPartial(w, "instance_row", inst)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logctx.From(r.Context()).Error("WebSocket upgrade failed for logs", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer h.registerSession(inst.ID, "logs", func(reason string) {
+		cancel()
+		closeWS(conn, reason)
+	})()
+
+	reader, err := h.docker.ContainerLogsStream(ctx, inst.ContainerID, "200")
+	if err != nil {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to stream logs: "+err.Error()))
+		return
+	}
+	defer reader.Close()
 
 	go func() {
-		// Remove old container and recreate to trigger entrypoint (updates dependencies)
-		if inst.ContainerID != "" {
-			_ = h.docker.StopContainer(context.Background(), inst.ContainerID)
-			_ = h.docker.RemoveContainer(context.Background(), inst.ContainerID)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
 		}
+	}()
 
-		containerID, err := h.docker.CreateContainer(context.Background(), inst)
+	buf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if writeErr := conn.WriteMessage(websocket.TextMessage, buf[:n]); writeErr != nil {
+				return
+			}
+		}
 		if err != nil {
-			inst.Status = "error"
-			inst.ErrorMsg = err.Error()
-			_ = h.store.Update(inst)
+			_ = conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "logs stream ended"))
 			return
 		}
-		inst.ContainerID = containerID
-		inst.Status = "running"
-		_ = h.store.Update(inst)
-		_ = h.proxy.Register(inst.ID, inst.Port)
-	}()
+	}
 }
 
-func (h *Handler) handleLogsWS(w http.ResponseWriter, r *http.Request) {
+// handleStatsWS pushes one docker.ContainerStats JSON frame per sample
+// (about every second) until the client disconnects or the container stops.
+func (h *Handler) handleStatsWS(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	inst, err := h.store.Get(id)
 	if err != nil {
@@ -449,14 +2822,17 @@ func (h *Handler) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if inst.ContainerID == "" || h.docker == nil {
+	if inst.ContainerID == "" {
 		http.Error(w, "Container not available", http.StatusBadRequest)
 		return
 	}
+	if !h.requireDocker(w, r) {
+		return
+	}
 
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed for logs: %v", err)
+		logctx.From(r.Context()).Error("WebSocket upgrade failed for stats", "error", err)
 		return
 	}
 	defer conn.Close()
@@ -464,12 +2840,12 @@ func (h *Handler) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	reader, err := h.docker.ContainerLogsStream(ctx, inst.ContainerID, "200")
+	stats, err := h.docker.ContainerStatsStream(ctx, inst.ContainerID)
 	if err != nil {
-		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to stream logs: "+err.Error()))
+		_ = conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "stats unavailable"))
 		return
 	}
-	defer reader.Close()
 
 	go func() {
 		for {
@@ -480,20 +2856,13 @@ func (h *Handler) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	buf := make([]byte, 4096)
-	for {
-		n, err := reader.Read(buf)
-		if n > 0 {
-			if writeErr := conn.WriteMessage(websocket.TextMessage, buf[:n]); writeErr != nil {
-				return
-			}
-		}
-		if err != nil {
-			_ = conn.WriteMessage(websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "logs stream ended"))
+	for s := range stats {
+		if err := conn.WriteJSON(s); err != nil {
 			return
 		}
 	}
+	_ = conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "stats stream ended"))
 }
 
 func (h *Handler) handleInstanceStatus(w http.ResponseWriter, r *http.Request) {
@@ -509,54 +2878,99 @@ func (h *Handler) handleInstanceStatus(w http.ResponseWriter, r *http.Request) {
 	// We compare against that instead of the DB status so the frontend always
 	// converges to the true state (fixes restart showing stale "removed").
 	clientStatus := r.URL.Query().Get("s")
-	if inst.ContainerID != "" && h.docker != nil {
-		if status, err := h.docker.ContainerStatus(r.Context(), inst.ContainerID); err == nil {
-			if status != inst.Status {
-				inst.Status = status
-				_ = h.store.Update(inst)
-			}
+	if statuses, err := h.instanceStatuses(); err == nil {
+		if status, ok := statuses[inst.ID]; ok {
+			inst.Status = status
 		}
 	}
 
-	if inst.Status == clientStatus {
+	// ?u= carries the time of the usage sample the row shows, so a row is
+	// re-rendered only when the collector has a newer sample.
+	h.attachUsage(inst)
+	sample := ""
+	if inst.Usage != nil {
+		sample = strconv.FormatInt(inst.Usage.SampledAt.Unix(), 10)
+	}
+	if inst.Status == clientStatus && sample == r.URL.Query().Get("u") {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	h.renderPartial(w, "instance_row", inst)
+	h.renderPartial(w, r, "instance_row", inst)
 }
 
 const instanceCookieName = "_cc_inst"
 
 func (h *Handler) handleProxy(w http.ResponseWriter, r *http.Request) {
+	markProxied(r)
 	id := r.PathValue("id")
+	h.setInstanceCookie(w, id)
+	if !h.proxy.IsRegistered(id) {
+		// 启动中的实例尚未注册代理，展示等待页而非 502
+		if inst, err := h.store.Get(id); err == nil {
+			switch inst.Status {
+			case "created", "starting", "restarting":
+				h.proxy.ServeWaiting(w, id, inst.Name)
+				return
+			case "stopped", "exited":
+				if h.opts.WakeOnTraffic && h.wakeInstance(r.Context(), id) {
+					h.proxy.ServeWaiting(w, id, inst.Name)
+					return
+				}
+			}
+		}
+	}
+	h.proxy.ServeHTTP(w, r, id)
+}
+
+// setInstanceCookie (re)issues the routing cookie with a sliding expiry so a
+// stale instance ID cannot keep capturing catch-all requests indefinitely.
+func (h *Handler) setInstanceCookie(w http.ResponseWriter, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  instanceCookieName,
+		Value: id,
+		// 即使配置了 base path 也保持 Path=/：opencode 资源请求走根路径的 catch-all
+		Path:     "/",
+		MaxAge:   int(h.opts.CookieTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearInstanceCookie(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     instanceCookieName,
-		Value:    id,
 		Path:     "/",
+		MaxAge:   -1,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	})
-	h.proxy.ServeHTTP(w, r, id)
 }
 
 func (h *Handler) handleCatchAll(w http.ResponseWriter, r *http.Request) {
-	instanceID := h.resolveInstanceID(r)
+	instanceID, fromCookie := h.resolveInstanceID(r)
 	if instanceID == "" {
 		http.NotFound(w, r)
 		return
 	}
+	markProxied(r)
 
+	// SPA 内部请求只依赖 cookie 路由时续期，避免活跃会话中途过期
+	if fromCookie {
+		h.setInstanceCookie(w, instanceID)
+	}
 	h.proxy.ServeHTTPDirect(w, r, instanceID)
 }
 
-func (h *Handler) resolveInstanceID(r *http.Request) string {
+// resolveInstanceID returns the target instance of a catch-all request and
+// whether it was taken from the routing cookie rather than the Referer.
+func (h *Handler) resolveInstanceID(r *http.Request) (string, bool) {
 	if id := extractInstanceIDFromReferer(r); id != "" {
-		return id
+		return id, false
 	}
 	if c, err := r.Cookie(instanceCookieName); err == nil && c.Value != "" {
-		return c.Value
+		return c.Value, true
 	}
-	return ""
+	return "", false
 }
 
 func extractInstanceIDFromReferer(r *http.Request) string {
@@ -579,6 +2993,286 @@ func extractInstanceIDFromReferer(r *http.Request) string {
 	return rest[:slashIdx]
 }
 
+// handleAuditAPI serves GET /api/v1/audit?action=&instance=&since=&page=&per_page=.
+// since accepts an RFC 3339 timestamp or a duration relative to now (e.g. "24h").
+func (h *Handler) handleAuditAPI(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.AuditFilter{
+		Action:     q.Get("action"),
+		InstanceID: q.Get("instance"),
+	}
+
+	if since := q.Get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.Since = t
+		} else if d, err := time.ParseDuration(since); err == nil {
+			filter.Since = time.Now().Add(-d)
+		} else {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an RFC 3339 timestamp or a duration"})
+			return
+		}
+	}
+
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage < 1 || perPage > 500 {
+		perPage = 50
+	}
+	filter.Limit = perPage
+	filter.Offset = (page - 1) * perPage
+
+	entries, total, err := h.store.QueryAudit(filter)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if entries == nil {
+		entries = []*store.AuditEntry{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries":  entries,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+// handleAuditPage renders the audit log, newest first, filtered by
+// ?action= and ?instance=.
+func (h *Handler) handleAuditPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.AuditFilter{
+		Action:     strings.TrimSpace(q.Get("action")),
+		InstanceID: strings.TrimSpace(q.Get("instance")),
+	}
+	page, err := positiveIntParam(q, "page", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	perPage, err := positiveIntParam(q, "per_page", defaultPerPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = min(perPage, maxPerPage)
+	filter.Offset = (page - 1) * filter.Limit
+
+	entries, total, err := h.store.QueryAudit(filter)
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "audit", map[string]interface{}{
+		"Entries":  entries,
+		"Filter":   filter,
+		"Filtered": filter.Action != "" || filter.InstanceID != "",
+		"Pager":    newPager(q, page, filter.Limit, total),
+		"Title":    "CloudCode - Audit Log",
+	})
+}
+
+// handleBatchStatus returns the status of every instance in one response,
+// served from the shared status sweep.
+func (h *Handler) handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	instances, err := h.store.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	statuses, err := h.instanceStatuses()
+	if err != nil {
+		logctx.From(r.Context()).Error("Error syncing container statuses", "error", err)
+	}
+	resp := make(map[string]string, len(instances))
+	for _, inst := range instances {
+		resp[inst.ID] = inst.Status
+		if status, ok := statuses[inst.ID]; ok {
+			resp[inst.ID] = status
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInstanceReady probes the instance backend and reports whether the
+// proxied Web UI can be served yet. The waiting page polls this endpoint.
+func (h *Handler) handleInstanceReady(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"ready": false, "detail": "instance not found"})
+		return
+	}
+
+	resp := map[string]interface{}{"ready": false, "status": inst.Status}
+	switch {
+	case inst.Status == "error":
+		resp["detail"] = "instance failed: " + inst.ErrorMsg
+	case inst.Status != "running":
+		resp["detail"] = "instance is " + inst.Status
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := proxy.Probe(ctx, inst.ID, inst.Port, "/"); err != nil {
+			resp["detail"] = "waiting for opencode: " + err.Error()
+		} else {
+			resp["ready"] = true
+			resp["detail"] = "ok"
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// volumeOwner identifies the instance a home volume belongs to.
+type volumeOwner struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// volumeOwners maps home volume names to the instances assigned to them,
+// including instances in the recycle bin whose volume is kept for restore.
+func (h *Handler) volumeOwners() (map[string]volumeOwner, error) {
+	instances, err := h.store.List()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := h.store.ListDeleted()
+	if err != nil {
+		return nil, err
+	}
+	instances = append(instances, deleted...)
+	owners := make(map[string]volumeOwner, len(instances))
+	for _, inst := range instances {
+		owners[docker.HomeVolumeName(inst)] = volumeOwner{ID: inst.ID, Name: inst.Name}
+	}
+	return owners, nil
+}
+
+func (h *Handler) handleListVolumes(w http.ResponseWriter, r *http.Request) {
+	if !h.requireDocker(w, r) {
+		return
+	}
+	volumes, err := h.docker.ListVolumes(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	owners, err := h.volumeOwners()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	// 体积统计可能较慢，失败时仍返回列表，size_bytes 保持 -1
+	sizes, err := h.docker.VolumeSizes(r.Context())
+	if err != nil {
+		logctx.From(r.Context()).Error("Error reading volume sizes", "error", err)
+	}
+
+	type volumeResp struct {
+		docker.VolumeInfo
+		Instance *volumeOwner `json:"instance"`
+	}
+	resp := make([]volumeResp, 0, len(volumes))
+	for _, v := range volumes {
+		if size, ok := sizes[v.Name]; ok {
+			v.SizeBytes = size
+		}
+		item := volumeResp{VolumeInfo: v}
+		if o, ok := owners[v.Name]; ok {
+			item.Instance = &o
+		}
+		resp = append(resp, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volumes": resp})
+}
+
+func (h *Handler) handleDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	if !h.requireDocker(w, r) {
+		return
+	}
+	name := r.PathValue("name")
+	owners, err := h.volumeOwners()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	// 属于现有实例的卷应通过删除实例来清理
+	if o, ok := owners[name]; ok {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("volume %q belongs to instance %s (%s)", name, o.Name, o.ID)})
+		return
+	}
+	if err := h.docker.RemoveVolume(r.Context(), name); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "volume_delete", "", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gpuDiagnostics summarizes GPU support for the diagnostics endpoint.
+func (h *Handler) gpuDiagnostics(ctx context.Context) map[string]interface{} {
+	d := map[string]interface{}{"enabled": h.opts.EnableGPU}
+	if h.docker == nil {
+		return d
+	}
+	info, err := h.docker.GPUInfo(ctx)
+	if err != nil {
+		d["error"] = err.Error()
+		return d
+	}
+	d["available"] = info.Available()
+	d["runtime"] = info.Runtime
+	d["devices"] = info.Devices
+	return d
+}
+
+// handleDiagnostics reports platform internals useful when debugging a
+// deployment.
+func (h *Handler) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"database": h.store.Stats(),
+		"docker":   h.docker != nil,
+		"leader":   h.isLeader(),
+		"gpu":      h.gpuDiagnostics(r.Context()),
+	})
+}
+
+// settingsValidation is the response of GET /settings/validate.
+type settingsValidation struct {
+	OK       bool                     `json:"ok"` // no errors; warnings are allowed
+	Errors   int                      `json:"errors"`
+	Warnings int                      `json:"warnings"`
+	Issues   []config.ValidationIssue `json:"issues"`
+}
+
+// handleValidateSettings runs every config check as a pre-flight. It returns
+// JSON, or the results partial for htmx requests from the settings page.
+func (h *Handler) handleValidateSettings(w http.ResponseWriter, r *http.Request) {
+	v := settingsValidation{Issues: h.config.Validate()}
+	if v.Issues == nil {
+		v.Issues = []config.ValidationIssue{}
+	}
+	for _, issue := range v.Issues {
+		if issue.Severity == config.SeverityError {
+			v.Errors++
+		} else {
+			v.Warnings++
+		}
+	}
+	v.OK = v.Errors == 0
+
+	if r.Header.Get("HX-Request") == "" {
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+	h.renderPartial(w, r, "settings_validation", v)
+}
+
 func (h *Handler) handleSettings(w http.ResponseWriter, r *http.Request) {
 	envVars, _ := h.config.GetEnvVars()
 	files := h.config.EditableFiles()
@@ -637,16 +3331,16 @@ func (h *Handler) handleSettings(w http.ResponseWriter, r *http.Request) {
 		"AgentsSkills": agentsSkills,
 		"ConfigDir":    h.config.RootDir(),
 	}
-	h.render(w, "settings", data)
+	h.render(w, r, "settings", data)
 }
 
-func (h *Handler) handleSaveEnvVars(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form data", http.StatusBadRequest)
-		return
-	}
-
+// envFromForm collects the env_key/env_value pairs of an environment
+// variable form. Rows without a key are dropped and values are trimmed at
+// both ends. Every key must be a valid variable name; the error lists all
+// that are not, so they can be fixed in one go.
+func envFromForm(r *http.Request) (map[string]string, error) {
 	env := make(map[string]string)
+	var invalid []string
 	keys := r.Form["env_key"]
 	values := r.Form["env_value"]
 	for i, k := range keys {
@@ -654,31 +3348,139 @@ func (h *Handler) handleSaveEnvVars(w http.ResponseWriter, r *http.Request) {
 		if k == "" {
 			continue
 		}
+		if !config.ValidEnvKey(k) {
+			invalid = append(invalid, strconv.Quote(k))
+			continue
+		}
 		v := ""
 		if i < len(values) {
 			v = strings.TrimSpace(values[i])
 		}
 		env[k] = v
 	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid variable names: %s (use letters, digits and _, not starting with a digit)", strings.Join(invalid, ", "))
+	}
+	return env, nil
+}
+
+func (h *Handler) handleSaveEnvVars(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	env, err := envFromForm(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err := h.config.SetEnvVars(env); err != nil {
-		respondError(w, "Failed to save environment variables: "+err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Failed to save environment variables: "+err.Error())
 		return
 	}
+	// 只记录变量名，值通常是 API key
+	h.audit(r.Context(), h.actor(r), "settings-env", "", strings.Join(slices.Sorted(maps.Keys(env)), ","))
 
-	w.Header().Set("HX-Redirect", "/settings")
+	w.Header().Set("HX-Redirect", h.url("/settings"))
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleImportEnvVars merges the variables of an uploaded .env file into
+// the global environment, see readDotEnv.
+func (h *Handler) handleImportEnvVars(w http.ResponseWriter, r *http.Request) {
+	imported, malformed, ok := readDotEnv(w, r)
+	if !ok {
+		return
+	}
+	env, err := h.config.GetEnvVars()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to read environment variables: "+err.Error())
+		return
+	}
+	if env == nil {
+		env = make(map[string]string)
+	}
+	maps.Copy(env, imported)
+	if err := h.config.SetEnvVars(env); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to save environment variables: "+err.Error())
+		return
+	}
+	h.audit(r.Context(), h.actor(r), "settings-env-import", "", strings.Join(slices.Sorted(maps.Keys(imported)), ","))
+
+	h.respondEnvImport(w, r, "env-rows", env, imported, malformed)
+}
+
+// maxDotEnvSize bounds an uploaded .env file.
+const maxDotEnvSize = 1 << 20
+
+// readDotEnv parses the .env file uploaded as "file", or pasted into the
+// "content" field when no file is given. Malformed lines are reported
+// back rather than failing the import, unless nothing else could be
+// parsed. On failure it writes the error response and returns ok false.
+func readDotEnv(w http.ResponseWriter, r *http.Request) (env map[string]string, malformed []string, ok bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxDotEnvSize+1<<16)
+	if err := r.ParseMultipartForm(maxDotEnvSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		writeError(w, r, http.StatusBadRequest, "Invalid upload: "+err.Error())
+		return nil, nil, false
+	}
+	content := r.FormValue("content")
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxDotEnvSize+1))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Failed to read upload: "+err.Error())
+			return nil, nil, false
+		}
+		if len(data) > maxDotEnvSize {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf(".env file exceeds %d KiB", maxDotEnvSize>>10))
+			return nil, nil, false
+		}
+		content = string(data)
+	}
+
+	env, malformed = config.ParseDotEnv(content)
+	if len(env) == 0 {
+		msg := "No variables found; expected KEY=VALUE lines"
+		if len(malformed) > 0 {
+			msg = "No variables imported: " + strings.Join(malformed, "; ")
+		}
+		writeError(w, r, http.StatusBadRequest, msg)
+		return nil, nil, false
+	}
+	return env, malformed, true
+}
+
+// respondEnvImport reports an import: HTML clients (see wantsHTML) get the
+// result message plus the refreshed variable rows, swapped out of band into
+// rowsID so the form does not save stale values over the import; others
+// get JSON.
+func (h *Handler) respondEnvImport(w http.ResponseWriter, r *http.Request, rowsID string, env, imported map[string]string, malformed []string) {
+	if !wantsHTML(r) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"imported":  slices.Sorted(maps.Keys(imported)),
+			"malformed": malformed,
+		})
+		return
+	}
+	h.renderPartial(w, r, "env_import_result", map[string]any{
+		"Imported":  len(imported),
+		"Malformed": malformed,
+		"Env":       env,
+		"RowsID":    rowsID,
+	})
+}
+
 func (h *Handler) handleGetConfigFile(w http.ResponseWriter, r *http.Request) {
 	relPath := r.URL.Query().Get("path")
 	if relPath == "" {
-		http.Error(w, "path is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "path is required")
 		return
 	}
 	content, err := h.config.ReadFile(relPath)
 	if err != nil {
-		http.Error(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "Failed to read file: "+err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -687,36 +3489,37 @@ func (h *Handler) handleGetConfigFile(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) handleSaveConfigFile(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
 		return
 	}
 
 	relPath := r.FormValue("path")
 	content := r.FormValue("content")
 	if relPath == "" {
-		http.Error(w, "path is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "path is required")
 		return
 	}
 
 	if err := h.config.WriteFile(relPath, content); err != nil {
-		respondError(w, "Failed to save file: "+err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Failed to save file: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "settings-file", "", relPath)
 
-	w.Header().Set("HX-Redirect", "/settings")
+	w.Header().Set("HX-Redirect", h.url("/settings"))
 	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handler) handleListDirFiles(w http.ResponseWriter, r *http.Request) {
 	dirName := r.URL.Query().Get("dir")
 	if dirName == "" {
-		http.Error(w, "dir is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "dir is required")
 		return
 	}
 
 	files, err := h.config.ListDirFiles(dirName)
 	if err != nil {
-		http.Error(w, "Failed to list files: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "Failed to list files: "+err.Error())
 		return
 	}
 
@@ -726,7 +3529,7 @@ func (h *Handler) handleListDirFiles(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) handleSaveDirFile(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid form data")
 		return
 	}
 
@@ -734,7 +3537,7 @@ func (h *Handler) handleSaveDirFile(w http.ResponseWriter, r *http.Request) {
 	filename := r.FormValue("filename")
 	content := r.FormValue("content")
 	if dir == "" || filename == "" {
-		http.Error(w, "dir and filename are required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "dir and filename are required")
 		return
 	}
 
@@ -746,76 +3549,100 @@ func (h *Handler) handleSaveDirFile(w http.ResponseWriter, r *http.Request) {
 		relPath = filepath.Join(config.DirOpenCodeConfig, dir, filename)
 	}
 	if err := h.config.WriteFile(relPath, content); err != nil {
-		respondError(w, "Failed to save file: "+err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Failed to save file: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "settings-file", "", relPath)
 
-	w.Header().Set("HX-Redirect", "/settings")
+	w.Header().Set("HX-Redirect", h.url("/settings"))
 	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handler) handleDeleteDirFile(w http.ResponseWriter, r *http.Request) {
 	relPath := r.URL.Query().Get("path")
 	if relPath == "" {
-		http.Error(w, "path is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "path is required")
 		return
 	}
 
 	if err := h.config.DeleteFile(relPath); err != nil {
-		respondError(w, "Failed to delete file: "+err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Failed to delete file: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "settings-file-delete", "", relPath)
 
-	w.Header().Set("HX-Redirect", "/settings")
+	w.Header().Set("HX-Redirect", h.url("/settings"))
 	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handler) handleDeleteAgentsSkill(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 	if name == "" {
-		http.Error(w, "name is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "name is required")
 		return
 	}
 
 	if err := h.config.DeleteAgentsSkill(name); err != nil {
-		respondError(w, "Failed to delete skill: "+err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Failed to delete skill: "+err.Error())
 		return
 	}
+	h.audit(r.Context(), h.actor(r), "skill-delete", "", name)
 
-	w.Header().Set("HX-Redirect", "/settings")
+	w.Header().Set("HX-Redirect", h.url("/settings"))
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) render(w http.ResponseWriter, name string, data interface{}) {
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
 	t, ok := h.tmpls[name]
 	if !ok {
-		log.Printf("Template not found: %s", name)
+		logctx.From(r.Context()).Error("Template not found", "template", name)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := t.ExecuteTemplate(w, "base", data); err != nil {
-		log.Printf("Template render error (%s): %v", name, err)
+		logctx.From(r.Context()).Error("Template render error", "template", name, "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
-func (h *Handler) renderPartial(w http.ResponseWriter, name string, data interface{}) {
+func (h *Handler) renderPartial(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
 	t, ok := h.tmpls[name]
 	if !ok {
-		log.Printf("Partial template not found: %s", name)
+		logctx.From(r.Context()).Error("Partial template not found", "template", name)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := t.ExecuteTemplate(w, name, data); err != nil {
-		log.Printf("Partial render error (%s): %v", name, err)
+		logctx.From(r.Context()).Error("Partial render error", "template", name, "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
-var wsUpgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// checkWSOrigin guards the terminal and log WebSockets against cross-site
+// hijacking. Requests without an Origin header (non-browser clients) are
+// allowed; browser requests must come from the same host or an origin
+// listed in Options.WSAllowedOrigins, unless WSAllowAnyOrigin is set.
+func (h *Handler) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || h.opts.WSAllowAnyOrigin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range h.opts.WSAllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	logctx.From(r.Context()).Warn("Rejected WebSocket from a foreign origin", "origin", origin, "host", r.Host)
+	return false
 }
 
 func (h *Handler) handleTerminalPage(w http.ResponseWriter, r *http.Request) {
@@ -829,8 +3656,9 @@ func (h *Handler) handleTerminalPage(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
 		"Instance": inst,
 		"Title":    fmt.Sprintf("CloudCode - %s Terminal", inst.Name),
+		"Record":   wantsRecording(r),
 	}
-	h.render(w, "terminal", data)
+	h.render(w, r, "terminal", data)
 }
 
 func (h *Handler) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
@@ -841,32 +3669,51 @@ func (h *Handler) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if inst.ContainerID == "" || h.docker == nil {
+	if inst.ContainerID == "" {
 		http.Error(w, "Container not available", http.StatusBadRequest)
 		return
 	}
+	if !h.requireDocker(w, r) {
+		return
+	}
 
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		logctx.From(r.Context()).Error("WebSocket upgrade failed", "error", err)
 		return
 	}
 	defer conn.Close()
 
 	ctx := r.Context()
 
-	execID, err := h.docker.ExecCreate(ctx, inst.ContainerID, []string{"/bin/bash", "-l"})
+	execID, err := h.docker.ExecCreate(ctx, inst.ContainerID, inst.ContainerWorkDir(), []string{"/bin/bash", "-l"})
 	if err != nil {
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to create exec: "+err.Error()))
+		_ = conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to create exec"))
 		return
 	}
 
 	hijacked, err := h.docker.ExecAttach(ctx, execID)
 	if err != nil {
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to attach exec: "+err.Error()))
+		_ = conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to attach exec"))
 		return
 	}
 	defer hijacked.Close()
+	// 关闭 exec 连接让输出循环立即结束，不必等 shell 退出
+	defer h.registerSession(inst.ID, "terminal", func(reason string) {
+		closeWS(conn, reason)
+		hijacked.Close()
+	})()
+
+	var rec *recording.Recorder
+	if wantsRecording(r) {
+		if rec = h.startRecording(inst, r); rec != nil {
+			defer rec.Close()
+		}
+	}
 
 	done := make(chan struct{})
 
@@ -876,11 +3723,16 @@ func (h *Handler) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
 		for {
 			n, err := hijacked.Reader.Read(buf)
 			if n > 0 {
+				if rec != nil {
+					rec.Output(buf[:n])
+				}
 				if writeErr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); writeErr != nil {
 					return
 				}
 			}
 			if err != nil {
+				// 进程退出（包括 attach 时已经退出）后 Reader 返回 EOF，发送关闭帧让浏览器正常结束会话
+				_ = conn.WriteMessage(websocket.CloseMessage, h.terminalCloseFrame(execID, err))
 				return
 			}
 		}
@@ -904,6 +3756,9 @@ func (h *Handler) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
 				var rm resizeMsg
 				if json.Unmarshal(msg, &rm) == nil && rm.Type == "resize" {
 					_ = h.docker.ExecResize(ctx, execID, rm.Rows, rm.Cols)
+					if rec != nil {
+						rec.Resize(rm.Cols, rm.Rows)
+					}
 					continue
 				}
 			}
@@ -917,7 +3772,84 @@ func (h *Handler) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
 	<-done
 }
 
-func respondError(w http.ResponseWriter, msg string) {
+// maxCloseReason is the longest reason a WebSocket close frame can carry.
+const maxCloseReason = 123
+
+// terminalCloseFrame builds the close frame sent when the output of a
+// terminal exec ends: a normal closure with the exit code once the shell
+// has exited, an internal error when reading from Docker failed.
+func (h *Handler) terminalCloseFrame(execID string, readErr error) []byte {
+	if !errors.Is(readErr, io.EOF) {
+		reason := "terminal stream failed: " + readErr.Error()
+		if len(reason) > maxCloseReason {
+			// 截断可能切开多字节字符，而关闭原因必须是合法的 UTF-8
+			reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+		}
+		return websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPingTimeout)
+	defer cancel()
+	reason := "session ended"
+	if code, err := h.docker.ExecExitCode(ctx, execID); err == nil && code >= 0 {
+		reason = fmt.Sprintf("session ended (exit code %d)", code)
+	}
+	return websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+}
+
+// registerProxy (re-)registers the reverse proxy route for an instance
+// using its per-instance proxy settings.
+func (h *Handler) registerProxy(inst *store.Instance) error {
+	return h.proxy.Register(inst.ID, inst.Port, proxy.RouteOptions{
+		Headers: inst.ProxyHeaders,
+		Name:    inst.Name,
+	})
+}
+
+// audit records an action in the audit log. Failures are logged but never
+// affect the primary action.
+func (h *Handler) audit(ctx context.Context, actor, action, instanceID, detail string) {
+	if err := h.store.LogAudit(actor, action, instanceID, detail); err != nil {
+		logctx.From(ctx).Error("Error writing audit log", "action", action, "instance", instanceID, "error", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError reports a failed request with status. HTMX requests and
+// clients that prefer HTML get an alert fragment, which app.js swaps into
+// the request's target or shows as a toast; API clients get
+// {"error": msg}.
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if !wantsHTML(r) {
+		writeJSON(w, status, map[string]string{"error": msg})
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
 	fmt.Fprintf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(msg))
 }
+
+// wantsHTML reports whether r comes from HTMX or lists text/html before
+// application/json in its Accept header. Quality values are ignored:
+// browsers list the type they prefer first.
+func wantsHTML(r *http.Request) bool {
+	if r.Header.Get("HX-Request") != "" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for part := range strings.SplitSeq(accept, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			switch strings.TrimSpace(mediaType) {
+			case "text/html":
+				return true
+			case "application/json":
+				return false
+			}
+		}
+	}
+	return false
+}
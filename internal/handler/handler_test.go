@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/config"
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/proxy"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// newTestHandler returns a Handler over a fresh store and config directory
+// in t.TempDir, with its routes mounted. dm may be nil.
+func newTestHandler(t *testing.T, dm *docker.Manager, opts Options) (*Handler, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := store.New(dir, store.Options{})
+	if err != nil {
+		t.Fatalf("store.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	cfg, err := config.NewManager(dir)
+	if err != nil {
+		t.Fatalf("config.NewManager: %v", err)
+	}
+	h := New(s, dm, proxy.New(proxy.Options{BasePath: opts.BasePath}), cfg, stubTemplates(), opts)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+	return h, h.Mount(mux)
+}
+
+// stubTemplates returns templates that render only their own name, for
+// tests that check what a handler renders rather than how it looks.
+func stubTemplates() map[string]*template.Template {
+	tmpls := make(map[string]*template.Template)
+	for _, name := range []string{
+		"dashboard", "instance_detail", "new_instance", "settings", "settings_image", "status", "terminal", "audit",
+		"instance_row", "bulk_result", "cleanup_result", "delete_preview", "env_import_result",
+		"file_browser", "file_upload_result", "image_pull_result", "settings_validation",
+	} {
+		tmpls[name] = template.Must(template.New(name).Parse(`{{define "` + name + `"}}` + name + `{{end}}{{define "base"}}` + name + `{{end}}`))
+	}
+	return tmpls
+}
+
+// serve sends r through handler and returns the recorded response.
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// createTestInstance stores an instance directly, bypassing the handler.
+func createTestInstance(t *testing.T, h *Handler, inst *store.Instance) *store.Instance {
+	t.Helper()
+	if inst.ID == "" {
+		inst.ID = uuid.New().String()[:8]
+	}
+	if inst.Status == "" {
+		inst.Status = "stopped"
+	}
+	if err := h.store.Create(inst); err != nil {
+		t.Fatalf("create instance %s: %v", inst.Name, err)
+	}
+	return inst
+}
+
+// testImage is the instance image of the fake daemon from newTestDocker.
+const testImage = "cloudcode-test:latest"
+
+// newTestDocker starts a fake Docker daemon holding testImage and returns
+// a Manager talking to it.
+func newTestDocker(t *testing.T, opts docker.Options) (*docker.Manager, *dockertest.Server) {
+	t.Helper()
+	srv := dockertest.NewServer(t)
+	srv.AddImage(testImage)
+	t.Setenv("DOCKER_HOST", srv.Host())
+	dm, err := docker.NewManager(testImage, nil, opts)
+	if err != nil {
+		t.Fatalf("docker.NewManager: %v", err)
+	}
+	t.Cleanup(func() { dm.Close() })
+	return dm, srv
+}
+
+// addInstanceContainer adds a managed container for instance id to the fake
+// daemon, as CreateContainer would have, and returns its ID.
+func addInstanceContainer(srv *dockertest.Server, id string, state container.ContainerState) string {
+	return srv.AddContainer(dockertest.Container{
+		Name:  docker.ContainerName(id),
+		State: state,
+		Config: &container.Config{
+			Image:  testImage,
+			Labels: map[string]string{"cloudcode.managed": "true", "cloudcode.instance-id": id},
+		},
+	})
+}
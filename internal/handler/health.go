@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// healthTimeout bounds each dependency check of the health endpoints.
+const healthTimeout = 3 * time.Second
+
+// handleHealthz is the liveness probe: 200 {"status":"ok"} as long as the
+// SQLite database answers a query.
+func (h *Handler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	if err := h.store.Ping(ctx); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "error", "database": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz is the readiness probe. Besides the database it checks that
+// the Docker daemon answers a ping; with -no-docker the Docker check is
+// reported as skipped instead of failing.
+func (h *Handler) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	checks := map[string]string{"database": "ok", "docker": "ok"}
+	ready := true
+	if err := h.store.Ping(ctx); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	}
+	if h.docker == nil {
+		checks["docker"] = "skipped"
+	} else if err := h.docker.Ping(ctx); err != nil {
+		checks["docker"] = err.Error()
+		ready = false
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "error", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// systemActor is the audit actor of actions CloudCode takes on its own,
+// such as stopping an idle instance.
+const systemActor = "system"
+
+// FlushAccess writes when this replica's proxy last served each instance
+// to the store, together with now for instances that have an open log or
+// terminal session here, so that the leader's idle check also sees
+// traffic and sessions on other replicas. Only times that moved since the
+// previous flush are written.
+func (h *Handler) FlushAccess(now time.Time) {
+	times := h.proxy.Activity()
+	h.sessionsMu.Lock()
+	for id := range h.sessions {
+		times[id] = now
+	}
+	h.sessionsMu.Unlock()
+
+	h.accessMu.Lock()
+	defer h.accessMu.Unlock()
+	changed := make(map[string]time.Time)
+	for id, t := range times {
+		if t.After(h.flushedAccess[id]) {
+			changed[id] = t
+		}
+	}
+	if err := h.store.TouchAccess(changed); err != nil {
+		log.Printf("Saving proxy access times failed: %v", err)
+		return
+	}
+	for id, t := range changed {
+		h.flushedAccess[id] = t
+	}
+}
+
+// StopIdleInstances stops running instances that have seen no proxy
+// traffic for Options.IdleTimeout, as of now, on this replica or on any
+// other that flushed its access times (see FlushAccess). Instances with an
+// open log or terminal session, adopted ones and those without a proxy
+// route are left alone. It returns the IDs it stopped. Only the leader
+// stops anything.
+func (h *Handler) StopIdleInstances(ctx context.Context, now time.Time) []string {
+	if h.opts.IdleTimeout <= 0 || h.docker == nil || !h.isLeader() {
+		return nil
+	}
+	instances, err := h.store.List()
+	if err != nil {
+		log.Printf("Idle check failed: %v", err)
+		return nil
+	}
+	// 其他副本代理的流量只能从数据库得知，读取失败时仅按本地记录判断
+	shared, err := h.store.LastAccess()
+	if err != nil {
+		log.Printf("Idle check: %v", err)
+	}
+
+	var stopped []string
+	for _, inst := range instances {
+		if inst.Status != "running" || inst.Adopted || inst.ContainerID == "" {
+			continue
+		}
+		last, ok := h.proxy.LastAccess(inst.ID)
+		if !ok || h.hasSessions(inst.ID) {
+			continue
+		}
+		if t := shared[inst.ID]; t.After(last) {
+			last = t
+		}
+		if now.Sub(last) < h.opts.IdleTimeout {
+			continue
+		}
+		log.Printf("Stopping idle instance %s (no proxy traffic since %s)", inst.ID, last.Format(time.RFC3339))
+		h.stopInstance(ctx, inst, systemActor)
+		stopped = append(stopped, inst.ID)
+	}
+	return stopped
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/proxy"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestStopIdleInstances(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{IdleTimeout: 10 * time.Minute})
+	for i, id := range []string{"idle", "remote", "session", "stopped"} {
+		status := "running"
+		if id == "stopped" {
+			status = "stopped"
+		}
+		cid := addInstanceContainer(srv, id, container.StateRunning)
+		createTestInstance(t, h, &store.Instance{ID: id, Name: id, Status: status, ContainerID: cid, Port: 10001 + i})
+		if err := h.proxy.Register(id, 10001+i, proxy.RouteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 注册路由算一次访问；一小时后本副本看来全部空闲
+	now := time.Now().Add(time.Hour)
+	// 另一个副本五分钟前代理过 remote
+	if err := h.store.TouchAccess(map[string]time.Time{"remote": now.Add(-5 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	unregister := h.registerSession("session", "terminal", func(string) {})
+	defer unregister()
+
+	stopped := h.StopIdleInstances(context.Background(), now)
+	if want := []string{"idle"}; !slices.Equal(stopped, want) {
+		t.Fatalf("stopped = %v, want %v", stopped, want)
+	}
+	waitCall(t, srv, "POST", "/containers/*/stop")
+	waitOps(t, h)
+	if c, _ := srv.Container(docker.ContainerName("idle")); c.State != container.StateExited {
+		t.Errorf("idle container state = %q, want exited", c.State)
+	}
+	entries, _, err := h.store.QueryAudit(store.AuditFilter{Action: "stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != systemActor || entries[0].InstanceID != "idle" {
+		t.Errorf("stop audit = %+v, want one entry for idle by %q", entries, systemActor)
+	}
+}
+
+func TestFlushAccess(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	if err := h.proxy.Register("routed", 10001, proxy.RouteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	unregister := h.registerSession("terminal", "terminal", func(string) {})
+	defer unregister()
+
+	now := time.Now().Add(time.Hour)
+	h.FlushAccess(now)
+	times, err := h.store.LastAccess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routed, _ := h.proxy.LastAccess("routed")
+	if !times["routed"].Equal(routed.Truncate(time.Millisecond)) {
+		t.Errorf("routed = %v, want %v", times["routed"], routed)
+	}
+	if !times["terminal"].Equal(now.Truncate(time.Millisecond)) {
+		t.Errorf("instance with a session = %v, want %v", times["terminal"], now)
+	}
+
+	// 存储的时间只会前进
+	if err := h.store.TouchAccess(map[string]time.Time{"terminal": now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	times, _ = h.store.LastAccess()
+	if !times["terminal"].Equal(now.Truncate(time.Millisecond)) {
+		t.Errorf("access time moved back to %v", times["terminal"])
+	}
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// imagePullKey tracks the manual image pull in the progress tracker,
+// alongside instance creations keyed by instance ID.
+const imagePullKey = "image-pull"
+
+// imagePullTimeout bounds a manual pull; it outlives the request so
+// closing the page doesn't abort a half-downloaded image.
+const imagePullTimeout = 30 * time.Minute
+
+// imagePullResult is the outcome of POST /settings/image/pull.
+type imagePullResult struct {
+	Image     string `json:"image"`
+	OldDigest string `json:"old_digest"`
+	NewDigest string `json:"new_digest"`
+	Changed   bool   `json:"changed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleImageSettings shows the instance image and its local digest.
+func (h *Handler) handleImageSettings(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title":  "CloudCode - Image",
+		"Docker": h.docker != nil,
+	}
+	if h.docker != nil {
+		data["Image"] = h.docker.Image()
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		digest, err := h.docker.ImageDigest(ctx)
+		if err != nil {
+			data["DigestError"] = err.Error()
+		}
+		data["Digest"] = digest
+		data["Pulling"] = h.imagePulling.Load()
+	}
+	h.render(w, r, "settings_image", data)
+}
+
+// handleImagePull pulls the latest image tag and reports whether the local
+// digest changed. Progress is published under imagePullKey and streamed by
+// handleImagePullWS; the request itself returns once the pull finishes.
+func (h *Handler) handleImagePull(w http.ResponseWriter, r *http.Request) {
+	htmx := r.Header.Get("HX-Request") != ""
+	if err := h.dockerErr(r.Context()); err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if !h.imagePulling.CompareAndSwap(false, true) {
+		writeError(w, r, http.StatusConflict, "An image pull is already in progress")
+		return
+	}
+	defer h.imagePulling.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), imagePullTimeout)
+	defer cancel()
+
+	res := imagePullResult{Image: h.docker.Image()}
+	// 本地尚无镜像时 digest 为空，拉取后一定视为变化
+	res.OldDigest, _ = h.docker.ImageDigest(ctx)
+
+	status := http.StatusOK
+	if err := h.docker.PullImage(ctx, h.progressFunc(imagePullKey)); err != nil {
+		logctx.From(r.Context()).Error("Manual image pull failed", "error", err)
+		h.progress.set(imagePullKey, docker.Progress{Phase: docker.PhaseError, Message: err.Error()})
+		res.Error = err.Error()
+		status = http.StatusBadGateway
+	} else if res.NewDigest, err = h.docker.ImageDigest(ctx); err != nil {
+		res.Error = err.Error()
+		status = http.StatusInternalServerError
+		h.progress.set(imagePullKey, docker.Progress{Phase: docker.PhaseError, Message: err.Error()})
+	} else {
+		res.Changed = res.NewDigest != res.OldDigest
+		msg := "Image is up to date"
+		if res.Changed {
+			msg = "Pulled a new image"
+		}
+		h.progress.set(imagePullKey, docker.Progress{Phase: docker.PhaseDone, Percent: 100, Message: msg})
+		h.audit(r.Context(), h.actor(r), "image-pull", "", fmt.Sprintf("%s %s -> %s", res.Image, res.OldDigest, res.NewDigest))
+	}
+
+	if !htmx {
+		writeJSON(w, status, res)
+		return
+	}
+	h.renderPartial(w, r, "image_pull_result", res)
+}
+
+// handleImagePullWS streams the progress of the running manual pull as
+// docker.Progress JSON frames, closing after the final one. Clients open
+// it before POSTing /settings/image/pull so no early events are missed.
+func (h *Handler) handleImagePullWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logctx.From(r.Context()).Error("WebSocket upgrade failed for image pull", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	last, tracked, updates, unsubscribe := h.progress.subscribe(imagePullKey)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	final := func(p docker.Progress) bool {
+		return p.Phase == docker.PhaseDone || p.Phase == docker.PhaseError
+	}
+	// 上一次拉取的最终结果会保留一段时间，忽略它，只推送进行中的拉取
+	if tracked && !final(last) {
+		if err := conn.WriteJSON(last); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-updates:
+			if err := conn.WriteJSON(p); err != nil {
+				return
+			}
+			if final(p) {
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "pull finished"))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestLogsDownload(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	raw := slices.Concat(
+		dockertest.Frame(stdcopy.Stdout, "2026-01-01T00:00:00Z listening on :4096\n"),
+		dockertest.Frame(stdcopy.Stderr, "2026-01-01T00:00:01Z warn: slow start\n"),
+		dockertest.Frame(stdcopy.Stdout, "2026-01-01T00:00:02Z ready\n"),
+	)
+	cid := srv.AddContainer(dockertest.Container{
+		Name:    docker.ContainerName("lg"),
+		State:   container.StateRunning,
+		RawLogs: raw,
+	})
+	createTestInstance(t, h, &store.Instance{ID: "lg", Name: "my app", ContainerID: cid})
+
+	rec := serve(mux, httptest.NewRequest("GET", "/instances/lg/logs/download?tail=100", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	// 多路复用的帧头被去掉，stdout 和 stderr 按原顺序合并
+	want := "2026-01-01T00:00:00Z listening on :4096\n" +
+		"2026-01-01T00:00:01Z warn: slow start\n" +
+		"2026-01-01T00:00:02Z ready\n"
+	if rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body, want)
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="my app-logs.txt"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	calls := srv.Calls("GET", "/containers/*/logs")
+	if len(calls) != 1 || calls[0].Query.Get("tail") != "100" || calls[0].Query.Get("follow") == "1" {
+		t.Errorf("logs requests = %+v, want one non-following request with tail=100", calls)
+	}
+
+	for _, tail := range []string{"-1", "some"} {
+		if rec := serve(mux, httptest.NewRequest("GET", "/instances/lg/logs/download?tail="+tail, nil)); rec.Code != http.StatusBadRequest {
+			t.Errorf("tail=%s: status %d, want 400", tail, rec.Code)
+		}
+	}
+}
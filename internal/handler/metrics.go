@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/naiba/cloudcode/internal/metrics"
+)
+
+// registerMetrics registers the gauges computed from handler state at
+// scrape time in the Handler's own registry, so several Handlers (as in
+// tests) do not report each other's instances. Container operation and
+// proxy request counters live in metrics.Default, from the docker and
+// proxy packages.
+func (h *Handler) registerMetrics() {
+	h.metrics = metrics.NewRegistry()
+	h.metrics.Register(metrics.NewGaugeVecFunc(
+		"cloudcode_instances",
+		"Instances by stored status, excluding the recycle bin.",
+		[]string{"status"},
+		func() []metrics.Sample {
+			instances, err := h.store.List()
+			if err != nil {
+				log.Printf("Metrics: list instances: %v", err)
+				return nil
+			}
+			counts := make(map[string]int)
+			for _, inst := range instances {
+				counts[inst.Status]++
+			}
+			var samples []metrics.Sample
+			for _, status := range slices.Sorted(maps.Keys(counts)) {
+				samples = append(samples, metrics.Sample{LabelValues: []string{status}, Value: float64(counts[status])})
+			}
+			return samples
+		},
+	))
+	h.metrics.Register(metrics.NewGaugeFunc(
+		"cloudcode_instances_deleted",
+		"Instances in the recycle bin.",
+		func() float64 {
+			deleted, err := h.store.ListDeleted()
+			if err != nil {
+				log.Printf("Metrics: list deleted instances: %v", err)
+			}
+			return float64(len(deleted))
+		},
+	))
+	h.metrics.Register(metrics.NewGaugeFunc(
+		"cloudcode_proxy_registrations",
+		"Instances with a registered reverse proxy route.",
+		func() float64 { return float64(h.proxy.Count()) },
+	))
+	h.metrics.Register(metrics.NewGaugeFunc(
+		"cloudcode_port_pool_size",
+		"Ports in the instance port range.",
+		func() float64 { return float64(h.portPool.Size()) },
+	))
+	h.metrics.Register(metrics.NewGaugeFunc(
+		"cloudcode_port_pool_used",
+		"Ports of the instance port range in use.",
+		func() float64 { return float64(h.portPool.InUse()) },
+	))
+}
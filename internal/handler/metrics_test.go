@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// scrape fetches /metrics and sums the samples of each metric name.
+func scrape(t *testing.T, mux http.Handler) map[string]float64 {
+	t.Helper()
+	rec := serve(mux, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d", rec.Code)
+	}
+	sums := make(map[string]float64)
+	for line := range strings.Lines(rec.Body.String()) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "{")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %v", line, err)
+		}
+		sums[name] += v
+	}
+	return sums
+}
+
+func TestMetricsAfterCreate(t *testing.T) {
+	dm, _ := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	// 另一个 Handler 的实例不应出现在这里
+	other, _ := newTestHandler(t, nil, Options{})
+	createTestInstance(t, other, &store.Instance{Name: "other", Status: "running"})
+
+	if got := scrape(t, mux)["cloudcode_instances"]; got != 0 {
+		t.Fatalf("cloudcode_instances before create = %v, want 0", got)
+	}
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"scraped"}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	waitOps(t, h)
+
+	sums := scrape(t, mux)
+	if got := sums["cloudcode_instances"]; got != 1 {
+		t.Errorf("cloudcode_instances = %v, want 1", got)
+	}
+	if got := sums["cloudcode_port_pool_used"]; got != 1 {
+		t.Errorf("cloudcode_port_pool_used = %v, want 1", got)
+	}
+	if got := sums["cloudcode_container_operations_total"]; got == 0 {
+		t.Errorf("cloudcode_container_operations_total missing from %v", sums)
+	}
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// versionExecTimeout bounds running opencode --version in a container.
+const versionExecTimeout = 10 * time.Second
+
+// errVersionUnavailable is returned by opencodeVersion while the container
+// is not running or opencode is not installed in it yet.
+var errVersionUnavailable = errors.New("opencode is not available yet")
+
+// cachedVersion is the opencode version reported by one container.
+type cachedVersion struct {
+	containerID string
+	version     string
+}
+
+// opencodeVersion returns the opencode version the instance's container
+// runs. The answer is cached per container, so it is looked up again only
+// after the container is recreated, e.g. with a new image.
+func (h *Handler) opencodeVersion(ctx context.Context, inst *store.Instance) (string, error) {
+	if inst.ContainerID == "" || inst.Status != "running" {
+		return "", errVersionUnavailable
+	}
+	h.versionsMu.Lock()
+	cached, ok := h.versions[inst.ID]
+	h.versionsMu.Unlock()
+	if ok && cached.containerID == inst.ContainerID {
+		return cached.version, nil
+	}
+	if err := h.dockerErr(ctx); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, versionExecTimeout)
+	defer cancel()
+	out, err := h.docker.ExecOutput(ctx, inst.ContainerID, []string{"opencode", "--version"})
+	if errors.Is(err, docker.ErrCommandNotFound) {
+		return "", errVersionUnavailable
+	}
+	if err != nil {
+		return "", fmt.Errorf("run opencode --version: %w", err)
+	}
+	version := parseOpencodeVersion(out)
+	if version == "" {
+		return "", errors.New("opencode --version printed nothing")
+	}
+
+	h.versionsMu.Lock()
+	h.versions[inst.ID] = cachedVersion{containerID: inst.ContainerID, version: version}
+	h.versionsMu.Unlock()
+	return version, nil
+}
+
+// forgetVersion drops the cached opencode version of a deleted instance.
+func (h *Handler) forgetVersion(id string) {
+	h.versionsMu.Lock()
+	delete(h.versions, id)
+	h.versionsMu.Unlock()
+}
+
+// parseOpencodeVersion picks the version from opencode --version output:
+// its last non-empty line, as update notices may come first.
+func parseOpencodeVersion(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	version := strings.TrimSpace(lines[len(lines)-1])
+	if len(version) > 64 {
+		version = version[:64]
+	}
+	return version
+}
+
+// handleOpencodeVersion reports the opencode version of a running instance,
+// as JSON or, for HTMX, as text for the detail page.
+func (h *Handler) handleOpencodeVersion(w http.ResponseWriter, r *http.Request) {
+	inst, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Instance not found", http.StatusNotFound)
+		return
+	}
+	if statuses, err := h.instanceStatuses(); err == nil {
+		if status, ok := statuses[inst.ID]; ok {
+			inst.Status = status
+		}
+	}
+
+	version, err := h.opencodeVersion(r.Context(), inst)
+	if r.Header.Get("HX-Request") == "" {
+		switch {
+		case errors.Is(err, errVersionUnavailable):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"version": version})
+		}
+		return
+	}
+
+	// 结果直接替换占位文本，失败时显示原因而不是弹出错误提示
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch {
+	case errors.Is(err, errVersionUnavailable):
+		fmt.Fprint(w, "Not available yet")
+	case err != nil:
+		fmt.Fprintf(w, `<span title="%s">Unknown</span>`, template.HTMLEscapeString(err.Error()))
+	default:
+		fmt.Fprint(w, template.HTMLEscapeString(version))
+	}
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/docker"
+)
+
+func TestPortPoolConcurrentAllocate(t *testing.T) {
+	pp := NewPortPool(20000, 20099)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		ports = make(map[int]int)
+	)
+	for range 50 {
+		wg.Go(func() {
+			port, err := pp.Allocate()
+			if err != nil {
+				t.Errorf("Allocate: %v", err)
+				return
+			}
+			mu.Lock()
+			ports[port]++
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if len(ports) != 50 {
+		t.Errorf("got %d distinct ports from 50 allocations", len(ports))
+	}
+	for port, n := range ports {
+		if n > 1 {
+			t.Errorf("port %d allocated %d times", port, n)
+		}
+		if port < 20000 || port > 20099 {
+			t.Errorf("port %d outside the range", port)
+		}
+	}
+	if pp.InUse() != 50 {
+		t.Errorf("InUse = %d, want 50", pp.InUse())
+	}
+}
+
+// fakePorts is a portSource with fixed container ports.
+type fakePorts struct {
+	ports []int
+	err   error
+}
+
+func (f fakePorts) ContainerPorts(context.Context) ([]int, error) { return f.ports, f.err }
+
+func TestReconcilePorts(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{PortStart: 10000, PortEnd: 10003})
+	h.portPool.MarkUsed(10000) // 来自数据库中的实例
+
+	marked, err := h.ReconcilePorts(context.Background(), fakePorts{ports: []int{10000, 10002, 30000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已占用的端口不重复报告，范围外的端口不影响分配
+	if !slices.Equal(marked, []int{10002, 30000}) {
+		t.Errorf("marked = %v, want [10002 30000]", marked)
+	}
+	for _, want := range []int{10001, 10003} {
+		port, err := h.portPool.Allocate()
+		if err != nil || port != want {
+			t.Fatalf("Allocate = %d, %v; want %d", port, err, want)
+		}
+	}
+	if port, err := h.portPool.Allocate(); err == nil {
+		t.Errorf("Allocate = %d, want the pool exhausted", port)
+	}
+
+	if _, err := h.ReconcilePorts(context.Background(), fakePorts{err: errors.New("daemon down")}); err == nil {
+		t.Error("ReconcilePorts ignored the port source error")
+	}
+}
+
+func TestCreateFailsWhenPortRangeIsExhausted(t *testing.T) {
+	dm, _ := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{PortStart: 10000, PortEnd: 10001})
+
+	for _, name := range []string{"first", "second"} {
+		if rec := serve(mux, postForm("/instances", url.Values{"name": {name}})); rec.Code != http.StatusCreated {
+			t.Fatalf("create %s: status %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+	rec := serve(mux, postForm("/instances", url.Values{"name": {"third"}}))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "No available ports") {
+		t.Errorf("third create: status %d: %s; want 503 No available ports", rec.Code, rec.Body)
+	}
+	waitOps(t, h)
+
+	instances, err := h.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ports []int
+	for _, inst := range instances {
+		ports = append(ports, inst.Port)
+	}
+	slices.Sort(ports)
+	if !slices.Equal(ports, []int{10000, 10001}) {
+		t.Errorf("stored instance ports = %v, want [10000 10001]", ports)
+	}
+}
@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// progressRetention keeps the final event around so a page loaded just
+// after creation finished still sees it.
+const progressRetention = time.Minute
+
+// progressTracker holds the latest creation progress per instance and fans
+// updates out to subscribers (the progress SSE stream).
+type progressTracker struct {
+	mu   sync.Mutex
+	last map[string]docker.Progress
+	subs map[string]map[chan docker.Progress]struct{}
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{
+		last: make(map[string]docker.Progress),
+		subs: make(map[string]map[chan docker.Progress]struct{}),
+	}
+}
+
+// set records p and notifies subscribers. Slow subscribers may miss
+// intermediate events but always receive the final one.
+func (t *progressTracker) set(id string, p docker.Progress) {
+	final := p.Phase == docker.PhaseDone || p.Phase == docker.PhaseError
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last[id] = p
+	for ch := range t.subs[id] {
+		select {
+		case ch <- p:
+		default:
+			if final {
+				// 丢弃一条旧事件腾出位置；只有 set 在持锁时发送，所以之后必定成功
+				<-ch
+				ch <- p
+			}
+		}
+	}
+	if final {
+		time.AfterFunc(progressRetention, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if cur, ok := t.last[id]; ok && cur == p {
+				delete(t.last, id)
+			}
+		})
+	}
+}
+
+// fail reports an error for an instance only if it is being tracked, so
+// errors from unrelated operations don't create progress state.
+func (t *progressTracker) fail(id string, err error) {
+	t.mu.Lock()
+	p, ok := t.last[id]
+	t.mu.Unlock()
+	if !ok || p.Phase == docker.PhaseDone || p.Phase == docker.PhaseError {
+		return
+	}
+	t.set(id, docker.Progress{Phase: docker.PhaseError, Percent: p.Percent, Message: err.Error()})
+}
+
+// subscribe returns the latest progress (if any) and a channel of updates.
+// cancel must be called to unsubscribe.
+func (t *progressTracker) subscribe(id string) (last docker.Progress, ok bool, ch <-chan docker.Progress, cancel func()) {
+	c := make(chan docker.Progress, 16)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok = t.last[id]
+	if t.subs[id] == nil {
+		t.subs[id] = make(map[chan docker.Progress]struct{})
+	}
+	t.subs[id][c] = struct{}{}
+	return last, ok, c, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subs[id], c)
+		if len(t.subs[id]) == 0 {
+			delete(t.subs, id)
+		}
+	}
+}
+
+// progressFunc returns a docker.ProgressFunc recording into the tracker.
+func (h *Handler) progressFunc(id string) docker.ProgressFunc {
+	return func(p docker.Progress) { h.progress.set(id, p) }
+}
+
+// initialProgress returns the event a new progress subscriber starts with:
+// the tracked progress, or for an instance not being created one derived
+// from its status. ok is false while creation has not reported anything
+// yet.
+func initialProgress(inst *store.Instance, last docker.Progress, tracked bool) (p docker.Progress, ok bool) {
+	if tracked {
+		return last, true
+	}
+	switch inst.Status {
+	case "running":
+		return docker.Progress{Phase: docker.PhaseDone, Percent: 100, Message: "Running"}, true
+	case "error":
+		return docker.Progress{Phase: docker.PhaseError, Message: inst.ErrorMsg}, true
+	case "created", "starting", "restarting":
+		// 创建尚未开始上报，等待后续事件
+		return docker.Progress{}, false
+	default:
+		return docker.Progress{Phase: docker.PhaseDone, Percent: 100, Message: "Instance is " + inst.Status}, true
+	}
+}
+
+// handleInstanceProgress streams creation progress as Server-Sent Events
+// ("progress" events with a docker.Progress JSON body) until the creation
+// finishes or the client goes away. Instances not being created get a
+// single event derived from their status.
+func (h *Handler) handleInstanceProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		http.Error(w, "Instance not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	last, tracked, updates, cancel := h.progress.subscribe(id)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(p docker.Progress) bool {
+		data, _ := json.Marshal(p)
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return p.Phase != docker.PhaseDone && p.Phase != docker.PhaseError
+	}
+
+	if p, ok := initialProgress(inst, last, tracked); ok && !send(p) {
+		return
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case p := <-updates:
+			if !send(p) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleInstanceProgressWS is the WebSocket variant of
+// handleInstanceProgress: each message is a docker.Progress JSON object,
+// and the server closes the connection after the done or error event.
+func (h *Handler) handleInstanceProgressWS(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	inst, err := h.store.Get(id)
+	if err != nil {
+		http.Error(w, "Instance not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logctx.From(r.Context()).Error("WebSocket upgrade failed for progress", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	last, tracked, updates, unsubscribe := h.progress.subscribe(id)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	send := func(p docker.Progress) bool {
+		if err := conn.WriteJSON(p); err != nil {
+			return false
+		}
+		if p.Phase == docker.PhaseDone || p.Phase == docker.PhaseError {
+			_ = conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, p.Phase))
+			return false
+		}
+		return true
+	}
+
+	if p, ok := initialProgress(inst, last, tracked); ok && !send(p) {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-updates:
+			if !send(p) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+const (
+	// defaultReadyTimeout is how long a started container may take to answer
+	// before the instance is marked running anyway.
+	defaultReadyTimeout = 10 * time.Minute
+
+	readyProbeMin = time.Second
+	readyProbeMax = 10 * time.Second
+)
+
+// readyWatcher is one in-flight readiness watch.
+type readyWatcher struct {
+	cancel context.CancelFunc
+}
+
+// watchReady keeps an instance in "starting" and re-probes its opencode
+// port (Options.ReadyPath) in the background, with backoff, until it
+// answers. Only then is the proxy registered and the status switched to
+// "running". If the port is still closed after Options.ReadyTimeout the
+// instance is marked running anyway with a logged warning: the container
+// runs, and opencode may still come up.
+//
+// Any later container operation on the instance (beginOp/cancelOp)
+// supersedes the watch. The watch logs with the logger of parent but
+// outlives its cancellation.
+func (h *Handler) watchReady(parent context.Context, inst *store.Instance) {
+	timeout := h.opts.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(parent), timeout)
+	w := &readyWatcher{cancel: cancel}
+
+	h.readyMu.Lock()
+	if prev, ok := h.readyWatch[inst.ID]; ok {
+		prev.cancel()
+	}
+	h.readyWatch[inst.ID] = w
+	h.readyMu.Unlock()
+
+	inst.Status = "starting"
+	h.saveInstance(inst)
+
+	go func() {
+		defer func() {
+			cancel()
+			h.readyMu.Lock()
+			if h.readyWatch[inst.ID] == w {
+				delete(h.readyWatch, inst.ID)
+			}
+			h.readyMu.Unlock()
+		}()
+
+		err := h.probeReady(ctx, inst, timeout)
+		// 探测成功与被取消同时发生时，以取消为准
+		if ctx.Err() == context.Canceled {
+			return
+		}
+		if err != nil {
+			logctx.From(ctx).Warn("Instance not ready, marking it running anyway", "instance", inst.ID, "after", timeout, "error", err)
+		}
+		inst.Status = "running"
+		h.saveInstance(inst)
+		h.invalidateStatuses()
+		if err := h.registerProxy(inst); err != nil {
+			logctx.From(ctx).Error("Error registering proxy", "instance", inst.ID, "error", err)
+		}
+		msg := "Ready"
+		if err != nil {
+			msg = "Running, but opencode is not answering yet"
+		}
+		h.progress.set(inst.ID, docker.Progress{Phase: docker.PhaseDone, Percent: 100, Message: msg})
+	}()
+}
+
+// probeReady probes the opencode port of inst with backoff until it answers
+// or ctx ends, and then returns nil or the last probe error.
+func (h *Handler) probeReady(ctx context.Context, inst *store.Instance, timeout time.Duration) error {
+	start := time.Now()
+	delay := readyProbeMin
+	for {
+		pct := docker.StartedPercent + int(float64(99-docker.StartedPercent)*float64(time.Since(start))/float64(timeout))
+		h.progress.set(inst.ID, docker.Progress{Phase: docker.PhaseReady, Percent: pct, Message: "Waiting for opencode"})
+
+		probeCtx, probeCancel := context.WithTimeout(ctx, 2*time.Second)
+		err := h.probe(probeCtx, inst.ID, inst.Port, h.opts.ReadyPath)
+		probeCancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, readyProbeMax)
+	}
+}
+
+// stopReadyWatch cancels the readiness watch of an instance, if any.
+func (h *Handler) stopReadyWatch(id string) {
+	h.readyMu.Lock()
+	defer h.readyMu.Unlock()
+	if w, ok := h.readyWatch[id]; ok {
+		w.cancel()
+		delete(h.readyWatch, id)
+	}
+}
+
+// watchingReady reports whether an instance is still waiting for opencode.
+func (h *Handler) watchingReady(id string) bool {
+	h.readyMu.Lock()
+	defer h.readyMu.Unlock()
+	_, ok := h.readyWatch[id]
+	return ok
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// fakeBackend serves 503 until ready is set, and points h's readiness
+// probe at it.
+func fakeBackend(t *testing.T, h *Handler) (ready *atomic.Bool, probes *atomic.Int32) {
+	t.Helper()
+	ready, probes = new(atomic.Bool), new(atomic.Int32)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(backend.Close)
+	h.probe = func(ctx context.Context, _ string, _ int, path string) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", backend.URL+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("backend returned %s", resp.Status)
+		}
+		return nil
+	}
+	return ready, probes
+}
+
+// waitStatus waits until the stored status of instance id is want.
+func waitStatus(t *testing.T, h *Handler, id, want string) *store.Instance {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inst, err := h.store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.Status == want {
+			return inst
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status of %s = %q, want %q", id, inst.Status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchReadyWaitsForBackend(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	ready, probes := fakeBackend(t, h)
+	inst := createTestInstance(t, h, &store.Instance{Name: "slow", Port: 10001})
+
+	h.watchReady(context.Background(), inst)
+	for probes.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := h.store.Get(inst.ID); got.Status != "starting" {
+		t.Fatalf("status while backend is down = %q, want starting", got.Status)
+	}
+	if h.proxy.Count() != 0 {
+		t.Fatal("proxy registered before the backend answered")
+	}
+
+	ready.Store(true)
+	waitStatus(t, h, inst.ID, "running")
+	if h.proxy.Count() != 1 {
+		t.Error("proxy not registered once the backend answered")
+	}
+	if probes.Load() < 2 {
+		t.Errorf("probes = %d, want a retry", probes.Load())
+	}
+}
+
+func TestWatchReadyTimeoutMarksRunning(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{ReadyTimeout: 50 * time.Millisecond})
+	fakeBackend(t, h)
+	inst := createTestInstance(t, h, &store.Instance{Name: "never", Port: 10002})
+
+	h.watchReady(context.Background(), inst)
+	got := waitStatus(t, h, inst.ID, "running")
+	if got.ErrorMsg != "" {
+		t.Errorf("ErrorMsg = %q, want none", got.ErrorMsg)
+	}
+	if h.proxy.Count() != 1 {
+		t.Error("proxy not registered after the timeout")
+	}
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/proxy"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestReconcileReleasesLeakedPorts(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	createTestInstance(t, h, &store.Instance{ID: "live", Name: "live", Port: 10001})
+	srv.AddContainer(dockertest.Container{
+		Name:  docker.ContainerName("gone"),
+		State: container.StateExited,
+		Config: &container.Config{
+			Image:  testImage,
+			Labels: map[string]string{"cloudcode.managed": "true", "cloudcode.instance-id": "gone", "cloudcode.port": "10002"},
+		},
+	})
+
+	// 10003 早已泄漏，10004 刚分配、实例尚未写入数据库
+	for _, p := range []int{10001, 10002, 10003, 10004} {
+		h.portPool.MarkUsed(p)
+	}
+	old := time.Now().Add(-2 * portReleaseGrace)
+	h.portPool.mu.Lock()
+	for _, p := range []int{10001, 10002, 10003} {
+		h.portPool.used[p] = old
+	}
+	h.portPool.mu.Unlock()
+
+	report, err := h.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if want := []int{10003}; !slices.Equal(report.PortsReleased, want) {
+		t.Errorf("released ports = %v, want %v", report.PortsReleased, want)
+	}
+	if got, want := h.portPool.Allocated(), []int{10001, 10002, 10004}; !slices.Equal(got, want) {
+		t.Errorf("allocated ports = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileMixedStates(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	runID := addInstanceContainer(srv, "run", container.StateRunning)
+	stopID := addInstanceContainer(srv, "stop", container.StateExited)
+	addInstanceContainer(srv, "orphan", container.StateRunning)
+
+	createTestInstance(t, h, &store.Instance{ID: "run", Name: "run", Port: 10001, Status: "stopped", ContainerID: runID})
+	createTestInstance(t, h, &store.Instance{ID: "stop", Name: "stop", Port: 10002, Status: "running", ContainerID: stopID})
+	createTestInstance(t, h, &store.Instance{ID: "gone", Name: "gone", Port: 10003, Status: "running", ContainerID: "deadbeef"})
+	createTestInstance(t, h, &store.Instance{ID: "adopted", Name: "adopted", Port: 10004, Status: "running", ContainerID: "cafebabe", Adopted: true})
+	// 重启前遗留的代理路由
+	for _, id := range []string{"stop", "gone"} {
+		if err := h.proxy.Register(id, 10000, proxy.RouteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := h.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	slices.Sort(report.StatusUpdated)
+	if want := []string{"adopted", "gone", "run", "stop"}; !slices.Equal(report.StatusUpdated, want) {
+		t.Errorf("status updated = %v, want %v", report.StatusUpdated, want)
+	}
+	if want := []string{"gone"}; !slices.Equal(report.Removed, want) {
+		t.Errorf("removed = %v, want %v", report.Removed, want)
+	}
+	if want := []string{docker.ContainerName("orphan")}; !slices.Equal(report.Orphans, want) {
+		t.Errorf("orphans = %v, want %v", report.Orphans, want)
+	}
+
+	for _, tc := range []struct {
+		id, status, containerID string
+		proxied                 bool
+	}{
+		{"run", "running", runID, true},
+		{"stop", "exited", stopID, false},
+		{"gone", "removed", "", false},
+		{"adopted", "removed", "cafebabe", false},
+	} {
+		inst, err := h.store.Get(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.Status != tc.status || inst.ContainerID != tc.containerID {
+			t.Errorf("%s: status %q, container %q; want %q, %q", tc.id, inst.Status, inst.ContainerID, tc.status, tc.containerID)
+		}
+		if got := h.proxy.IsRegistered(tc.id); got != tc.proxied {
+			t.Errorf("%s: proxy registered = %v, want %v", tc.id, got, tc.proxied)
+		}
+	}
+
+	// 第二次运行不应再有改动
+	report, err = h.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.StatusUpdated)+len(report.Recovered)+len(report.Removed) != 0 {
+		t.Errorf("second pass changed instances: %+v", report)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/naiba/cloudcode/internal/config"
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/recording"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// wantsRecording reports whether a terminal WebSocket request asked for the
+// session to be recorded (?record=1).
+func wantsRecording(r *http.Request) bool {
+	v := r.URL.Query().Get("record")
+	return v == "1" || v == "true"
+}
+
+// startRecording opens a cast file for a terminal session of inst. The
+// initial size comes from the cols/rows query parameters; later resizes
+// are recorded as events. A failure is logged and the session continues
+// unrecorded.
+func (h *Handler) startRecording(inst *store.Instance, r *http.Request) *recording.Recorder {
+	q := r.URL.Query()
+	cols, err := strconv.Atoi(q.Get("cols"))
+	if err != nil || cols <= 0 {
+		cols = 80
+	}
+	rows, err := strconv.Atoi(q.Get("rows"))
+	if err != nil || rows <= 0 {
+		rows = 24
+	}
+
+	f, name, err := h.config.CreateRecording(inst.ID)
+	if err != nil {
+		logctx.From(r.Context()).Error("Failed to start terminal recording", "instance", inst.ID, "error", err)
+		return nil
+	}
+	rec, err := recording.New(f, cols, rows, inst.Name)
+	if err != nil {
+		f.Close()
+		logctx.From(r.Context()).Error("Failed to start terminal recording", "instance", inst.ID, "error", err)
+		return nil
+	}
+	logctx.From(r.Context()).Info("Recording terminal session", "instance", inst.ID, "file", name)
+	h.audit(r.Context(), h.actor(r), "terminal-record", inst.ID, name)
+	return rec
+}
+
+// handleRecordings lists an instance's terminal recordings, newest first.
+func (h *Handler) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := h.store.Get(id); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		return
+	}
+	recordings, err := h.config.ListRecordings(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if recordings == nil {
+		recordings = []config.RecordingInfo{}
+	}
+	writeJSON(w, http.StatusOK, recordings)
+}
+
+// handleRecording downloads one recording as an asciinema v2 cast file.
+func (h *Handler) handleRecording(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	path, err := h.config.RecordingPath(r.PathValue("id"), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// requestIDHeader carries the request ID in both directions: an ID set by
+// an upstream proxy is reused, and every response reports the one used.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRe limits which incoming request IDs are trusted, so a client
+// cannot inject arbitrary text into the log.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestInfo is shared between logRequests and the handlers it wraps.
+type requestInfo struct {
+	proxied bool
+}
+
+type requestInfoKey struct{}
+
+// markProxied records that r is served by an instance through the reverse
+// proxy. Such requests are logged at debug level: an open opencode UI
+// sends many of them.
+func markProxied(r *http.Request) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.proxied = true
+	}
+}
+
+// logRequests assigns each request an ID, puts a logger carrying it into
+// the request context (see logctx.From) and logs method, path, status and
+// duration once the request is done. WebSocket and event-stream requests
+// are logged when they end.
+func (h *Handler) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = logctx.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id)
+		info := &requestInfo{}
+		ctx := logctx.With(r.Context(), logger)
+		ctx = context.WithValue(ctx, requestInfoKey{}, info)
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if info.proxied {
+			level = slog.LevelDebug
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		logger.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration", time.Since(start).Round(time.Microsecond),
+		)
+	})
+}
+
+// responseRecorder remembers the response status. It passes flushing and
+// hijacking through for the event streams and WebSockets it wraps.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.status == 0 {
+		rr.status = code
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) Flush() {
+	_ = http.NewResponseController(rr.ResponseWriter).Flush()
+}
+
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rr.ResponseWriter).Hijack()
+	if err == nil && rr.status == 0 {
+		rr.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
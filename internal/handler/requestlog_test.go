@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// captureLog sends slog.Default to a JSON buffer for the rest of the test
+// and returns a func decoding the lines logged so far.
+func captureLog(t *testing.T) func() []map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return func() []map[string]any {
+		var lines []map[string]any
+		for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var m map[string]any
+			if err := json.Unmarshal([]byte(l), &m); err != nil {
+				t.Fatalf("log line %q: %v", l, err)
+			}
+			lines = append(lines, m)
+		}
+		return lines
+	}
+}
+
+func TestLogRequestsSetsRequestID(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	logged := captureLog(t)
+	handler := h.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logctx.From(r.Context()).Info("creating container")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	rec := serve(handler, httptest.NewRequest("POST", "/instances", nil))
+	id := rec.Header().Get(requestIDHeader)
+	if !requestIDRe.MatchString(id) {
+		t.Fatalf("request ID = %q", id)
+	}
+	lines := logged()
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %v", len(lines), lines)
+	}
+	// 处理器内部的日志和请求日志带同一个 ID
+	inner, access := lines[0], lines[1]
+	if inner["msg"] != "creating container" || inner["request_id"] != id {
+		t.Errorf("handler line = %v, want request_id %s", inner, id)
+	}
+	if access["msg"] != "request" || access["request_id"] != id || access["method"] != "POST" ||
+		access["path"] != "/instances" || access["status"] != float64(http.StatusAccepted) {
+		t.Errorf("request line = %v", access)
+	}
+	if _, ok := access["duration"]; !ok {
+		t.Errorf("request line has no duration: %v", access)
+	}
+}
+
+func TestLogRequestsReusesIncomingID(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	logged := captureLog(t)
+	handler := h.logRequests(http.NotFoundHandler())
+
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set(requestIDHeader, "upstream-42")
+	if got := serve(handler, r).Header().Get(requestIDHeader); got != "upstream-42" {
+		t.Errorf("request ID = %q, want the upstream one", got)
+	}
+	// 不合法的 ID 不会写进日志
+	r = httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set(requestIDHeader, "bad id\nforged=1")
+	if got := serve(handler, r).Header().Get(requestIDHeader); got == "" || strings.Contains(got, "forged") {
+		t.Errorf("request ID = %q, want a fresh one", got)
+	}
+	lines := logged()
+	if len(lines) != 2 || lines[0]["request_id"] != "upstream-42" || lines[0]["status"] != float64(http.StatusNotFound) {
+		t.Errorf("logged %v", lines)
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// session is an open log or terminal WebSocket of an instance.
+type session struct {
+	kind  string // "logs" or "terminal"
+	close func(reason string)
+}
+
+// registerSession records an open session of an instance. Open sessions
+// keep the instance from being stopped as idle, and closeSessions ends them
+// when the instance is deleted (SweepSessions on the other replicas). close
+// must make the session's handler return. Call the returned func when the
+// session ends.
+func (h *Handler) registerSession(id, kind string, close func(reason string)) (unregister func()) {
+	s := &session{kind: kind, close: close}
+	h.sessionsMu.Lock()
+	if h.sessions[id] == nil {
+		h.sessions[id] = make(map[*session]struct{})
+	}
+	h.sessions[id][s] = struct{}{}
+	h.sessionsMu.Unlock()
+	return func() {
+		h.sessionsMu.Lock()
+		delete(h.sessions[id], s)
+		if len(h.sessions[id]) == 0 {
+			delete(h.sessions, id)
+		}
+		h.sessionsMu.Unlock()
+	}
+}
+
+func (h *Handler) hasSessions(id string) bool {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	return len(h.sessions[id]) > 0
+}
+
+// closeSessions ends every open session of an instance. The sessions
+// unregister themselves as their handlers return.
+func (h *Handler) closeSessions(ctx context.Context, id, reason string) {
+	h.sessionsMu.Lock()
+	sessions := make([]*session, 0, len(h.sessions[id]))
+	for s := range h.sessions[id] {
+		sessions = append(sessions, s)
+	}
+	h.sessionsMu.Unlock()
+
+	for _, s := range sessions {
+		logctx.From(ctx).Info("Closing session", "kind", s.kind, "instance", id, "reason", reason)
+		s.close(reason)
+	}
+}
+
+// SweepSessions closes the sessions of instances that are no longer in the
+// store. A delete closes the sessions held by the replica that handled it;
+// this catches sessions held by the other replicas.
+func (h *Handler) SweepSessions() {
+	h.sessionsMu.Lock()
+	ids := slices.Collect(maps.Keys(h.sessions))
+	h.sessionsMu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	instances, err := h.store.List()
+	if err != nil {
+		log.Printf("Session sweep failed: %v", err)
+		return
+	}
+	live := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		live[inst.ID] = true
+	}
+	for _, id := range ids {
+		if !live[id] {
+			h.closeSessions(context.Background(), id, "instance deleted")
+		}
+	}
+}
+
+// closeWS sends a going-away close frame with reason and closes conn.
+// WriteControl may be called concurrently with the session's own writes.
+func closeWS(conn *websocket.Conn, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+		time.Now().Add(time.Second))
+	_ = conn.Close()
+}
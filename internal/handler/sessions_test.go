@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// openSession registers a session of instance id whose close records the
+// reason it was given.
+func openSession(h *Handler, id string) (reason *string) {
+	reason = new(string)
+	var unregister func()
+	unregister = h.registerSession(id, "terminal", func(r string) {
+		*reason = r
+		unregister()
+	})
+	return reason
+}
+
+func TestDeleteClosesActiveSession(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "busy", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "busy", Name: "busy", Status: "running", ContainerID: cid})
+	reason := openSession(h, "busy")
+
+	rec := serve(mux, httptest.NewRequest("DELETE", "/instances/busy", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	if *reason != "instance deleted" {
+		t.Errorf("session close reason = %q, want instance deleted", *reason)
+	}
+	if h.hasSessions("busy") {
+		t.Error("session still registered after delete")
+	}
+}
+
+func TestSweepSessions(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	gone := createTestInstance(t, h, &store.Instance{Name: "gone"})
+	kept := createTestInstance(t, h, &store.Instance{Name: "kept"})
+	goneReason := openSession(h, gone.ID)
+	keptReason := openSession(h, kept.ID)
+
+	// 另一个副本删除了实例：本副本的会话表里还留着它
+	if err := h.store.Delete(gone.ID); err != nil {
+		t.Fatal(err)
+	}
+	h.SweepSessions()
+
+	if *goneReason != "instance deleted" {
+		t.Errorf("session of deleted instance: close reason = %q", *goneReason)
+	}
+	if *keptReason != "" || !h.hasSessions(kept.ID) {
+		t.Errorf("session of live instance was closed: %q", *keptReason)
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Shutdown prepares the handler for process exit. With Options.StopOnExit
+// it cancels in-flight container operations and stops every running
+// instance container, recording them as stopped; otherwise containers are
+// left running. In both cases the store's WAL is checkpointed so nothing
+// is left pending in it. ctx bounds the whole shutdown.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	if h.opts.StopOnExit && h.docker != nil && h.isLeader() {
+		stopped := h.stopAllContainers(ctx)
+		log.Printf("Stopped %d running containers on exit", stopped)
+	}
+	return h.store.Checkpoint()
+}
+
+// stopAllContainers stops the containers of all running or starting
+// instances in parallel and returns how many were stopped. Adopted
+// containers are left alone: CloudCode did not start them.
+func (h *Handler) stopAllContainers(ctx context.Context) int {
+	instances, err := h.store.List()
+	if err != nil {
+		log.Printf("Error listing instances on exit: %v", err)
+		return 0
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped int
+	)
+	for _, inst := range instances {
+		if inst.Adopted || inst.ContainerID == "" {
+			continue
+		}
+		switch inst.Status {
+		case "running", "starting", "restarting":
+		default:
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 先取消进行中的创建/重启和就绪等待，避免停止后又被标记为 running
+			select {
+			case <-h.cancelOp(inst.ID):
+			case <-ctx.Done():
+				return
+			}
+			h.proxy.Unregister(inst.ID)
+			if err := h.docker.StopContainer(ctx, inst.ID, inst.ContainerID, inst.StopTimeout); err != nil {
+				log.Printf("Error stopping container for %s on exit: %v", inst.ID, err)
+				return
+			}
+			inst.Status = "stopped"
+			h.saveInstance(inst)
+			mu.Lock()
+			stopped++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return stopped
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestStatusCacheInvalidatedByStop(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "s1", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "s1", Name: "s1", Status: "running", ContainerID: cid})
+
+	statuses, err := h.instanceStatuses()
+	if err != nil || statuses["s1"] != "running" {
+		t.Fatalf("statuses = %v, %v; want s1 running", statuses, err)
+	}
+
+	serve(mux, httptest.NewRequest("POST", "/instances/s1/stop", nil))
+	waitCall(t, srv, "POST", "/containers/*/stop")
+	waitOps(t, h)
+
+	// 仍在 statusCacheTTL 内，停止操作结束后也必须看到新状态
+	statuses, err = h.instanceStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses["s1"] != string(container.StateExited) {
+		t.Errorf("status after stop = %q, want exited", statuses["s1"])
+	}
+}
+
+func TestStatusSweepShared(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	want := make(map[string]string)
+	for i := range 50 {
+		id := fmt.Sprintf("i%02d", i)
+		state := container.StateRunning
+		if i%3 == 0 {
+			state = container.StateExited
+		}
+		cid := addInstanceContainer(srv, id, state)
+		if i%10 == 9 {
+			// 容器已被外部删除
+			cid = "gone-" + id
+			state = "removed"
+		}
+		createTestInstance(t, h, &store.Instance{ID: id, Name: id, Status: "running", ContainerID: cid})
+		want[id] = string(state)
+	}
+	createTestInstance(t, h, &store.Instance{ID: "nocontainer", Name: "nocontainer"})
+
+	// 只统计此后的列表请求
+	lists := len(srv.Calls("GET", "/containers/json"))
+	entered, release := blockDocker(srv, "GET", "/containers/json")
+	results := make([]map[string]string, 20)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses, err := h.instanceStatuses()
+			if err != nil {
+				t.Errorf("instanceStatuses: %v", err)
+			}
+			results[i] = statuses
+		}()
+	}
+	<-entered
+	release()
+	wg.Wait()
+
+	// 所有并发调用共用一次列表请求，不再逐个 inspect
+	if n := len(srv.Calls("GET", "/containers/json")) - lists; n != 1 {
+		t.Errorf("container list calls = %d, want 1", n)
+	}
+	if n := len(srv.Calls("GET", "/containers/*/json")); n != 0 {
+		t.Errorf("container inspect calls = %d, want 0", n)
+	}
+	for i, statuses := range results {
+		if len(statuses) != len(want) {
+			t.Errorf("caller %d got %d statuses, want %d", i, len(statuses), len(want))
+		}
+		for id, status := range want {
+			if statuses[id] != status {
+				t.Errorf("caller %d: %s = %q, want %q", i, id, statuses[id], status)
+			}
+		}
+	}
+
+	// 变化的状态已写回，列表顺序保持不变
+	instances, err := h.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inst := range instances {
+		if w, ok := want[inst.ID]; ok && inst.Status != w {
+			t.Errorf("stored %s status = %q, want %q", inst.ID, inst.Status, w)
+		}
+	}
+
+	h.invalidateStatuses()
+	if _, err := h.instanceStatuses(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Calls("GET", "/containers/json")) - lists; n != 2 {
+		t.Errorf("container list calls after invalidate = %d, want 2", n)
+	}
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/docker/dockertest"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestTerminalSendsCloseFrameOnExit(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "term", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "term", Name: "term", Status: "running", ContainerID: cid})
+	// shell 输出一行后以退出码 3 结束
+	srv.Exec = func(string, []string) dockertest.ExecResult {
+		return dockertest.ExecResult{Stdout: "bye\r\n", ExitCode: 3}
+	}
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/instances/term/terminal/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var output strings.Builder
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("connection ended without a close frame: %v", err)
+			}
+			if ce.Code != websocket.CloseNormalClosure || ce.Text != "session ended (exit code 3)" {
+				t.Errorf("close frame = %d %q, want %d %q", ce.Code, ce.Text, websocket.CloseNormalClosure, "session ended (exit code 3)")
+			}
+			break
+		}
+		output.Write(msg)
+	}
+	if output.String() != "bye\r\n" {
+		t.Errorf("terminal output = %q, want %q", output.String(), "bye\r\n")
+	}
+}
+
+func TestTerminalCloseFrameOnReadError(t *testing.T) {
+	h, _ := newTestHandler(t, nil, Options{})
+	for _, msg := range []string{"connection reset", strings.Repeat("é", 100)} {
+		frame := h.terminalCloseFrame("exec", errors.New(msg))
+		code := int(frame[0])<<8 | int(frame[1])
+		reason := string(frame[2:])
+		if code != websocket.CloseInternalServerErr {
+			t.Errorf("close code = %d, want %d", code, websocket.CloseInternalServerErr)
+		}
+		// 关闭原因受帧长度限制，且必须是合法的 UTF-8
+		if len(reason) > maxCloseReason || !utf8.ValidString(reason) || !strings.HasPrefix(reason, "terminal stream failed: ") {
+			t.Errorf("close reason = %q (%d bytes)", reason, len(reason))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+// statsSampleTimeout bounds one stats sample. Docker needs about a second
+// per sample; a daemon that takes much longer is skipped this round.
+const statsSampleTimeout = 10 * time.Second
+
+// CollectStats samples CPU and memory of every running instance in parallel
+// and replaces the usage cache with the result, so stopped and deleted
+// instances drop out of it. An instance whose sample fails keeps no entry
+// until the next round succeeds. Every replica collects for itself: the
+// cache is in memory only.
+func (h *Handler) CollectStats(ctx context.Context) {
+	if h.docker == nil {
+		return
+	}
+	instances, err := h.store.List()
+	if err != nil {
+		log.Printf("Stats collection failed: %v", err)
+		return
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		usage = make(map[string]store.ResourceUsage)
+	)
+	for _, inst := range instances {
+		if inst.Status != "running" || inst.ContainerID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sctx, cancel := context.WithTimeout(ctx, statsSampleTimeout)
+			defer cancel()
+			stats, err := h.docker.ContainerStatsSample(sctx, inst.ContainerID)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Stats of instance %s: %v", inst.ID, err)
+				}
+				return
+			}
+			mu.Lock()
+			usage[inst.ID] = usageFromStats(stats)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	h.usageMu.Lock()
+	h.usage = usage
+	h.usageMu.Unlock()
+}
+
+func usageFromStats(s docker.ContainerStats) store.ResourceUsage {
+	at := s.Read
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return store.ResourceUsage{
+		CPUPercent:  s.CPUPercent,
+		MemoryUsage: s.MemoryUsage,
+		MemoryLimit: s.MemoryLimit,
+		SampledAt:   at,
+	}
+}
+
+// attachUsage sets Usage on the running instances the stats cache has a
+// sample for.
+func (h *Handler) attachUsage(instances ...*store.Instance) {
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+	for _, inst := range instances {
+		if u, ok := h.usage[inst.ID]; ok && inst.Status == "running" {
+			inst.Usage = &u
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestCollectStats(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, _ := newTestHandler(t, dm, Options{})
+	read := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv.Stats = func(string) container.StatsResponse {
+		var s container.StatsResponse
+		s.Read = read
+		s.CPUStats.OnlineCPUs = 2
+		s.CPUStats.CPUUsage.TotalUsage = 300
+		s.CPUStats.SystemUsage = 2000
+		s.PreCPUStats.CPUUsage.TotalUsage = 100
+		s.PreCPUStats.SystemUsage = 1000
+		s.MemoryStats.Usage = 400 << 20
+		s.MemoryStats.Limit = 1 << 30
+		s.MemoryStats.Stats = map[string]uint64{"inactive_file": 60 << 20}
+		return s
+	}
+	running := addInstanceContainer(srv, "run", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "run", Name: "run", Status: "running", ContainerID: running})
+	stopped := addInstanceContainer(srv, "off", container.StateExited)
+	createTestInstance(t, h, &store.Instance{ID: "off", Name: "off", Status: "stopped", ContainerID: stopped})
+
+	h.CollectStats(t.Context())
+
+	if _, ok := h.usage["off"]; ok {
+		t.Error("stopped instance was sampled")
+	}
+	u, ok := h.usage["run"]
+	if !ok {
+		t.Fatal("running instance has no sample")
+	}
+	// 200/1000 × 2 核 = 40%，内存去掉 60 MiB 页缓存
+	want := store.ResourceUsage{CPUPercent: 40, MemoryUsage: 340 << 20, MemoryLimit: 1 << 30, SampledAt: read}
+	if u != want {
+		t.Errorf("usage = %+v, want %+v", u, want)
+	}
+}
+
+func TestInstanceStatusWithUsage(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "u1", container.StateRunning)
+	createTestInstance(t, h, &store.Instance{ID: "u1", Name: "u1", Status: "running", ContainerID: cid})
+	sampled := time.Unix(1700000000, 0)
+	h.usage = map[string]store.ResourceUsage{"u1": {CPUPercent: 5, SampledAt: sampled}}
+
+	poll := func(query string) int {
+		return serve(mux, httptest.NewRequest("GET", "/instances/u1/status?"+query, nil)).Code
+	}
+	current := "s=running&u=" + strconv.FormatInt(sampled.Unix(), 10)
+	if code := poll(current); code != http.StatusNoContent {
+		t.Errorf("poll with current sample = %d, want 204", code)
+	}
+	if code := poll("s=running&u=1600000000"); code != http.StatusOK {
+		t.Errorf("poll with old sample = %d, want 200", code)
+	}
+	if code := poll("s=running"); code != http.StatusOK {
+		t.Errorf("poll without sample = %d, want 200", code)
+	}
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+)
+
+// wakeInstance starts instance id if it is stopped, in response to proxy
+// traffic (Options.WakeOnTraffic). Concurrent calls are serialized and
+// the instance is re-read each time: startInstance marks it as starting
+// before returning, so a burst of requests starts it only once. It
+// reports whether a start was triggered.
+func (h *Handler) wakeInstance(ctx context.Context, id string) bool {
+	if h.docker == nil || !h.isLeader() {
+		return false
+	}
+	h.wakeMu.Lock()
+	defer h.wakeMu.Unlock()
+
+	inst, err := h.store.Get(id)
+	if err != nil || inst.Adopted {
+		return false
+	}
+	status := inst.Status
+	if status == "running" && inst.ContainerID != "" {
+		// 代理连不上后端：容器可能已在外部停止，而数据库还没同步
+		if statuses, err := h.instanceStatuses(); err == nil {
+			if s, ok := statuses[id]; ok {
+				status = s
+			}
+		}
+		if status != inst.Status {
+			if inst, err = h.store.Get(id); err != nil {
+				return false
+			}
+		}
+	}
+	switch status {
+	case "stopped", "exited":
+	default:
+		return false
+	}
+
+	logctx.From(ctx).Info("Waking instance on proxy traffic", "instance", id)
+	if err := h.startInstance(ctx, inst, ""); err != nil {
+		logctx.From(ctx).Error("Error waking instance", "instance", id, "error", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/naiba/cloudcode/internal/docker"
+	"github.com/naiba/cloudcode/internal/store"
+)
+
+func TestWakeOnTrafficStartsOnce(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{WakeOnTraffic: true})
+	h.probe = func(context.Context, string, int, string) error { return nil }
+	cid := addInstanceContainer(srv, "sleepy", container.StateExited)
+	createTestInstance(t, h, &store.Instance{ID: "sleepy", Name: "sleepy", Port: 10001, Status: "stopped", ContainerID: cid})
+
+	// 打开的页面同时发出一批请求
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = serve(mux, httptest.NewRequest("GET", "/instance/sleepy/", nil)).Code
+		}()
+	}
+	wg.Wait()
+	waitStatus(t, h, "sleepy", "running")
+	waitOps(t, h)
+
+	if n := len(srv.Calls("POST", "/containers/"+cid+"/start")); n != 1 {
+		t.Errorf("container started %d times, want exactly once", n)
+	}
+	for i, code := range codes {
+		if code != http.StatusBadGateway {
+			t.Errorf("request %d: status %d, want the 502 waiting page", i, code)
+		}
+	}
+}
+
+func TestWakeOnTrafficDisabled(t *testing.T) {
+	dm, srv := newTestDocker(t, docker.Options{})
+	h, mux := newTestHandler(t, dm, Options{})
+	cid := addInstanceContainer(srv, "off", container.StateExited)
+	createTestInstance(t, h, &store.Instance{ID: "off", Name: "off", Port: 10002, Status: "stopped", ContainerID: cid})
+
+	serve(mux, httptest.NewRequest("GET", "/instance/off/", nil))
+	if n := len(srv.Calls("POST", "/containers/*/start")); n != 0 {
+		t.Errorf("container started %d times without WakeOnTraffic", n)
+	}
+	if inst, _ := h.store.Get("off"); inst.Status != "stopped" {
+		t.Errorf("status = %q, want stopped", inst.Status)
+	}
+}
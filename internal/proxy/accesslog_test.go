@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// logBuffer collects JSON log lines written from any goroutine.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// proxyLines returns the access log lines logged so far.
+func (b *logBuffer) proxyLines(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]any
+	for _, l := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var m map[string]any
+		if l == "" || json.Unmarshal([]byte(l), &m) != nil || m["msg"] != "proxy" {
+			continue
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+// captureLog sends slog.Default to a buffer for the rest of the test.
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(b, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return b
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLog(t)
+	front := newTestRoute(t, New(Options{AccessLog: true}), "acc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	resp, err := http.Post(front.URL+"/instance/acc/session", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	lines := logs.proxyLines(t)
+	if len(lines) != 1 {
+		t.Fatalf("logged %d access lines, want 1: %v", len(lines), lines)
+	}
+	l := lines[0]
+	if l["instance"] != "acc" || l["method"] != "POST" || l["path"] != "/instance/acc/session" || l["status"] != float64(http.StatusCreated) {
+		t.Errorf("access line = %v", l)
+	}
+	if _, ok := l["duration"]; !ok {
+		t.Errorf("access line has no duration: %v", l)
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	logs := captureLog(t)
+	front := newTestRoute(t, New(Options{}), "quiet", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if lines := logs.proxyLines(t); len(lines) != 0 {
+		t.Errorf("logged %v without AccessLog", lines)
+	}
+}
+
+func TestAccessLogWebSocketAtConnect(t *testing.T) {
+	logs := captureLog(t)
+	release := make(chan struct{})
+	defer close(release)
+	front := newTestRoute(t, New(Options{AccessLog: true}), "wsl", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-release
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(front.URL, "http")+"/instance/wsl/pty", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 连接仍然打开时就应该已经记录
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lines := logs.proxyLines(t)
+		if len(lines) == 1 {
+			if lines[0]["instance"] != "wsl" || lines[0]["status"] != float64(http.StatusSwitchingProtocols) {
+				t.Errorf("access line = %v", lines[0])
+			}
+			return
+		}
+		if len(lines) > 1 || time.Now().After(deadline) {
+			t.Fatalf("access lines while connected = %v, want one 101 line", lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
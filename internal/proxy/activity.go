@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// activity tracks proxy traffic to one instance for idle detection.
+type activity struct {
+	last   atomic.Int64 // UnixNano of the latest request start or end
+	active atomic.Int32 // requests currently being proxied
+}
+
+func newActivity(now time.Time) *activity {
+	a := &activity{}
+	a.last.Store(now.UnixNano())
+	return a
+}
+
+// begin records a request starting; the returned func records its end.
+// Both count as access so a long request does not look idle afterwards.
+func (a *activity) begin() (end func()) {
+	if a == nil {
+		return func() {}
+	}
+	a.active.Add(1)
+	a.last.Store(time.Now().UnixNano())
+	return func() {
+		a.last.Store(time.Now().UnixNano())
+		a.active.Add(-1)
+	}
+}
+
+// LastAccess returns when the instance last saw proxy traffic. While a
+// request is in flight, e.g. an open event stream or WebSocket of the
+// opencode UI, it reports the current time. Registering a route counts as
+// access. ok is false when the instance has no route.
+func (rp *ReverseProxy) LastAccess(instanceID string) (t time.Time, ok bool) {
+	rp.mu.RLock()
+	a, ok := rp.activity[instanceID]
+	rp.mu.RUnlock()
+	if !ok {
+		return time.Time{}, false
+	}
+	if a.active.Load() > 0 {
+		return time.Now(), true
+	}
+	return time.Unix(0, a.last.Load()), true
+}
+
+// Activity returns LastAccess for every instance with a route.
+func (rp *ReverseProxy) Activity() map[string]time.Time {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+	now := time.Now()
+	times := make(map[string]time.Time, len(rp.activity))
+	for id, a := range rp.activity {
+		if a.active.Load() > 0 {
+			times[id] = now
+		} else {
+			times[id] = time.Unix(0, a.last.Load())
+		}
+	}
+	return times
+}
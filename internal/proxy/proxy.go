@@ -1,66 +1,335 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/naiba/cloudcode/internal/logctx"
+	"github.com/naiba/cloudcode/internal/metrics"
+)
+
+var (
+	proxyRequests = metrics.Register(metrics.NewCounterVec(
+		"cloudcode_proxy_requests_total",
+		"Requests proxied to instances by response status code.",
+		"code",
+	))
+	proxyDuration = metrics.Register(metrics.NewHistogramVec(
+		"cloudcode_proxy_request_duration_seconds",
+		"Latency of proxied requests, excluding WebSocket upgrades.",
+		metrics.DefBuckets,
+	))
 )
 
 // ReverseProxy manages dynamic reverse proxying to opencode instances.
 type ReverseProxy struct {
-	mu      sync.RWMutex
-	proxies map[string]*httputil.ReverseProxy // instanceID → proxy (strips /instance/{id} prefix)
-	direct  map[string]*httputil.ReverseProxy // instanceID → proxy (forwards path as-is)
-	ports   map[string]int                    // instanceID → port
+	mu        sync.RWMutex
+	proxies   map[string]*httputil.ReverseProxy // instanceID → proxy (strips /instance/{id} prefix)
+	direct    map[string]*httputil.ReverseProxy // instanceID → proxy (forwards path as-is)
+	ports     map[string]int                    // instanceID → port
+	limiters  map[string]*tokenBucket           // instanceID → rate limiter, when Options.RateLimit is set
+	activity  map[string]*activity              // instanceID → traffic, see LastAccess
+	opts      Options
+	transport http.RoundTripper // shared by all instance proxies
+	wake      func(instanceID string)
 }
 
+// DefaultResponseTimeout is how long a backend may take to send response
+// headers when Options.ResponseTimeout is zero.
+const DefaultResponseTimeout = 30 * time.Second
+
+// backendDialTimeout bounds connecting to an instance container; they sit
+// on the same Docker network, so anything slower means it is not listening.
+const backendDialTimeout = 5 * time.Second
+
+// Options configures the ReverseProxy.
+type Options struct {
+	// TrustProxy keeps X-Forwarded-* headers sent by a trusted upstream
+	// proxy (nginx, Cloudflare, ...) instead of discarding them.
+	TrustProxy bool
+	// TrustedProxies lists the peers whose X-Forwarded-* headers are kept
+	// when TrustProxy is set.
+	TrustedProxies []*net.IPNet
+	// BasePath is the URL prefix CloudCode is mounted under (e.g.
+	// "/cloudcode"), used for links back to the platform. Empty for root.
+	BasePath string
+	// ResponseTimeout bounds the wait for a backend's response headers so a
+	// hung instance fails the request instead of blocking it. Zero means
+	// DefaultResponseTimeout, negative disables it. WebSocket upgrades and
+	// event streams are exempt, and bodies are never cut off.
+	ResponseTimeout time.Duration
+	// RateLimit caps requests per second to each instance, with bursts of
+	// up to one second's worth. Requests over the limit get 429. Zero
+	// means unlimited.
+	RateLimit float64
+	// WaitingTemplate renders the page shown while an instance is starting,
+	// with a WaitingPage as data. Nil uses the built-in page.
+	WaitingTemplate *template.Template
+	// WaitingRefresh is how often the waiting page retries: its meta
+	// refresh without JavaScript and the readiness poll after an error.
+	// Zero means DefaultWaitingRefresh.
+	WaitingRefresh time.Duration
+	// AccessLog logs every proxied request with instance ID, method, path,
+	// status and duration at info level. WebSocket upgrades are logged
+	// once the connection is established.
+	AccessLog bool
+	// DisableIsolation stops injecting the script that gives each instance
+	// its own localStorage into HTML pages, so instances on the same origin
+	// share browser storage. Meant for debugging opencode's Web UI.
+	DisableIsolation bool
+}
+
+// DefaultWaitingRefresh is the waiting page retry interval when
+// Options.WaitingRefresh is zero.
+const DefaultWaitingRefresh = 3 * time.Second
+
 // New creates a new ReverseProxy manager.
-func New() *ReverseProxy {
+func New(opts Options) *ReverseProxy {
+	if opts.ResponseTimeout == 0 {
+		opts.ResponseTimeout = DefaultResponseTimeout
+	}
+	if opts.WaitingTemplate == nil {
+		opts.WaitingTemplate = defaultWaitingTemplate
+	}
+	if opts.WaitingRefresh <= 0 {
+		opts.WaitingRefresh = DefaultWaitingRefresh
+	}
 	return &ReverseProxy{
-		proxies: make(map[string]*httputil.ReverseProxy),
-		direct:  make(map[string]*httputil.ReverseProxy),
-		ports:   make(map[string]int),
+		proxies:   make(map[string]*httputil.ReverseProxy),
+		direct:    make(map[string]*httputil.ReverseProxy),
+		ports:     make(map[string]int),
+		limiters:  make(map[string]*tokenBucket),
+		activity:  make(map[string]*activity),
+		opts:      opts,
+		transport: newBackendTransport(opts.ResponseTimeout),
+	}
+}
+
+// backendTransport sends long-lived requests (WebSocket upgrades, event
+// streams) through a transport without a response header timeout, since
+// such backends may legitimately hold the response back.
+type backendTransport struct {
+	timed, streaming *http.Transport
+}
+
+func newBackendTransport(responseTimeout time.Duration) *backendTransport {
+	streaming := http.DefaultTransport.(*http.Transport).Clone()
+	streaming.DialContext = (&net.Dialer{
+		Timeout:   backendDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	timed := streaming.Clone()
+	if responseTimeout > 0 {
+		timed.ResponseHeaderTimeout = responseTimeout
+	}
+	return &backendTransport{timed: timed, streaming: streaming}
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isUpgradeRequest(req) || strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return t.streaming.RoundTrip(req)
+	}
+	return t.timed.RoundTrip(req)
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs or bare IPs.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedPeer reports whether the direct peer of r may set X-Forwarded-*.
+func (rp *ReverseProxy) trustedPeer(r *http.Request) bool {
+	if !rp.opts.TrustProxy {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range rp.opts.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders is called from the directors before req.Host is
+// rewritten. Headers from untrusted peers are dropped so clients cannot
+// spoof their address; httputil.ReverseProxy then appends the peer IP to
+// X-Forwarded-For itself. strippedPrefix is the path prefix the director
+// removes, if any; it is appended to X-Forwarded-Prefix so the backend can
+// build absolute URLs as the client sees them.
+func (rp *ReverseProxy) setForwardedHeaders(req *http.Request, strippedPrefix string) {
+	if !rp.trustedPeer(req) {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Prefix")
+		req.Header.Del("Forwarded")
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if strippedPrefix != "" {
+		// 上游代理已剥离的前缀在前，CloudCode 剥离的在后
+		upstream := strings.TrimSuffix(req.Header.Get("X-Forwarded-Prefix"), "/")
+		req.Header.Set("X-Forwarded-Prefix", upstream+strippedPrefix)
+	}
+}
+
+// RouteOptions holds per-instance proxy settings.
+type RouteOptions struct {
+	// Headers are static request headers set on every forwarded request.
+	Headers map[string]string
+	// Name is the instance name shown on the waiting page.
+	Name string
+}
+
+// reservedHeaders are managed by the proxy itself and cannot be overridden.
+var reservedHeaders = map[string]bool{
+	"Host":              true,
+	"Connection":        true,
+	"Upgrade":           true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Te":                true,
+	"Trailer":           true,
+	"Keep-Alive":        true,
+	"Accept-Encoding":   true,
+}
+
+// ValidateHeaderName checks that name is a valid HTTP header field name
+// (an RFC 7230 token) and not one of the headers the proxy manages.
+func ValidateHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("header name is empty")
+	}
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return fmt.Errorf("header name %q contains invalid character %q", name, c)
+		}
+	}
+	if reservedHeaders[http.CanonicalHeaderKey(name)] {
+		return fmt.Errorf("header %q is managed by the proxy and cannot be set", name)
+	}
+	return nil
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// backendURL returns the in-network address of an instance's opencode server.
+func backendURL(instanceID string, port int) string {
+	return fmt.Sprintf("http://cloudcode-%s:%d", instanceID, port)
+}
+
+var probeClient = &http.Client{
+	// 不跟随重定向：任何 HTTP 响应都说明 opencode 已在监听
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Probe performs a single readiness check against an instance backend over
+// the Docker network. The backend is ready once it answers path with any
+// non-5xx status.
+func Probe(ctx context.Context, instanceID string, port int, path string) error {
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendURL(instanceID, port)+path, nil)
+	if err != nil {
+		return err
 	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("backend returned %s", resp.Status)
+	}
+	return nil
 }
 
 // Register adds or updates a proxy route for an instance.
 // Traffic is routed via Docker network using container name (cloudcode-{id}).
-func (rp *ReverseProxy) Register(instanceID string, port int) error {
-	containerName := fmt.Sprintf("cloudcode-%s", instanceID)
-	target, err := url.Parse(fmt.Sprintf("http://%s:%d", containerName, port))
+func (rp *ReverseProxy) Register(instanceID string, port int, opts RouteOptions) error {
+	target, err := url.Parse(backendURL(instanceID, port))
 	if err != nil {
 		return fmt.Errorf("parse target URL: %w", err)
 	}
 
 	stripProxy := httputil.NewSingleHostReverseProxy(target)
 	originalDirector := stripProxy.Director
+	routePrefix := fmt.Sprintf("/instance/%s", instanceID)
 	stripProxy.Director = func(req *http.Request) {
 		originalDirector(req)
-		prefix := fmt.Sprintf("/instance/%s", instanceID)
-		if strings.HasPrefix(req.URL.Path, prefix) {
-			req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
-			if req.URL.Path == "" {
-				req.URL.Path = "/"
-			}
-		}
-		req.Host = target.Host
-		req.Header.Del("Accept-Encoding")
+		rp.setForwardedHeaders(req, rp.opts.BasePath+routePrefix)
+		stripPathPrefix(req.URL, routePrefix)
+		rewriteBackendHost(req, target)
+		setHeaders(req, opts.Headers)
 	}
-	stripProxy.ModifyResponse = injectInstanceIsolation(instanceID)
+	stripProxy.Transport = rp.transport
+	stripProxy.ModifyResponse = rp.modifyResponse(instanceID)
+	// 连接失败和响应头超时都会到这里，展示等待页而不是让请求一直挂着
 	stripProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusBadGateway)
-		tmpl := template.Must(template.New("waiting").Parse(waitingPageHTML))
-		_ = tmpl.Execute(w, map[string]string{"InstanceID": instanceID})
+		if !isTimeout(err) {
+			rp.triggerWake(instanceID)
+		}
+		rp.ServeWaiting(w, instanceID, opts.Name)
 	}
 
 	// Proxy that forwards path as-is (for Referer-based fallback requests)
@@ -68,11 +337,18 @@ func (rp *ReverseProxy) Register(instanceID string, port int) error {
 	origDirectDirector := directProxy.Director
 	directProxy.Director = func(req *http.Request) {
 		origDirectDirector(req)
-		req.Host = target.Host
-		req.Header.Del("Accept-Encoding")
+		rp.setForwardedHeaders(req, "")
+		rewriteBackendHost(req, target)
+		setHeaders(req, opts.Headers)
 	}
-	directProxy.ModifyResponse = injectInstanceIsolation(instanceID)
+	directProxy.Transport = rp.transport
+	directProxy.ModifyResponse = rp.modifyResponse(instanceID)
 	directProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if isTimeout(err) {
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+		rp.triggerWake(instanceID)
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 	}
 
@@ -81,10 +357,100 @@ func (rp *ReverseProxy) Register(instanceID string, port int) error {
 	rp.proxies[instanceID] = stripProxy
 	rp.direct[instanceID] = directProxy
 	rp.ports[instanceID] = port
+	// 重新注册（如修改代理头）时保留已有的令牌桶
+	if _, ok := rp.limiters[instanceID]; !ok && rp.opts.RateLimit > 0 {
+		rp.limiters[instanceID] = newTokenBucket(rp.opts.RateLimit)
+	}
+	if _, ok := rp.activity[instanceID]; !ok {
+		rp.activity[instanceID] = newActivity(time.Now())
+	}
 
 	return nil
 }
 
+// SetWake installs fn to be called, in its own goroutine, whenever a
+// registered instance's backend cannot be reached, e.g. because its
+// container was stopped. fn is expected to start the instance if needed
+// and to ignore repeated calls. Call it before serving requests.
+func (rp *ReverseProxy) SetWake(fn func(instanceID string)) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.wake = fn
+}
+
+func (rp *ReverseProxy) triggerWake(instanceID string) {
+	rp.mu.RLock()
+	wake := rp.wake
+	rp.mu.RUnlock()
+	if wake != nil {
+		go wake(instanceID)
+	}
+}
+
+// stripPathPrefix removes prefix from u, keeping RawPath in step with Path
+// so escaped characters such as %2F survive. A bare prefix becomes "/".
+func stripPathPrefix(u *url.URL, prefix string) {
+	if !strings.HasPrefix(u.Path, prefix) {
+		return
+	}
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.RawPath != "" {
+		u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+		if u.RawPath == "" {
+			u.RawPath = "/"
+		}
+	}
+}
+
+// rewriteBackendHost points req at the instance backend. Normal requests
+// drop Accept-Encoding so the transport negotiates gzip itself and hands
+// injectInstanceIsolation a decoded HTML body. WebSocket upgrades keep
+// their headers; a same-origin Origin is rewritten to the backend origin
+// so servers that compare Origin with Host accept the proxied handshake.
+// Cross-origin handshakes keep their Origin and are still rejected.
+func rewriteBackendHost(req *http.Request, target *url.URL) {
+	if isUpgradeRequest(req) {
+		if o, err := url.Parse(req.Header.Get("Origin")); err == nil && o.Host != "" && strings.EqualFold(o.Host, req.Host) {
+			req.Header.Set("Origin", target.Scheme+"://"+target.Host)
+		}
+	} else {
+		req.Header.Del("Accept-Encoding")
+	}
+	req.Host = target.Host
+}
+
+// isTimeout reports whether err is a network timeout, such as the
+// transport's response header timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// isUpgradeRequest reports whether req asks for a protocol upgrade, e.g.
+// a WebSocket handshake.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setHeaders(req *http.Request, headers map[string]string) {
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+}
+
 // Unregister removes a proxy route.
 func (rp *ReverseProxy) Unregister(instanceID string) {
 	rp.mu.Lock()
@@ -92,20 +458,20 @@ func (rp *ReverseProxy) Unregister(instanceID string) {
 	delete(rp.proxies, instanceID)
 	delete(rp.direct, instanceID)
 	delete(rp.ports, instanceID)
+	delete(rp.limiters, instanceID)
+	delete(rp.activity, instanceID)
 }
 
 // ServeHTTP handles proxied requests, stripping /instance/{id} prefix.
 func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, instanceID string) {
 	rp.mu.RLock()
 	proxy, ok := rp.proxies[instanceID]
+	limiter := rp.limiters[instanceID]
+	act := rp.activity[instanceID]
 	rp.mu.RUnlock()
 
-	if !ok {
-		http.Error(w, "Instance not found or not running", http.StatusBadGateway)
-		return
-	}
-
-	proxy.ServeHTTP(w, r)
+	defer act.begin()()
+	rp.serveCounted(w, r, instanceID, proxy, ok, limiter)
 }
 
 // ServeHTTPDirect handles proxied requests, forwarding the original path as-is.
@@ -114,14 +480,152 @@ func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, instan
 func (rp *ReverseProxy) ServeHTTPDirect(w http.ResponseWriter, r *http.Request, instanceID string) {
 	rp.mu.RLock()
 	proxy, ok := rp.direct[instanceID]
+	limiter := rp.limiters[instanceID]
+	act := rp.activity[instanceID]
 	rp.mu.RUnlock()
 
-	if !ok {
-		http.Error(w, "Instance not found or not running", http.StatusBadGateway)
+	defer act.begin()()
+	rp.serveCounted(w, r, instanceID, proxy, ok, limiter)
+}
+
+// serveCounted serves r through proxy (or a 502 when the route is missing,
+// a 429 when limiter is out of tokens), records the request in the proxy
+// metrics and, with Options.AccessLog, logs it.
+func (rp *ReverseProxy) serveCounted(w http.ResponseWriter, r *http.Request, instanceID string, proxy *httputil.ReverseProxy, ok bool, limiter *tokenBucket) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	if rp.opts.AccessLog {
+		// WebSocket 连接可能持续数小时，在握手成功时就记录，而不是等到关闭
+		rec.onUpgrade = func() {
+			rp.logAccess(r, instanceID, http.StatusSwitchingProtocols, start)
+		}
+	}
+	switch {
+	case !ok:
+		http.Error(rec, "Instance not found or not running", http.StatusBadGateway)
+	case !limiter.allow(start):
+		rec.Header().Set("Retry-After", "1")
+		http.Error(rec, "Too many requests to this instance, retry in a moment", http.StatusTooManyRequests)
+	default:
+		proxy.ServeHTTP(rec, r)
+	}
+
+	code := rec.status
+	if code == 0 {
+		code = http.StatusOK
+	}
+	proxyRequests.Inc(strconv.Itoa(code))
+	// WebSocket 连接的时长是会话时长而不是请求延迟，不计入
+	if code != http.StatusSwitchingProtocols {
+		proxyDuration.Observe(time.Since(start).Seconds())
+		if rp.opts.AccessLog {
+			rp.logAccess(r, instanceID, code, start)
+		}
+	}
+}
+
+// logAccess writes the access log line of a proxied request.
+func (rp *ReverseProxy) logAccess(r *http.Request, instanceID string, status int, start time.Time) {
+	logctx.From(r.Context()).Info("proxy",
+		"instance", instanceID,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status,
+		"duration", time.Since(start).Round(time.Microsecond),
+	)
+}
+
+// statusRecorder remembers the response status. Unwrap lets
+// http.ResponseController reach the underlying writer for flushing;
+// Hijack is intercepted because the reverse proxy writes the 101 response
+// of a WebSocket upgrade directly to the hijacked connection. onUpgrade,
+// when set, runs once that happens.
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	onUpgrade func()
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sr.ResponseWriter).Hijack()
+	if err == nil && sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+		if sr.onUpgrade != nil {
+			sr.onUpgrade()
+		}
+	}
+	return conn, brw, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// WaitingPage is the data a waiting page template receives.
+type WaitingPage struct {
+	InstanceID     string
+	InstanceName   string
+	BasePath       string // platform URL prefix, for the readiness API
+	RefreshSeconds int    // retry interval, see Options.WaitingRefresh
+}
+
+// LoadWaitingTemplate parses a custom waiting page from path. It returns
+// nil without error when the file does not exist, so callers fall back to
+// the built-in page.
+func LoadWaitingTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("waiting").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// ServeWaiting renders the page shown while an instance's opencode server
+// is not answering yet. It polls the readiness API and reloads once ready.
+func (rp *ReverseProxy) ServeWaiting(w http.ResponseWriter, instanceID, name string) {
+	var buf bytes.Buffer
+	err := rp.opts.WaitingTemplate.Execute(&buf, WaitingPage{
+		InstanceID:     instanceID,
+		InstanceName:   name,
+		BasePath:       rp.opts.BasePath,
+		RefreshSeconds: max(1, int(rp.opts.WaitingRefresh.Round(time.Second)/time.Second)),
+	})
+	if err != nil {
+		log.Printf("Error rendering waiting page for %s: %v", instanceID, err)
+		http.Error(w, "Instance is starting, retry in a moment", http.StatusBadGateway)
 		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadGateway)
+	_, _ = w.Write(buf.Bytes())
+}
 
-	proxy.ServeHTTP(w, r)
+// Count returns the number of registered instance routes.
+func (rp *ReverseProxy) Count() int {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+	return len(rp.proxies)
 }
 
 // IsRegistered checks if an instance has a registered proxy.
@@ -138,7 +642,25 @@ func generateNonce() string {
 	return hex.EncodeToString(b)
 }
 
-func injectInstanceIsolation(instanceID string) func(*http.Response) error {
+// modifyResponse returns the ModifyResponse hook for an instance's proxies:
+// the isolation script injection unless Options.DisableIsolation is set.
+func (rp *ReverseProxy) modifyResponse(instanceID string) func(*http.Response) error {
+	if rp.opts.DisableIsolation {
+		return passStreamingResponse
+	}
+	return injectInstanceIsolation(instanceID, rp.opts.BasePath)
+}
+
+// passStreamingResponse leaves responses untouched apart from marking
+// streams as unbuffered for an nginx in front of CloudCode.
+func passStreamingResponse(resp *http.Response) error {
+	if isStreamingResponse(resp) {
+		resp.Header.Set("X-Accel-Buffering", "no")
+	}
+	return nil
+}
+
+func injectInstanceIsolation(instanceID, basePath string) func(*http.Response) error {
 	scriptBody := `
 (function() {
   var K = "_cc_active_inst";
@@ -210,7 +732,7 @@ func injectInstanceIsolation(instanceID string) func(*http.Response) error {
         // window.close() may be blocked if not opened via script;
         // replace the page with a redirect to dashboard
         document.title = "Redirecting...";
-        location.replace("/");
+        location.replace("` + basePath + `/");
       }
     };
   }
@@ -218,6 +740,14 @@ func injectInstanceIsolation(instanceID string) func(*http.Response) error {
 `
 
 	return func(resp *http.Response) error {
+		// Streaming responses must never be buffered: httputil.ReverseProxy
+		// flushes event streams and bodies of unknown length after every
+		// write as long as the body is passed through untouched. Checked
+		// before the text/html case, which reads the whole body.
+		if isStreamingResponse(resp) {
+			return passStreamingResponse(resp)
+		}
+
 		ct := resp.Header.Get("Content-Type")
 		if !strings.Contains(ct, "text/html") {
 			return nil
@@ -257,12 +787,34 @@ func injectInstanceIsolation(instanceID string) func(*http.Response) error {
 	}
 }
 
+// isStreamingResponse reports whether the response body is an open-ended
+// stream that has to be forwarded as it arrives: an upgraded connection,
+// a streaming media type, or any response the backend marked with
+// "X-Accel-Buffering: no", even text/html.
+func isStreamingResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	if strings.EqualFold(resp.Header.Get("X-Accel-Buffering"), "no") {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch ct {
+	case "text/event-stream", "application/x-ndjson", "application/ndjson",
+		"application/jsonl", "application/x-jsonlines", "multipart/x-mixed-replace":
+		return true
+	}
+	return strings.HasSuffix(ct, "/stream+json") // 如 application/stream+json
+}
+
+var defaultWaitingTemplate = template.Must(template.New("waiting").Parse(waitingPageHTML))
+
 const waitingPageHTML = `<!DOCTYPE html>
 <html>
 <head>
 <meta charset="utf-8">
-<title>Starting...</title>
-<meta http-equiv="refresh" content="3">
+<title>{{if .InstanceName}}{{.InstanceName}} - {{end}}Starting...</title>
+<noscript><meta http-equiv="refresh" content="{{.RefreshSeconds}}"></noscript>
 <style>
 *{margin:0;padding:0;box-sizing:border-box}
 body{font-family:-apple-system,BlinkMacSystemFont,'Segoe UI',Roboto,sans-serif;background:#0f1117;color:#e4e6ed;display:flex;align-items:center;justify-content:center;min-height:100vh}
@@ -276,8 +828,21 @@ p{color:#8b8fa3;font-size:.875rem}
 <body>
 <div class="wrap">
 <div class="spinner"></div>
-<h2>Instance Starting</h2>
-<p>OpenCode is initializing, this page will refresh automatically...</p>
+<h2>{{if .InstanceName}}{{.InstanceName}} is starting{{else}}Instance Starting{{end}}</h2>
+<p id="detail">OpenCode is initializing, this page will refresh automatically...</p>
 </div>
+<script>
+(function() {
+  var url = "{{.BasePath}}/api/v1/instances/{{.InstanceID}}/ready";
+  function poll() {
+    fetch(url, {cache: "no-store"}).then(function(r) { return r.json(); }).then(function(s) {
+      if (s.ready) { location.reload(); return; }
+      if (s.detail) { document.getElementById("detail").textContent = s.detail; }
+      setTimeout(poll, 1000);
+    }).catch(function() { setTimeout(poll, {{.RefreshSeconds}} * 1000); });
+  }
+  poll();
+})();
+</script>
 </body>
 </html>`
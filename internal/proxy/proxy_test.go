@@ -0,0 +1,465 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestRoute registers instance id on rp with every backend connection
+// going to backend, and returns a server that proxies through the
+// /instance/{id}/ route.
+func newTestRoute(t *testing.T, rp *ReverseProxy, id string, backend http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+	addr := srv.Listener.Addr().String()
+	// cloudcode-{id} 只在 Docker 网络里能解析，测试里改为连到本地后端
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	bt := rp.transport.(*backendTransport)
+	bt.timed.DialContext = dial
+	bt.streaming.DialContext = dial
+	if err := rp.Register(id, 4096, RouteOptions{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.ServeHTTP(w, r, id)
+	}))
+	t.Cleanup(front.Close)
+	return front
+}
+
+func TestChunkedSSEIsNotBuffered(t *testing.T) {
+	next := make(chan struct{})
+	front := newTestRoute(t, New(Options{}), "sse", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, token := range []string{"one", "two"} {
+			io.WriteString(w, "data: "+token+"\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer close(next)
+
+	req, _ := http.NewRequest("GET", front.URL+"/instance/sse/event", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("TransferEncoding = %v, want chunked", resp.TransferEncoding)
+	}
+	if got := resp.Header.Get("X-Accel-Buffering"); got != "no" {
+		t.Errorf("X-Accel-Buffering = %q, want no", got)
+	}
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if line := sc.Text(); line != "" {
+				lines <- line
+			}
+		}
+		close(lines)
+	}()
+	// 后端在第二个事件前阻塞，第一个事件必须先到达客户端
+	for _, want := range []string{"data: one", "data: two"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("event = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q did not arrive while the backend held the stream open", want)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	tests := []struct {
+		status int
+		header http.Header
+		want   bool
+	}{
+		{http.StatusSwitchingProtocols, http.Header{}, true},
+		{200, http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}, true},
+		{200, http.Header{"Content-Type": {"application/x-ndjson"}}, true},
+		{200, http.Header{"Content-Type": {"application/jsonl"}}, true},
+		{200, http.Header{"Content-Type": {"application/stream+json"}}, true},
+		{200, http.Header{"Content-Type": {"multipart/x-mixed-replace; boundary=frame"}}, true},
+		{200, http.Header{"Content-Type": {"text/html"}, "X-Accel-Buffering": {"no"}}, true},
+		{200, http.Header{"Content-Type": {"text/html"}}, false},
+		{200, http.Header{"Content-Type": {"application/json"}}, false},
+		{200, http.Header{"Content-Type": {"text/plain"}, "X-Accel-Buffering": {"yes"}}, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+		if got := isStreamingResponse(resp); got != tt.want {
+			t.Errorf("isStreamingResponse(%d, %v) = %v, want %v", tt.status, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestStreamingHTMLIsNotInjected(t *testing.T) {
+	page := "<html><head></head><body>live</body></html>"
+	front := newTestRoute(t, New(Options{}), "html", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Query().Has("stream") {
+			w.Header().Set("X-Accel-Buffering", "no")
+		}
+		io.WriteString(w, page)
+	}))
+
+	for _, tt := range []struct {
+		query    string
+		injected bool
+	}{{"", true}, {"?stream", false}} {
+		resp, err := http.Get(front.URL + "/instance/html/" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.Contains(string(body), "<script nonce="); got != tt.injected {
+			t.Errorf("%q: script injected = %v, want %v", tt.query, got, tt.injected)
+		}
+	}
+}
+
+func TestIsolationInjection(t *testing.T) {
+	// 第二个 <head> 出现在正文里，不能再次注入
+	page := "<!DOCTYPE html><html><head><title>oc</title></head><body><pre>&lt;head&gt; <head></pre></body></html>"
+	for _, disabled := range []bool{false, true} {
+		rp := New(Options{DisableIsolation: disabled})
+		front := newTestRoute(t, rp, "iso", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, page)
+		}))
+		direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rp.ServeHTTPDirect(w, r, "iso")
+		}))
+		defer direct.Close()
+
+		for _, target := range []string{front.URL + "/instance/iso/", direct.URL + "/"} {
+			resp, err := http.Get(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("disabled=%v %s: Content-Length %d, body %d bytes", disabled, target, resp.ContentLength, len(body))
+			}
+			if disabled {
+				if string(body) != page {
+					t.Errorf("disabled=%v %s: body modified:\n%s", disabled, target, body)
+				}
+				continue
+			}
+			if n := strings.Count(string(body), "<script nonce="); n != 1 {
+				t.Errorf("disabled=%v %s: %d scripts injected, want 1", disabled, target, n)
+			}
+			head, rest, _ := strings.Cut(string(body), "<head>")
+			if head != "<!DOCTYPE html><html>" || !strings.HasPrefix(rest, "<script nonce=") || !strings.Contains(rest, `var ID = "iso";`) {
+				t.Errorf("disabled=%v %s: script not at the start of <head>:\n%s", disabled, target, body)
+			}
+			if _, tail, _ := strings.Cut(string(body), "</script>"); tail != strings.TrimPrefix(page, "<!DOCTYPE html><html><head>") {
+				t.Errorf("disabled=%v %s: rest of the page changed:\n%s", disabled, target, tail)
+			}
+		}
+	}
+}
+
+func TestWebSocketEchoThroughProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	paths := make(chan string, 1)
+	front := newTestRoute(t, New(Options{}), "ws", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}))
+
+	url := "ws" + strings.TrimPrefix(front.URL, "http") + "/instance/ws/pty/abc"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial through proxy: %v (response %v)", err, resp)
+	}
+	defer conn.Close()
+	if got := <-paths; got != "/pty/abc" {
+		t.Errorf("backend path = %q, want /pty/abc", got)
+	}
+
+	for _, msg := range []string{"hello", strings.Repeat("x", 64<<10)} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		typ, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.TextMessage || string(got) != msg {
+			t.Errorf("echo of %d bytes = type %d, %d bytes", len(msg), typ, len(got))
+		}
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if typ, got, err := conn.ReadMessage(); err != nil || typ != websocket.BinaryMessage || string(got) != "\x00\x01\x02" {
+		t.Errorf("binary echo = %d %q %v", typ, got, err)
+	}
+}
+
+func TestSlowBackend(t *testing.T) {
+	rp := New(Options{ResponseTimeout: 100 * time.Millisecond})
+	var wakes atomic.Int32
+	rp.SetWake(func(string) { wakes.Add(1) })
+	front := newTestRoute(t, rp, "slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := func(d time.Duration) {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+			}
+		}
+		switch r.URL.Path {
+		case "/hang":
+			wait(5 * time.Second)
+		case "/slow-body":
+			// 响应头及时返回，之后的慢速 body 不受超时限制
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			wait(300 * time.Millisecond)
+			io.WriteString(w, "done")
+		case "/events":
+			wait(300 * time.Millisecond)
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: late\n\n")
+		}
+	}))
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.ServeHTTPDirect(w, r, "slow")
+	}))
+	defer direct.Close()
+
+	get := func(url, accept string) (*http.Response, string, time.Duration) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body), time.Since(start)
+	}
+
+	resp, body, took := get(front.URL+"/instance/slow/hang", "")
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "Starting") || took > 2*time.Second {
+		t.Errorf("hung backend via strip route: %d after %v, want the waiting page quickly", resp.StatusCode, took)
+	}
+	resp, _, took = get(direct.URL+"/hang", "")
+	if resp.StatusCode != http.StatusGatewayTimeout || took > 2*time.Second {
+		t.Errorf("hung backend via direct route: %d after %v, want 504 quickly", resp.StatusCode, took)
+	}
+	if n := wakes.Load(); n != 0 {
+		t.Errorf("timeouts triggered %d wakes, want none", n)
+	}
+
+	if resp, body, _ := get(front.URL+"/instance/slow/slow-body", ""); resp.StatusCode != http.StatusOK || body != "done" {
+		t.Errorf("slow body: %d %q, want 200 done", resp.StatusCode, body)
+	}
+	if resp, body, _ := get(front.URL+"/instance/slow/events", "text/event-stream"); resp.StatusCode != http.StatusOK || body != "data: late\n\n" {
+		t.Errorf("late event stream: %d %q, want it exempt from the timeout", resp.StatusCode, body)
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	rp := New(Options{RateLimit: 5})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	busy := newTestRoute(t, rp, "busy", ok)
+	quiet := newTestRoute(t, rp, "quiet", ok)
+
+	counts := make(map[int]int)
+	for range 20 {
+		resp, err := http.Get(busy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		counts[resp.StatusCode]++
+	}
+	if counts[http.StatusOK] < 5 || counts[http.StatusTooManyRequests] == 0 || counts[http.StatusOK]+counts[http.StatusTooManyRequests] != 20 {
+		t.Errorf("status counts = %v, want the burst of 5 served and the rest 429", counts)
+	}
+
+	// 每个实例有独立的限额
+	resp, err := http.Get(quiet.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("other instance: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	// 后端把收到的转发头原样返回
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := make(map[string]string)
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Prefix", "Forwarded"} {
+			got[name] = r.Header.Get(name)
+		}
+		got["Path"] = r.URL.Path
+		json.NewEncoder(w).Encode(got)
+	})
+	spoofed := map[string]string{
+		"X-Forwarded-For":    "203.0.113.7",
+		"X-Forwarded-Host":   "code.example.com",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Prefix": "/cc/",
+		"Forwarded":          "for=203.0.113.7",
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		tls     bool
+		direct  bool
+		path    string
+		headers map[string]string
+		want    map[string]string // 空字符串表示该头必须不存在
+	}{
+		{
+			name: "untrusted peer headers are replaced",
+			path: "/instance/fw/api", headers: spoofed,
+			want: map[string]string{
+				"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Host": "{host}", "X-Forwarded-Proto": "http",
+				"X-Forwarded-Prefix": "/instance/fw", "Forwarded": "", "Path": "/api",
+			},
+		},
+		{
+			name: "trusted peer chain is kept",
+			opts: Options{TrustProxy: true, TrustedProxies: mustParseCIDRs(t, "127.0.0.0/8")},
+			path: "/instance/fw/api", headers: spoofed,
+			want: map[string]string{
+				"X-Forwarded-For": "203.0.113.7, 127.0.0.1", "X-Forwarded-Host": "code.example.com", "X-Forwarded-Proto": "https",
+				"X-Forwarded-Prefix": "/cc/instance/fw", "Forwarded": "for=203.0.113.7", "Path": "/api",
+			},
+		},
+		{
+			name: "trust needs a listed peer",
+			opts: Options{TrustProxy: true, TrustedProxies: mustParseCIDRs(t, "10.0.0.0/8")},
+			path: "/instance/fw/api", headers: spoofed,
+			want: map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Host": "{host}", "X-Forwarded-Proto": "http"},
+		},
+		{
+			name: "tls sets https",
+			tls:  true, path: "/instance/fw/api",
+			want: map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Host": "{host}", "X-Forwarded-Proto": "https"},
+		},
+		{
+			name: "base path is part of the prefix",
+			opts: Options{BasePath: "/cloudcode"},
+			path: "/instance/fw/api",
+			want: map[string]string{"X-Forwarded-Prefix": "/cloudcode/instance/fw", "Path": "/api"},
+		},
+		{
+			name:   "direct route keeps the path and sets no prefix",
+			direct: true, path: "/assets/app.js",
+			want: map[string]string{
+				"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Host": "{host}", "X-Forwarded-Proto": "http",
+				"X-Forwarded-Prefix": "", "Path": "/assets/app.js",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := New(tt.opts)
+			newTestRoute(t, rp, "fw", echo)
+			serve := rp.ServeHTTP
+			if tt.direct {
+				serve = rp.ServeHTTPDirect
+			}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { serve(w, r, "fw") })
+			front := httptest.NewUnstartedServer(handler)
+			if tt.tls {
+				front.StartTLS()
+			} else {
+				front.Start()
+			}
+			defer front.Close()
+
+			req, err := http.NewRequest("GET", front.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := front.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var got map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decode echoed headers: %v", err)
+			}
+			for name, want := range tt.want {
+				want = strings.ReplaceAll(want, "{host}", front.Listener.Addr().String())
+				if got[name] != want {
+					t.Errorf("%s = %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+// mustParseCIDRs parses list with ParseCIDRs, failing the test on error.
+func mustParseCIDRs(t *testing.T, list string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the request rate to one instance. It refills at rate
+// tokens per second up to burst, and each request takes one token. A nil
+// bucket allows everything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for rate requests per second. The
+// burst is one second's worth of requests, at least one.
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := max(1, math.Ceil(rate))
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2)
+	now := b.last
+	for i := range 2 {
+		if !b.allow(now) {
+			t.Fatalf("request %d of the burst was refused", i)
+		}
+	}
+	if b.allow(now) {
+		t.Error("request over the burst was allowed")
+	}
+	// 半秒补充一个令牌
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("request after refill was refused")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("second request after a one-token refill was allowed")
+	}
+	// 长时间空闲后令牌数不超过 burst
+	later := now.Add(time.Hour)
+	allowed := 0
+	for range 5 {
+		if b.allow(later) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d requests after an idle hour, want the burst of 2", allowed)
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.allow(now) {
+		t.Error("nil bucket refused a request")
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCustomWaitingTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waiting.html")
+	custom := `id={{.InstanceID}} name={{.InstanceName}} base={{.BasePath}} refresh={{.RefreshSeconds}}`
+	if err := os.WriteFile(path, []byte(custom), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := LoadWaitingTemplate(path)
+	if err != nil || tmpl == nil {
+		t.Fatalf("LoadWaitingTemplate = %v, %v", tmpl, err)
+	}
+	rp := New(Options{BasePath: "/cc", WaitingTemplate: tmpl, WaitingRefresh: 10 * time.Second})
+
+	// 后端连不上时由 ErrorHandler 渲染等待页
+	bt := rp.transport.(*backendTransport)
+	bt.timed.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	if err := rp.Register("w1", 4096, RouteOptions{Name: "my app"}); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "/instance/w1/", nil), "w1")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if want := "id=w1 name=my app base=/cc refresh=10"; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestLoadWaitingTemplate(t *testing.T) {
+	dir := t.TempDir()
+	tmpl, err := LoadWaitingTemplate(filepath.Join(dir, "missing.html"))
+	if tmpl != nil || err != nil {
+		t.Errorf("missing file: %v, %v; want nil, nil", tmpl, err)
+	}
+	bad := filepath.Join(dir, "bad.html")
+	if err := os.WriteFile(bad, []byte("{{.InstanceID"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWaitingTemplate(bad); err == nil {
+		t.Error("malformed template loaded without error")
+	}
+
+	// 内置页面使用默认的刷新间隔
+	rec := httptest.NewRecorder()
+	New(Options{}).ServeWaiting(rec, "w2", "demo")
+	if body := rec.Body.String(); !strings.Contains(body, `content="3"`) || !strings.Contains(body, "demo is starting") {
+		t.Errorf("built-in waiting page = %q", body)
+	}
+}
+
+func TestUnreachableBackendWakes(t *testing.T) {
+	rp := New(Options{})
+	woken := make(chan string, 4)
+	rp.SetWake(func(id string) { woken <- id })
+	rp.transport.(*backendTransport).timed.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	if err := rp.Register("zz", 4096, RouteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "/instance/zz/", nil), "zz")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want the 502 waiting page", rec.Code)
+	}
+	select {
+	case id := <-woken:
+		if id != "zz" {
+			t.Errorf("woke %q, want zz", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wake callback not called")
+	}
+	select {
+	case id := <-woken:
+		t.Errorf("wake callback called again for %q", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
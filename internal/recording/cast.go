@@ -0,0 +1,183 @@
+// Package recording writes terminal sessions as asciinema v2 cast files
+// (https://docs.asciinema.org/manual/asciicast/v2/).
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// bufferedEvents is how many events may wait for the disk before new ones
+// are dropped.
+const bufferedEvents = 1024
+
+// Header is the first line of a cast file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type event struct {
+	at   time.Duration
+	kind string // "o" output, "r" resize
+	data []byte
+}
+
+// Recorder appends terminal events to a cast file. Events carry the time
+// they were recorded, not written, and are written by a background
+// goroutine so a slow disk never blocks the live terminal: when the buffer
+// is full, events are dropped and counted.
+type Recorder struct {
+	start  time.Time
+	events chan event
+	done   chan struct{}
+	w      io.WriteCloser
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+	err     error
+}
+
+// New writes the cast header for a width×height terminal to w and returns
+// a Recorder appending to it. Close closes w.
+func New(w io.WriteCloser, width, height int, title string) (*Recorder, error) {
+	start := time.Now()
+	hdr, err := json.Marshal(Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(hdr, '\n')); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		start:  start,
+		events: make(chan event, bufferedEvents),
+		done:   make(chan struct{}),
+		w:      w,
+	}
+	go r.run()
+	return r, nil
+}
+
+// Output records terminal output. p is copied.
+func (r *Recorder) Output(p []byte) {
+	r.add(event{kind: "o", data: append([]byte(nil), p...)})
+}
+
+// Resize records a terminal size change.
+func (r *Recorder) Resize(cols, rows uint) {
+	r.add(event{kind: "r", data: fmt.Appendf(nil, "%dx%d", cols, rows)})
+}
+
+func (r *Recorder) add(e event) {
+	e.at = time.Since(r.start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.events <- e:
+	default:
+		r.dropped++
+	}
+}
+
+// Close flushes the buffered events and closes the underlying writer. It
+// returns the first write error, if any.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		<-r.done
+		return r.err
+	}
+	r.closed = true
+	close(r.events)
+	r.mu.Unlock()
+
+	<-r.done
+	if r.dropped > 0 {
+		log.Printf("Terminal recording dropped %d events because the disk was too slow", r.dropped)
+	}
+	return r.err
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	bw := bufio.NewWriter(r.w)
+	// pending 保存被截断在块尾的不完整 UTF-8 字符，拼到下一块输出前面
+	var pending []byte
+	write := func(e event) error {
+		line, err := json.Marshal([]any{e.at.Seconds(), e.kind, string(e.data)})
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(append(line, '\n'))
+		return err
+	}
+	for e := range r.events {
+		if r.err != nil {
+			continue
+		}
+		if e.kind == "o" {
+			data := append(pending, e.data...)
+			cut := len(data) - incompleteSuffix(data)
+			pending = append([]byte(nil), data[cut:]...)
+			if cut == 0 {
+				continue
+			}
+			e.data = data[:cut]
+		}
+		r.err = write(e)
+		// 没有更多待写事件时刷盘，保证会话中途也能看到录像内容
+		if r.err == nil && len(r.events) == 0 {
+			r.err = bw.Flush()
+		}
+	}
+	if r.err == nil && len(pending) > 0 {
+		r.err = write(event{at: time.Since(r.start), kind: "o", data: pending})
+	}
+	if r.err == nil {
+		r.err = bw.Flush()
+	}
+	if err := r.w.Close(); r.err == nil {
+		r.err = err
+	}
+}
+
+// incompleteSuffix returns the length of a truncated UTF-8 sequence at the
+// end of p, or 0.
+func incompleteSuffix(p []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(p); i++ {
+		c := p[len(p)-i]
+		if c < 0x80 {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
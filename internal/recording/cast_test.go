@@ -0,0 +1,112 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// nopCloser is a buffer that records whether it was closed.
+type nopCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *nopCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRecorderWritesCast(t *testing.T) {
+	var buf nopCloser
+	r, err := New(&buf, 80, 24, "demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "é" 被拆在两次输出之间，录像里应当合并成一个完整字符
+	r.Output([]byte("hello \xc3"))
+	r.Output([]byte("\xa9\r\n"))
+	r.Resize(120, 40)
+	r.Output([]byte("bye"))
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !buf.closed {
+		t.Error("Close did not close the underlying writer")
+	}
+
+	sc := bufio.NewScanner(&buf)
+	if !sc.Scan() {
+		t.Fatal("cast file is empty")
+	}
+	var hdr Header
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+		t.Fatalf("header %q: %v", sc.Text(), err)
+	}
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 || hdr.Title != "demo" || hdr.Timestamp == 0 {
+		t.Errorf("header = %+v", hdr)
+	}
+
+	type line struct {
+		at         float64
+		kind, data string
+	}
+	var events []line
+	for sc.Scan() {
+		var raw []any
+		if err := json.Unmarshal(sc.Bytes(), &raw); err != nil {
+			t.Fatalf("event %q: %v", sc.Text(), err)
+		}
+		if len(raw) != 3 {
+			t.Fatalf("event %q has %d fields, want 3", sc.Text(), len(raw))
+		}
+		at, ok1 := raw[0].(float64)
+		kind, ok2 := raw[1].(string)
+		data, ok3 := raw[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			t.Fatalf("event %q has unexpected field types", sc.Text())
+		}
+		events = append(events, line{at, kind, data})
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []line{
+		{kind: "o", data: "hello "},
+		{kind: "o", data: "é\r\n"},
+		{kind: "r", data: "120x40"},
+		{kind: "o", data: "bye"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events %+v, want %d", len(events), events, len(want))
+	}
+	for i, e := range events {
+		if e.kind != want[i].kind || e.data != want[i].data {
+			t.Errorf("event %d = %q %q, want %q %q", i, e.kind, e.data, want[i].kind, want[i].data)
+		}
+		if i > 0 && e.at < events[i-1].at {
+			t.Errorf("event %d at %v is before event %d at %v", i, e.at, i-1, events[i-1].at)
+		}
+	}
+}
+
+func TestIncompleteSuffix(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"é", 0},
+		{"a\xc3", 1},
+		{"a\xe2\x82", 2},
+		{"a\xf0\x9f\x98", 3},
+		{"a\xf0\x9f\x98\x80", 0},
+	} {
+		if got := incompleteSuffix([]byte(tc.in)); got != tc.want {
+			t.Errorf("incompleteSuffix(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// TouchAccess records when instances last saw proxy traffic, keyed by
+// instance ID. Replicas sharing the database each write what their own
+// proxy served; a stored time is only ever moved forward.
+func (s *Store) TouchAccess(times map[string]time.Time) error {
+	if len(times) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("touch access: %w", err)
+	}
+	defer tx.Rollback()
+	for id, t := range times {
+		_, err := tx.Exec(`
+			INSERT INTO instance_access (instance_id, last_access) VALUES (?, ?)
+			ON CONFLICT(instance_id) DO UPDATE SET last_access = MAX(last_access, excluded.last_access)`,
+			id, t.UnixMilli())
+		if err != nil {
+			return fmt.Errorf("touch access of %s: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("touch access: %w", err)
+	}
+	return nil
+}
+
+// LastAccess returns the access times recorded by TouchAccess, keyed by
+// instance ID.
+func (s *Store) LastAccess() (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT instance_id, last_access FROM instance_access`)
+	if err != nil {
+		return nil, fmt.Errorf("query access times: %w", err)
+	}
+	defer rows.Close()
+	times := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			id string
+			ms int64
+		)
+		if err := rows.Scan(&id, &ms); err != nil {
+			return nil, fmt.Errorf("scan access time: %w", err)
+		}
+		times[id] = time.UnixMilli(ms)
+	}
+	return times, rows.Err()
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry is a single recorded platform action.
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Actor      string    `json:"actor"` // authenticated user, "system" for idle stops, "" when unauthenticated
+	Action     string    `json:"action"`
+	InstanceID string    `json:"instance_id"`
+	Detail     string    `json:"detail"`
+}
+
+// AuditFilter selects audit entries. Zero values mean "no constraint".
+type AuditFilter struct {
+	Action     string
+	InstanceID string
+	Since      time.Time
+	Limit      int
+	Offset     int
+}
+
+// LogAudit records an action performed by actor.
+func (s *Store) LogAudit(actor, action, instanceID, detail string) error {
+	_, err := s.db.Exec(`INSERT INTO audit_log (created_at, actor, action, instance_id, detail) VALUES (?, ?, ?, ?, ?)`,
+		time.Now(), actor, action, instanceID, detail)
+	if err != nil {
+		return fmt.Errorf("insert audit entry: %w", err)
+	}
+	return nil
+}
+
+// QueryAudit returns audit entries matching the filter, newest first, along
+// with the total number of matching entries (ignoring Limit/Offset).
+func (s *Store) QueryAudit(f AuditFilter) ([]*AuditEntry, int, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.InstanceID != "" {
+		where = append(where, "instance_id = ?")
+		args = append(args, f.InstanceID)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM audit_log`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count audit entries: %w", err)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.db.Query(`SELECT id, created_at, actor, action, instance_id, detail FROM audit_log`+clause+
+		` ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`, append(args, limit, f.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.Action, &e.InstanceID, &e.Detail); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, total, rows.Err()
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	s := newTestStore(t, Options{})
+	entries := []struct{ actor, action, instanceID, detail string }{
+		{"alice", "create", "a1", "name=one"},
+		{"alice", "start", "a1", ""},
+		{"", "create", "b2", "name=two"},
+		{"system", "stop", "a1", "idle"},
+		{"bob", "delete", "b2", ""},
+	}
+	for _, e := range entries {
+		if err := s.LogAudit(e.actor, e.action, e.instanceID, e.detail); err != nil {
+			t.Fatalf("LogAudit %s: %v", e.action, err)
+		}
+	}
+
+	got, total, err := s.QueryAudit(AuditFilter{})
+	if err != nil {
+		t.Fatalf("QueryAudit: %v", err)
+	}
+	if total != len(entries) || len(got) != len(entries) {
+		t.Fatalf("got %d entries of %d, want %d", len(got), total, len(entries))
+	}
+	// 最新的在前；同一时刻写入的按 id 倒序
+	for i, e := range got {
+		want := entries[len(entries)-1-i]
+		if e.Actor != want.actor || e.Action != want.action || e.InstanceID != want.instanceID || e.Detail != want.detail {
+			t.Errorf("entry %d = %+v, want %+v", i, e, want)
+		}
+		if e.CreatedAt.IsZero() || time.Since(e.CreatedAt) > time.Minute {
+			t.Errorf("entry %d created at %v", i, e.CreatedAt)
+		}
+		if i > 0 && (e.ID >= got[i-1].ID || e.CreatedAt.After(got[i-1].CreatedAt)) {
+			t.Errorf("entry %d (id %d) is not older than entry %d (id %d)", i, e.ID, i-1, got[i-1].ID)
+		}
+	}
+
+	recent, total, err := s.QueryAudit(AuditFilter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(entries) || len(recent) != 2 || recent[0].Action != "delete" || recent[1].Action != "stop" {
+		t.Errorf("limit 2: total %d, entries %+v", total, recent)
+	}
+	older, _, err := s.QueryAudit(AuditFilter{Limit: 2, Offset: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(older) != 2 || older[0].Action != "create" || older[0].InstanceID != "b2" || older[1].Action != "start" {
+		t.Errorf("offset 2: entries %+v", older)
+	}
+
+	forA1, total, err := s.QueryAudit(AuditFilter{InstanceID: "a1", Action: "create"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(forA1) != 1 || forA1[0].Detail != "name=one" {
+		t.Errorf("a1 creates: total %d, entries %+v", total, forA1)
+	}
+	future, total, err := s.QueryAudit(AuditFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 || len(future) != 0 {
+		t.Errorf("since an hour from now: total %d, entries %+v", total, future)
+	}
+}
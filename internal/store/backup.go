@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// importTables are the tables ImportFrom copies. The locks table is left
+// alone: leader leases belong to the running replicas, not to the data.
+var importTables = []string{"instances", "audit_log"}
+
+// Snapshot writes a consistent copy of the database to dst, which must not
+// exist yet. It is safe to call while the store is in use.
+func (s *Store) Snapshot(dst string) error {
+	if _, err := s.db.Exec(`VACUUM INTO ?`, dst); err != nil {
+		return fmt.Errorf("snapshot database: %w", err)
+	}
+	return nil
+}
+
+// ImportFrom replaces the rows of importTables with those of the SQLite
+// database at path, in one transaction. The source may come from an older
+// schema: only columns present in both are copied and the rest keep their
+// defaults.
+func (s *Store) ImportFrom(path string) error {
+	ctx := context.Background()
+	// ATTACH 只对当前连接生效，必须在同一个连接上完成整个导入
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS src`, path); err != nil {
+		return fmt.Errorf("attach import database: %w", err)
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range importTables {
+		srcCols, err := tableColumns(ctx, tx, "src", table)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM main.`+table); err != nil {
+			return fmt.Errorf("clear %s: %w", table, err)
+		}
+		if len(srcCols) == 0 {
+			continue // 旧版本的数据库可能还没有这张表
+		}
+		mainCols, err := tableColumns(ctx, tx, "main", table)
+		if err != nil {
+			return err
+		}
+		var cols []string
+		for _, c := range mainCols {
+			if slices.Contains(srcCols, c) {
+				cols = append(cols, c)
+			}
+		}
+		list := strings.Join(cols, ", ")
+		if _, err := tx.ExecContext(ctx, `INSERT INTO main.`+table+` (`+list+`) SELECT `+list+` FROM src.`+table); err != nil {
+			return fmt.Errorf("import %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	return nil
+}
+
+// tableColumns returns the columns of schema.table in declaration order,
+// or none when the table does not exist.
+func tableColumns(ctx context.Context, tx *sql.Tx, schema, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM pragma_table_info(?, ?)`, table, schema)
+	if err != nil {
+		return nil, fmt.Errorf("columns of %s.%s: %w", schema, table, err)
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
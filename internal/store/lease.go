@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Lease is an advisory, time-bounded lock stored as a row in the locks table.
+// Replicas sharing one database compete for the same lease name; the holder
+// renews it with heartbeats and everyone else waits for it to expire.
+type Lease struct {
+	s      *Store
+	name   string
+	holder string
+	ttl    time.Duration
+	held   atomic.Bool
+}
+
+// NewLease returns a lease handle. It does not touch the database until
+// TryAcquire or Run is called.
+func (s *Store) NewLease(name, holder string, ttl time.Duration) *Lease {
+	return &Lease{s: s, name: name, holder: holder, ttl: ttl}
+}
+
+// Holder returns the identity this lease acquires as.
+func (l *Lease) Holder() string { return l.holder }
+
+// Held reports whether the last heartbeat acquired or renewed the lease.
+func (l *Lease) Held() bool { return l.held.Load() }
+
+// TryAcquire takes the lease if it is free or expired, or renews it if this
+// holder already owns it. It reports whether the lease is now held.
+func (l *Lease) TryAcquire() (bool, error) {
+	now := time.Now()
+	// 仅当租约属于自己或已过期时才会更新行，否则 RowsAffected 为 0
+	res, err := l.s.db.Exec(`
+		INSERT INTO locks (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET holder=excluded.holder, expires_at=excluded.expires_at
+		WHERE locks.holder = excluded.holder OR locks.expires_at < ?`,
+		l.name, l.holder, now.Add(l.ttl).UnixMilli(), now.UnixMilli(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("acquire lease %s: %w", l.name, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("acquire lease %s: %w", l.name, err)
+	}
+	return n > 0, nil
+}
+
+// Release gives the lease up early so another replica can take over
+// without waiting for it to expire.
+func (l *Lease) Release() error {
+	l.held.Store(false)
+	_, err := l.s.db.Exec(`DELETE FROM locks WHERE name = ? AND holder = ?`, l.name, l.holder)
+	return err
+}
+
+// Run heartbeats the lease every ttl/3 until ctx is cancelled, then releases
+// it. onElected is called each time this replica becomes the holder, before
+// Held starts reporting true. A database error counts as losing the lease.
+func (l *Lease) Run(ctx context.Context, onElected func()) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		ok, err := l.TryAcquire()
+		if err != nil {
+			log.Printf("Lease %s heartbeat failed: %v", l.name, err)
+		}
+		switch {
+		case ok && !l.held.Load():
+			log.Printf("Acquired lease %s as %s", l.name, l.holder)
+			if onElected != nil {
+				onElected()
+			}
+		case !ok && l.held.Load():
+			log.Printf("Lost lease %s, continuing as read-only follower", l.name)
+		}
+		l.held.Store(ok)
+
+		select {
+		case <-ctx.Done():
+			if l.held.Load() {
+				if err := l.Release(); err != nil {
+					log.Printf("Release lease %s: %v", l.name, err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
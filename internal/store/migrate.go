@@ -0,0 +1,234 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one forward step of the store schema. Steps must be
+// idempotent: databases created before schema_migrations existed already
+// contain some of their changes and run them once more.
+type migration struct {
+	desc string
+	up   func(tx *sql.Tx) error
+}
+
+// migrations is the ordered list of schema steps; step i brings the
+// database to version i+1. Only ever append to it.
+var migrations = []migration{
+	{"initial schema", migrateInitial},
+	{"instances.tags", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "tags", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{"audit_log.actor", func(tx *sql.Tx) error {
+		return addColumn(tx, "audit_log", "actor", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"instances.networks", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "networks", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{"instances.image", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "image", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"instances.bind_mounts", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "bind_mounts", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{"instances.labels", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "labels", "TEXT NOT NULL DEFAULT '{}'")
+	}},
+	{"instances.stop_timeout", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "stop_timeout", "INTEGER NOT NULL DEFAULT 30")
+	}},
+	{"instances.command", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "command", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{"instances.dns", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "dns", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{"instances.extra_hosts", func(tx *sql.Tx) error {
+		return addColumn(tx, "instances", "extra_hosts", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{"instance_access", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS instance_access (
+				instance_id  TEXT PRIMARY KEY,
+				last_access  INTEGER NOT NULL
+			)
+		`)
+		return err
+	}},
+}
+
+// SchemaVersion identifies the store schema this build creates. Backup
+// archives record it so a build never imports a database newer than it
+// understands.
+var SchemaVersion = len(migrations)
+
+// migrate applies the pending migrations in order, each in its own
+// transaction together with its schema_migrations row, so a failed step
+// leaves the database at the previous version and is retried on the next
+// start.
+func (s *Store) migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version     INTEGER PRIMARY KEY,
+			applied_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	current, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, SchemaVersion)
+	}
+	for i, m := range migrations {
+		if err := s.applyMigration(i+1, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the highest applied migration, 0 for a new or
+// unversioned database.
+func (s *Store) schemaVersion() (int, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return int(v.Int64), nil
+}
+
+// applyMigration runs m as version unless it has been applied already. The
+// check happens inside the transaction, so replicas starting at the same
+// time do not apply a step twice.
+func (s *Store) applyMigration(version int, m migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	defer tx.Rollback()
+
+	var applied int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, version).Scan(&applied); err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	if applied > 0 {
+		return nil
+	}
+	if err := m.up(tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", version, m.desc, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now()); err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	log.Printf("Applied store migration %d: %s", version, m.desc)
+	return nil
+}
+
+// migrateInitial creates the schema as it was when versioning started.
+// The columns added before that point are listed separately so databases
+// from those older builds are brought up to date as well.
+func migrateInitial(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS instances (
+			id           TEXT PRIMARY KEY,
+			name         TEXT NOT NULL UNIQUE,
+			container_id TEXT NOT NULL DEFAULT '',
+			status       TEXT NOT NULL DEFAULT 'created',
+			error_msg    TEXT NOT NULL DEFAULT '',
+			port         INTEGER NOT NULL DEFAULT 0,
+			work_dir     TEXT NOT NULL DEFAULT '/root',
+			env_vars     TEXT NOT NULL DEFAULT '{}',
+			memory_mb    INTEGER NOT NULL DEFAULT 0,
+			cpu_cores    REAL NOT NULL DEFAULT 0,
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			action      TEXT NOT NULL,
+			instance_id TEXT NOT NULL DEFAULT '',
+			detail      TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_created_at ON audit_log (created_at);
+		CREATE INDEX IF NOT EXISTS idx_audit_action ON audit_log (action, created_at);
+		CREATE INDEX IF NOT EXISTS idx_audit_instance ON audit_log (instance_id, created_at);
+
+		CREATE TABLE IF NOT EXISTS locks (
+			name        TEXT PRIMARY KEY,
+			holder      TEXT NOT NULL,
+			expires_at  INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	columns := []struct{ name, def string }{
+		{"home_volume", "TEXT NOT NULL DEFAULT ''"},
+		{"proxy_headers", "TEXT NOT NULL DEFAULT '{}'"},
+		{"log_level", "TEXT NOT NULL DEFAULT ''"},
+		{"sysctls", "TEXT NOT NULL DEFAULT '{}'"},
+		{"gpus", "INTEGER NOT NULL DEFAULT 0"},
+		{"stop_signal", "TEXT NOT NULL DEFAULT ''"},
+		{"adopted", "INTEGER NOT NULL DEFAULT 0"},
+		{"cpuset_cpus", "TEXT NOT NULL DEFAULT ''"},
+		{"restart_policy", "TEXT NOT NULL DEFAULT 'unless-stopped'"},
+		{"deleted_at", "DATETIME"},
+	}
+	for _, c := range columns {
+		if err := addColumn(tx, "instances", c.name, c.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column unless it already exists. SQLite has no
+// ADD COLUMN IF NOT EXISTS, so the current schema is checked first.
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	if err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
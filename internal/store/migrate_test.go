@@ -0,0 +1,123 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// migrationRows returns the applied versions with their timestamps.
+func migrationRows(t *testing.T, s *Store) map[int]string {
+	t.Helper()
+	rows, err := s.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	out := make(map[int]string)
+	for rows.Next() {
+		var v int
+		var at string
+		if err := rows.Scan(&v, &at); err != nil {
+			t.Fatal(err)
+		}
+		out[v] = at
+	}
+	return out
+}
+
+func TestMigrateTwiceIsNoOp(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := migrationRows(t, s)
+	if len(before) != SchemaVersion {
+		t.Fatalf("%d migrations recorded, want %d", len(before), SchemaVersion)
+	}
+	if err := s.migrate(); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	after := migrationRows(t, s)
+	if len(after) != len(before) {
+		t.Fatalf("second migrate recorded %d migrations, want %d", len(after), len(before))
+	}
+	for v, at := range before {
+		if after[v] != at {
+			t.Errorf("migration %d re-applied: %s → %s", v, at, after[v])
+		}
+	}
+	s.Close()
+
+	// 重新打开同一个数据库也不会重复执行
+	s, err = New(dir, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if got := migrationRows(t, s); len(got) != SchemaVersion {
+		t.Errorf("%d migrations recorded after reopening, want %d", len(got), SchemaVersion)
+	}
+}
+
+func TestMigrateFromV1(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, "cloudcode.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按 v1 的结构建库并写入一个实例
+	if _, err := db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateInitial(tx); err != nil {
+		t.Fatalf("migrateInitial: %v", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO instances (id, name, status, port, env_vars) VALUES ('v1', 'old', 'stopped', 10001, '{"A":"1"}')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO audit_log (action, instance_id) VALUES ('create', 'v1')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := New(dir, Options{})
+	if err != nil {
+		t.Fatalf("upgrade v1 database: %v", err)
+	}
+	defer s.Close()
+	if v, err := s.schemaVersion(); err != nil || v != SchemaVersion {
+		t.Errorf("schema version = %d, %v; want %d", v, err, SchemaVersion)
+	}
+	inst, err := s.Get("v1")
+	if err != nil {
+		t.Fatalf("Get after upgrade: %v", err)
+	}
+	if inst.Name != "old" || inst.Port != 10001 || inst.EnvVars["A"] != "1" {
+		t.Errorf("instance after upgrade = %+v", inst)
+	}
+	// 新列取默认值
+	if len(inst.Tags) != 0 || len(inst.Networks) != 0 || inst.Image != "" || inst.StopTimeout != 30 {
+		t.Errorf("new columns = tags %v, networks %v, image %q, stop timeout %d", inst.Tags, inst.Networks, inst.Image, inst.StopTimeout)
+	}
+	entries, _, err := s.QueryAudit(AuditFilter{})
+	if err != nil || len(entries) != 1 || entries[0].Actor != "" {
+		t.Errorf("audit after upgrade = %+v, %v", entries, err)
+	}
+	// 升级后的库可以正常写入新列
+	inst.Tags = []string{"legacy"}
+	if err := s.Update(inst); err != nil {
+		t.Fatalf("Update after upgrade: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sort orders accepted by QueryOptions.Sort.
+const (
+	SortCreated = "created" // newest first, the default
+	SortName    = "name"    // case-insensitive, A–Z
+	SortStatus  = "status"  // grouped by status, then by name
+)
+
+// sortClauses maps each sort order to its ORDER BY clause. Only these
+// fixed clauses are ever interpolated into the query.
+var sortClauses = map[string]string{
+	SortCreated: "created_at DESC",
+	SortName:    "name COLLATE NOCASE ASC, created_at DESC",
+	SortStatus:  "status ASC, name COLLATE NOCASE ASC",
+}
+
+// QueryOptions filters and orders the instances returned by Query. Zero
+// values disable a filter.
+type QueryOptions struct {
+	Name   string // case-insensitive substring of the instance name
+	Status string // exact status
+	Tag    string // instances carrying this tag
+	Sort   string // one of the Sort* orders; "" = SortCreated
+}
+
+// ValidSort reports whether sort is empty or a known sort order.
+func ValidSort(sort string) bool {
+	_, ok := sortClauses[sort]
+	return sort == "" || ok
+}
+
+// Tags returns every tag used by an instance outside the recycle bin,
+// sorted.
+func (s *Store) Tags() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT j.value FROM instances, json_each(instances.tags) AS j WHERE deleted_at IS NULL ORDER BY j.value`)
+	if err != nil {
+		return nil, fmt.Errorf("query tags: %w", err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// Query returns the instances outside the recycle bin matching opts. With
+// zero options it returns the same rows in the same order as List.
+func (s *Store) Query(opts QueryOptions) ([]*Instance, error) {
+	where, args := opts.where()
+	order, err := opts.orderBy()
+	if err != nil {
+		return nil, err
+	}
+	return s.queryInstances(`SELECT `+instanceColumns+` FROM instances WHERE `+where+` ORDER BY `+order, args...)
+}
+
+// QueryPaged is Query limited to one page of at most limit rows starting
+// at offset. It also returns the total number of matching instances.
+func (s *Store) QueryPaged(opts QueryOptions, limit, offset int) ([]*Instance, int, error) {
+	where, args := opts.where()
+	order, err := opts.orderBy()
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM instances WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count instances: %w", err)
+	}
+	instances, err := s.queryInstances(`SELECT `+instanceColumns+` FROM instances WHERE `+where+` ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return instances, total, nil
+}
+
+// ListPaged returns one page of the instances List would return, plus the
+// total count. List stays for callers that need every instance.
+func (s *Store) ListPaged(limit, offset int) ([]*Instance, int, error) {
+	return s.QueryPaged(QueryOptions{}, limit, offset)
+}
+
+// where builds the WHERE clause and its arguments. User input only ever
+// reaches SQLite as bound parameters.
+func (o QueryOptions) where() (string, []any) {
+	conds := []string{"deleted_at IS NULL"}
+	var args []any
+	if o.Name != "" {
+		// instr 而不是 LIKE，免去转义 % 和 _
+		conds = append(conds, "instr(lower(name), lower(?)) > 0")
+		args = append(args, o.Name)
+	}
+	if o.Status != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, o.Status)
+	}
+	if o.Tag != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM json_each(instances.tags) WHERE value = ?)")
+		args = append(args, o.Tag)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (o QueryOptions) orderBy() (string, error) {
+	if o.Sort == "" {
+		return sortClauses[SortCreated], nil
+	}
+	clause, ok := sortClauses[o.Sort]
+	if !ok {
+		return "", fmt.Errorf("unknown sort order %q", o.Sort)
+	}
+	return clause, nil
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestQueryOptionsWhere(t *testing.T) {
+	where, args := QueryOptions{Name: "Api", Status: "running", Tag: "prod"}.where()
+	wantWhere := "deleted_at IS NULL AND instr(lower(name), lower(?)) > 0 AND status = ? AND " +
+		"EXISTS (SELECT 1 FROM json_each(instances.tags) WHERE value = ?)"
+	if where != wantWhere {
+		t.Errorf("where = %q\nwant    %q", where, wantWhere)
+	}
+	if !slices.Equal(args, []any{"Api", "running", "prod"}) {
+		t.Errorf("args = %v", args)
+	}
+
+	if where, args := (QueryOptions{}).where(); where != "deleted_at IS NULL" || len(args) != 0 {
+		t.Errorf("zero options: where = %q, args = %v", where, args)
+	}
+	if _, err := (QueryOptions{Sort: "name; DROP TABLE instances"}).orderBy(); err == nil {
+		t.Error("unknown sort order accepted")
+	}
+}
+
+// queryNames returns the names of the instances Query returns for opts.
+func queryNames(t *testing.T, s *Store, opts QueryOptions) []string {
+	t.Helper()
+	instances, err := s.Query(opts)
+	if err != nil {
+		t.Fatalf("Query(%+v): %v", opts, err)
+	}
+	var names []string
+	for _, inst := range instances {
+		names = append(names, inst.Name)
+	}
+	return names
+}
+
+func TestQuery(t *testing.T) {
+	s := newTestStore(t, Options{})
+	for _, inst := range []*Instance{
+		{ID: "1", Name: "api-prod", Status: "running", Tags: []string{"prod", "api"}},
+		{ID: "2", Name: "API-staging", Status: "stopped", Tags: []string{"staging", "api"}},
+		{ID: "3", Name: "web_100%", Status: "running", Tags: []string{"prod"}},
+		{ID: "4", Name: "worker", Status: "running"},
+	} {
+		if err := s.Create(inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("4"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts QueryOptions
+		want []string
+	}{
+		{QueryOptions{Sort: SortName}, []string{"api-prod", "API-staging", "web_100%"}},
+		{QueryOptions{Name: "api", Sort: SortName}, []string{"api-prod", "API-staging"}},
+		{QueryOptions{Name: "api", Status: "running"}, []string{"api-prod"}},
+		{QueryOptions{Tag: "prod", Status: "running", Sort: SortName}, []string{"api-prod", "web_100%"}},
+		{QueryOptions{Name: "api", Tag: "prod", Status: "stopped"}, nil},
+		{QueryOptions{Status: "running", Sort: SortStatus}, []string{"api-prod", "web_100%"}},
+		// % 和 _ 按字面匹配，不是 LIKE 通配符
+		{QueryOptions{Name: "%"}, []string{"web_100%"}},
+		{QueryOptions{Name: "_1"}, []string{"web_100%"}},
+		{QueryOptions{Name: "worker"}, nil}, // 在回收站里
+		// 注入的 SQL 只是被查找的字符串
+		{QueryOptions{Name: "' OR 1=1 --"}, nil},
+		{QueryOptions{Tag: "prod') OR 1=1 --"}, nil},
+		{QueryOptions{Status: "running' OR '1'='1"}, nil},
+	}
+	for _, tt := range tests {
+		if got := queryNames(t, s, tt.opts); !slices.Equal(got, tt.want) {
+			t.Errorf("Query(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+
+	if all, err := s.List(); err != nil || len(all) != 3 {
+		t.Errorf("List after injection attempts = %d instances, %v; want 3", len(all), err)
+	}
+}
+
+func TestListPaged(t *testing.T) {
+	s := newTestStore(t, Options{})
+	for i := range 120 {
+		if err := s.Create(&Instance{ID: fmt.Sprintf("i%03d", i), Name: fmt.Sprintf("inst-%03d", i), Status: "stopped"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paged []*Instance
+	for page, wantLen := range []int{50, 50, 20, 0} {
+		instances, total, err := s.ListPaged(50, page*50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 120 {
+			t.Errorf("page %d: total = %d, want 120", page+1, total)
+		}
+		if len(instances) != wantLen {
+			t.Errorf("page %d: %d instances, want %d", page+1, len(instances), wantLen)
+		}
+		paged = append(paged, instances...)
+	}
+	// 各页首尾相接，顺序与 List 一致，没有重复或遗漏
+	if !slices.EqualFunc(paged, all, func(a, b *Instance) bool { return a.ID == b.ID }) {
+		t.Error("pages do not add up to List")
+	}
+
+	instances, total, err := s.QueryPaged(QueryOptions{Name: "inst-11", Sort: SortName}, 5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 10 || len(instances) != 5 || instances[0].Name != "inst-115" {
+		t.Errorf("filtered second page: total %d, %d instances starting at %v", total, len(instances), instances)
+	}
+}
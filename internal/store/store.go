@@ -1,35 +1,171 @@
 package store
 
 import (
-"database/sql"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/moby/moby/api/types/container"
+	"github.com/naiba/cloudcode/internal/config"
 	_ "modernc.org/sqlite"
 )
 
 // Instance represents an opencode container instance.
 type Instance struct {
-	ID          string            `json:"id"`
-	Name        string            `json:"name"`
-	ContainerID string            `json:"container_id"`
-	Status      string            `json:"status"` // created, running, stopped, error
-	ErrorMsg    string            `json:"error_msg"`
-	Port        int               `json:"port"`
-	WorkDir     string            `json:"work_dir"`
-	EnvVars     map[string]string `json:"env_vars"` // API keys, GH_TOKEN, etc.
-	MemoryMB    int               `json:"memory_mb"`  // 0 = unlimited
-	CPUCores    float64           `json:"cpu_cores"` // 0 = unlimited
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
+	ID            string                  `json:"id"`
+	Name          string                  `json:"name"`
+	ContainerID   string                  `json:"container_id"`
+	Status        string                  `json:"status"` // created, running, stopped, error
+	ErrorMsg      string                  `json:"error_msg"`
+	Port          int                     `json:"port"`
+	WorkDir       string                  `json:"work_dir"`
+	EnvVars       map[string]string       `json:"env_vars"`       // API keys, GH_TOKEN, etc.
+	MemoryMB      int                     `json:"memory_mb"`      // 0 = unlimited
+	CPUCores      float64                 `json:"cpu_cores"`      // 0 = unlimited
+	CpusetCpus    string                  `json:"cpuset_cpus"`    // CPUs the container may run on, e.g. "0-3,8"; "" = any
+	HomeVolume    string                  `json:"home_volume"`    // "" = cloudcode-home-{id}
+	ProxyHeaders  map[string]string       `json:"proxy_headers"`  // static request headers added by the reverse proxy
+	Sysctls       map[string]string       `json:"sysctls"`        // kernel parameters applied via HostConfig.Sysctls
+	GPUs          int                     `json:"gpus"`           // NVIDIA GPUs to attach: 0 = none, -1 = all
+	StopSignal    string                  `json:"stop_signal"`    // e.g. "SIGINT"; "" uses the global default
+	RestartPolicy string                  `json:"restart_policy"` // one of RestartPolicies; "" = DefaultRestartPolicy
+	StopTimeout   int                     `json:"stop_timeout"`   // seconds between the stop signal and SIGKILL, 0..MaxStopTimeout
+	LogLevel      string                  `json:"log_level"`      // opencode log level, "" = image default
+	Adopted       bool                    `json:"adopted"`        // container was created outside CloudCode and adopted
+	Tags          []string                `json:"tags"`           // free-form labels for grouping, see NormalizeTags
+	Networks      []string                `json:"networks"`       // extra Docker networks joined besides cloudcode-net
+	Image         string                  `json:"image"`          // container image; "" = the global -image
+	BindMounts    []config.ContainerMount `json:"bind_mounts"`    // host directories mounted into the container, see config.ValidateBindMounts
+	Labels        map[string]string       `json:"labels"`         // custom container labels, applied when the container is created
+	Command       []string                `json:"command"`        // container command arguments; empty = the image's CMD
+	DNS           []string                `json:"dns"`            // nameserver IPs; empty = Docker's default resolver
+	ExtraHosts    []string                `json:"extra_hosts"`    // "hostname:ip" entries added to /etc/hosts
+	CreatedAt     time.Time               `json:"created_at"`
+	UpdatedAt     time.Time               `json:"updated_at"`
+	DeletedAt     *time.Time              `json:"deleted_at,omitempty"` // set while the instance is in the recycle bin
+
+	Usage *ResourceUsage `json:"usage,omitempty"` // latest stats sample of a running instance; kept in memory, never stored
+}
+
+// ResourceUsage is a resource usage sample of a running instance, filled in
+// from the handler's stats cache.
+type ResourceUsage struct {
+	CPUPercent  float64   `json:"cpu_percent"`  // 100 = one full core
+	MemoryUsage uint64    `json:"memory_usage"` // bytes
+	MemoryLimit uint64    `json:"memory_limit"` // bytes
+	SampledAt   time.Time `json:"sampled_at"`
+}
+
+// Limits on instance tags. Tags also become Docker label keys, so they are
+// restricted to characters valid there.
+const (
+	maxTags      = 20
+	maxTagLength = 64
+)
+
+// NormalizeTags trims, lower-cases and de-duplicates tags, dropping empty
+// ones, and returns them sorted. It rejects tags with characters other than
+// letters, digits, '.', '_' and '-'.
+func NormalizeTags(tags []string) ([]string, error) {
+	out := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || slices.Contains(out, t) {
+			continue
+		}
+		if len(t) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", t, maxTagLength)
+		}
+		for _, c := range t {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '.' && c != '_' && c != '-' {
+				return nil, fmt.Errorf("tag %q may only contain letters, digits, '.', '_' and '-'", t)
+			}
+		}
+		out = append(out, t)
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// LogLevels are the opencode log levels accepted for Instance.LogLevel.
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// ValidLogLevel reports whether level is empty (image default) or one of LogLevels.
+func ValidLogLevel(level string) bool {
+	if level == "" {
+		return true
+	}
+	for _, l := range LogLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// RestartPolicies are the Docker restart policies accepted for
+// Instance.RestartPolicy.
+var RestartPolicies = []string{"no", "on-failure", "unless-stopped", "always"}
+
+// DefaultRestartPolicy is used for instances without an explicit policy,
+// matching what every container was created with before it was configurable.
+const DefaultRestartPolicy = "unless-stopped"
+
+// DefaultStopTimeout is the stop timeout, in seconds, of new instances and
+// of those created before it was configurable.
+const DefaultStopTimeout = 30
+
+// MaxStopTimeout caps Instance.StopTimeout. Other operations on the
+// instance wait while it is being stopped.
+const MaxStopTimeout = 3600
+
+// onFailureMaxRetries caps restarts under the on-failure policy so a
+// crash-looping opencode ends up exited instead of restarting forever.
+const onFailureMaxRetries = 5
+
+// ValidRestartPolicy reports whether policy is empty (default) or one of
+// RestartPolicies.
+func ValidRestartPolicy(policy string) bool {
+	return policy == "" || slices.Contains(RestartPolicies, policy)
+}
+
+// ContainerRestartPolicy returns the Docker restart policy for the instance.
+func (inst *Instance) ContainerRestartPolicy() container.RestartPolicy {
+	switch inst.RestartPolicy {
+	case "":
+		return container.RestartPolicy{Name: DefaultRestartPolicy}
+	case "on-failure":
+		return container.RestartPolicy{Name: container.RestartPolicyOnFailure, MaximumRetryCount: onFailureMaxRetries}
+	default:
+		return container.RestartPolicy{Name: container.RestartPolicyMode(inst.RestartPolicy)}
+	}
+}
+
+// DefaultWorkDir is the working directory of instances that do not set one.
+const DefaultWorkDir = "/root"
+
+// ContainerWorkDir returns the working directory of the instance container.
+func (inst *Instance) ContainerWorkDir() string {
+	if inst.WorkDir == "" {
+		return DefaultWorkDir
+	}
+	return inst.WorkDir
 }
 
 // ContainerResources returns Docker resource constraints based on instance config.
-// MemoryMB=0 or CPUCores=0 means unlimited (Docker default).
+// MemoryMB=0 or CPUCores=0 means unlimited (Docker default), CpusetCpus=""
+// allows all CPUs.
 func (inst *Instance) ContainerResources() container.Resources {
 	var res container.Resources
 	if inst.MemoryMB > 0 {
@@ -38,32 +174,80 @@ func (inst *Instance) ContainerResources() container.Resources {
 	if inst.CPUCores > 0 {
 		res.NanoCPUs = int64(inst.CPUCores * 1e9)
 	}
+	res.CpusetCpus = inst.CpusetCpus
+	if inst.GPUs != 0 {
+		res.DeviceRequests = []container.DeviceRequest{{
+			Driver:       "nvidia",
+			Count:        inst.GPUs,
+			Capabilities: [][]string{{"gpu"}},
+		}}
+	}
 	return res
 }
 
 // Store manages persistent storage of instances.
 type Store struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
 }
 
+// Options configures how the SQLite database is opened.
+type Options struct {
+	// JournalMode is the SQLite journal mode, one of JournalModes. Empty
+	// means "wal"; "delete" or "truncate" suit network filesystems on which
+	// WAL's shared memory misbehaves.
+	JournalMode string
+	// BusyTimeout is how long a statement waits for a lock held by another
+	// connection before failing with "database is locked". Zero means
+	// DefaultBusyTimeout, negative fails immediately.
+	BusyTimeout time.Duration
+}
+
+// JournalModes are the accepted values of Options.JournalMode.
+var JournalModes = []string{"wal", "delete", "truncate"}
+
+// DefaultBusyTimeout is the lock wait when Options.BusyTimeout is zero.
+const DefaultBusyTimeout = 5 * time.Second
+
 // New creates a new Store backed by SQLite.
-func New(dataDir string) (*Store, error) {
+func New(dataDir string, opts Options) (*Store, error) {
+	if opts.JournalMode == "" {
+		opts.JournalMode = "wal"
+	}
+	opts.JournalMode = strings.ToLower(opts.JournalMode)
+	if !slices.Contains(JournalModes, opts.JournalMode) {
+		return nil, fmt.Errorf("invalid journal mode %q (allowed: %s)", opts.JournalMode, strings.Join(JournalModes, ", "))
+	}
+	if opts.BusyTimeout == 0 {
+		opts.BusyTimeout = DefaultBusyTimeout
+	}
+
 	if err := os.MkdirAll(dataDir, 0750); err != nil {
 		return nil, fmt.Errorf("create data dir: %w", err)
 	}
 
 	dbPath := filepath.Join(dataDir, "cloudcode.db")
-	db, err := sql.Open("sqlite", dbPath)
+	// 这两个 PRAGMA 都是连接级别的（WAL 除外），放在 DSN 里让连接池中的每个连接都生效
+	q := url.Values{"_pragma": {
+		fmt.Sprintf("busy_timeout(%d)", max(0, opts.BusyTimeout.Milliseconds())),
+		fmt.Sprintf("journal_mode(%s)", opts.JournalMode),
+	}}
+	db, err := sql.Open("sqlite", dbPath+"?"+q.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
-	// Enable WAL mode for better concurrent access
-	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
-		return nil, fmt.Errorf("set WAL mode: %w", err)
+	// SQLite silently keeps the old mode when it cannot switch, e.g. to WAL
+	// on a filesystem without shared memory support
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		return nil, fmt.Errorf("set journal mode: %w", err)
+	}
+	if mode != opts.JournalMode {
+		return nil, fmt.Errorf("set journal mode %s: database is in %s mode", opts.JournalMode, mode)
 	}
 
-	s := &Store{db: db}
+	s := &Store{db: db, path: dbPath}
 	if err := s.migrate(); err != nil {
 		return nil, fmt.Errorf("migrate: %w", err)
 	}
@@ -71,29 +255,7 @@ func New(dataDir string) (*Store, error) {
 	return s, nil
 }
 
-func (s *Store) migrate() error {
-	_, err := s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS instances (
-			id           TEXT PRIMARY KEY,
-			name         TEXT NOT NULL UNIQUE,
-			container_id TEXT NOT NULL DEFAULT '',
-			status       TEXT NOT NULL DEFAULT 'created',
-			error_msg    TEXT NOT NULL DEFAULT '',
-			port         INTEGER NOT NULL DEFAULT 0,
-			work_dir     TEXT NOT NULL DEFAULT '/root',
-			env_vars     TEXT NOT NULL DEFAULT '{}',
-			memory_mb    INTEGER NOT NULL DEFAULT 0,
-			cpu_cores    REAL NOT NULL DEFAULT 0,
-			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
+const instanceColumns = `id, name, container_id, status, error_msg, port, work_dir, env_vars, memory_mb, cpu_cores, home_volume, proxy_headers, log_level, sysctls, gpus, stop_signal, adopted, cpuset_cpus, restart_policy, stop_timeout, tags, networks, image, bind_mounts, labels, command, dns, extra_hosts, created_at, updated_at, deleted_at`
 
 // Create inserts a new instance.
 func (s *Store) Create(inst *Instance) error {
@@ -101,36 +263,93 @@ func (s *Store) Create(inst *Instance) error {
 	if err != nil {
 		return fmt.Errorf("marshal env vars: %w", err)
 	}
+	headersJSON, err := json.Marshal(inst.ProxyHeaders)
+	if err != nil {
+		return fmt.Errorf("marshal proxy headers: %w", err)
+	}
+	sysctlsJSON, err := json.Marshal(inst.Sysctls)
+	if err != nil {
+		return fmt.Errorf("marshal sysctls: %w", err)
+	}
+	tagsJSON, err := marshalList("tags", inst.Tags)
+	if err != nil {
+		return err
+	}
+	networksJSON, err := marshalList("networks", inst.Networks)
+	if err != nil {
+		return err
+	}
+	mountsJSON, err := marshalList("bind mounts", inst.BindMounts)
+	if err != nil {
+		return err
+	}
+	labelsJSON, err := json.Marshal(inst.Labels)
+	if err != nil {
+		return fmt.Errorf("marshal labels: %w", err)
+	}
+	commandJSON, err := marshalList("command", inst.Command)
+	if err != nil {
+		return err
+	}
+	dnsJSON, err := marshalList("dns", inst.DNS)
+	if err != nil {
+		return err
+	}
+	hostsJSON, err := marshalList("extra hosts", inst.ExtraHosts)
+	if err != nil {
+		return err
+	}
 
+	if inst.RestartPolicy == "" {
+		inst.RestartPolicy = DefaultRestartPolicy
+	}
 	now := time.Now()
 	inst.CreatedAt = now
 	inst.UpdatedAt = now
 
 	_, err = s.db.Exec(`
-		INSERT INTO instances (id, name, container_id, status, error_msg, port, work_dir, env_vars, memory_mb, cpu_cores, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, inst.ID, inst.Name, inst.ContainerID, inst.Status, inst.ErrorMsg, inst.Port, inst.WorkDir, string(envJSON), inst.MemoryMB, inst.CPUCores, inst.CreatedAt, inst.UpdatedAt)
+		INSERT INTO instances (`+instanceColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL)
+	`, inst.ID, inst.Name, inst.ContainerID, inst.Status, inst.ErrorMsg, inst.Port, inst.WorkDir, string(envJSON), inst.MemoryMB, inst.CPUCores, inst.HomeVolume, string(headersJSON), inst.LogLevel, string(sysctlsJSON), inst.GPUs, inst.StopSignal, inst.Adopted, inst.CpusetCpus, inst.RestartPolicy, inst.StopTimeout, tagsJSON, networksJSON, inst.Image, mountsJSON, string(labelsJSON), commandJSON, dnsJSON, hostsJSON, inst.CreatedAt, inst.UpdatedAt)
 	if err != nil {
 		return fmt.Errorf("insert instance: %w", err)
 	}
 	return nil
 }
 
-// Get retrieves an instance by ID.
+// Get retrieves an instance by ID. Instances in the recycle bin are not
+// returned; use GetDeleted for those.
 func (s *Store) Get(id string) (*Instance, error) {
-	row := s.db.QueryRow(`SELECT id, name, container_id, status, error_msg, port, work_dir, env_vars, memory_mb, cpu_cores, created_at, updated_at FROM instances WHERE id = ?`, id)
+	row := s.db.QueryRow(`SELECT `+instanceColumns+` FROM instances WHERE id = ? AND deleted_at IS NULL`, id)
 	return scanInstance(row)
 }
 
-// GetByName retrieves an instance by name.
+// GetDeleted retrieves an instance in the recycle bin by ID.
+func (s *Store) GetDeleted(id string) (*Instance, error) {
+	row := s.db.QueryRow(`SELECT `+instanceColumns+` FROM instances WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	return scanInstance(row)
+}
+
+// GetByName retrieves an instance by name, including soft-deleted ones
+// since names stay reserved until the instance is purged.
 func (s *Store) GetByName(name string) (*Instance, error) {
-	row := s.db.QueryRow(`SELECT id, name, container_id, status, error_msg, port, work_dir, env_vars, memory_mb, cpu_cores, created_at, updated_at FROM instances WHERE name = ?`, name)
+	row := s.db.QueryRow(`SELECT `+instanceColumns+` FROM instances WHERE name = ?`, name)
 	return scanInstance(row)
 }
 
-// List returns all instances.
+// List returns all instances that are not in the recycle bin.
 func (s *Store) List() ([]*Instance, error) {
-	rows, err := s.db.Query(`SELECT id, name, container_id, status, error_msg, port, work_dir, env_vars, memory_mb, cpu_cores, created_at, updated_at FROM instances ORDER BY created_at DESC`)
+	return s.queryInstances(`SELECT ` + instanceColumns + ` FROM instances WHERE deleted_at IS NULL ORDER BY created_at DESC`)
+}
+
+// ListDeleted returns the instances in the recycle bin, most recently
+// deleted first.
+func (s *Store) ListDeleted() ([]*Instance, error) {
+	return s.queryInstances(`SELECT ` + instanceColumns + ` FROM instances WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+}
+
+func (s *Store) queryInstances(query string, args ...any) ([]*Instance, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query instances: %w", err)
 	}
@@ -138,7 +357,7 @@ func (s *Store) List() ([]*Instance, error) {
 
 	var instances []*Instance
 	for rows.Next() {
-		inst, err := scanInstanceRow(rows)
+		inst, err := scanInstance(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -147,58 +366,274 @@ func (s *Store) List() ([]*Instance, error) {
 	return instances, rows.Err()
 }
 
-// Update updates an instance.
+// Update updates an instance. Instances in the recycle bin are left alone
+// and sql.ErrNoRows is returned, so a background operation that outlived a
+// delete cannot rewrite them; Restore them first.
 func (s *Store) Update(inst *Instance) error {
 	envJSON, err := json.Marshal(inst.EnvVars)
 	if err != nil {
 		return fmt.Errorf("marshal env vars: %w", err)
 	}
+	headersJSON, err := json.Marshal(inst.ProxyHeaders)
+	if err != nil {
+		return fmt.Errorf("marshal proxy headers: %w", err)
+	}
+	sysctlsJSON, err := json.Marshal(inst.Sysctls)
+	if err != nil {
+		return fmt.Errorf("marshal sysctls: %w", err)
+	}
+	tagsJSON, err := marshalList("tags", inst.Tags)
+	if err != nil {
+		return err
+	}
+	networksJSON, err := marshalList("networks", inst.Networks)
+	if err != nil {
+		return err
+	}
+	mountsJSON, err := marshalList("bind mounts", inst.BindMounts)
+	if err != nil {
+		return err
+	}
+	labelsJSON, err := json.Marshal(inst.Labels)
+	if err != nil {
+		return fmt.Errorf("marshal labels: %w", err)
+	}
+	commandJSON, err := marshalList("command", inst.Command)
+	if err != nil {
+		return err
+	}
+	dnsJSON, err := marshalList("dns", inst.DNS)
+	if err != nil {
+		return err
+	}
+	hostsJSON, err := marshalList("extra hosts", inst.ExtraHosts)
+	if err != nil {
+		return err
+	}
 
 	inst.UpdatedAt = time.Now()
 
-	_, err = s.db.Exec(`
-		UPDATE instances SET name=?, container_id=?, status=?, error_msg=?, port=?, work_dir=?, env_vars=?, memory_mb=?, cpu_cores=?, updated_at=?
-		WHERE id=?
-	`, inst.Name, inst.ContainerID, inst.Status, inst.ErrorMsg, inst.Port, inst.WorkDir, string(envJSON), inst.MemoryMB, inst.CPUCores, inst.UpdatedAt, inst.ID)
+	res, err := s.db.Exec(`
+		UPDATE instances SET name=?, container_id=?, status=?, error_msg=?, port=?, work_dir=?, env_vars=?, memory_mb=?, cpu_cores=?, home_volume=?, proxy_headers=?, log_level=?, sysctls=?, gpus=?, stop_signal=?, adopted=?, cpuset_cpus=?, restart_policy=?, stop_timeout=?, tags=?, networks=?, image=?, bind_mounts=?, labels=?, command=?, dns=?, extra_hosts=?, updated_at=?
+		WHERE id=? AND deleted_at IS NULL
+	`, inst.Name, inst.ContainerID, inst.Status, inst.ErrorMsg, inst.Port, inst.WorkDir, string(envJSON), inst.MemoryMB, inst.CPUCores, inst.HomeVolume, string(headersJSON), inst.LogLevel, string(sysctlsJSON), inst.GPUs, inst.StopSignal, inst.Adopted, inst.CpusetCpus, inst.RestartPolicy, inst.StopTimeout, tagsJSON, networksJSON, inst.Image, mountsJSON, string(labelsJSON), commandJSON, dnsJSON, hostsJSON, inst.UpdatedAt, inst.ID)
 	if err != nil {
 		return fmt.Errorf("update instance: %w", err)
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateStatuses sets the status of several instances in one transaction.
+// Only the status column is written, so other fields changed since the
+// instances were read are left alone.
+func (s *Store) UpdateStatuses(statuses map[string]string) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("update statuses: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE instances SET status = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("update statuses: %w", err)
+	}
+	defer stmt.Close()
+	now := time.Now()
+	for id, status := range statuses {
+		if _, err := stmt.Exec(status, now, id); err != nil {
+			return fmt.Errorf("update status of %s: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("update statuses: %w", err)
+	}
 	return nil
 }
 
-// Delete removes an instance by ID.
+// Delete moves an instance to the recycle bin by setting deleted_at. The
+// row is kept until HardDelete.
 func (s *Store) Delete(id string) error {
+	now := time.Now()
+	res, err := s.db.Exec(`UPDATE instances SET deleted_at = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL`, now, now, id)
+	if err != nil {
+		return fmt.Errorf("soft delete instance: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Restore takes an instance out of the recycle bin.
+func (s *Store) Restore(id string) error {
+	res, err := s.db.Exec(`UPDATE instances SET deleted_at = NULL, updated_at = ? WHERE id = ? AND deleted_at IS NOT NULL`, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("restore instance: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// HardDelete removes an instance row permanently.
+func (s *Store) HardDelete(id string) error {
 	_, err := s.db.Exec(`DELETE FROM instances WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM instance_access WHERE instance_id = ?`, id)
+	return err
+}
+
+// Ping checks that the database connection answers a query.
+func (s *Store) Ping(ctx context.Context) error {
+	var one int
+	if err := s.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("ping database: %w", err)
+	}
+	return nil
+}
+
+// DBStats describes the on-disk size of the database.
+type DBStats struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	WALBytes  int64  `json:"wal_bytes"`
+}
+
+// Stats returns the current size of the database file and its WAL.
+func (s *Store) Stats() DBStats {
+	st := DBStats{Path: s.path}
+	if fi, err := os.Stat(s.path); err == nil {
+		st.SizeBytes = fi.Size()
+	}
+	if fi, err := os.Stat(s.path + "-wal"); err == nil {
+		st.WALBytes = fi.Size()
+	}
+	return st
+}
+
+// Checkpoint moves the WAL content into the main database file and
+// truncates the WAL so it does not grow without bound.
+func (s *Store) Checkpoint() error {
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
 	return err
 }
 
+// Vacuum rebuilds the database file, reclaiming free pages.
+func (s *Store) Vacuum() error {
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+// StartMaintenance runs periodic WAL checkpoints and, optionally, VACUUM
+// until ctx is cancelled. A zero interval disables the respective task.
+func (s *Store) StartMaintenance(ctx context.Context, checkpointEvery, vacuumEvery time.Duration) {
+	if checkpointEvery <= 0 && vacuumEvery <= 0 {
+		return
+	}
+	go func() {
+		var checkpointC, vacuumC <-chan time.Time
+		if checkpointEvery > 0 {
+			t := time.NewTicker(checkpointEvery)
+			defer t.Stop()
+			checkpointC = t.C
+		}
+		if vacuumEvery > 0 {
+			t := time.NewTicker(vacuumEvery)
+			defer t.Stop()
+			vacuumC = t.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-checkpointC:
+				if err := s.Checkpoint(); err != nil {
+					log.Printf("WAL checkpoint failed: %v", err)
+				}
+			case <-vacuumC:
+				before := s.Stats().SizeBytes
+				if err := s.Vacuum(); err != nil {
+					log.Printf("VACUUM failed: %v", err)
+					continue
+				}
+				log.Printf("VACUUM done: %d -> %d bytes", before, s.Stats().SizeBytes)
+			}
+		}
+	}()
+}
+
 // Close closes the database connection.
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
 // scanInstance scans a single row into an Instance.
-func scanInstance(row *sql.Row) (*Instance, error) {
+func scanInstance(row rowScanner) (*Instance, error) {
 	var inst Instance
-	var envJSON string
-	if err := row.Scan(&inst.ID, &inst.Name, &inst.ContainerID, &inst.Status, &inst.ErrorMsg, &inst.Port, &inst.WorkDir, &envJSON, &inst.MemoryMB, &inst.CPUCores, &inst.CreatedAt, &inst.UpdatedAt); err != nil {
+	var envJSON, headersJSON, sysctlsJSON, tagsJSON, networksJSON, mountsJSON, labelsJSON, commandJSON, dnsJSON, hostsJSON string
+	var deletedAt sql.NullTime
+	if err := row.Scan(&inst.ID, &inst.Name, &inst.ContainerID, &inst.Status, &inst.ErrorMsg, &inst.Port, &inst.WorkDir, &envJSON, &inst.MemoryMB, &inst.CPUCores, &inst.HomeVolume, &headersJSON, &inst.LogLevel, &sysctlsJSON, &inst.GPUs, &inst.StopSignal, &inst.Adopted, &inst.CpusetCpus, &inst.RestartPolicy, &inst.StopTimeout, &tagsJSON, &networksJSON, &inst.Image, &mountsJSON, &labelsJSON, &commandJSON, &dnsJSON, &hostsJSON, &inst.CreatedAt, &inst.UpdatedAt, &deletedAt); err != nil {
 		return nil, err
 	}
+	if deletedAt.Valid {
+		inst.DeletedAt = &deletedAt.Time
+	}
 	if err := json.Unmarshal([]byte(envJSON), &inst.EnvVars); err != nil {
 		return nil, fmt.Errorf("unmarshal env vars: %w", err)
 	}
+	if err := json.Unmarshal([]byte(headersJSON), &inst.ProxyHeaders); err != nil {
+		return nil, fmt.Errorf("unmarshal proxy headers: %w", err)
+	}
+	if err := json.Unmarshal([]byte(sysctlsJSON), &inst.Sysctls); err != nil {
+		return nil, fmt.Errorf("unmarshal sysctls: %w", err)
+	}
+	if err := json.Unmarshal([]byte(tagsJSON), &inst.Tags); err != nil {
+		return nil, fmt.Errorf("unmarshal tags: %w", err)
+	}
+	if err := json.Unmarshal([]byte(networksJSON), &inst.Networks); err != nil {
+		return nil, fmt.Errorf("unmarshal networks: %w", err)
+	}
+	if err := json.Unmarshal([]byte(mountsJSON), &inst.BindMounts); err != nil {
+		return nil, fmt.Errorf("unmarshal bind mounts: %w", err)
+	}
+	if err := json.Unmarshal([]byte(labelsJSON), &inst.Labels); err != nil {
+		return nil, fmt.Errorf("unmarshal labels: %w", err)
+	}
+	if err := json.Unmarshal([]byte(commandJSON), &inst.Command); err != nil {
+		return nil, fmt.Errorf("unmarshal command: %w", err)
+	}
+	if err := json.Unmarshal([]byte(dnsJSON), &inst.DNS); err != nil {
+		return nil, fmt.Errorf("unmarshal dns: %w", err)
+	}
+	if err := json.Unmarshal([]byte(hostsJSON), &inst.ExtraHosts); err != nil {
+		return nil, fmt.Errorf("unmarshal extra hosts: %w", err)
+	}
 	return &inst, nil
 }
 
-// scanInstanceRow scans from sql.Rows.
-func scanInstanceRow(rows *sql.Rows) (*Instance, error) {
-	var inst Instance
-	var envJSON string
-	if err := rows.Scan(&inst.ID, &inst.Name, &inst.ContainerID, &inst.Status, &inst.ErrorMsg, &inst.Port, &inst.WorkDir, &envJSON, &inst.MemoryMB, &inst.CPUCores, &inst.CreatedAt, &inst.UpdatedAt); err != nil {
-		return nil, err
+// marshalList encodes a list column as a JSON array, "[]" when it is
+// empty, so json_each (used by QueryOptions.Tag) always sees an array.
+func marshalList[T any](column string, list []T) (string, error) {
+	if list == nil {
+		list = []T{}
 	}
-	if err := json.Unmarshal([]byte(envJSON), &inst.EnvVars); err != nil {
-		return nil, fmt.Errorf("unmarshal env vars: %w", err)
+	b, err := json.Marshal(list)
+	if err != nil {
+		return "", fmt.Errorf("marshal %s: %w", column, err)
 	}
-	return &inst, nil
+	return string(b), nil
 }
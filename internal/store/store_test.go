@@ -0,0 +1,188 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// newTestStore opens a fresh store in t.TempDir.
+func newTestStore(t *testing.T, opts Options) *Store {
+	t.Helper()
+	return newTestStoreAt(t, t.TempDir(), opts)
+}
+
+// newTestStoreAt opens the store in dir, closing it when the test ends.
+func newTestStoreAt(t *testing.T, dir string, opts Options) *Store {
+	t.Helper()
+	s, err := New(dir, opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestContainerRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   container.RestartPolicy
+	}{
+		{"", container.RestartPolicy{Name: DefaultRestartPolicy}},
+		{"no", container.RestartPolicy{Name: container.RestartPolicyDisabled}},
+		{"always", container.RestartPolicy{Name: container.RestartPolicyAlways}},
+		{"unless-stopped", container.RestartPolicy{Name: container.RestartPolicyUnlessStopped}},
+		{"on-failure", container.RestartPolicy{Name: container.RestartPolicyOnFailure, MaximumRetryCount: onFailureMaxRetries}},
+	}
+	for _, tt := range tests {
+		inst := &Instance{RestartPolicy: tt.policy}
+		if got := inst.ContainerRestartPolicy(); got != tt.want {
+			t.Errorf("ContainerRestartPolicy(%q) = %+v, want %+v", tt.policy, got, tt.want)
+		}
+		if !ValidRestartPolicy(tt.policy) {
+			t.Errorf("ValidRestartPolicy(%q) = false", tt.policy)
+		}
+	}
+	for _, policy := range []string{"sometimes", "Always", "on-failure:3"} {
+		if ValidRestartPolicy(policy) {
+			t.Errorf("ValidRestartPolicy(%q) = true", policy)
+		}
+	}
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	s := newTestStore(t, Options{})
+	for _, tt := range []struct {
+		id   string
+		tags []string
+	}{
+		{"nil", nil},
+		{"empty", []string{}},
+		{"one", []string{"backend"}},
+		{"many", []string{"alice", "backend", "team.core"}},
+	} {
+		if err := s.Create(&Instance{ID: tt.id, Name: tt.id, Status: "stopped", Tags: tt.tags}); err != nil {
+			t.Fatalf("Create %s: %v", tt.id, err)
+		}
+		got, err := s.Get(tt.id)
+		if err != nil {
+			t.Fatalf("Get %s: %v", tt.id, err)
+		}
+		// 没有标签时读回空切片，模板和 JSON 都不必区分 nil
+		if got.Tags == nil || !slices.Equal(got.Tags, tt.tags) {
+			t.Errorf("%s: tags = %#v, want %#v", tt.id, got.Tags, tt.tags)
+		}
+	}
+
+	inst, _ := s.Get("many")
+	inst.Tags = []string{"frontend"}
+	if err := s.Update(inst); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	inst, _ = s.Get("many")
+	if !slices.Equal(inst.Tags, []string{"frontend"}) {
+		t.Errorf("tags after update = %v", inst.Tags)
+	}
+	tags, err := s.Tags()
+	if err != nil {
+		t.Fatalf("Tags: %v", err)
+	}
+	if want := []string{"backend", "frontend"}; !slices.Equal(tags, want) {
+		t.Errorf("Tags() = %v, want %v", tags, want)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	got, err := NormalizeTags([]string{" Backend", "", "alice", "backend", "team.core"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "backend", "team.core"}; !slices.Equal(got, want) {
+		t.Errorf("NormalizeTags = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"has space", "a/b", "x=y"} {
+		if _, err := NormalizeTags([]string{bad}); err == nil {
+			t.Errorf("NormalizeTags(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestUpdateSkipsRecycleBin(t *testing.T) {
+	s := newTestStore(t, Options{})
+	inst := &Instance{ID: "trash", Name: "trash", Status: "running", ContainerID: "c1", Port: 10000}
+	if err := s.Create(inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(inst.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除后仍在运行的后台操作不能改写回收站中的行
+	inst.Status, inst.ErrorMsg, inst.ContainerID = "error", "boom", ""
+	if err := s.Update(inst); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Update of a deleted instance = %v, want sql.ErrNoRows", err)
+	}
+	got, err := s.GetDeleted(inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "running" || got.ErrorMsg != "" || got.ContainerID != "c1" {
+		t.Errorf("deleted row rewritten: status %q error %q container %q", got.Status, got.ErrorMsg, got.ContainerID)
+	}
+
+	if err := s.Restore(inst.ID); err != nil {
+		t.Fatal(err)
+	}
+	inst.Status, inst.ErrorMsg = "created", ""
+	if err := s.Update(inst); err != nil {
+		t.Fatalf("Update after Restore: %v", err)
+	}
+	if got, _ := s.Get(inst.ID); got == nil || got.Status != "created" || got.ContainerID != "" {
+		t.Errorf("restored row = %+v, want the update applied", got)
+	}
+}
+
+func TestDeleteJournalMode(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, Options{JournalMode: "DELETE", BusyTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var mode string
+	var timeout int
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "delete" {
+		t.Errorf("journal_mode = %q, %v; want delete", mode, err)
+	}
+	if err := s.db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 2000 {
+		t.Errorf("busy_timeout = %d, %v; want 2000", timeout, err)
+	}
+	if err := s.Create(&Instance{ID: "dm", Name: "delete-mode", Status: "stopped", Port: 10001}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	s.Close()
+
+	// delete 模式不会留下 -wal 文件
+	if _, err := os.Stat(filepath.Join(dir, "cloudcode.db-wal")); !os.IsNotExist(err) {
+		t.Errorf("WAL file exists in delete mode: %v", err)
+	}
+	s = newTestStoreAt(t, dir, Options{JournalMode: "delete"})
+	inst, err := s.Get("dm")
+	if err != nil {
+		t.Fatalf("Get after reopen: %v", err)
+	}
+	if inst.Name != "delete-mode" || inst.Port != 10001 {
+		t.Errorf("read back %+v", inst)
+	}
+}
+
+func TestInvalidJournalMode(t *testing.T) {
+	if _, err := New(t.TempDir(), Options{JournalMode: "memoryish"}); err == nil {
+		t.Error("New accepted an invalid journal mode")
+	}
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/naiba/cloudcode/internal/backup"
 	"github.com/naiba/cloudcode/internal/config"
 	"github.com/naiba/cloudcode/internal/docker"
 	"github.com/naiba/cloudcode/internal/handler"
@@ -24,29 +31,159 @@ var version = "dev"
 func main() {
 	var (
 		addr     = flag.String("addr", ":8080", "HTTP listen address")
+		tlsCert  = flag.String("tls-cert", "", "TLS certificate file (PEM, with -tls-cert-key); serves HTTPS on -addr")
+		tlsKey   = flag.String("tls-cert-key", "", "TLS private key file (PEM, with -tls-cert)")
+		redirect = flag.String("redirect-http", "", "Extra plaintext listen address (e.g. :80) that redirects to HTTPS (with -tls-cert)")
 		dataDir  = flag.String("data", "./data", "Data directory for SQLite database")
 		imgName  = flag.String("image", "ghcr.io/naiba/cloudcode-base:latest", "Docker image name for opencode instances")
 		noDocker = flag.Bool("no-docker", false, "Skip Docker initialization (for UI preview)")
+		cleanup  = flag.Bool("cleanup", false, "Remove CloudCode containers and home volumes that belong to no instance, print what was removed and exit")
+
+		sqliteJournal = flag.String("sqlite-journal", "wal", "SQLite journal mode: wal, delete or truncate (use delete or truncate on network filesystems)")
+		sqliteBusy    = flag.Duration("sqlite-busy-timeout", store.DefaultBusyTimeout, "How long SQLite statements wait for a lock held by another connection (negative = fail immediately)")
+		walCheckpoint = flag.Duration("wal-checkpoint-interval", time.Hour, "Interval between SQLite WAL checkpoints (0 = disabled)")
+		vacuumEvery   = flag.Duration("vacuum-interval", 0, "Interval between SQLite VACUUM runs (0 = disabled)")
+		backupEvery   = flag.Duration("backup-interval", 0, "Interval between automatic backups of the database and config (0 = disabled, needs -backup-dir)")
+		backupDir     = flag.String("backup-dir", "", "Directory for automatic backup archives")
+		backupKeep    = flag.Int("backup-keep", backup.DefaultKeep, "Number of automatic backups to retain")
+		cookieTTL     = flag.Duration("proxy-cookie-ttl", 30*time.Minute, "Idle lifetime of the instance routing cookie")
+
+		trustProxy     = flag.Bool("trust-proxy", false, "Keep X-Forwarded-* headers from trusted upstream proxies")
+		waitingPage    = flag.String("waiting-page", "", "Custom html/template for the page shown while an instance starts (default <data>/waiting.html, built-in page when absent)")
+		waitingRefresh = flag.Duration("waiting-refresh", proxy.DefaultWaitingRefresh, "How often the instance waiting page retries")
+		proxyRate      = flag.Float64("proxy-rate", 0, "Requests per second allowed to each instance through the proxy; excess requests get 429 (0 = unlimited)")
+		proxyTimeout   = flag.Duration("proxy-timeout", proxy.DefaultResponseTimeout, "How long an instance may take to send response headers before proxied requests fail (negative = no limit; WebSockets and event streams are exempt)")
+		proxyLog       = flag.Bool("proxy-log", false, "Log every proxied request with instance ID, method, path, status and duration (WebSockets when they connect)")
+		noIsolation    = flag.Bool("no-isolation", false, "Do not inject the script that gives each instance its own localStorage into proxied pages")
+		trustedProxies = flag.String("trusted-proxies", "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16", "Comma-separated CIDRs allowed to set X-Forwarded-* headers (with -trust-proxy)")
+
+		publicStatus = flag.Bool("public-status", false, "Serve a read-only instance status page at /status without authentication")
+
+		authUser = flag.String("auth-user", "", "Username for HTTP basic auth on the management UI (with -auth-pass; the /instance/ proxy stays open)")
+		authPass = flag.String("auth-pass", os.Getenv("CLOUDCODE_AUTH_PASS"), "Password for HTTP basic auth on the management UI (default $CLOUDCODE_AUTH_PASS)")
+
+		leaderLease = flag.Duration("leader-lease", 0, "Enable leader election for replicas sharing the data dir with this lease TTL (0 = single replica)")
+
+		allowedSysctls = flag.String("allowed-sysctls", "", "Comma-separated sysctls instances may set, \"prefix.*\" allows a namespace (empty = none)")
+
+		volumeDriver = flag.String("volume-driver", "", "Docker volume driver for new home volumes (empty = local, auto-created)")
+		volumeOpts   = flag.String("volume-opt", "", "Comma-separated key=value driver options for new home volumes (with -volume-driver)")
+
+		enableGPU = flag.Bool("enable-gpu", false, "Allow instances to request NVIDIA GPUs (requires the nvidia container toolkit)")
+		basePath  = flag.String("base-path", "", "URL path prefix to serve CloudCode under (e.g. /cloudcode)")
+
+		allowBindMounts = flag.Bool("allow-bind-mounts", false, "Allow instances to mount host directories (system paths and the data dir are always refused)")
+
+		alwaysPull = flag.Bool("always-pull", false, "Pull the instance image on every container create even if it exists locally")
+		stopSignal = flag.String("stop-signal", "", "Default container stop signal, e.g. SIGINT (empty = Docker default SIGTERM)")
+
+		reconcileEvery = flag.Duration("reconcile-interval", time.Minute, "Interval of the background store/Docker reconciliation (0 = disabled)")
+		readyPath      = flag.String("ready-path", "/", "Path probed on a started instance's opencode port; any non-5xx response marks it running")
+		readyTimeout   = flag.Duration("ready-timeout", 10*time.Minute, "How long a started instance may take to answer on its opencode port before it is marked running with a warning")
+		idleTimeout    = flag.Duration("idle-timeout", 0, "Stop running instances after this long without proxy traffic; open log/terminal streams count as activity (0 = never)")
+		statsInterval  = flag.Duration("stats-interval", 30*time.Second, "Interval of the CPU/memory sampling of running instances shown on the dashboard (0 = disabled)")
+		wakeOnTraffic  = flag.Bool("wake-on-traffic", false, "Start a stopped instance when a request for it reaches the proxy (pairs with -idle-timeout)")
+		stopOnExit     = flag.Bool("stop-on-exit", false, "Stop all running instance containers when CloudCode shuts down")
+		maxUploadMB    = flag.Int64("max-upload-mb", 100, "Largest file, in MiB, that can be uploaded into an instance container")
+		maxDownloadMB  = flag.Int64("max-download-mb", 1024, "Largest file or directory archive, in MiB, that can be downloaded from an instance container")
+
+		portStart = flag.Int("port-start", 10000, "First port of the instance port range")
+		portEnd   = flag.Int("port-end", 10100, "Last port of the instance port range (inclusive)")
+
+		wsAllowedOrigins = flag.String("ws-allowed-origins", "", "Comma-separated extra origins (scheme://host) allowed to open terminal/log WebSockets; the serving host is always allowed")
+		wsAnyOrigin      = flag.Bool("ws-allow-any-origin", false, "Disable the WebSocket origin check (development only)")
+
+		logDriver  = flag.String("log-driver", "", "Container log driver (e.g. json-file, local, journald); empty keeps the Docker default")
+		logMaxSize = flag.String("log-max-size", "10m", "Max size per container log file (json-file/local drivers, with -log-driver)")
+		logMaxFile = flag.String("log-max-file", "3", "Max number of container log files (json-file/local drivers, with -log-driver)")
 	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n%s\nFlags:\n", os.Args[0], commandUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	cmd, err := parseCommand(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.Println("Starting CloudCode Management Platform...")
+	if cmd == nil {
+		log.Println("Starting CloudCode Management Platform...")
+	}
 
-	db, err := store.New(*dataDir)
+	if *portStart < 1 || *portEnd > 65535 || *portEnd < *portStart {
+		log.Fatalf("Invalid port range %d-%d: need 1 <= -port-start <= -port-end <= 65535", *portStart, *portEnd)
+	}
+	if (*authUser == "") != (*authPass == "") {
+		log.Fatalf("-auth-user and -auth-pass must be set together")
+	}
+	if *authUser != "" {
+		log.Printf("Basic auth enabled for user %q", *authUser)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("-tls-cert and -tls-cert-key must be set together")
+	}
+	if *redirect != "" && *tlsCert == "" {
+		log.Fatalf("-redirect-http requires -tls-cert and -tls-cert-key")
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		// 启动时就加载证书，避免在绑定端口之后才发现证书和私钥不匹配
+		var err error
+		if tlsConfig, err = loadTLSConfig(*tlsCert, *tlsKey); err != nil {
+			log.Fatalf("Failed to load TLS certificate %s / key %s: %v", *tlsCert, *tlsKey, err)
+		}
+	}
+
+	if err := checkDataDirWritable(*dataDir); err != nil {
+		log.Fatalf("Data directory %s is not usable: %v", *dataDir, err)
+	}
+
+	db, err := store.New(*dataDir, store.Options{
+		JournalMode: *sqliteJournal,
+		BusyTimeout: *sqliteBusy,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize store: %v", err)
 	}
 	defer db.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db.StartMaintenance(ctx, *walCheckpoint, *vacuumEvery)
+
 	cfgMgr, err := config.NewManager(*dataDir)
 	if err != nil {
 		log.Fatalf("Failed to initialize config manager: %v", err)
 	}
 
+	backups := *backupEvery > 0 && *backupDir != ""
+	if backups && *backupKeep < 1 {
+		log.Fatalf("Invalid -backup-keep %d: must be at least 1", *backupKeep)
+	} else if *backupEvery > 0 && !backups {
+		log.Printf("Warning: -backup-interval is set without -backup-dir, automatic backups are disabled")
+	}
+
+	defaultStopSignal, err := docker.NormalizeStopSignal(*stopSignal)
+	if err != nil {
+		log.Fatalf("Invalid -stop-signal: %v", err)
+	}
+
 	var dm *docker.Manager
 	if !*noDocker {
-		dm, err = docker.NewManager(*imgName, cfgMgr)
+		dm, err = docker.NewManager(*imgName, cfgMgr, docker.Options{
+			LogDriver:       *logDriver,
+			LogMaxSize:      *logMaxSize,
+			LogMaxFile:      *logMaxFile,
+			VolumeDriver:    *volumeDriver,
+			VolumeOpts:      parseKeyValues(*volumeOpts),
+			StopSignal:      defaultStopSignal,
+			AlwaysPull:      *alwaysPull,
+			AllowBindMounts: *allowBindMounts,
+		})
 		if err != nil {
 			log.Fatalf("Failed to initialize Docker manager: %v", err)
 		}
@@ -63,14 +200,192 @@ func main() {
 		log.Println("Docker disabled (--no-docker), container operations will fail")
 	}
 
-	rp := proxy.New()
+	base := normalizeBasePath(*basePath)
 
-	tmpl, err := loadTemplates()
+	trustedNets, err := proxy.ParseCIDRs(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	waitingPath := *waitingPage
+	if waitingPath == "" {
+		waitingPath = filepath.Join(*dataDir, "waiting.html")
+	}
+	waitingTmpl, err := proxy.LoadWaitingTemplate(waitingPath)
 	if err != nil {
-		log.Fatalf("Failed to load templates: %v", err)
+		log.Fatalf("Invalid waiting page: %v", err)
+	}
+	if waitingTmpl != nil {
+		log.Printf("Using custom waiting page %s", waitingPath)
+	} else if *waitingPage != "" {
+		log.Printf("Warning: waiting page %s not found, using the built-in page", waitingPath)
+	}
+	rp := proxy.New(proxy.Options{
+		TrustProxy:       *trustProxy,
+		TrustedProxies:   trustedNets,
+		BasePath:         base,
+		ResponseTimeout:  *proxyTimeout,
+		RateLimit:        *proxyRate,
+		WaitingTemplate:  waitingTmpl,
+		WaitingRefresh:   *waitingRefresh,
+		AccessLog:        *proxyLog,
+		DisableIsolation: *noIsolation,
+	})
+
+	// 子命令不渲染页面，也不依赖工作目录下的 templates/
+	var tmpl map[string]*template.Template
+	if cmd == nil {
+		tmpl, err = loadTemplates(base)
+		if err != nil {
+			log.Fatalf("Failed to load templates: %v", err)
+		}
+	}
+
+	var lease *store.Lease
+	if *leaderLease > 0 {
+		host, _ := os.Hostname()
+		lease = db.NewLease("leader", fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.NewString()[:8]), *leaderLease)
+	}
+
+	h := handler.New(db, dm, rp, cfgMgr, tmpl, handler.Options{
+		CookieTTL:        *cookieTTL,
+		PublicStatus:     *publicStatus,
+		Lease:            lease,
+		AllowedSysctls:   splitList(*allowedSysctls),
+		BasePath:         base,
+		EnableGPU:        *enableGPU,
+		AllowBindMounts:  *allowBindMounts,
+		WSAllowedOrigins: splitList(*wsAllowedOrigins),
+		WSAllowAnyOrigin: *wsAnyOrigin,
+		ReadyTimeout:     *readyTimeout,
+		ReadyPath:        *readyPath,
+		PortStart:        *portStart,
+		PortEnd:          *portEnd,
+		StopOnExit:       *stopOnExit,
+		MaxUploadSize:    *maxUploadMB << 20,
+		MaxDownloadSize:  *maxDownloadMB << 20,
+		IdleTimeout:      *idleTimeout,
+		WakeOnTraffic:    *wakeOnTraffic,
+		AuthUser:         *authUser,
+		AuthPass:         *authPass,
+	})
+	if *cleanup {
+		if dm == nil {
+			log.Fatalf("-cleanup needs Docker")
+		}
+		report, err := h.CleanupOrphans(ctx)
+		if err != nil {
+			log.Fatalf("Cleanup failed: %v", err)
+		}
+		for _, name := range report.Containers {
+			fmt.Println("removed container", name)
+		}
+		for _, name := range report.Volumes {
+			fmt.Println("removed volume", name)
+		}
+		for _, e := range report.Errors {
+			log.Printf("Cleanup: %s", e)
+		}
+		log.Printf("Cleanup removed %d containers and %d volumes", len(report.Containers), len(report.Volumes))
+		if len(report.Errors) > 0 {
+			log.Fatalf("Cleanup: %d resources could not be removed", len(report.Errors))
+		}
+		return
+	}
+	if cmd != nil {
+		if err := runCommand(ctx, h, cmd, os.Stdout); err != nil {
+			log.Fatalf("%s: %v", cmd.name, err)
+		}
+		return
+	}
+	if lease != nil {
+		go lease.Run(ctx, h.OnLeaderElected)
+	}
+	if backups {
+		log.Printf("Automatic backups every %s to %s (keeping %d)", *backupEvery, *backupDir, *backupKeep)
+		opts := backup.ScheduleOptions{
+			Dir:           *backupDir,
+			Interval:      *backupEvery,
+			Keep:          *backupKeep,
+			ConfigDir:     cfgMgr.RootDir(),
+			SchemaVersion: store.SchemaVersion,
+			Snapshot:      db.Snapshot,
+		}
+		// 共享数据目录的副本中只有 leader 备份
+		if lease != nil {
+			opts.Leader = lease.Held
+		}
+		go backup.Schedule(ctx, opts)
+	}
+	// 平台停机期间容器可能被删除、崩溃或在外部启动，先同步一次再开始服务
+	if dm != nil {
+		rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		h.LogReconcile(rctx)
+		cancel()
+	}
+	if dm != nil && *reconcileEvery > 0 {
+		go func() {
+			ticker := time.NewTicker(*reconcileEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					h.LogReconcile(ctx)
+				}
+			}
+		}()
 	}
 
-	h := handler.New(db, dm, rp, cfgMgr, tmpl)
+	if dm != nil && *idleTimeout > 0 {
+		log.Printf("Stopping instances idle for %s", *idleTimeout)
+		go func() {
+			ticker := time.NewTicker(min(max(*idleTimeout/2, time.Second), time.Minute))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					// 每个副本都写回自己代理的访问时间，leader 据此判断空闲
+					h.FlushAccess(now)
+					h.StopIdleInstances(ctx, now)
+				}
+			}
+		}()
+	}
+
+	if dm != nil {
+		// 其他副本删除实例时，本副本上的终端和日志会话由这里关闭
+		go func() {
+			ticker := time.NewTicker(15 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					h.SweepSessions()
+				}
+			}
+		}()
+	}
+
+	if dm != nil && *statsInterval > 0 {
+		go func() {
+			h.CollectStats(ctx)
+			ticker := time.NewTicker(*statsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					h.CollectStats(ctx)
+				}
+			}
+		}()
+	}
 
 	// Setup routes
 	mux := http.NewServeMux()
@@ -78,8 +393,23 @@ func main() {
 
 	// Start server
 	server := &http.Server{
-		Addr:    *addr,
-		Handler: mux,
+		Addr:      *addr,
+		Handler:   h.Mount(mux),
+		TLSConfig: tlsConfig,
+	}
+	var redirectServer *http.Server
+	if *redirect != "" {
+		redirectServer = &http.Server{
+			Addr:              *redirect,
+			Handler:           httpsRedirect(*addr),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Redirecting plaintext HTTP on %s to HTTPS", *redirect)
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("Redirect server error: %v", err)
+			}
+		}()
 	}
 
 	// Graceful shutdown
@@ -88,19 +418,129 @@ func main() {
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
 		log.Println("Shutting down...")
+		// 在释放 leader lease 之前执行，否则 Shutdown 会把本副本当作 follower
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 60*time.Second)
+		if err := h.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+		shutdownCancel()
+		cancel()
+		if redirectServer != nil {
+			redirectServer.Close()
+		}
 		server.Close()
 	}()
 
-	log.Printf("CloudCode listening on %s", *addr)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if tlsConfig != nil {
+		log.Printf("CloudCode listening on %s%s/ (HTTPS)", *addr, base)
+		// 证书已在 TLSConfig 中，文件名留空
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("CloudCode listening on %s%s/", *addr, base)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
 }
 
-func loadTemplates() (map[string]*template.Template, error) {
+// loadTLSConfig returns the server TLS configuration for a PEM certificate
+// and private key pair.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// httpsRedirect answers every request with a 301 to the same URL on the
+// HTTPS listener at tlsAddr, keeping the host name the client used.
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// normalizeBasePath turns "cloudcode/", "/cloudcode" etc. into "/cloudcode",
+// and "/" or "" into "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs.
+func parseKeyValues(s string) map[string]string {
+	items := splitList(s)
+	if len(items) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(items))
+	for _, item := range items {
+		k, v, _ := strings.Cut(item, "=")
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out
+}
+
+// checkDataDirWritable creates the data directory if needed and verifies it
+// is writable by creating and removing a temp file, so a read-only mount or
+// full disk fails at startup instead of deep inside a request handler.
+func checkDataDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return config.DescribeWriteError(err)
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return config.DescribeWriteError(err)
+	}
+	name := f.Name()
+	_, err = f.WriteString("ok")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	_ = os.Remove(name)
+	if err != nil {
+		return config.DescribeWriteError(err)
+	}
+	return nil
+}
+
+func loadTemplates(basePath string) (map[string]*template.Template, error) {
 	funcMap := template.FuncMap{
 		"version":  func() string { return version },
+		"base":     func() string { return basePath },
 		"contains": strings.Contains,
+		"join":     strings.Join,
+		"sub":      func(a, b int) int { return a - b },
+		"mib":      func(n uint64) uint64 { return n >> 20 },
+		"command":  docker.FormatCommand,
 		"statusColor": func(status string) string {
 			switch status {
 			case "running":
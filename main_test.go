@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 and its
+// key as PEM files in dir and returns their paths and the certificate.
+func writeSelfSigned(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cloudcode test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeTLSWithSelfSignedCert(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSigned(t, t.TempDir(), "server")
+	tlsConfig, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loadTLSConfig: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "secure")
+		}),
+		TLSConfig: tlsConfig,
+	}
+	done := make(chan error, 1)
+	// 和 main 一样，证书只来自 TLSConfig
+	go func() { done <- server.ServeTLS(ln, "", "") }()
+	defer func() {
+		server.Close()
+		if err := <-done; err != http.ErrServerClosed {
+			t.Errorf("ServeTLS: %v", err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET over TLS: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "secure" || resp.TLS == nil {
+		t.Errorf("response = %d %q, TLS %v", resp.StatusCode, body, resp.TLS != nil)
+	}
+	if resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("negotiated TLS version %x, want at least 1.2", resp.TLS.Version)
+	}
+}
+
+func TestLoadTLSConfigMismatchedKey(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _, _ := writeSelfSigned(t, dir, "a")
+	_, otherKey, _ := writeSelfSigned(t, dir, "b")
+	if _, err := loadTLSConfig(certFile, otherKey); err == nil {
+		t.Error("loadTLSConfig accepted a key that does not match the certificate")
+	}
+	if _, err := loadTLSConfig(filepath.Join(dir, "missing.crt"), otherKey); err == nil {
+		t.Error("loadTLSConfig accepted a missing certificate")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		tlsAddr, host, target, want string
+	}{
+		{":443", "example.com", "/a?b=c", "https://example.com/a?b=c"},
+		{":8443", "example.com:80", "/", "https://example.com:8443/"},
+		{":443", "[::1]:80", "/x", "https://[::1]/x"},
+		{":8443", "[::1]", "/x", "https://[::1]:8443/x"},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		r.Host = tc.host
+		rec := httptest.NewRecorder()
+		httpsRedirect(tc.tlsAddr).ServeHTTP(rec, r)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s via %s: %d %q, want 301 %q", tc.host+tc.target, tc.tlsAddr, rec.Code, rec.Header().Get("Location"), tc.want)
+		}
+	}
+}
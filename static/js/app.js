@@ -66,8 +66,35 @@
 })();
 
 document.addEventListener('htmx:responseError', function(event) {
-    var msg = event.detail.xhr.responseText || 'An error occurred';
-    showToast(msg, 'error');
+    var xhr = event.detail.xhr;
+    var msg = xhr.responseText;
+    // writeError 返回的 alert 片段只取文本显示
+    if (msg && (xhr.getResponseHeader('Content-Type') || '').indexOf('text/html') === 0) {
+        msg = new DOMParser().parseFromString(msg, 'text/html').body.textContent.trim();
+    }
+    showToast(msg || 'An error occurred', 'error');
+});
+
+// Error alerts from writeError are shown in place when the request fills a
+// result container (the default innerHTML swap); requests that replace an
+// element or swap nothing fall through to the toast above.
+document.addEventListener('htmx:beforeSwap', function(event) {
+    var xhr = event.detail.xhr;
+    if (xhr.status < 400 || (xhr.getResponseHeader('Content-Type') || '').indexOf('text/html') !== 0) return;
+    var elt = event.detail.requestConfig && event.detail.requestConfig.elt;
+    var swapElt = elt && elt.closest ? elt.closest('[hx-swap]') : null;
+    var swap = swapElt ? swapElt.getAttribute('hx-swap') : 'innerHTML';
+    if (swap.indexOf('innerHTML') === 0 && event.detail.target) {
+        event.detail.shouldSwap = true;
+        event.detail.isError = false;
+    }
+});
+
+// Delete preview partials are swapped into the shared dialog; open it once loaded
+document.addEventListener('htmx:afterSwap', function(event) {
+    if (event.detail.target && event.detail.target.id === 'delete-modal') {
+        event.detail.target.showModal();
+    }
 });
 
 document.addEventListener('instanceDeleted', function(event) {
@@ -81,8 +108,61 @@ document.addEventListener('instanceDeleted', function(event) {
     window.location.reload();
 });
 
+// Creation progress: rows of instances being created/started carry a
+// data-progress element fed by the progress SSE stream. When it finishes the
+// row re-polls its status so the normal buttons appear.
+function watchProgress(root) {
+    root.querySelectorAll('[data-progress]').forEach(function(el) {
+        if (el._cc_source) return;
+        var id = el.getAttribute('data-progress');
+        var src = new EventSource((window.CC_BASE || '') + '/api/v1/instances/' + id + '/progress');
+        el._cc_source = src;
+        src.addEventListener('progress', function(e) {
+            if (!el.isConnected) {
+                src.close();
+                return;
+            }
+            var p = JSON.parse(e.data);
+            el.querySelector('.instance-progress-text').textContent = p.message;
+            el.querySelector('.instance-progress-bar > div').style.width = p.percent + '%';
+            if (p.phase === 'done' || p.phase === 'error') {
+                src.close();
+                el.classList.toggle('instance-progress-error', p.phase === 'error');
+                var row = el.closest('.instance-card');
+                if (row) htmx.trigger(row, 'progress-done');
+            }
+        });
+    });
+}
+
+document.addEventListener('DOMContentLoaded', function() { watchProgress(document); });
+document.addEventListener('htmx:load', function(event) { watchProgress(event.detail.elt); });
+
+// Dashboard status updates are pushed over the /events SSE stream instead
+// of every row polling: a changed row re-fetches itself, rows of new
+// instances are added and deleted ones removed.
+function watchInstanceEvents() {
+    var grid = document.querySelector('.instance-grid');
+    if (!grid || !window.EventSource) return;
+    var base = window.CC_BASE || '';
+    var src = new EventSource(base + '/events');
+    src.addEventListener('status', function(e) {
+        var ev = JSON.parse(e.data);
+        var row = document.getElementById('instance-' + ev.id);
+        if (ev.status === 'deleted') {
+            if (row) row.remove();
+        } else if (row) {
+            htmx.trigger(row, 'status-changed');
+        } else if (!grid.hasAttribute('data-filtered')) {
+            // 过滤或排序视图中新实例的位置未知，等刷新后再显示
+            htmx.ajax('GET', base + '/instances/' + ev.id + '/status', { target: grid, swap: 'afterbegin' });
+        }
+    });
+}
+document.addEventListener('DOMContentLoaded', watchInstanceEvents);
+
 function switchInstance(id) {
-    window.open('/instance/' + id + '/', '_blank');
+    window.open((window.CC_BASE || '') + '/instance/' + id + '/', '_blank');
 }
 
 document.addEventListener('htmx:beforeSwap', function(event) {